@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+var aclCommand = cli.Command{
+	Name:     "acl",
+	Usage:    "Work with egress ACL files",
+	HideHelp: true,
+	Subcommands: []cli.Command{
+		{
+			Name:      "validate",
+			Usage:     "Check ACL files for problems, exiting non-zero if any are found",
+			ArgsUsage: "FILE...",
+			HideHelp:  true,
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return cli.NewExitError("missing argument: FILE", 2)
+				}
+				if !validateACLFiles(os.Stdout, c.Args()) {
+					return cli.NewExitError("", 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "Print how the ACL in NEW differs from the one in OLD, exiting non-zero if it does",
+			ArgsUsage: "OLD NEW",
+			HideHelp:  true,
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					return cli.NewExitError("expected arguments: OLD NEW", 2)
+				}
+				same, err := diffACLFiles(os.Stdout, c.Args().Get(0), c.Args().Get(1))
+				if err != nil {
+					return err
+				}
+				if !same {
+					return cli.NewExitError("", 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:     "test",
+			Usage:    "Print the ACL's decision for a request, exiting non-zero if it is denied",
+			HideHelp: true,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config-file",
+					Usage: "Load the ACL named in the configuration `FILE`",
+				},
+				cli.StringFlag{
+					Name:  "egress-acl-file",
+					Usage: "Load the ACL from `FILE`",
+				},
+				cli.StringFlag{
+					Name:  "egress-acl-public-key",
+					Usage: "Require the ACL to be signed by the PEM encoded public key in `FILE`",
+				},
+				cli.StringFlag{
+					Name:  "role",
+					Usage: "Decide for a client with role `ROLE`",
+				},
+				cli.StringFlag{
+					Name:  "host",
+					Usage: "Decide for a request to `HOST`, with or without a port",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if !c.IsSet("host") {
+					return cli.NewExitError("missing flag: --host", 2)
+				}
+
+				conf := smokescreen.NewConfig()
+				if c.IsSet("config-file") {
+					var err error
+					conf, err = smokescreen.LoadConfig(c.String("config-file"))
+					if err != nil {
+						return err
+					}
+				}
+				if c.IsSet("egress-acl-public-key") {
+					if err := conf.SetupEgressAclPublicKey(c.String("egress-acl-public-key")); err != nil {
+						return err
+					}
+				}
+				if c.IsSet("egress-acl-file") {
+					if err := conf.SetupEgressAcl(c.String("egress-acl-file")); err != nil {
+						return err
+					}
+				}
+				if conf.EgressACL == nil {
+					return cli.NewExitError("no ACL configured: pass --egress-acl-file or a --config-file with acl_file", 2)
+				}
+
+				allowed, err := testACLDecision(os.Stdout, conf.EgressACL, c.String("role"), c.String("host"))
+				if err != nil {
+					return err
+				}
+				if !allowed {
+					return cli.NewExitError("", 1)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// testACLDecision writes the decision of decider for a request from role to
+// host to w and reports whether the request is allowed.
+func testACLDecision(w io.Writer, decider acl.Decider, role, host string) (bool, error) {
+	host = hostport.Host(host)
+
+	d, err := decider.Decide(role, host)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(w, "decision: %s\n", d.Result)
+	fmt.Fprintf(w, "reason: %s\n", d.Reason)
+	fmt.Fprintf(w, "rule: %s\n", d.RuleID)
+	fmt.Fprintf(w, "project: %s\n", d.Project)
+	fmt.Fprintf(w, "default rule: %t\n", d.Default)
+	if d.FallbackRole != "" {
+		fmt.Fprintf(w, "fallback role: %s\n", d.FallbackRole)
+	}
+	if d.ExpiredRuleID != "" {
+		fmt.Fprintf(w, "expired rule: %s\n", d.ExpiredRuleID)
+	}
+	if d.UpstreamProxy != nil {
+		fmt.Fprintf(w, "upstream proxy: %s\n", d.UpstreamProxy.Redacted())
+	}
+	if d.RateLimit != nil {
+		fmt.Fprintf(w, "rate limit: %s\n", d.RateLimit)
+	}
+	if d.ConnectOnly {
+		fmt.Fprintf(w, "connect only: true\n")
+	}
+	if d.AddressFamily != acl.AnyFamily {
+		fmt.Fprintf(w, "address family: %s\n", d.AddressFamily)
+	}
+	if d.ResolverAddress != "" {
+		fmt.Fprintf(w, "resolver address: %s\n", d.ResolverAddress)
+	}
+	if d.Mitm != nil {
+		fmt.Fprintf(w, "tls inspection: methods %v, paths %v\n", d.Mitm.AllowedMethods, d.Mitm.AllowedPaths)
+	}
+	if d.InspectPlaintext {
+		fmt.Fprintf(w, "plaintext inspection: true\n")
+	}
+	if d.DenyLogInterval != 0 {
+		fmt.Fprintf(w, "deny log interval: %s\n", d.DenyLogInterval)
+	}
+	if d.ConnectPorts != nil {
+		if len(d.ConnectPorts) == 0 {
+			fmt.Fprintf(w, "connect ports: any\n")
+		} else {
+			fmt.Fprintf(w, "connect ports: %v\n", d.ConnectPorts)
+		}
+	}
+
+	return d.Result != acl.Deny, nil
+}
+
+// diffACLFiles writes the changes between the ACLs in oldPath and newPath to
+// w and reports whether there were none.
+func diffACLFiles(w io.Writer, oldPath, newPath string) (bool, error) {
+	old, err := acl.NewYAMLLoader(oldPath).Load()
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", oldPath, err)
+	}
+	new, err := acl.NewYAMLLoader(newPath).Load()
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", newPath, err)
+	}
+
+	changes := acl.Diff(old, new)
+	for _, c := range changes {
+		fmt.Fprintln(w, c)
+	}
+	return len(changes) == 0, nil
+}
+
+// validateACLFiles writes the problems found in each of paths to w and
+// reports whether there were none.
+func validateACLFiles(w io.Writer, paths []string) bool {
+	ok := true
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %v\n", path, err)
+			ok = false
+			continue
+		}
+
+		for _, p := range acl.Lint(contents) {
+			fmt.Fprintf(w, "%s: %s\n", path, p)
+			ok = false
+		}
+	}
+	return ok
+}
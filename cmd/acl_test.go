@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestValidateACLFiles(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-acl")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.yaml")
+	r.NoError(ioutil.WriteFile(valid, []byte(`
+version: v1
+services:
+  - name: payments
+    project: payments
+    action: enforce
+    allowed_domains: [api.partner.example.com]
+`), 0644))
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	r.NoError(ioutil.WriteFile(invalid, []byte(`
+version: v1
+services:
+  - name: payments
+    project: payments
+    action: enforce
+    allowed_domains: ["*.example.com", api.example.com]
+`), 0644))
+
+	var out bytes.Buffer
+	a.True(validateACLFiles(&out, []string{valid}))
+	a.Empty(out.String())
+
+	a.False(validateACLFiles(&out, []string{valid, invalid, filepath.Join(dir, "missing.yaml")}))
+	a.Contains(out.String(), invalid+": service payments: allowed domain api.example.com is already covered by *.example.com\n")
+	a.Contains(out.String(), "missing.yaml: open ")
+
+	conf, err := NewConfiguration([]string{"smokescreen", "acl", "validate", valid}, nil)
+	a.NoError(err)
+	a.Nil(conf)
+}
+
+func TestTestACLDecision(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	const aclFile = "../pkg/smokescreen/acl/v1/testdata/sample_config.yaml"
+	decider, err := acl.New(logrus.New(), acl.NewYAMLLoader(aclFile), nil)
+	r.NoError(err)
+
+	var out bytes.Buffer
+	allowed, err := testACLDecision(&out, decider, "enforce-dummy-srv", "example1.com:443")
+	r.NoError(err)
+	a.True(allowed)
+	a.Contains(out.String(), "decision: Allow\n")
+	a.Contains(out.String(), "rule: enforce-dummy-srv\n")
+
+	out.Reset()
+	allowed, err = testACLDecision(&out, decider, "enforce-dummy-srv", "www.example1.com")
+	r.NoError(err)
+	a.False(allowed)
+	a.Contains(out.String(), "decision: Deny\n")
+	a.Contains(out.String(), "reason: rule has enforce policy\n")
+
+	conf, err := NewConfiguration([]string{"smokescreen", "acl", "test", "--egress-acl-file", aclFile, "--role", "enforce-dummy-srv", "--host", "example1.com"}, nil)
+	a.NoError(err)
+	a.Nil(conf)
+}
+
+func TestDiffACLFiles(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-acl")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "old.yaml")
+	r.NoError(ioutil.WriteFile(old, []byte(`
+version: v1
+services:
+  - {name: payments, action: report, allowed_domains: [api.partner.example.com]}
+`), 0644))
+	new := filepath.Join(dir, "new.yaml")
+	r.NoError(ioutil.WriteFile(new, []byte(`
+version: v1
+services:
+  - {name: payments, action: enforce, allowed_domains: [api.partner.example.com]}
+`), 0644))
+
+	var out bytes.Buffer
+	same, err := diffACLFiles(&out, old, old)
+	r.NoError(err)
+	a.True(same)
+	a.Empty(out.String())
+
+	same, err = diffACLFiles(&out, old, new)
+	r.NoError(err)
+	a.False(same)
+	a.Equal("service payments: action changed from Report to Enforce\n", out.String())
+
+	_, err = diffACLFiles(&out, old, filepath.Join(dir, "missing.yaml"))
+	a.Error(err)
+}
@@ -3,6 +3,7 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -18,6 +19,7 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/sirupsen/logrus"
@@ -25,6 +27,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/stripe/smokescreen/internal/faultserver"
 	"github.com/stripe/smokescreen/pkg/smokescreen"
 	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
 )
@@ -433,6 +436,7 @@ func startSmokescreen(t *testing.T, useTls bool, logHook logrus.Hook) (*httptest
 		"--deny-range=1.1.1.1/32",
 		"--allow-range=127.0.0.1/32",
 		"--deny-address=1.0.0.1:123",
+		"--connect-port=*",
 	}
 
 	if useTls {
@@ -469,3 +473,121 @@ func startSmokescreen(t *testing.T, useTls bool, logHook logrus.Hook) (*httptest
 
 	return server, nil
 }
+
+// connectThrough opens a CONNECT tunnel to target through the proxy at
+// proxyURL, as role.
+func connectThrough(t *testing.T, proxyURL, target, role string) net.Conn {
+	r := require.New(t)
+
+	u, err := url.Parse(proxyURL)
+	r.NoError(err)
+	conn, err := net.Dial("tcp", u.Host)
+	r.NoError(err)
+
+	req, err := http.NewRequest("CONNECT", "http://"+target, nil)
+	r.NoError(err)
+	req.Host = target
+	req.Header.Add("X-Smokescreen-Role", role)
+	r.NoError(req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	r.NoError(err)
+	r.Equal(http.StatusOK, resp.StatusCode)
+	r.Zero(br.Buffered(), "the destination spoke before the client")
+	return conn
+}
+
+func TestSmokescreenIntegrationFaults(t *testing.T) {
+	// Earlier tests leave upstream proxies in the environment.
+	os.Unsetenv("http_proxy")
+	os.Unsetenv("https_proxy")
+
+	var logHook logrustest.Hook
+	proxy, err := startSmokescreen(t, false, &logHook)
+	require.NoError(t, err)
+	defer proxy.Close()
+	role := "egressneedingservice-" + generateRoleForAction(acl.Open)
+
+	start := func(t *testing.T, opts faultserver.Options) *faultserver.Server {
+		server, err := faultserver.Start(opts)
+		require.NoError(t, err)
+		return server
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		a := assert.New(t)
+		server := start(t, faultserver.Options{Fault: faultserver.Echo})
+		defer server.Close()
+
+		conn := connectThrough(t, proxy.URL, server.Addr(), role)
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(conn, buf)
+		a.NoError(err)
+		a.Equal("hello", string(buf))
+	})
+
+	t.Run("slow accept", func(t *testing.T) {
+		a := assert.New(t)
+		server := start(t, faultserver.Options{Fault: faultserver.SlowAccept, Delay: 200 * time.Millisecond})
+		defer server.Close()
+
+		start := time.Now()
+		conn := connectThrough(t, proxy.URL, server.Addr(), role)
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(conn, buf)
+		a.NoError(err)
+		a.Equal("hello", string(buf))
+		a.True(time.Since(start) >= 200*time.Millisecond)
+	})
+
+	t.Run("reset mid-transfer", func(t *testing.T) {
+		a := assert.New(t)
+		server := start(t, faultserver.Options{Fault: faultserver.Reset, ResetAfter: 5})
+		defer server.Close()
+
+		conn := connectThrough(t, proxy.URL, server.Addr(), role)
+		defer conn.Close()
+		conn.Write([]byte("hello world"))
+
+		// The client gets what was sent before the reset, then the tunnel
+		// is torn down.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := ioutil.ReadAll(conn)
+		if ne, ok := err.(net.Error); ok {
+			a.False(ne.Timeout(), "the tunnel outlived the destination connection")
+		}
+		a.Equal("hello", string(got))
+	})
+
+	t.Run("TLS failure", func(t *testing.T) {
+		a := assert.New(t)
+		server := start(t, faultserver.Options{Fault: faultserver.TLSFailure})
+		defer server.Close()
+
+		conn := connectThrough(t, proxy.URL, server.Addr(), role)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		err := tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+		a.Error(err)
+		a.Contains(err.Error(), "handshake failure")
+	})
+
+	t.Run("blackhole", func(t *testing.T) {
+		a := assert.New(t)
+		server := start(t, faultserver.Options{Fault: faultserver.Blackhole})
+		defer server.Close()
+
+		conn := connectThrough(t, proxy.URL, server.Addr(), role)
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		ne, ok := err.(net.Error)
+		a.True(ok && ne.Timeout(), "expected a timeout, got %v", err)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -32,11 +33,13 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 	app.Usage = "A simple HTTP proxy that prevents SSRF and can restrict destinations"
 	app.ArgsUsage = " " // blank but non-empty to suppress default "[arguments...]"
 
-	// Suppress "help" subcommand, as we have no other subcommands.
-	// Unfortunately, this also suppresses "--help", so we'll add it back in
-	// manually below.  See https://github.com/urfave/cli/issues/523
+	// Suppress "help" subcommand, as running the proxy is what the app is
+	// for. Unfortunately, this also suppresses "--help", so we'll add it back
+	// in manually below.  See https://github.com/urfave/cli/issues/523
 	app.HideHelp = true
 
+	app.Commands = []cli.Command{aclCommand}
+
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:  "help",
@@ -55,11 +58,114 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Value: 4750,
 			Usage: "Listen on port `PORT`.\n\t\tThis argument is ignored when running under Einhorn.",
 		},
+		cli.IntFlag{
+			Name:  "listen-backlog",
+			Usage: "Allow up to `N` connections to wait in the listener's accept queue.\n\t\tCapped by the net.core.somaxconn sysctl. Linux only.",
+		},
+		cli.DurationFlag{
+			Name:  "listen-queue-stats-interval",
+			Usage: "Report the listener's accept queue depth and overflows every `DURATION`. Linux only.  Disabled by default.",
+		},
+		cli.IntFlag{
+			Name:  "max-header-bytes",
+			Usage: "Reject client requests whose headers exceed `BYTES`. (default: 1048576)",
+		},
+		cli.Int64Flag{
+			Name:  "memory-budget-mb",
+			Usage: "Shed client connections once the buffers they could take would exceed `MB` megabytes.  Disabled by default.",
+		},
+		cli.IntFlag{
+			Name:  "max-conns",
+			Usage: "Shed CONNECT requests with a 503 while `N` connections are open.  Unlimited by default.",
+		},
+		cli.IntFlag{
+			Name:  "max-conns-per-host",
+			Usage: "Allow at most `N` connections to each destination host at once, rejecting further requests with a 503.  Unlimited by default.",
+		},
+		cli.Float64Flag{
+			Name:  "port-exhaustion-threshold",
+			Usage: "Stop dialing a destination address once `FRACTION` of the ephemeral port range is taken by connections to it.  Disabled by default.",
+		},
+		cli.StringFlag{
+			Name:  "port-exhaustion-mode",
+			Value: "shed",
+			Usage: "Reject dials beyond the port exhaustion threshold with a 503 (\"shed\") or wait up to the connect timeout for a port (\"queue\")",
+		},
+		cli.BoolFlag{
+			Name:  "adaptive-concurrency",
+			Usage: "Limit the dials in progress at once, lowering the limit when dials fail or are slow and raising it when they aren't.",
+		},
+		cli.IntFlag{
+			Name:  "adaptive-concurrency-max",
+			Usage: "Never raise the adaptive concurrency limit above `N`, where it also starts. (default: 1000)",
+		},
+		cli.DurationFlag{
+			Name:  "adaptive-concurrency-latency",
+			Usage: "Lower the adaptive concurrency limit when dials take longer than `DURATION`. (default: 1s)",
+		},
+		cli.IntFlag{
+			Name:  "circuit-breaker-threshold",
+			Usage: "Fail requests to a destination with a 502 once `N` dials to it in a row have failed, until a probe dial succeeds.  Disabled by default.",
+		},
+		cli.DurationFlag{
+			Name:  "circuit-breaker-open-duration",
+			Usage: "Let a probe dial through to a destination whose circuit is open every `DURATION`. (default: 30s)",
+		},
+		cli.DurationFlag{
+			Name:  "idle-threshold",
+			Value: 10 * time.Second,
+			Usage: "Consider connections idle when nothing has been sent or received on them for `DURATION`.",
+		},
+		cli.BoolFlag{
+			Name:  "reap-idle-connections",
+			Usage: "Close connections once they have been idle for the idle threshold, rather than only at shutdown.",
+		},
+		cli.DurationFlag{
+			Name:  "max-conn-lifetime",
+			Usage: "Close connections once they have been open for `DURATION`, however active they are.  Unlimited by default.",
+		},
+		cli.Int64Flag{
+			Name:  "max-conn-transfer-mb",
+			Usage: "Close connections once they have transferred more than `MB` megabytes.  Unlimited by default.",
+		},
+		cli.Int64Flag{
+			Name:  "max-conn-bandwidth-kb",
+			Usage: "Hold each direction of a connection to `KB` kilobytes per second.  Unlimited by default.",
+		},
+		cli.DurationFlag{
+			Name:  "bytes-report-interval",
+			Usage: "Report the bytes transferred by open connections every `DURATION`, rather than only when they close.",
+		},
+		cli.DurationFlag{
+			Name:  "read-idle-threshold",
+			Usage: "Consider connections idle when nothing has been received on them for `DURATION`, even if data is still being sent.",
+		},
+		cli.DurationFlag{
+			Name:  "write-idle-threshold",
+			Usage: "Consider connections idle when nothing has been sent on them for `DURATION`, even if data is still being received.",
+		},
 		cli.DurationFlag{
 			Name:  "timeout",
 			Value: time.Duration(10) * time.Second,
 			Usage: "Time out after `DURATION` when connecting.",
 		},
+		cli.DurationFlag{
+			Name:  "tunnel-connect-timeout",
+			Usage: "Time out after `DURATION` when connecting for CONNECT requests, instead of --timeout.",
+		},
+		cli.DurationFlag{
+			Name:  "http-connect-timeout",
+			Usage: "Time out after `DURATION` when connecting for plain HTTP requests, instead of --timeout.",
+		},
+		cli.DurationFlag{
+			Name:  "upstream-connect-timeout",
+			Usage: "Time out after `DURATION` when connecting for requests sent through an upstream proxy, instead of the other timeouts.",
+		},
+		cli.DurationFlag{
+			Name:  "transient-retry-after",
+			Value: time.Second,
+			Usage: "Ask clients to retry requests that failed temporarily, such as on a connect timeout, after `DURATION`.",
+		},
 		cli.BoolFlag{
 			Name:  "proxy-protocol",
 			Usage: "Enable PROXY protocol support.",
@@ -72,6 +178,19 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Name:  "allow-range",
 			Usage: "Add `RANGE` (in CIDR notation) to list of allowed IP ranges.  Repeatable.",
 		},
+		cli.StringSliceFlag{
+			Name:  "deny-range-file",
+			Usage: "Add the IP ranges listed in `FILE`, one address or CIDR range per line, to the blocked IP ranges.  Repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-range-file",
+			Usage: "Add the IP ranges listed in `FILE`, one address or CIDR range per line, to the allowed IP ranges.  Repeatable.",
+		},
+		cli.IntFlag{
+			Name:  "range-file-max-entries",
+			Value: smokescreen.DefaultRangeFileMaxEntries,
+			Usage: "Refuse to start if range files list more than `N` entries in total. 0 means no limit.",
+		},
 		cli.StringSliceFlag{
 			Name:  "deny-address",
 			Usage: "Add IP[:PORT] to list of blocked IPs.  Repeatable.",
@@ -80,19 +199,131 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Name:  "allow-address",
 			Usage: "Add IP[:PORT] to list of allowed IPs.  Repeatable.",
 		},
+		cli.BoolFlag{
+			Name:  "danger-allow-access-to-cloud-metadata",
+			Usage: "WARNING: disable the built-in protection of cloud instance metadata services, exposing instance credentials to clients.",
+		},
+		cli.BoolFlag{
+			Name:  "dns-anomaly-detection",
+			Usage: "Log and count when a host's resolved IPs move between public and private address space.",
+		},
+		cli.StringSliceFlag{
+			Name:  "connect-port",
+			Usage: "Allow CONNECT requests to `PORT`, or to any port if \"*\", unless the role lists its own ports in the egress ACL.  Repeatable.  Defaults to 443.",
+		},
+		cli.BoolFlag{
+			Name:  "verify-sni",
+			Usage: "Close CONNECT tunnels whose TLS ClientHello names a server other than the destination the ACL allowed.",
+		},
+		cli.BoolFlag{
+			Name:  "ignore-proxy-environment",
+			Usage: "Connect to destinations directly, even if the http_proxy or https_proxy environment variables are set.",
+		},
+		cli.StringFlag{
+			Name:  "upstream-proxy",
+			Usage: "Chain traffic through the HTTP or SOCKS5 proxy at `URL`, unless the role has its own upstream proxy in the egress ACL.",
+		},
+		cli.StringSliceFlag{
+			Name:  "upstream-proxy-bypass",
+			Usage: "Connect directly to destinations in the domain, or resolving to the IP address or CIDR range, `ENTRY`, even for roles with an upstream proxy.  Repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "upstream-proxy-identity",
+			Usage: "Identify clients to upstream proxies with `MODE`: none, forwarded (Forwarded and role headers) or proxy-protocol (PROXY protocol v1).  Defaults to none.",
+		},
+		cli.BoolFlag{
+			Name:  "dial-only-allowed-addresses",
+			Usage: "When a host resolves to both allowed and blocked IPs, connect to an allowed IP instead of denying the request.",
+		},
+		cli.StringFlag{
+			Name:  "dial-guard-mode",
+			Value: "enforce",
+			Usage: "Refuse (\"enforce\") or only log (\"log\") dials to denied addresses that got past the proxy decision",
+		},
 		cli.StringFlag{
 			Name:  "egress-acl-file",
 			Usage: "Validate egress traffic against `FILE`",
 		},
+		cli.StringFlag{
+			Name:  "egress-acl-url",
+			Usage: "Validate egress traffic against the ACL at `URL`, which must be https unless the ACL is signed.\n\t\tThe ACL is checked for changes with conditional requests.",
+		},
+		cli.DurationFlag{
+			Name:  "egress-acl-poll-interval",
+			Value: smokescreen.DefaultEgressAclPollInterval,
+			Usage: "Check the ACL given by --egress-acl-url for changes every `DURATION`.",
+		},
+		cli.StringFlag{
+			Name:  "egress-acl-cache-file",
+			Usage: "Cache the ACL given by --egress-acl-url in `FILE`, and start from it if the URL can't be fetched",
+		},
+		cli.StringFlag{
+			Name:  "egress-acl-public-key",
+			Usage: "Only load egress ACL files signed by the PEM encoded public key in `FILE`.\n\t\tThe signature is read from the ACL file's last line, or from a detached \"<acl file>.sig\" file.",
+		},
+		cli.StringFlag{
+			Name:  "role-alias-file",
+			Usage: "Translate the identities clients present to ACL roles with the aliases in `FILE`",
+		},
+		cli.DurationFlag{
+			Name:  "role-alias-reload-interval",
+			Value: smokescreen.DefaultRoleAliasReloadInterval,
+			Usage: "Check the file given by --role-alias-file for changes every `DURATION`.  Zero disables reloading.",
+		},
+		cli.StringFlag{
+			Name:  "role-config-file",
+			Usage: "Determine roles as the jwt_role, header_role, spiffe_role, k8s_token_role or role_chain section in `FILE` says, reloading it when it changes",
+		},
+		cli.DurationFlag{
+			Name:  "role-config-reload-interval",
+			Value: smokescreen.DefaultRoleConfigReloadInterval,
+			Usage: "Check the file given by --role-config-file for changes every `DURATION`.  Zero disables reloading.",
+		},
 		cli.StringSliceFlag{
 			Name:  "resolver-address",
 			Usage: "Make DNS requests to `ADDRESS` (IP:port).  Repeatable.",
 		},
+		cli.StringFlag{
+			Name:  "resolver-failure-mode",
+			Value: "unavailable",
+			Usage: "Reject requests as failing temporarily (\"unavailable\") or deny them (\"deny\") when the resolver is unavailable",
+		},
+		cli.StringFlag{
+			Name:  "address-selection",
+			Value: "first",
+			Usage: "Pick the address to dial among those a destination resolves to with `STRATEGY`: \"first\", \"random\", \"round-robin\" or \"ecs\"",
+		},
+		cli.StringFlag{
+			Name:  "resolver-client-subnet",
+			Usage: "Send `CIDR` as the EDNS Client Subnet of every DNS query.  Required by --address-selection=ecs.",
+		},
+		cli.BoolFlag{
+			Name:  "dns-cache",
+			Usage: "Cache DNS answers for as long as their TTLs allow.",
+		},
+		cli.IntFlag{
+			Name:  "dns-cache-max-entries",
+			Value: 10000,
+			Usage: "Keep at most `NUMBER` answers in the DNS cache.",
+		},
 		cli.StringFlag{
 			Name:  "statsd-address",
 			Value: "127.0.0.1:8200",
 			Usage: "Send metrics to statsd at `ADDRESS` (IP:port).",
 		},
+		cli.StringFlag{
+			Name:  "statsd-namespace",
+			Value: smokescreen.DefaultStatsdNamespace,
+			Usage: "Prefix the names of metrics with `NAMESPACE`",
+		},
+		cli.StringSliceFlag{
+			Name:  "statsd-tag",
+			Usage: "Add `TAG`, e.g. datacenter:us-east-1, to every metric.  Repeatable.",
+		},
+		cli.BoolFlag{
+			Name:  "statsd-destination-tags",
+			Usage: "Tag ACL decision metrics with the destination host",
+		},
 		cli.StringFlag{
 			Name:  "tls-server-bundle-file",
 			Usage: "Authenticate to clients using key and certs from `FILE`",
@@ -105,10 +336,54 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Name:  "tls-crl-file",
 			Usage: "Verify validity of client certificates against Certificate Revocation List from `FILE`",
 		},
+		cli.DurationFlag{
+			Name:  "tls-client-ca-reload-interval",
+			Usage: "Check client CA and CRL files for changes every `DURATION` and reload them.  Disabled by default.",
+		},
+		cli.StringFlag{
+			Name:  "tls-min-version",
+			Usage: "Refuse TLS connections from clients below `VERSION`, one of 1.0, 1.1, 1.2 or 1.3",
+		},
+		cli.StringFlag{
+			Name:  "tls-max-version",
+			Usage: "Negotiate at most TLS `VERSION`, one of 1.0, 1.1, 1.2 or 1.3",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cipher-suite",
+			Usage: "Only negotiate cipher suite `NAME`, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, for TLS 1.2 and earlier. Repeat for several suites.",
+		},
+		cli.BoolFlag{
+			Name:  "tls-http2",
+			Usage: "Let TLS clients negotiate HTTP/2, to multiplex CONNECT tunnels over one connection",
+		},
+		cli.DurationFlag{
+			Name:  "tls-server-cert-reload-interval",
+			Usage: "Check the server bundle file for changes every `DURATION` and reload it without dropping connections.  Disabled by default.",
+		},
 		cli.StringFlag{
 			Name:  "additional-error-message-on-deny",
 			Usage: "Display `MESSAGE` in the HTTP response if proxying request is denied",
 		},
+		cli.DurationFlag{
+			Name:  "deny-log-interval",
+			Usage: "Log repeated denials of a role's requests to the same host once per `DURATION`, with a summary of the rest",
+		},
+		cli.BoolFlag{
+			Name:  "identify-responses",
+			Usage: "Add X-Smokescreen-Instance and X-Smokescreen-Trace-ID headers to the responses to plain HTTP requests",
+		},
+		cli.BoolFlag{
+			Name:  "health-endpoints",
+			Usage: "Answer /healthz (liveness) and /readyz (readiness) requests on the proxy listener",
+		},
+		cli.StringFlag{
+			Name:  "instance-id",
+			Usage: "Identify this instance as `ID` in the X-Smokescreen-Instance header. Defaults to the hostname.",
+		},
+		cli.StringSliceFlag{
+			Name:  "canonical-log-key",
+			Usage: "Log the `FIELD=NAME` field of proxy decision log lines as NAME instead, e.g. requested_host=dst.host.  Repeatable.",
+		},
 		cli.StringSliceFlag{
 			Name:  "disable-acl-policy-action",
 			Usage: "Disable usage of a `POLICY ACTION` such as \"open\" in the egress ACL",
@@ -122,6 +397,94 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Value: "700",
 			Usage: "Set the filemode to `FILE_MODE` on the statistics socket",
 		},
+		cli.StringFlag{
+			Name:  "access-log",
+			Usage: "Write a JSON record of every proxy decision and closed connection to `FILE`",
+		},
+		cli.Int64Flag{
+			Name:  "access-log-max-size",
+			Value: 100,
+			Usage: "Rotate the access log once it grows past `MB` megabytes. 0 disables rotation.",
+		},
+		cli.IntFlag{
+			Name:  "access-log-max-backups",
+			Value: 5,
+			Usage: "Keep `COUNT` rotated access logs",
+		},
+		cli.BoolFlag{
+			Name:  "access-log-compress",
+			Usage: "Gzip rotated access logs",
+		},
+		cli.StringFlag{
+			Name:  "request-log",
+			Usage: "Write a line per proxied request and CONNECT tunnel to `FILE`, in Common Log Format or W3C extended format. It is rotated like the access log.",
+		},
+		cli.StringFlag{
+			Name:  "request-log-format",
+			Value: "common",
+			Usage: "Write the request log in `FORMAT`: common or w3c",
+		},
+		cli.StringFlag{
+			Name:  "audit-replication-url",
+			Usage: "Replicate access log records to the bulk endpoint at `URL`, posting them as newline-delimited JSON",
+		},
+		cli.StringFlag{
+			Name:  "audit-replication-kafka-topic",
+			Usage: "Publish replicated records to the Kafka `TOPIC` instead, through the Kafka REST Proxy at the replication URL",
+		},
+		cli.StringFlag{
+			Name:  "audit-replication-spool",
+			Usage: "Keep access log records that can't be replicated in `FILE` until the endpoint recovers",
+		},
+		cli.Int64Flag{
+			Name:  "audit-replication-max-spool-size",
+			Value: 1024,
+			Usage: "Drop records that can't be replicated once the spool holds `MB` megabytes. 0 means no limit.",
+		},
+		cli.StringFlag{
+			Name:  "deny-webhook-url",
+			Usage: "Post denied requests to the webhook at `URL`, in batches of JSON events",
+		},
+		cli.StringFlag{
+			Name:  "mitm-ca-file",
+			Usage: "Inspect the TLS connections of roles with a mitm ACL rule, signing certificates with the CA cert and key in `FILE`",
+		},
+		cli.StringFlag{
+			Name:  "opa-url",
+			Usage: "Also require requests to be allowed by the Open Policy Agent document at `URL`, e.g. http://127.0.0.1:8181/v1/data/smokescreen/allow",
+		},
+		cli.DurationFlag{
+			Name:  "policy-timeout",
+			Usage: "Deny requests the policy engine takes longer than `DURATION` to decide",
+		},
+		cli.DurationFlag{
+			Name:  "policy-cache-ttl",
+			Usage: "Remember the policy engine's decisions for `DURATION`",
+		},
+		cli.StringFlag{
+			Name:  "ext-authz-address",
+			Usage: "Answer Envoy HTTP external authorization checks at `ADDRESS` (IP:port)",
+		},
+		cli.StringFlag{
+			Name:  "admin-address",
+			Usage: "Serve the admin API, including live connection introspection, at `ADDRESS` (IP:port). Requires --admin-token-file.",
+		},
+		cli.StringFlag{
+			Name:  "admin-token-file",
+			Usage: "Require the bearer token in `FILE` for requests to the admin API",
+		},
+		cli.BoolFlag{
+			Name:  "admin-debug",
+			Usage: "Serve pprof profiles, expvar variables and a runtime summary under /debug/ on the admin API, to loopback clients only",
+		},
+		cli.IntFlag{
+			Name:  "decision-history",
+			Usage: "Keep the last `N` proxy decisions in memory, served by /decisions on the admin API",
+		},
+		cli.BoolFlag{
+			Name:  "stats-openmetrics",
+			Usage: "Serve ACL decision metrics in OpenMetrics format at /metrics on the statistics socket.\n\t\tRequests carrying a trace ID are attached to the metrics as exemplars.",
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -160,9 +523,102 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			conf.Port = uint16(port)
 		}
 
+		if c.IsSet("listen-backlog") {
+			conf.ListenBacklog = c.Int("listen-backlog")
+		}
+
+		if c.IsSet("listen-queue-stats-interval") {
+			conf.ListenQueueStatsInterval = c.Duration("listen-queue-stats-interval")
+		}
+
+		if c.IsSet("max-header-bytes") {
+			conf.MaxHeaderBytes = c.Int("max-header-bytes")
+		}
+
+		if c.IsSet("memory-budget-mb") {
+			conf.MemoryBudget = c.Int64("memory-budget-mb") << 20
+		}
+
+		if c.IsSet("max-conns") {
+			conf.MaxConns = c.Int("max-conns")
+		}
+
+		if c.IsSet("max-conns-per-host") {
+			conf.MaxConnsPerHost = c.Int("max-conns-per-host")
+		}
+
+		if c.IsSet("port-exhaustion-threshold") {
+			if err := conf.SetupPortExhaustionProtection(c.Float64("port-exhaustion-threshold"), c.String("port-exhaustion-mode")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("adaptive-concurrency") {
+			if err := conf.SetupAdaptiveConcurrency(smokescreen.AdaptiveConcurrencyConfig{
+				MaxLimit:         c.Int("adaptive-concurrency-max"),
+				LatencyThreshold: c.Duration("adaptive-concurrency-latency"),
+			}); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("circuit-breaker-threshold") {
+			if err := conf.SetupCircuitBreaker(smokescreen.CircuitBreakerConfig{
+				FailureThreshold: c.Int("circuit-breaker-threshold"),
+				OpenDuration:     c.Duration("circuit-breaker-open-duration"),
+			}); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("idle-threshold") {
+			conf.IdleThreshold = c.Duration("idle-threshold")
+		}
+
+		if c.IsSet("reap-idle-connections") {
+			conf.ReapIdleConnections = c.Bool("reap-idle-connections")
+		}
+
+		if c.IsSet("max-conn-lifetime") {
+			conf.MaxConnLifetime = c.Duration("max-conn-lifetime")
+		}
+
+		if c.IsSet("max-conn-transfer-mb") {
+			conf.MaxConnBytes = c.Int64("max-conn-transfer-mb") << 20
+		}
+
+		if c.IsSet("max-conn-bandwidth-kb") {
+			conf.MaxConnBandwidth = c.Int64("max-conn-bandwidth-kb") << 10
+		}
+
+		if c.IsSet("bytes-report-interval") {
+			conf.BytesReportInterval = c.Duration("bytes-report-interval")
+		}
+
+		if c.IsSet("read-idle-threshold") {
+			conf.ReadIdleThreshold = c.Duration("read-idle-threshold")
+		}
+
+		if c.IsSet("write-idle-threshold") {
+			conf.WriteIdleThreshold = c.Duration("write-idle-threshold")
+		}
+
 		if c.IsSet("timeout") {
 			conf.ConnectTimeout = c.Duration("timeout")
 		}
+		if c.IsSet("tunnel-connect-timeout") {
+			conf.TunnelConnectTimeout = c.Duration("tunnel-connect-timeout")
+		}
+		if c.IsSet("http-connect-timeout") {
+			conf.HTTPConnectTimeout = c.Duration("http-connect-timeout")
+		}
+		if c.IsSet("upstream-connect-timeout") {
+			conf.UpstreamConnectTimeout = c.Duration("upstream-connect-timeout")
+		}
+
+		if c.IsSet("transient-retry-after") {
+			conf.TransientRetryAfter = c.Duration("transient-retry-after")
+		}
 
 		if c.IsSet("proxy-protocol") {
 			conf.SupportProxyProtocol = c.Bool("proxy-protocol")
@@ -172,6 +628,34 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			conf.AdditionalErrorMessageOnDeny = c.String("additional-error-message-on-deny")
 		}
 
+		if c.IsSet("deny-log-interval") {
+			conf.DenyLogInterval = c.Duration("deny-log-interval")
+		}
+
+		if c.IsSet("health-endpoints") {
+			conf.HealthEndpoints = true
+		}
+
+		if c.IsSet("identify-responses") {
+			if err := conf.SetupResponseIdentity(c.String("instance-id")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("canonical-log-key") {
+			keys := make(map[string]string)
+			for _, mapping := range c.StringSlice("canonical-log-key") {
+				parts := strings.SplitN(mapping, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("invalid canonical-log-key %q; expected FIELD=NAME", mapping)
+				}
+				keys[parts[0]] = parts[1]
+			}
+			if err := conf.SetupCanonicalLogKeys(keys); err != nil {
+				return err
+			}
+		}
+
 		if c.IsSet("disable-acl-policy-action") {
 			conf.DisabledAclPolicyActions = c.StringSlice("disable-acl-policy-action")
 		}
@@ -188,6 +672,103 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			conf.StatsSocketFileMode = os.FileMode(filemode)
 		}
 
+		if c.IsSet("access-log") {
+			err := conf.SetupAccessLog(
+				c.String("access-log"),
+				c.Int64("access-log-max-size")<<20,
+				c.Int("access-log-max-backups"),
+				c.Bool("access-log-compress"))
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("request-log") {
+			err := conf.SetupRequestLog(
+				c.String("request-log"),
+				c.String("request-log-format"),
+				c.Int64("access-log-max-size")<<20,
+				c.Int("access-log-max-backups"),
+				c.Bool("access-log-compress"))
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("audit-replication-url") {
+			var sink smokescreen.AuditSink = &smokescreen.HTTPAuditSink{URL: c.String("audit-replication-url")}
+			if c.IsSet("audit-replication-kafka-topic") {
+				sink = &smokescreen.KafkaRESTAuditSink{
+					URL:   c.String("audit-replication-url"),
+					Topic: c.String("audit-replication-kafka-topic"),
+				}
+			}
+			err := conf.SetupAuditReplication(&smokescreen.AuditReplicator{
+				Sink:          sink,
+				SpoolFile:     c.String("audit-replication-spool"),
+				MaxSpoolBytes: c.Int64("audit-replication-max-spool-size") << 20,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("deny-webhook-url") {
+			err := conf.SetupDenyNotifier(&smokescreen.DenyNotifier{URL: c.String("deny-webhook-url")})
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("mitm-ca-file") {
+			if err := conf.SetupMitmCa(c.String("mitm-ca-file"), ""); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("opa-url") {
+			conf.PolicyEngine = &smokescreen.OPAPolicyEngine{URL: c.String("opa-url")}
+		}
+
+		if c.IsSet("policy-timeout") {
+			conf.PolicyTimeout = c.Duration("policy-timeout")
+		}
+
+		if c.IsSet("policy-cache-ttl") {
+			err := conf.SetupPolicyCache(&smokescreen.PolicyCache{TTL: c.Duration("policy-cache-ttl")})
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("ext-authz-address") {
+			conf.ExtAuthzAddr = c.String("ext-authz-address")
+		}
+
+		if c.IsSet("admin-address") {
+			conf.AdminAddr = c.String("admin-address")
+		}
+
+		if c.IsSet("admin-token-file") {
+			if err := conf.SetupAdminToken(c.String("admin-token-file")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("admin-debug") {
+			conf.AdminDebug = true
+		}
+
+		if c.IsSet("decision-history") {
+			if err := conf.SetupDecisionHistory(c.Int("decision-history")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("stats-openmetrics") {
+			conf.OpenMetrics = smokescreen.NewOpenMetrics()
+		}
+
 		if c.IsSet("deny-range") {
 			if err := conf.SetDenyRanges(c.StringSlice("deny-range")); err != nil {
 				return err
@@ -200,26 +781,132 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			}
 		}
 
+		if c.IsSet("range-file-max-entries") {
+			conf.RangeFileMaxEntries = c.Int("range-file-max-entries")
+		}
+
+		if c.IsSet("deny-range-file") {
+			if err := conf.SetupDenyRangeFiles(c.StringSlice("deny-range-file")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("allow-range-file") {
+			if err := conf.SetupAllowRangeFiles(c.StringSlice("allow-range-file")); err != nil {
+				return err
+			}
+		}
+
 		if c.IsSet("deny-address") {
 			if err := conf.SetDenyAddresses(c.StringSlice("deny-address")); err != nil {
 				return err
 			}
 		}
 
+		if c.IsSet("danger-allow-access-to-cloud-metadata") {
+			conf.AllowCloudMetadataAccess = c.Bool("danger-allow-access-to-cloud-metadata")
+		}
+
+		if c.IsSet("dns-anomaly-detection") {
+			conf.DNSAnomalyDetector = smokescreen.NewDNSAnomalyDetector()
+		}
+
+		if c.IsSet("connect-port") {
+			if err := conf.SetupConnectPorts(c.StringSlice("connect-port")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("verify-sni") {
+			conf.VerifySNI = c.Bool("verify-sni")
+		}
+
+		if c.IsSet("ignore-proxy-environment") {
+			conf.IgnoreProxyEnvironment = c.Bool("ignore-proxy-environment")
+		}
+
+		if c.IsSet("upstream-proxy") {
+			if err := conf.SetupUpstreamProxy(c.String("upstream-proxy")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("upstream-proxy-bypass") {
+			if err := conf.SetupUpstreamProxyBypass(c.StringSlice("upstream-proxy-bypass")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("upstream-proxy-identity") {
+			identity, err := smokescreen.UpstreamIdentityFromString(c.String("upstream-proxy-identity"))
+			if err != nil {
+				return err
+			}
+			conf.UpstreamProxyIdentity = identity
+		}
+
+		if c.IsSet("dial-only-allowed-addresses") {
+			conf.DialOnlyAllowedAddresses = c.Bool("dial-only-allowed-addresses")
+		}
+
+		if c.IsSet("dial-guard-mode") {
+			mode, err := smokescreen.DialGuardModeFromString(c.String("dial-guard-mode"))
+			if err != nil {
+				return err
+			}
+			conf.DialGuardMode = mode
+		}
+
 		if c.IsSet("resolver-address") {
 			if err := conf.SetResolverAddresses(c.StringSlice("resolver-address")); err != nil {
 				return err
 			}
 		}
 
+		if c.IsSet("resolver-failure-mode") {
+			mode, err := smokescreen.ResolverFailureModeFromString(c.String("resolver-failure-mode"))
+			if err != nil {
+				return err
+			}
+			conf.ResolverFailureMode = mode
+		}
+
+		if c.IsSet("address-selection") || c.IsSet("resolver-client-subnet") {
+			if err := conf.SetupAddressSelection(c.String("address-selection"), c.String("resolver-client-subnet")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("dns-cache") {
+			cache := smokescreen.NewDNSCache()
+			cache.MaxEntries = c.Int("dns-cache-max-entries")
+			conf.SetupDNSCache(cache)
+		}
+
 		if c.IsSet("allow-address") {
 			if err := conf.SetAllowAddresses(c.StringSlice("allow-address")); err != nil {
 				return err
 			}
 		}
 
-		if c.IsSet("statsd-address") {
-			if err := conf.SetupStatsd(c.String("statsd-address")); err != nil {
+		if c.IsSet("statsd-tag") {
+			if err := conf.SetupStatsdTags(c.StringSlice("statsd-tag")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("statsd-address") || c.IsSet("statsd-namespace") {
+			if err := conf.SetupStatsdWithNamespace(c.String("statsd-address"), c.String("statsd-namespace")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("statsd-destination-tags") {
+			conf.StatsdDestinationTags = true
+		}
+
+		if c.IsSet("egress-acl-public-key") {
+			if err := conf.SetupEgressAclPublicKey(c.String("egress-acl-public-key")); err != nil {
 				return err
 			}
 		}
@@ -230,8 +917,21 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			}
 		}
 
-		if c.IsSet("tls-crl-file") {
-			if err := conf.SetupCrls(c.StringSlice("tls-crl-file")); err != nil {
+		if c.IsSet("egress-acl-url") {
+			conf.EgressAclCacheFile = c.String("egress-acl-cache-file")
+			if err := conf.SetupEgressAclURL(c.String("egress-acl-url"), c.Duration("egress-acl-poll-interval")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("role-alias-file") {
+			if err := conf.SetupRoleAliases(c.String("role-alias-file"), c.Duration("role-alias-reload-interval")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("role-config-file") {
+			if err := conf.SetupRoleConfigFile(c.String("role-config-file"), c.Duration("role-config-reload-interval")); err != nil {
 				return err
 			}
 		}
@@ -253,8 +953,48 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			}
 		}
 
+		if c.IsSet("tls-min-version") || c.IsSet("tls-max-version") || c.IsSet("tls-cipher-suite") {
+			if err := conf.SetupTlsVersions(
+				c.String("tls-min-version"),
+				c.String("tls-max-version"),
+				c.StringSlice("tls-cipher-suite")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("tls-http2") {
+			if err := conf.SetupHTTP2(); err != nil {
+				return err
+			}
+		}
+
+		// CRLs are only trusted once the CA that issued them has been loaded.
+		if c.IsSet("tls-crl-file") {
+			if err := conf.SetupCrls(c.StringSlice("tls-crl-file")); err != nil {
+				return err
+			}
+		}
+
+		if c.IsSet("tls-client-ca-reload-interval") {
+			conf.TlsClientCAReloadInterval = c.Duration("tls-client-ca-reload-interval")
+		}
+
+		if c.IsSet("tls-server-cert-reload-interval") {
+			conf.TlsServerCertReloadInterval = c.Duration("tls-server-cert-reload-interval")
+		}
+
 		// Setup the connection tracker
-		conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, conf.StatsdClient, conf.Log, conf.ShuttingDown)
+		conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, conf.MetricsClient, conf.Log, conf.ShuttingDown)
+		conf.ConnTracker.ReadIdleThreshold = conf.ReadIdleThreshold
+		conf.ConnTracker.MaxConnsPerHost = conf.MaxConnsPerHost
+		conf.ConnTracker.MaxConns = conf.MaxConns
+		conf.ConnTracker.MaxLifetime = conf.MaxConnLifetime
+		conf.ConnTracker.MaxConnBytes = conf.MaxConnBytes
+		conf.ConnTracker.MaxConnBandwidth = conf.MaxConnBandwidth
+		conf.ConnTracker.WriteIdleThreshold = conf.WriteIdleThreshold
+		conf.ConnTracker.AccessLog = conf.AccessLog
+
+		conf.ConfigHash = smokescreen.HashConfig(conf.ConfigHash, args[1:])
 
 		configToReturn = conf
 		return nil
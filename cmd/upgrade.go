@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// upgradeListenersEnv tells a freshly started process how many listening
+	// sockets it inherited. They are passed starting at fd 3, followed by the
+	// pipe used to report readiness to the parent.
+	upgradeListenersEnv = "SMOKESCREEN_UPGRADE_LISTENERS"
+
+	upgradeSignal       = syscall.SIGUSR1
+	upgradeReadyTimeout = time.Minute
+)
+
+// Upgrader implements zero-downtime binary upgrades.
+//
+// When the running process receives SIGUSR1, it starts a new copy of its
+// executable with the same arguments and hands it the listening sockets. Once
+// the new process is ready to accept connections, the old process shuts down
+// gracefully: it stops accepting and waits for the connection tracker to drain
+// existing tunnels, just as it would when Einhorn replaces a worker.
+type Upgrader struct {
+	Log *log.Logger
+
+	inherited []*os.File
+	listeners []*net.TCPListener
+
+	ready     *os.File
+	readyOnce sync.Once
+}
+
+// NewUpgrader returns an Upgrader, picking up any listeners inherited from a
+// parent process that is being upgraded, or else passed by systemd socket
+// activation.
+func NewUpgrader(logger *log.Logger) (*Upgrader, error) {
+	u := &Upgrader{Log: logger}
+
+	n := os.Getenv(upgradeListenersEnv)
+	if n == "" {
+		inherited, err := systemdListenerFiles()
+		if err != nil {
+			return nil, err
+		}
+		u.inherited = inherited
+		return u, nil
+	}
+	os.Unsetenv(upgradeListenersEnv)
+
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid %s value %q", upgradeListenersEnv, n)
+	}
+
+	for i := 0; i < count; i++ {
+		u.inherited = append(u.inherited, os.NewFile(uintptr(3+i), fmt.Sprintf("listener-%d", i)))
+	}
+	u.ready = os.NewFile(uintptr(3+count), "upgrade-ready")
+
+	return u, nil
+}
+
+// Listen returns the next listener inherited from the parent process, or a
+// new listener bound to addr when there is nothing left to inherit. Listeners
+// must be requested in the same order by every generation of the process.
+func (u *Upgrader) Listen(addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+
+	if len(u.inherited) > 0 {
+		f := u.inherited[0]
+		u.inherited = u.inherited[1:]
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("listener for %s is not a TCP listener", addr)
+	}
+	u.listeners = append(u.listeners, tl)
+
+	return &upgradeListener{Listener: ln, upgrader: u}, nil
+}
+
+// Ready notifies the parent process, if any, that this process is accepting
+// connections so the parent can start draining. It is called automatically
+// the first time one of the Upgrader's listeners accepts.
+func (u *Upgrader) Ready() {
+	u.readyOnce.Do(func() {
+		if u.ready == nil {
+			return
+		}
+		if _, err := u.ready.Write([]byte{1}); err != nil {
+			u.Log.Errorf("failed to notify parent process of readiness: %v", err)
+		}
+		u.ready.Close()
+	})
+}
+
+// Upgrade starts a new copy of the running executable, passes it the
+// listening sockets and waits until it reports that it is ready.
+func (u *Upgrader) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range u.listeners {
+		f, err := ln.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	child := exec.Command(exe, os.Args[1:]...)
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.Env = append(os.Environ(), fmt.Sprintf("%s=%d", upgradeListenersEnv, len(files)))
+	child.ExtraFiles = append(files, w)
+
+	err = child.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	go child.Wait()
+
+	readyCh := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		readyCh <- err
+	}()
+
+	select {
+	case err := <-readyCh:
+		if err != nil {
+			child.Process.Kill()
+			return fmt.Errorf("new process exited before becoming ready: %v", err)
+		}
+	case <-time.After(upgradeReadyTimeout):
+		child.Process.Kill()
+		return errors.New("timed out waiting for new process to become ready")
+	}
+
+	u.Log.WithField("pid", child.Process.Pid).Print("new process is ready")
+	return nil
+}
+
+// ServeUpgrades waits for SIGUSR1 and performs an upgrade. When the upgrade
+// succeeds, the current process is asked to shut down gracefully.
+func (u *Upgrader) ServeUpgrades() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, upgradeSignal)
+
+	for range sig {
+		u.Log.Print("upgrade requested, starting new process")
+		if err := u.Upgrade(); err != nil {
+			u.Log.Errorf("upgrade failed: %v", err)
+			continue
+		}
+
+		signal.Stop(sig)
+		u.Log.Print("upgrade complete, draining connections")
+		syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+		return
+	}
+}
+
+// upgradeListener is a net.Listener that reports readiness to the parent
+// process the first time its Accept method is called, mirroring
+// einhornListener's ACK.
+type upgradeListener struct {
+	net.Listener
+	upgrader *Upgrader
+}
+
+func (ul *upgradeListener) Accept() (net.Conn, error) {
+	ul.upgrader.Ready()
+	return ul.Listener.Accept()
+}
+
+// SyscallConn gives access to the listening socket, so its accept queue can
+// be resized and monitored as that of a plain TCP listener can.
+func (ul *upgradeListener) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := ul.Listener.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("listener has no underlying socket")
+	}
+	return sc.SyscallConn()
+}
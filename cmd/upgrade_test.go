@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgraderListen(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	u, err := NewUpgrader(logrus.New())
+	r.NoError(err)
+
+	ln, err := u.Listen("127.0.0.1:0")
+	r.NoError(err)
+	defer ln.Close()
+	a.Len(u.listeners, 1)
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	// Not started by an upgrade, so readiness is a no-op.
+	conn, err := ln.Accept()
+	r.NoError(err)
+	conn.Close()
+}
+
+func TestUpgraderListenerSyscallConn(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	u, err := NewUpgrader(logrus.New())
+	r.NoError(err)
+	ln, err := u.Listen("127.0.0.1:0")
+	r.NoError(err)
+	defer ln.Close()
+
+	// The listen backlog and the accept queue monitor get at the socket
+	// through syscall.Conn.
+	sc, ok := ln.(syscall.Conn)
+	r.True(ok)
+	rc, err := sc.SyscallConn()
+	r.NoError(err)
+	var accepting int
+	var sockErr error
+	r.NoError(rc.Control(func(fd uintptr) {
+		accepting, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	}))
+	r.NoError(sockErr)
+	a.Equal(1, accepting)
+}
+
+func TestUpgraderSystemdListeners(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	activated, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer activated.Close()
+	f, err := activated.(*net.TCPListener).File()
+	r.NoError(err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	r.NoError(err)
+
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	listenFdsStart = fd
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "proxy")
+
+	u, err := NewUpgrader(logrus.New())
+	r.NoError(err)
+	a.Empty(os.Getenv("LISTEN_FDS"))
+	r.Len(u.inherited, 1)
+	a.Equal("proxy", u.inherited[0].Name())
+
+	ln, err := u.Listen("127.0.0.1:1")
+	r.NoError(err)
+	defer ln.Close()
+	a.Equal(activated.Addr().String(), ln.Addr().String())
+
+	// Once the activated sockets are used up, listeners are bound as usual.
+	ln2, err := u.Listen("127.0.0.1:0")
+	r.NoError(err)
+	defer ln2.Close()
+	a.NotEqual(activated.Addr().String(), ln2.Addr().String())
+}
+
+func TestUpgraderIgnoresOtherProcessSystemdListeners(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	u, err := NewUpgrader(logrus.New())
+	r.NoError(err)
+	a.Empty(u.inherited)
+	a.Empty(os.Getenv("LISTEN_PID"))
+}
@@ -0,0 +1,149 @@
+// Package faultserver provides TCP destinations that fail in controlled ways,
+// so tests can check how tunnels through Smokescreen handle slow, broken and
+// unresponsive destinations without relying on external hosts.
+package faultserver
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fault is the way a Server misbehaves.
+type Fault int
+
+const (
+	Echo       Fault = iota // Echoes what it receives. After the client half-closes, finishes echoing and half-closes too
+	SlowAccept              // Like Echo, but waits Delay before reading or writing anything on a new connection
+	Reset                   // Echoes ResetAfter bytes, then resets the connection
+	TLSFailure              // Answers whatever it receives with a fatal TLS handshake_failure alert and closes the connection
+	Blackhole               // Accepts connections but never reads from or writes to them
+)
+
+// Options configures a Server.
+type Options struct {
+	Fault      Fault
+	Delay      time.Duration // How long SlowAccept waits
+	ResetAfter int           // How many bytes Reset echoes before resetting
+}
+
+// Server is a destination listening on the loopback interface.
+type Server struct {
+	opts Options
+	ln   net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Start starts a Server on a random loopback port.
+func Start(opts Options) (*Server, error) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		opts:  opts,
+		ln:    ln,
+		conns: make(map[net.Conn]bool),
+		done:  make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server and closes the connections it still holds.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	switch s.opts.Fault {
+	case Echo:
+		echo(c)
+	case SlowAccept:
+		time.Sleep(s.opts.Delay)
+		echo(c)
+	case Reset:
+		io.CopyN(c, c, int64(s.opts.ResetAfter))
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		c.Close()
+	case TLSFailure:
+		c.Read(make([]byte, 1024))
+		// A fatal (2) handshake_failure (40) alert record, as TLS 1.2.
+		c.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28})
+		c.Close()
+	case Blackhole:
+		<-s.done
+	}
+}
+
+// echo copies c back to itself until the client half-closes it, then
+// half-closes it too.
+func echo(c net.Conn) {
+	defer c.Close()
+	io.Copy(c, c)
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+}
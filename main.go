@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/go-einhorn/einhorn"
 	"github.com/stripe/smokescreen/cmd"
 	"github.com/stripe/smokescreen/pkg/smokescreen"
 )
@@ -23,14 +25,44 @@ func defaultRoleFromRequest(req *http.Request) (string, error) {
 	return req.TLS.PeerCertificates[0].Subject.CommonName, nil
 }
 
+// setupUpgrader binds (or inherits) the listeners for conf and its tenants so
+// they can be handed off to a new process on upgrade.
+func setupUpgrader(conf *smokescreen.Config) error {
+	upgrader, err := cmd.NewUpgrader(conf.Log)
+	if err != nil {
+		return err
+	}
+
+	conf.Listener, err = upgrader.Listen(fmt.Sprintf("%s:%d", conf.Ip, conf.Port))
+	if err != nil {
+		return err
+	}
+	for _, t := range conf.Tenants {
+		t.Listener, err = upgrader.Listen(fmt.Sprintf("%s:%d", t.Ip, t.Port))
+		if err != nil {
+			return err
+		}
+	}
+
+	go upgrader.ServeUpgrades()
+	return nil
+}
+
 func main() {
 	conf, err := cmd.NewConfiguration(nil, nil)
 	if err != nil {
 		logrus.Fatalf("Could not create configuration: %v", err)
 	} else if conf != nil {
-		conf.RoleFromRequest = defaultRoleFromRequest
+		if conf.RoleFromRequest == nil {
+			conf.RoleFromRequest = defaultRoleFromRequest
+		}
 
 		conf.Log.Formatter = &logrus.JSONFormatter{}
+		for _, t := range conf.Tenants {
+			if t.Log != nil {
+				t.Log.Formatter = conf.Log.Formatter
+			}
+		}
 
 		adapter := &smokescreen.Log2LogrusWriter{
 			Entry: conf.Log.WithField("stdlog", "1"),
@@ -39,6 +71,14 @@ func main() {
 		// Set the standard logger to use our logger's writter as output.
 		log.SetOutput(adapter)
 		log.SetFlags(0)
+
+		// Einhorn manages its own socket handoff between workers.
+		if !einhorn.IsWorker() {
+			if err := setupUpgrader(conf); err != nil {
+				logrus.Fatalf("Could not set up upgrades: %v", err)
+			}
+		}
+
 		smokescreen.StartWithConfig(conf, nil)
 	} else {
 		// --help or --version was passed and handled by NewConfiguration, so do nothing
@@ -0,0 +1,182 @@
+package smokescreen
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetupAccessLog writes a JSON record of every proxy decision and closed
+// connection to path, separately from the operational log. The file is
+// rotated once it grows past maxSize bytes, keeping maxBackups old files,
+// gzipped if compress is set. A maxSize of 0 disables rotation.
+func (config *Config) SetupAccessLog(path string, maxSize int64, maxBackups int, compress bool) error {
+	if path == "" {
+		return nil
+	}
+
+	file, err := OpenRotatingFile(path, maxSize, maxBackups, compress)
+	if err != nil {
+		return err
+	}
+
+	logger := log.New()
+	logger.Out = file
+	logger.Formatter = &log.JSONFormatter{}
+	logger.Level = log.InfoLevel
+	config.AccessLog = logger
+	return nil
+}
+
+// RotatingFile is an append-only file that is rotated once it reaches
+// MaxSize bytes: the current file becomes <path>.1, or <path>.1.gz when
+// compressing, earlier backups move up by one and the oldest beyond
+// MaxBackups is removed.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	Compress   bool
+	Header     func() []byte // If set, written at the start of every new file
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int, compress bool) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		Compress:   compress,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	if rf.size == 0 && rf.Header != nil {
+		n, err := file.Write(rf.Header())
+		rf.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past MaxSize.
+// Records are never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.MaxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+func (rf *RotatingFile) backupName(i int) string {
+	name := fmt.Sprintf("%s.%d", rf.Path, i)
+	if rf.Compress {
+		name += ".gz"
+	}
+	return name
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+
+	if rf.MaxBackups > 0 {
+		os.Remove(rf.backupName(rf.MaxBackups))
+		for i := rf.MaxBackups - 1; i > 0; i-- {
+			if err := os.Rename(rf.backupName(i), rf.backupName(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		var err error
+		if rf.Compress {
+			err = gzipFile(rf.Path, rf.backupName(1))
+		} else {
+			err = os.Rename(rf.Path, rf.backupName(1))
+		}
+		if err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.Path); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+// gzipFile compresses src into dst and removes src.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
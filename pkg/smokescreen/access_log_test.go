@@ -0,0 +1,110 @@
+package smokescreen
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestRotatingFile(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-access-log")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	rf, err := OpenRotatingFile(path, 10, 2, true)
+	r.NoError(err)
+	defer rf.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := rf.Write([]byte(line))
+		r.NoError(err)
+	}
+
+	current, err := ioutil.ReadFile(path)
+	r.NoError(err)
+	a.Equal("fourth\n", string(current))
+
+	readGzip := func(name string) string {
+		f, err := os.Open(name)
+		r.NoError(err)
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		r.NoError(err)
+		b, err := ioutil.ReadAll(gz)
+		r.NoError(err)
+		return string(b)
+	}
+	a.Equal("third\n", readGzip(path+".1.gz"))
+	a.Equal("second\n", readGzip(path+".2.gz"))
+	_, err = os.Stat(path + ".3.gz")
+	a.True(os.IsNotExist(err))
+	_, err = os.Stat(path + ".1")
+	a.True(os.IsNotExist(err))
+}
+
+func TestAccessLog(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-access-log")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	conf := NewConfig()
+	r.NoError(conf.SetupAccessLog(path, 0, 0, false))
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+
+	proxySrv := httptest.NewServer(BuildProxy(conf))
+	defer proxySrv.Close()
+	client, err := proxyClient(proxySrv.URL)
+	r.NoError(err)
+
+	resp, err := client.Get(ts.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	f, err := os.Open(path)
+	r.NoError(err)
+	defer f.Close()
+
+	// The connection to the destination may or may not have been logged as
+	// closed yet.
+	var decision map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		r.NoError(json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		if record["msg"] == LOGLINE_CANONICAL_PROXY_DECISION {
+			decision = record
+		}
+	}
+	r.NoError(scanner.Err())
+
+	r.NotNil(decision)
+	a.Equal("http", decision["proxy_type"])
+	a.Equal(true, decision["allow"])
+	a.Equal("127.0.0.1", decision["dest_ip"])
+}
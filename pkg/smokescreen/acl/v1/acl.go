@@ -1,10 +1,17 @@
 package acl
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
 )
 
 type Decider interface {
@@ -16,21 +23,129 @@ type ACL struct {
 	DefaultRule      *Rule
 	GlobalDenyList   []string
 	GlobalAllowList  []string
+	FallbackRole     string // If set, services without a rule are decided by this service's rule instead of the default rule
 	DisabledPolicies []EnforcementPolicy
 	*logrus.Logger
+
+	matchers matcherCache // Compiled on first use, see matcher.go
 }
 
 type Rule struct {
-	Project     string
-	Policy      EnforcementPolicy
-	DomainGlobs []string
+	ID               string // Identifies the rule in metrics, logs and deny responses. Defaults to the service name, or "default".
+	Project          string
+	Policy           EnforcementPolicy
+	DomainGlobs      []string
+	UpstreamProxy    *url.URL      // Proxy to chain this service's traffic through, if any
+	RateLimit        *RateLimit    // Maximum request rate for this service, if any
+	Mitm             *MitmRule     // If set, this service's TLS connections are inspected
+	InspectPlaintext bool          // If set, the HTTP requests this service sends through CONNECT tunnels to port 80 are parsed, logged and checked against Mitm
+	ValidUntil       time.Time     // If set, the rule no longer applies after this time
+	ConnectOnly      bool          // If set, this service may only use CONNECT, not plain HTTP proxying
+	AddressFamily    AddressFamily // Which addresses this service's destinations resolve to
+	ResolverAddress  string        // If set, this service's destinations are resolved by the DNS server at this host:port instead of the configured resolver
+	DenyLogInterval  time.Duration // If set, repeated denials of this service's requests to the same host are logged once per interval, with a summary of the rest
+	ConnectPorts     []int         // If not nil, the ports this service's CONNECT requests may target instead of the proxy's list. Empty allows any port.
+	FollowRedirects  int           // If positive, redirects of this service's plain HTTP requests are followed, up to this many, rather than passed to the client
+	ALPNProtocols    []string      // If not empty, the only ALPN protocols, such as "h2" and "http/1.1", this service's TLS connections may offer
+	Exceptions       []Exception   // Domains this service is allowed on top of DomainGlobs until each exception expires
+}
+
+// Expired reports whether the rule no longer applies at now.
+func (r *Rule) Expired(now time.Time) bool {
+	return !r.ValidUntil.IsZero() && now.After(r.ValidUntil)
+}
+
+// MaxFollowRedirects is the most redirects a rule may have followed.
+const MaxFollowRedirects = 20
+
+// ValidateFollowRedirects checks the number of redirects a rule has
+// followed, which must be between 0 and MaxFollowRedirects.
+func ValidateFollowRedirects(n int) error {
+	if n < 0 || n > MaxFollowRedirects {
+		return fmt.Errorf("follow_redirects must be between 0 and %d", MaxFollowRedirects)
+	}
+	return nil
+}
+
+// ValidateALPNProtocols checks the ALPN protocols a rule allows, which must
+// be non-empty and at most 255 bytes long, as TLS requires.
+func ValidateALPNProtocols(protocols []string) error {
+	for _, p := range protocols {
+		if p == "" || len(p) > 255 {
+			return fmt.Errorf("invalid ALPN protocol %q", p)
+		}
+	}
+	return nil
+}
+
+// ValidateResolverAddress checks the resolver address of a rule, which must
+// be empty or a host:port.
+func ValidateResolverAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid resolver address: %v", err)
+	}
+	return nil
+}
+
+// ParseConnectPorts parses a list of the ports CONNECT requests may target.
+// The entry "*" allows any port, which is returned as an empty but non-nil
+// list. An empty list is nil.
+func ParseConnectPorts(entries []string) ([]int, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	ports := []int{}
+	for _, e := range entries {
+		if e == "*" {
+			if len(entries) > 1 {
+				return nil, fmt.Errorf("connect port \"*\" can't be listed with other ports")
+			}
+			return ports, nil
+		}
+		port, err := hostport.ParsePort(e)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid connect port %q", e)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// RateLimit allows Requests requests per Per, with bursts of up to Requests.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (rl RateLimit) String() string {
+	return fmt.Sprintf("%d requests per %s", rl.Requests, rl.Per)
 }
 
 type Decision struct {
-	Reason  string
-	Default bool
-	Result  DecisionResult
-	Project string
+	Reason           string
+	RuleID           string // The rule, or global list entry, that decided
+	Default          bool
+	Result           DecisionResult
+	Project          string
+	UpstreamProxy    *url.URL
+	RateLimit        *RateLimit
+	Mitm             *MitmRule
+	InspectPlaintext bool
+	ConnectOnly      bool
+	AddressFamily    AddressFamily
+	ResolverAddress  string
+	DenyLogInterval  time.Duration
+	ConnectPorts     []int
+	FollowRedirects  int
+	ALPNProtocols    []string
+	ExpiredRuleID    string // The rule that would have applied had it not expired, if any
+	FallbackRole     string // The role whose rule was used because the service has none, if any
+
+	Exception        *Exception // The exception that allowed the host, if any
+	ExpiredException *Exception // An expired exception that would otherwise have allowed the host, if any
 }
 
 func New(logger *logrus.Logger, loader Loader, disabledActions []string) (*ACL, error) {
@@ -51,6 +166,7 @@ func New(logger *logrus.Logger, loader Loader, disabledActions []string) (*ACL,
 	if acl.DefaultRule == nil {
 		acl.Warn("no default rule set. any services without a rule will be denied.")
 	}
+	acl.warnExpiredExceptions(time.Now())
 	return acl, nil
 }
 
@@ -68,53 +184,114 @@ func (acl *ACL) Add(svc string, r Rule) error {
 		return err
 	}
 
+	if r.Mitm != nil {
+		if err := r.Mitm.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := ValidateResolverAddress(r.ResolverAddress); err != nil {
+		return err
+	}
+
+	if err := validateExceptions(r.Exceptions); err != nil {
+		return fmt.Errorf("service %v: %v", svc, err)
+	}
+
+	if err := ValidateALPNProtocols(r.ALPNProtocols); err != nil {
+		return fmt.Errorf("service %v: %v", svc, err)
+	}
+
 	if _, ok := acl.Rules[svc]; ok {
 		return fmt.Errorf("rule already exists for service %v", svc)
 	}
 	acl.Rules[svc] = r
+	acl.matchers.forget(matcherKey{kind: 's', service: svc})
 	return nil
 }
 
 // Decide takes uses the rule configured for the given service to determine if
 //   1. The host is in the rule's allowed domain
-//   2. The host has been globally denied
-//   3. The host has been globally allowed
-//   4. There is a default rule for the ACL
+//   2. The host is in one of the rule's unexpired exceptions
+//   3. The host has been globally denied
+//   4. The host has been globally allowed
+//   5. There is a default rule for the ACL
 func (acl *ACL) Decide(service, host string) (Decision, error) {
 	var d Decision
 
-	rule := acl.Rule(service)
+	// Hosts are matched in their normalized form, whoever passed them in.
+	if normalized, err := hostport.Normalize(host); err == nil {
+		host = normalized
+	}
+
+	ruleService := service
+	if acl.usesFallback(service) {
+		ruleService = acl.FallbackRole
+		d.FallbackRole = acl.FallbackRole
+	}
+
+	rule := acl.Rule(ruleService)
+	if rule != nil && rule.Expired(time.Now()) {
+		// An expired service rule falls back to the default rule, as if it
+		// had been removed.
+		d.ExpiredRuleID = acl.ruleID(ruleService, rule)
+		if rule != acl.DefaultRule && acl.DefaultRule != nil && !acl.DefaultRule.Expired(time.Now()) {
+			rule = acl.DefaultRule
+		} else {
+			rule = nil
+		}
+	}
 	if rule == nil {
 		d.Result = Deny
 		d.Reason = "no rule matched"
+		if d.ExpiredRuleID != "" {
+			d.Reason = "matched rule has expired"
+		}
 		return d, nil
 	}
 
 	d.Project = rule.Project
 	d.Default = rule == acl.DefaultRule
+	d.RuleID = acl.ruleID(ruleService, rule)
+	d.UpstreamProxy = rule.UpstreamProxy
+	d.RateLimit = rule.RateLimit
+	d.Mitm = rule.Mitm
+	d.InspectPlaintext = rule.InspectPlaintext
+	d.ConnectOnly = rule.ConnectOnly
+	d.AddressFamily = rule.AddressFamily
+	d.ResolverAddress = rule.ResolverAddress
+	d.DenyLogInterval = rule.DenyLogInterval
+	d.ConnectPorts = rule.ConnectPorts
+	d.FollowRedirects = rule.FollowRedirects
+	d.ALPNProtocols = rule.ALPNProtocols
 
 	// if the host matches any of the rule's allowed domains, allow
-	for _, dg := range rule.DomainGlobs {
-		if hostMatchesGlob(host, dg) {
-			d.Result, d.Reason = Allow, "host matched allowed domain in rule"
-			return d, nil
-		}
+	if _, ok := acl.ruleMatcher(ruleService, rule).match(host); ok {
+		d.Result, d.Reason = Allow, "host matched allowed domain in rule"
+		return d, nil
 	}
 
+	// if the host matches any of the rule's unexpired exceptions, allow
+	exception, expired := matchException(rule.Exceptions, host, time.Now())
+	if exception != nil {
+		d.Result, d.Reason = Allow, "host matched exception in rule"
+		d.Exception = exception
+		return d, nil
+	}
+	d.ExpiredException = expired
+
 	// if the host matches any of the global deny list, deny
-	for _, dg := range acl.GlobalDenyList {
-		if hostMatchesGlob(host, dg) {
-			d.Result, d.Reason = Deny, "host matched rule in global deny list"
-			return d, nil
-		}
+	if dg, ok := acl.matchers.get(matcherKey{kind: 'r'}, acl.GlobalDenyList).match(host); ok {
+		d.Result, d.Reason = Deny, "host matched rule in global deny list"
+		d.RuleID = "global_deny_list/" + dg
+		return d, nil
 	}
 
 	// if the host matches any of the global allow list, allow
-	for _, dg := range acl.GlobalAllowList {
-		if hostMatchesGlob(host, dg) {
-			d.Result, d.Reason = Allow, "host matched rule in global allow list"
-			return d, nil
-		}
+	if dg, ok := acl.matchers.get(matcherKey{kind: 'a'}, acl.GlobalAllowList).match(host); ok {
+		d.Result, d.Reason = Allow, "host matched rule in global allow list"
+		d.RuleID = "global_allow_list/" + dg
+		return d, nil
 	}
 
 	var err error
@@ -132,11 +309,24 @@ func (acl *ACL) Decide(service, host string) (Decision, error) {
 
 	if d.Default {
 		d.Reason = "default rule policy used"
+	} else if d.FallbackRole != "" {
+		d.Reason = "fallback role policy used"
 	}
 
 	return d, err
 }
 
+// ruleID returns the ID reported for rule, which applies to service.
+func (acl *ACL) ruleID(service string, rule *Rule) string {
+	if rule.ID != "" {
+		return rule.ID
+	}
+	if rule == acl.DefaultRule {
+		return "default"
+	}
+	return service
+}
+
 // DisablePolicies takes a slice of actions (open, report, enforce), maps them
 // to their corresponding EnforcementPolicy, and adds them to the global
 // disabledPolicy slice.
@@ -152,8 +342,14 @@ func (acl *ACL) DisablePolicies(actions []string) error {
 }
 
 // Validate checks that the ACL that every rule has a conformant domain glob
-// and is not utilizing a disabled enforcement policy.
+// and is not utilizing a disabled enforcement policy, and that the fallback
+// role, if any, has a rule.
 func (acl *ACL) Validate() error {
+	if acl.FallbackRole != "" {
+		if _, ok := acl.Rules[acl.FallbackRole]; !ok {
+			return fmt.Errorf("fallback role %v has no service rule", acl.FallbackRole)
+		}
+	}
 	for svc, r := range acl.Rules {
 		err := acl.ValidateDomains(r.DomainGlobs)
 		if err != nil {
@@ -163,10 +359,28 @@ func (acl *ACL) Validate() error {
 		if err != nil {
 			return err
 		}
+		err = validateExceptions(r.Exceptions)
+		if err != nil {
+			return fmt.Errorf("service %v: %v", svc, err)
+		}
 	}
 	return nil
 }
 
+// normalizeGlob puts the domain of a glob in the form Decide matches hosts
+// in, so that globs written in mixed case, with a trailing dot or in Unicode
+// match the hosts they name.
+func normalizeGlob(glob string) string {
+	prefix, domain := "", glob
+	if strings.HasPrefix(glob, "*.") {
+		prefix, domain = "*.", glob[2:]
+	}
+	if normalized, err := hostport.Normalize(domain); err == nil {
+		return prefix + normalized
+	}
+	return strings.ToLower(strings.TrimSuffix(glob, "."))
+}
+
 // ValidateDomains takes a slice of domains and verifies they conform to
 // smokescreen's domain glob policy.
 //
@@ -212,16 +426,53 @@ func (acl *ACL) Project(service string) (string, error) {
 	return rule.Project, nil
 }
 
-// Rule returns the configured rule for a service, or the default rule if none
-// is configured.
+// Rule returns the configured rule for a service, or the fallback role's or
+// the default rule if none is configured.
 func (acl *ACL) Rule(service string) *Rule {
+	if acl.usesFallback(service) {
+		service = acl.FallbackRole
+	}
 	if service, ok := acl.Rules[service]; ok {
 		return &service
 	}
 	return acl.DefaultRule
 }
 
+// usesFallback reports whether service, having no rule of its own, is
+// decided by the fallback role's rule.
+func (acl *ACL) usesFallback(service string) bool {
+	if acl.FallbackRole == "" {
+		return false
+	}
+	if _, ok := acl.Rules[service]; ok {
+		return false
+	}
+	_, ok := acl.Rules[acl.FallbackRole]
+	return ok
+}
+
+// Hash returns a short digest of the ACL's rules and lists, which changes
+// whenever any of them does, so instances serving different policies can be
+// told apart.
+func (acl *ACL) Hash() string {
+	// encoding/json sorts map keys, which keeps the digest stable.
+	b, err := json.Marshal(struct {
+		Rules            map[string]Rule
+		DefaultRule      *Rule
+		GlobalDenyList   []string
+		GlobalAllowList  []string
+		FallbackRole     string
+		DisabledPolicies []EnforcementPolicy
+	}{acl.Rules, acl.DefaultRule, acl.GlobalDenyList, acl.GlobalAllowList, acl.FallbackRole, acl.DisabledPolicies})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
 func hostMatchesGlob(host string, domainGlob string) bool {
+	domainGlob = normalizeGlob(domainGlob)
 	if domainGlob != "" && domainGlob[0] == '*' {
 		suffix := domainGlob[1:]
 		if strings.HasSuffix(host, suffix) {
@@ -244,3 +244,51 @@ func TestACLAddExistingRule(t *testing.T) {
 	a.NoError(acl.Add(svc, r))
 	a.Error(acl.Add(svc, r))
 }
+
+func TestACLFallbackRole(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+fallback_role: onboarding
+services:
+  - name: onboarding
+    project: platform
+    action: enforce
+    allowed_domains: [api.example.com]
+  - name: known
+    project: known
+    action: enforce
+    allowed_domains: [known.example.com]
+default:
+  project: other
+  action: open
+`))
+	a.NoError(err)
+	a.NoError(acl.Validate())
+
+	d, err := acl.Decide("renamed", "api.example.com")
+	a.NoError(err)
+	a.Equal(Allow, d.Result)
+	a.Equal("onboarding", d.FallbackRole)
+	a.Equal("onboarding", d.RuleID)
+	a.False(d.Default)
+
+	d, err = acl.Decide("renamed", "other.example.com")
+	a.NoError(err)
+	a.Equal(Deny, d.Result)
+	a.Equal("fallback role policy used", d.Reason)
+
+	proj, err := acl.Project("renamed")
+	a.NoError(err)
+	a.Equal("platform", proj)
+
+	// Services with a rule of their own don't fall back.
+	d, err = acl.Decide("known", "api.example.com")
+	a.NoError(err)
+	a.Equal(Deny, d.Result)
+	a.Empty(d.FallbackRole)
+
+	acl.FallbackRole = "missing"
+	a.Error(acl.Validate())
+}
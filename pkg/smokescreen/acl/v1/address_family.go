@@ -0,0 +1,39 @@
+package acl
+
+import "fmt"
+
+// AddressFamily controls which address records a service's destinations are
+// resolved to, and in which order they are tried.
+type AddressFamily int
+
+const (
+	AnyFamily  AddressFamily = iota // A and AAAA records, in the order the resolver returns them
+	IPv4Only                        // Only A records are looked up
+	IPv6Only                        // Only AAAA records are looked up
+	PreferIPv4                      // A records are tried before AAAA records
+	PreferIPv6                      // AAAA records are tried before A records
+)
+
+var AddressFamilies = map[string]AddressFamily{
+	"any":         AnyFamily,
+	"ipv4":        IPv4Only,
+	"ipv6":        IPv6Only,
+	"prefer_ipv4": PreferIPv4,
+	"prefer_ipv6": PreferIPv6,
+}
+
+func (f AddressFamily) String() string {
+	return [...]string{"any", "ipv4", "ipv6", "prefer_ipv4", "prefer_ipv6"}[f]
+}
+
+// AddressFamilyFromString parses an address_family setting. An empty string
+// is AnyFamily.
+func AddressFamilyFromString(s string) (AddressFamily, error) {
+	if s == "" {
+		return AnyFamily, nil
+	}
+	if v, ok := AddressFamilies[s]; ok {
+		return v, nil
+	}
+	return AnyFamily, fmt.Errorf("unknown address family %v", s)
+}
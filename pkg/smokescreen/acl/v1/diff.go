@@ -0,0 +1,202 @@
+package acl
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Change is a difference Diff found between two ACLs.
+type Change struct {
+	Service string // Empty for the default rule and the global lists
+	Message string
+}
+
+func (c Change) String() string {
+	if c.Service == "" {
+		return c.Message
+	}
+	return fmt.Sprintf("service %s: %s", c.Service, c.Message)
+}
+
+// Diff returns the changes that turn old into new, as loaded: a service that
+// gains a domain through a group or a service it extends shows the domain as
+// added, while reordering domains or moving them into a group changes
+// nothing. Services are reported in name order.
+func Diff(old, new *ACL) []Change {
+	var changes []Change
+	add := func(service, format string, args ...interface{}) {
+		changes = append(changes, Change{Service: service, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, name := range serviceNames(old, new) {
+		o, inOld := old.Rules[name]
+		n, inNew := new.Rules[name]
+		switch {
+		case !inNew:
+			add(name, "removed")
+		case !inOld:
+			add(name, "added")
+		default:
+			for _, msg := range diffRules(&o, &n) {
+				add(name, "%s", msg)
+			}
+		}
+	}
+
+	switch {
+	case old.DefaultRule != nil && new.DefaultRule == nil:
+		add("", "default rule removed")
+	case old.DefaultRule == nil && new.DefaultRule != nil:
+		add("", "default rule added")
+	case old.DefaultRule != nil:
+		for _, msg := range diffRules(old.DefaultRule, new.DefaultRule) {
+			add("", "default rule: %s", msg)
+		}
+	}
+
+	if old.FallbackRole != new.FallbackRole {
+		add("", "fallback role changed from %q to %q", old.FallbackRole, new.FallbackRole)
+	}
+
+	for _, msg := range diffStrings("global_allow_list entry", old.GlobalAllowList, new.GlobalAllowList) {
+		add("", "%s", msg)
+	}
+	for _, msg := range diffStrings("global_deny_list entry", old.GlobalDenyList, new.GlobalDenyList) {
+		add("", "%s", msg)
+	}
+	return changes
+}
+
+func serviceNames(acls ...*ACL) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, a := range acls {
+		for name := range a.Rules {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func diffRules(o, n *Rule) []string {
+	var msgs []string
+	changed := func(field string, from, to interface{}) {
+		if from != to {
+			msgs = append(msgs, fmt.Sprintf("%s changed from %v to %v", field, from, to))
+		}
+	}
+
+	changed("id", o.ID, n.ID)
+	changed("project", o.Project, n.Project)
+	changed("action", o.Policy, n.Policy)
+	changed("upstream proxy", urlString(o.UpstreamProxy), urlString(n.UpstreamProxy))
+	changed("rate limit", rateLimitString(o.RateLimit), rateLimitString(n.RateLimit))
+	changed("valid until", validUntilString(o), validUntilString(n))
+	changed("connect only", o.ConnectOnly, n.ConnectOnly)
+	changed("address family", o.AddressFamily, n.AddressFamily)
+	changed("resolver address", resolverString(o.ResolverAddress), resolverString(n.ResolverAddress))
+	changed("tls inspection", mitmString(o.Mitm), mitmString(n.Mitm))
+	changed("plaintext inspection", o.InspectPlaintext, n.InspectPlaintext)
+	changed("deny log interval", o.DenyLogInterval, n.DenyLogInterval)
+	changed("connect ports", connectPortsString(o.ConnectPorts), connectPortsString(n.ConnectPorts))
+	changed("followed redirects", o.FollowRedirects, n.FollowRedirects)
+	changed("alpn protocols", alpnString(o.ALPNProtocols), alpnString(n.ALPNProtocols))
+	msgs = append(msgs, diffStrings("allowed domain", o.DomainGlobs, n.DomainGlobs)...)
+	msgs = append(msgs, diffStrings("exception", exceptionStrings(o.Exceptions), exceptionStrings(n.Exceptions))...)
+	return msgs
+}
+
+// diffStrings reports the entries added to and removed from a list,
+// ignoring order.
+func diffStrings(what string, old, new []string) []string {
+	inOld := make(map[string]bool, len(old))
+	for _, s := range old {
+		inOld[s] = true
+	}
+	inNew := make(map[string]bool, len(new))
+	for _, s := range new {
+		inNew[s] = true
+	}
+
+	var msgs []string
+	for _, s := range new {
+		if !inOld[s] {
+			msgs = append(msgs, fmt.Sprintf("%s added: %s", what, s))
+		}
+	}
+	for _, s := range old {
+		if !inNew[s] {
+			msgs = append(msgs, fmt.Sprintf("%s removed: %s", what, s))
+		}
+	}
+	return msgs
+}
+
+func urlString(u *url.URL) string {
+	if u == nil {
+		return "none"
+	}
+	return u.Redacted()
+}
+
+func rateLimitString(rl *RateLimit) string {
+	if rl == nil {
+		return "none"
+	}
+	return rl.String()
+}
+
+func validUntilString(r *Rule) string {
+	if r.ValidUntil.IsZero() {
+		return "never"
+	}
+	return r.ValidUntil.Format(time.RFC3339)
+}
+
+func alpnString(protocols []string) string {
+	if len(protocols) == 0 {
+		return "any"
+	}
+	return strings.Join(protocols, ", ")
+}
+
+func exceptionStrings(exceptions []Exception) []string {
+	var strs []string
+	for i := range exceptions {
+		strs = append(strs, exceptions[i].String())
+	}
+	return strs
+}
+
+func mitmString(m *MitmRule) string {
+	if m == nil {
+		return "off"
+	}
+	return fmt.Sprintf("methods %v, paths %v", m.AllowedMethods, m.AllowedPaths)
+}
+
+func resolverString(addr string) string {
+	if addr == "" {
+		return "default"
+	}
+	return addr
+}
+
+// connectPortsString formats a rule's connect ports, which may be the
+// proxy's, any port, or a list.
+func connectPortsString(ports []int) string {
+	if ports == nil {
+		return "default"
+	}
+	if len(ports) == 0 {
+		return "any"
+	}
+	return fmt.Sprint(ports)
+}
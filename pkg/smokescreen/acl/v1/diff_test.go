@@ -0,0 +1,56 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, err := loadYAML([]byte(`
+version: v1
+groups:
+  mirrors: [pypi.org]
+services:
+  - {name: builder, project: ci, action: report, allowed_domains: [github.com, gitlab.com]}
+  - {name: legacy, action: open}
+  - {name: unchanged, action: enforce, allowed_domains: [a.example.com, b.example.com]}
+global_deny_list: [evil.example.com]
+`))
+	r.NoError(err)
+
+	new, err := loadYAML([]byte(`
+version: v1
+groups:
+  mirrors: [pypi.org]
+services:
+  - {name: builder, project: ci, action: enforce, allowed_domains: [github.com], allowed_groups: [mirrors], address_family: ipv4}
+  - {name: unchanged, action: enforce, allowed_domains: [b.example.com, a.example.com]}
+  - {name: worker, action: enforce}
+default:
+  action: open
+global_deny_list: [evil.example.com, worse.example.com]
+`))
+	r.NoError(err)
+
+	var got []string
+	for _, c := range Diff(old, new) {
+		got = append(got, c.String())
+	}
+	a.Equal([]string{
+		"service builder: action changed from Report to Enforce",
+		"service builder: address family changed from any to ipv4",
+		"service builder: allowed domain added: pypi.org",
+		"service builder: allowed domain removed: gitlab.com",
+		"service legacy: removed",
+		"service worker: added",
+		"default rule added",
+		"global_deny_list entry added: worse.example.com",
+	}, got)
+
+	a.Empty(Diff(new, new))
+}
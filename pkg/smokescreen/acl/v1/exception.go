@@ -0,0 +1,105 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exception temporarily allows a service more domains than its rule does,
+// with a record of who approved it and why. Unlike the rule's domains, an
+// exception stops matching once it expires, so temporary allowances can't
+// silently become permanent policy.
+type Exception struct {
+	DomainGlobs []string
+	Expires     time.Time // The exception no longer applies after this time
+	Approver    string    // Who approved the exception
+	Ticket      string    // The ticket or change request justifying the exception
+}
+
+// Expired reports whether the exception no longer applies at now.
+func (e *Exception) Expired(now time.Time) bool {
+	return now.After(e.Expires)
+}
+
+func (e *Exception) String() string {
+	return fmt.Sprintf("%s for %s until %s, approved by %s",
+		e.Ticket, strings.Join(e.DomainGlobs, ", "), e.Expires.Format(time.RFC3339), e.Approver)
+}
+
+// Validate checks that the exception has domains, an expiry, an approver and
+// a ticket.
+func (e *Exception) Validate() error {
+	switch {
+	case len(e.DomainGlobs) == 0:
+		return errors.New("exception has no allowed domains")
+	case e.Expires.IsZero():
+		return errors.New("exception has no expiry")
+	case e.Approver == "":
+		return errors.New("exception has no approver")
+	case e.Ticket == "":
+		return errors.New("exception has no ticket")
+	}
+	return (&ACL{}).ValidateDomains(e.DomainGlobs)
+}
+
+// matchException returns the first of exceptions that allows host and is
+// unexpired at now and, if host is only allowed by expired exceptions, the
+// first of those.
+func matchException(exceptions []Exception, host string, now time.Time) (active, expired *Exception) {
+	for i := range exceptions {
+		e := &exceptions[i]
+		matched := false
+		for _, g := range e.DomainGlobs {
+			if hostMatchesGlob(host, g) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if !e.Expired(now) {
+			return e, nil
+		}
+		if expired == nil {
+			expired = e
+		}
+	}
+	return nil, expired
+}
+
+func validateExceptions(exceptions []Exception) error {
+	for i := range exceptions {
+		if err := exceptions[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warnExpiredExceptions logs the exceptions that have expired at now, which
+// no longer allow anything and should be removed or renewed.
+func (acl *ACL) warnExpiredExceptions(now time.Time) {
+	warn := func(service string, r *Rule) {
+		for i := range r.Exceptions {
+			if e := &r.Exceptions[i]; e.Expired(now) {
+				acl.WithFields(logrus.Fields{
+					"service":  service,
+					"ticket":   e.Ticket,
+					"approver": e.Approver,
+					"expires":  e.Expires.Format(time.RFC3339),
+				}).Warn("ACL exception has expired")
+			}
+		}
+	}
+	for svc, r := range acl.Rules {
+		warn(svc, &r)
+	}
+	if acl.DefaultRule != nil {
+		warn("default", acl.DefaultRule)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build fuzz
+// +build fuzz
+
+package acl
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzLoadYAML checks that no ACL configuration, however malformed, crashes
+// the loader, and that the ACLs it accepts can be validated and decided on.
+func FuzzLoadYAML(f *testing.F) {
+	files, err := filepath.Glob("testdata/*.yaml")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		acl, err := loadYAML(b)
+		if err != nil {
+			return
+		}
+		if err := acl.Validate(); err != nil {
+			return
+		}
+		for _, svc := range []string{"", "enforce-dummy-srv", "unknown-service"} {
+			acl.Decide(svc, "example.com")
+		}
+		acl.Hash()
+	})
+}
@@ -0,0 +1,249 @@
+package acl
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNotModified is returned by HTTPLoader.Load when the ACL hasn't changed
+// since it was last loaded.
+var ErrNotModified = errors.New("ACL not modified")
+
+// HTTPLoader fetches a YAML ACL from URL. Requests are conditional on the
+// ETag and Last-Modified time of the last ACL loaded, so polling an unchanged
+// ACL costs the server little and the proxy nothing.
+//
+// With CacheFile set, every ACL fetched is also saved there. The first load
+// is then conditional on the cached copy, which is used if the server says it
+// is current, or if the server can't be reached or serves an ACL that
+// doesn't load. A fleet restarting at once thus transfers little, and can
+// start while the server is down.
+type HTTPLoader struct {
+	URL       string
+	Key       crypto.PublicKey // If set, the ACL must carry an embedded signature by this key
+	Client    *http.Client     // Defaults to http.DefaultClient
+	CacheFile string           // If set, fetched ACLs are saved here, along with a CacheFile.meta file
+
+	mu           sync.Mutex
+	loaded       bool
+	cacheFailed  bool // Whether the cache file couldn't be loaded, so it is no longer tried
+	etag         string
+	lastModified string
+	fetchedAt    time.Time
+}
+
+// httpCacheMeta is what is known about the ACL saved in a cache file.
+type httpCacheMeta struct {
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	FetchedAt    time.Time `json:"fetched_at"` // When the server last confirmed this ACL was current
+}
+
+func NewHTTPLoader(url string, key crypto.PublicKey, client *http.Client) *HTTPLoader {
+	return &HTTPLoader{URL: url, Key: key, Client: client}
+}
+
+// LastFetched returns when the server last confirmed that the loaded ACL was
+// current, which for an ACL loaded from the cache may be long ago. It is
+// zero if no ACL has been loaded.
+func (hl *HTTPLoader) LastFetched() time.Time {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	return hl.fetchedAt
+}
+
+func (hl *HTTPLoader) Load() (*ACL, error) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+
+	useCache := !hl.loaded && hl.CacheFile != "" && !hl.cacheFailed
+	var meta httpCacheMeta
+	if useCache {
+		var err error
+		meta, err = hl.readCacheMeta()
+		if err != nil {
+			useCache = false
+		} else {
+			hl.etag, hl.lastModified = meta.ETag, meta.LastModified
+		}
+	}
+
+	acl, err := hl.fetch()
+	if !useCache || err == nil {
+		return acl, err
+	}
+
+	// Nothing has been loaded yet, so fall back to the cached copy, whether
+	// the server says it is current or couldn't provide an ACL.
+	if err == ErrNotModified {
+		meta.FetchedAt = time.Now()
+	}
+	cached, cacheErr := hl.loadCache(meta)
+	if cacheErr != nil {
+		hl.cacheFailed = true
+		hl.etag, hl.lastModified = "", ""
+		if err == ErrNotModified {
+			return nil, cacheErr
+		}
+		return nil, err
+	}
+	if err == ErrNotModified {
+		hl.writeCacheMeta(meta)
+	}
+	return cached, nil
+}
+
+// fetch requests the ACL from the server.
+func (hl *HTTPLoader) fetch() (*ACL, error) {
+	req, err := http.NewRequest("GET", hl.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hl.etag != "" {
+		req.Header.Set("If-None-Match", hl.etag)
+	}
+	if hl.lastModified != "" {
+		req.Header.Set("If-Modified-Since", hl.lastModified)
+	}
+
+	client := hl.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if hl.loaded {
+			hl.fetchedAt = time.Now()
+		}
+		return nil, ErrNotModified
+	default:
+		return nil, fmt.Errorf("fetching ACL from %s: unexpected status %s", hl.URL, resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	var tmp *os.File
+	if hl.CacheFile != "" {
+		tmp, err = ioutil.TempFile(filepath.Dir(hl.CacheFile), filepath.Base(hl.CacheFile)+".tmp")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		body = io.TeeReader(resp.Body, tmp)
+	}
+
+	acl, err := hl.decode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only remember a version that loaded, so a broken ACL keeps being
+	// fetched, and reported, until it is fixed.
+	meta := httpCacheMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+	}
+	hl.remember(meta)
+
+	if tmp != nil {
+		// Caching is best effort: a cache that can't be written only costs
+		// a full fetch on the next start.
+		hl.saveCache(tmp, body, meta)
+	}
+	return acl, nil
+}
+
+// saveCache moves the ACL being written to tmp, as it is read from body,
+// into the cache file.
+func (hl *HTTPLoader) saveCache(tmp *os.File, body io.Reader, meta httpCacheMeta) error {
+	// The decoder may stop short of the end of the body.
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), hl.CacheFile); err != nil {
+		return err
+	}
+	return hl.writeCacheMeta(meta)
+}
+
+func (hl *HTTPLoader) decode(r io.Reader) (*ACL, error) {
+	if hl.Key == nil {
+		return decodeYAML(r)
+	}
+
+	bundle, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := VerifyBundle(hl.Key, bundle, nil)
+	if err != nil {
+		return nil, err
+	}
+	return loadYAML(contents)
+}
+
+func (hl *HTTPLoader) remember(meta httpCacheMeta) {
+	hl.loaded = true
+	hl.etag = meta.ETag
+	hl.lastModified = meta.LastModified
+	hl.fetchedAt = meta.FetchedAt
+}
+
+// loadCache loads the ACL saved in the cache file, described by meta.
+func (hl *HTTPLoader) loadCache(meta httpCacheMeta) (*ACL, error) {
+	f, err := os.Open(hl.CacheFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl, err := hl.decode(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("loading cached ACL %s: %v", hl.CacheFile, err)
+	}
+	hl.remember(meta)
+	return acl, nil
+}
+
+func (hl *HTTPLoader) readCacheMeta() (httpCacheMeta, error) {
+	var meta httpCacheMeta
+	data, err := ioutil.ReadFile(hl.CacheFile + ".meta")
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func (hl *HTTPLoader) writeCacheMeta(meta httpCacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := hl.CacheFile + ".meta.tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, hl.CacheFile+".meta")
+}
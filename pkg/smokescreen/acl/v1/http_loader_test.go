@@ -0,0 +1,159 @@
+package acl
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPLoader(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	contents, err := ioutil.ReadFile("testdata/sample_config.yaml")
+	r.NoError(err)
+
+	body, etag := contents, `"v1"`
+	var conditional []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conditional = append(conditional, req.Header.Get("If-None-Match"))
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	loader := NewHTTPLoader(srv.URL, nil, nil)
+
+	acl, err := loader.Load()
+	r.NoError(err)
+	a.Equal(4, len(acl.Rules))
+
+	_, err = loader.Load()
+	a.Equal(ErrNotModified, err)
+
+	body, etag = []byte("version: v1\nservices: []\n"), `"v2"`
+	acl, err = loader.Load()
+	r.NoError(err)
+	a.Empty(acl.Rules)
+
+	// A broken ACL isn't remembered, so it is fetched again.
+	body, etag = []byte("version: v2\nservices: []\n"), `"v3"`
+	_, err = loader.Load()
+	a.Error(err)
+	_, err = loader.Load()
+	a.Error(err)
+
+	a.Equal([]string{"", `"v1"`, `"v1"`, `"v2"`, `"v2"`}, conditional)
+}
+
+func TestHTTPLoaderErrors(t *testing.T) {
+	a := assert.New(t)
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	_, err := NewHTTPLoader(srv.URL, nil, nil).Load()
+	a.EqualError(err, "fetching ACL from "+srv.URL+": unexpected status 404 Not Found")
+}
+
+func TestHTTPLoaderSigned(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	r.NoError(err)
+
+	contents, err := ioutil.ReadFile("testdata/sample_config.yaml")
+	r.NoError(err)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, contents))
+
+	body := contents
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	_, err = NewHTTPLoader(srv.URL, pub, nil).Load()
+	a.EqualError(err, "ACL bundle is not signed")
+
+	body = append(append([]byte{}, contents...), EmbeddedSignaturePrefix+sig+"\n"...)
+	acl, err := NewHTTPLoader(srv.URL, pub, nil).Load()
+	r.NoError(err)
+	a.Equal(4, len(acl.Rules))
+}
+
+func TestHTTPLoaderCache(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-acl-cache")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "acl.yaml")
+
+	contents, err := ioutil.ReadFile("testdata/sample_config.yaml")
+	r.NoError(err)
+
+	up := true
+	var conditional []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		conditional = append(conditional, req.Header.Get("If-None-Match"))
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(contents)
+	}))
+	defer srv.Close()
+
+	loader := &HTTPLoader{URL: srv.URL, CacheFile: cacheFile}
+	_, err = loader.Load()
+	r.NoError(err)
+	cached, err := ioutil.ReadFile(cacheFile)
+	r.NoError(err)
+	a.Equal(contents, cached)
+
+	// A restarted proxy asks whether its cached copy is current, and loads
+	// it if it is.
+	loader = &HTTPLoader{URL: srv.URL, CacheFile: cacheFile}
+	acl, err := loader.Load()
+	r.NoError(err)
+	a.Equal(4, len(acl.Rules))
+	a.WithinDuration(time.Now(), loader.LastFetched(), time.Minute)
+	a.Equal([]string{"", `"v1"`}, conditional)
+
+	// It starts from the cached copy if the server is down.
+	up = false
+	loader = &HTTPLoader{URL: srv.URL, CacheFile: cacheFile}
+	acl, err = loader.Load()
+	r.NoError(err)
+	a.Equal(4, len(acl.Rules))
+
+	// But only before an ACL has loaded.
+	_, err = loader.Load()
+	a.EqualError(err, "fetching ACL from "+srv.URL+": unexpected status 503 Service Unavailable")
+
+	// Without a usable cache, the server's error is returned.
+	r.NoError(ioutil.WriteFile(cacheFile, []byte("version: v2\n"), 0644))
+	_, err = (&HTTPLoader{URL: srv.URL, CacheFile: cacheFile}).Load()
+	a.EqualError(err, "fetching ACL from "+srv.URL+": unexpected status 503 Service Unavailable")
+}
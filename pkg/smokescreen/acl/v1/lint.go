@@ -0,0 +1,187 @@
+package acl
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Problem is an issue Lint found in an ACL file.
+type Problem struct {
+	Service string // Empty for problems that don't belong to a service
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Service == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("service %s: %s", p.Service, p.Message)
+}
+
+// Lint checks a YAML ACL file and returns every problem it finds, where
+// loading the file stops at the first error. Besides what loading rejects,
+// such as unknown actions, invalid globs and duplicate services, it reports
+// unknown keys, rules past their valid_until time, expired exceptions, and
+// globs that can never make a difference because another one shadows them.
+func Lint(yamlFile []byte) []Problem {
+	now := time.Now()
+
+	var cfg YAMLConfig
+	if err := yaml.Unmarshal(yamlFile, &cfg); err != nil {
+		return []Problem{{Message: err.Error()}}
+	}
+
+	var problems []Problem
+	add := func(service, format string, args ...interface{}) {
+		problems = append(problems, Problem{Service: service, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Loading ignores unknown keys, so a misspelled one silently does nothing.
+	if err := yaml.UnmarshalStrict(yamlFile, &YAMLConfig{}); err != nil {
+		add("", "%v", err)
+	}
+
+	if cfg.Version != "v1" {
+		add("", "expected version \"v1\" got %#v", cfg.Version)
+	}
+	if cfg.Services == nil {
+		add("", "top level list 'services' is missing")
+	}
+
+	for _, g := range invalidGlobs(cfg.GlobalAllowList) {
+		add("", "global_allow_list: %v", g)
+	}
+	for _, g := range invalidGlobs(cfg.GlobalDenyList) {
+		add("", "global_deny_list: %v", g)
+	}
+	for _, g := range cfg.GlobalAllowList {
+		if by, ok := shadowingGlob(g, cfg.GlobalDenyList); ok {
+			add("", "global_allow_list entry %s is overridden by global_deny_list entry %s", g, by)
+		}
+	}
+	for name, globs := range cfg.Groups {
+		for _, g := range invalidGlobs(globs) {
+			add("", "group %s: %v", name, g)
+		}
+	}
+
+	seen := make(map[string]bool)
+	ids := make(map[string]string)
+	resolved := make(map[string][]string)
+	for _, svc := range cfg.Services {
+		name := svc.Name
+		if name == "" {
+			add("", "service without a name")
+			name = "(unnamed)"
+		} else if seen[name] {
+			add(name, "defined more than once")
+		}
+		seen[name] = true
+		if svc.ID != "" {
+			if other, ok := ids[svc.ID]; ok {
+				add(name, "id %s is already used by service %s", svc.ID, other)
+			}
+			ids[svc.ID] = name
+		}
+		if _, err := cfg.resolveDomains(svc, []string{name}, resolved); err != nil {
+			add(name, "%v", err)
+		}
+		problems = append(problems, lintRule(name, svc, cfg.GlobalAllowList, now)...)
+	}
+	if cfg.Default != nil {
+		if _, err := cfg.resolveDomains(*cfg.Default, nil, resolved); err != nil {
+			add("default", "%v", err)
+		}
+		problems = append(problems, lintRule("default", *cfg.Default, cfg.GlobalAllowList, now)...)
+	}
+
+	return problems
+}
+
+func lintRule(name string, r YAMLRule, globalAllowList []string, now time.Time) []Problem {
+	var problems []Problem
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{Service: name, Message: fmt.Sprintf(format, args...)})
+	}
+
+	policy, err := PolicyFromAction(r.Action)
+	if err != nil {
+		add("%v", err)
+	}
+	if _, err := ParseUpstreamProxy(r.UpstreamProxy); err != nil {
+		add("%v", err)
+	}
+	if _, err := parseRateLimit(r.RateLimit); err != nil {
+		add("%v", err)
+	}
+	if r.ValidUntil != nil && now.After(*r.ValidUntil) {
+		add("expired at %s", r.ValidUntil.Format(time.RFC3339))
+	}
+	for _, e := range r.exceptions() {
+		if err := e.Validate(); err != nil {
+			add("%v", err)
+		} else if e.Expired(now) {
+			add("exception %s expired at %s", e.Ticket, e.Expires.Format(time.RFC3339))
+		}
+	}
+	if m := r.Mitm.rule(); m != nil {
+		if err := m.Validate(); err != nil {
+			add("mitm: %v", err)
+		}
+	}
+	if err := ValidateResolverAddress(r.ResolverAddress); err != nil {
+		add("%v", err)
+	}
+	if r.DenyLogInterval < 0 {
+		add("deny log interval must not be negative")
+	}
+	if _, err := ParseConnectPorts(r.ConnectPorts); err != nil {
+		add("%v", err)
+	}
+	if err := ValidateALPNProtocols(r.ALPNProtocols); err != nil {
+		add("%v", err)
+	}
+
+	for _, g := range invalidGlobs(r.AllowedHosts) {
+		add("%v", g)
+	}
+	for i, g := range r.AllowedHosts {
+		if by, ok := shadowingGlob(g, r.AllowedHosts[:i]); ok {
+			add("allowed domain %s is already covered by %s", g, by)
+		} else if by, ok := shadowingGlob(g, r.AllowedHosts[i+1:]); ok && by != g {
+			add("allowed domain %s is already covered by %s", g, by)
+		}
+		if policy == Enforce {
+			if by, ok := shadowingGlob(g, globalAllowList); ok {
+				add("allowed domain %s is already covered by global_allow_list entry %s", g, by)
+			}
+		}
+	}
+	return problems
+}
+
+// invalidGlobs returns the validation error of each invalid glob in globs.
+func invalidGlobs(globs []string) []error {
+	var errs []error
+	for _, g := range globs {
+		if err := (&ACL{}).ValidateDomains([]string{g}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// shadowingGlob returns the first of globs that matches everything glob does.
+func shadowingGlob(glob string, globs []string) (string, bool) {
+	for _, other := range globs {
+		if other == "" || glob == "" {
+			continue
+		}
+		if other == glob || (other[0] == '*' && hostMatchesGlob(glob, other)) {
+			return other, true
+		}
+	}
+	return "", false
+}
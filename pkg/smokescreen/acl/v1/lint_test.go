@@ -0,0 +1,99 @@
+package acl
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintSampleConfigs(t *testing.T) {
+	contents, err := ioutil.ReadFile("testdata/sample_config.yaml")
+	require.NoError(t, err)
+	assert.Empty(t, Lint(contents))
+
+	// This one exercises a domain in both global lists on purpose.
+	contents, err = ioutil.ReadFile("testdata/sample_config_with_global.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, []Problem{{
+		Message: "global_allow_list entry conflictingexample.com is overridden by global_deny_list entry conflictingexample.com",
+	}}, Lint(contents))
+}
+
+func TestLint(t *testing.T) {
+	a := assert.New(t)
+
+	problems := Lint([]byte(`
+version: v1
+services:
+  - name: payments
+    project: payments
+    action: enforce
+    allowed_domains:
+      - "*.partner.example.com"
+      - api.partner.example.com
+      - api.partner.example.com
+      - ex*ample.com
+      - shared.example.com
+  - name: payments
+    project: payments
+    action: enforce
+  - name: search
+    id: payments
+    project: search
+    action: block
+  - name: billing
+    id: payments
+    project: billing
+    action: open
+    allowed_domain: [search.example.com]
+    valid_until: 2020-01-01T00:00:00Z
+    exceptions:
+      - {allowed_domains: [old.example.com], expires: 2020-01-01T00:00:00Z, approver: security, ticket: SEC-1}
+      - {allowed_domains: [new.example.com], expires: 2999-01-01}
+global_allow_list: [shared.example.com, "*.cdn.example.com"]
+global_deny_list: [bad.cdn.example.com, "*.cdn.example.com"]
+`))
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	a.ElementsMatch([]string{
+		"yaml: unmarshal errors:\n  line 24: field allowed_domain not found in type acl.YAMLRule",
+		"global_allow_list entry *.cdn.example.com is overridden by global_deny_list entry *.cdn.example.com",
+		"service payments: ex*ample.com: domain globs are only supported as prefix",
+		"service payments: allowed domain api.partner.example.com is already covered by *.partner.example.com",
+		"service payments: allowed domain api.partner.example.com is already covered by *.partner.example.com",
+		"service payments: allowed domain shared.example.com is already covered by global_allow_list entry shared.example.com",
+		"service payments: defined more than once",
+		"service search: unknown action block",
+		"service billing: id payments is already used by service search",
+		"service billing: expired at 2020-01-01T00:00:00Z",
+		"service billing: exception SEC-1 expired at 2020-01-01T00:00:00Z",
+		"service billing: exception has no approver",
+	}, got)
+
+	a.Len(Lint([]byte("services: [")), 1)
+
+	problems = Lint([]byte(`
+version: v1
+groups:
+  bad: [ex*ample.com]
+services:
+  - {name: a, action: enforce, extends: [b]}
+  - {name: b, action: enforce, extends: [a]}
+  - {name: c, action: enforce, allowed_groups: [missing]}
+`))
+	got = nil
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	a.ElementsMatch([]string{
+		"group bad: ex*ample.com: domain globs are only supported as prefix",
+		"service a: extends cycle: a -> b -> a",
+		"service b: extends cycle: b -> a -> b",
+		"service c: unknown group missing",
+	}, got)
+}
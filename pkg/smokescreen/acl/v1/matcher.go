@@ -0,0 +1,172 @@
+package acl
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// domainMatcher matches hosts against a list of domain globs with map
+// lookups, rather than by trying each glob in turn, which adds up for rules
+// allowing thousands of domains.
+type domainMatcher struct {
+	globs    []string
+	exact    map[string]int // Index of each exact glob in globs
+	suffixes map[string]int // Index of each "*." glob in globs, keyed by its suffix, e.g. ".example.com" for "*.example.com"
+	others   []int          // Indexes of globs matched the slow way, which validated ACLs don't have
+	size     int64          // Approximate memory used, in bytes
+}
+
+func compileDomainMatcher(globs []string) *domainMatcher {
+	m := &domainMatcher{
+		globs:    globs,
+		exact:    make(map[string]int),
+		suffixes: make(map[string]int),
+	}
+	for i, g := range globs {
+		g = normalizeGlob(g)
+		switch {
+		case strings.HasPrefix(g, "*."):
+			if _, ok := m.suffixes[g[1:]]; !ok {
+				m.suffixes[g[1:]] = i
+			}
+		case strings.HasPrefix(g, "*"):
+			m.others = append(m.others, i)
+		default:
+			if _, ok := m.exact[g]; !ok {
+				m.exact[g] = i
+			}
+		}
+		// Map entries cost their key's header and bucket overhead on top of
+		// the string itself, which globs shares.
+		m.size += 48
+	}
+	return m
+}
+
+// compiledFrom reports whether m was compiled from globs, rather than from
+// the globs of a rule since replaced.
+func (m *domainMatcher) compiledFrom(globs []string) bool {
+	if len(globs) != len(m.globs) {
+		return false
+	}
+	return len(globs) == 0 || &globs[0] == &m.globs[0]
+}
+
+// match returns the first of the globs host matches, as hostMatchesGlob
+// would find trying them in order.
+func (m *domainMatcher) match(host string) (string, bool) {
+	best := -1
+	consider := func(i int) {
+		if best < 0 || i < best {
+			best = i
+		}
+	}
+	if i, ok := m.exact[host]; ok {
+		consider(i)
+	}
+	for j := 0; j < len(host); j++ {
+		if host[j] != '.' {
+			continue
+		}
+		if i, ok := m.suffixes[host[j:]]; ok {
+			consider(i)
+		}
+	}
+	for _, i := range m.others {
+		if hostMatchesGlob(host, m.globs[i]) {
+			consider(i)
+			break
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return m.globs[best], true
+}
+
+// matcherKey names the list of globs a matcher was compiled from: a service's
+// rule, the default rule or a global list.
+type matcherKey struct {
+	kind    byte // 's' for a service's rule, 'd' for the default rule, 'a' and 'r' for the global allow and deny lists
+	service string
+}
+
+// matcherCache holds the matchers compiled for an ACL. Matchers are compiled
+// the first time they're needed, so the rules of services that never make
+// requests through a given instance cost nothing beyond their definition.
+type matcherCache struct {
+	matchers sync.Map // matcherKey to *domainMatcher
+	compiled int64
+	size     int64
+}
+
+func (c *matcherCache) get(key matcherKey, globs []string) *domainMatcher {
+	if v, ok := c.matchers.Load(key); ok {
+		m := v.(*domainMatcher)
+		if m.compiledFrom(globs) {
+			return m
+		}
+	}
+	m := compileDomainMatcher(globs)
+	if old, loaded := c.matchers.Load(key); loaded {
+		atomic.AddInt64(&c.size, -old.(*domainMatcher).size)
+	} else {
+		atomic.AddInt64(&c.compiled, 1)
+	}
+	c.matchers.Store(key, m)
+	atomic.AddInt64(&c.size, m.size)
+	return m
+}
+
+func (c *matcherCache) forget(key matcherKey) {
+	if old, loaded := c.matchers.Load(key); loaded {
+		c.matchers.Delete(key)
+		atomic.AddInt64(&c.compiled, -1)
+		atomic.AddInt64(&c.size, -old.(*domainMatcher).size)
+	}
+}
+
+// ruleMatcher returns the matcher for the domain globs of rule, which Decide
+// found for service.
+func (acl *ACL) ruleMatcher(service string, rule *Rule) *domainMatcher {
+	key := matcherKey{kind: 's', service: service}
+	if rule == acl.DefaultRule {
+		key = matcherKey{kind: 'd'}
+	}
+	return acl.matchers.get(key, rule.DomainGlobs)
+}
+
+// Stats describes the size of an ACL, so the memory large machine-generated
+// ACLs take can be monitored.
+type Stats struct {
+	Rules            int   // Service rules
+	DomainGlobs      int   // Domain globs of all rules and global lists
+	DomainGlobBytes  int64 // Total length of the domain globs
+	CompiledMatchers int   // Rules and lists whose matchers have been compiled
+	MatcherBytes     int64 // Approximate memory taken by the compiled matchers
+}
+
+// Stats returns the size of the ACL and of the matchers compiled so far.
+func (acl *ACL) Stats() Stats {
+	s := Stats{
+		Rules:            len(acl.Rules),
+		CompiledMatchers: int(atomic.LoadInt64(&acl.matchers.compiled)),
+		MatcherBytes:     atomic.LoadInt64(&acl.matchers.size),
+	}
+	count := func(globs []string) {
+		s.DomainGlobs += len(globs)
+		for _, g := range globs {
+			s.DomainGlobBytes += int64(len(g))
+		}
+	}
+	for _, r := range acl.Rules {
+		count(r.DomainGlobs)
+	}
+	if acl.DefaultRule != nil {
+		count(acl.DefaultRule.DomainGlobs)
+	}
+	count(acl.GlobalAllowList)
+	count(acl.GlobalDenyList)
+	return s
+}
@@ -0,0 +1,176 @@
+package acl
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainMatcher(t *testing.T) {
+	a := assert.New(t)
+
+	globs := []string{"api.example.com", "*.internal.example.com", "*.example.com", "example.org", "*.example.com", "*weird.example.net"}
+	m := compileDomainMatcher(globs)
+	for _, host := range []string{
+		"api.example.com",
+		"www.example.com",
+		"a.b.internal.example.com",
+		"internal.example.com",
+		"example.com",
+		"example.org",
+		"www.example.org",
+		"notexample.com",
+		"weird.example.net",
+		"veryweird.example.net",
+		"",
+	} {
+		want := ""
+		for _, g := range globs {
+			if hostMatchesGlob(host, g) {
+				want = g
+				break
+			}
+		}
+		got, ok := m.match(host)
+		a.Equal(want != "", ok, host)
+		a.Equal(want, got, host)
+	}
+}
+
+func TestACLMatchersCompiledLazily(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - name: one
+    project: one
+    action: enforce
+    allowed_domains: [one.example.com, "*.one.example.net"]
+  - name: two
+    project: two
+    action: enforce
+    allowed_domains: [two.example.com]
+default:
+  project: other
+  action: enforce
+  allowed_domains: [default.example.com]
+global_deny_list: [bad.example.com]
+`))
+	r.NoError(err)
+
+	stats := acl.Stats()
+	a.Equal(2, stats.Rules)
+	a.Equal(5, stats.DomainGlobs)
+	a.Equal(0, stats.CompiledMatchers)
+	a.Zero(stats.MatcherBytes)
+
+	d, err := acl.Decide("one", "www.one.example.net")
+	r.NoError(err)
+	a.Equal(Allow, d.Result)
+
+	// Only one's rule has been compiled: the global lists weren't needed.
+	stats = acl.Stats()
+	a.Equal(1, stats.CompiledMatchers)
+	a.True(stats.MatcherBytes > 0)
+
+	d, err = acl.Decide("unknown", "default.example.com")
+	r.NoError(err)
+	a.Equal(Allow, d.Result)
+	a.True(d.Default)
+	a.Equal(2, acl.Stats().CompiledMatchers)
+
+	// Rules replaced after their matcher was compiled are recompiled.
+	rule := acl.Rules["one"]
+	rule.DomainGlobs = []string{"new.example.com"}
+	acl.Rules["one"] = rule
+	d, err = acl.Decide("one", "new.example.com")
+	r.NoError(err)
+	a.Equal(Allow, d.Result)
+	d, err = acl.Decide("one", "one.example.com")
+	r.NoError(err)
+	a.Equal(Deny, d.Result)
+	a.Equal(4, acl.Stats().CompiledMatchers) // One's, the default rule's and both global lists
+}
+
+// generatedACL builds the YAML of an ACL with roles services, each allowing
+// a handful of domains and extending the one before, as machine-generated
+// ACLs often do.
+func generatedACL(roles int) []byte {
+	var b strings.Builder
+	b.WriteString("version: v1\nservices:\n")
+	for i := 0; i < roles; i++ {
+		fmt.Fprintf(&b, "  - name: role-%d\n    project: project-%d\n    action: enforce\n", i, i%100)
+		fmt.Fprintf(&b, "    allowed_domains: [api-%d.example.com, \"*.svc-%d.example.net\", files-%d.example.org]\n", i, i, i)
+		if i%10 != 0 {
+			fmt.Fprintf(&b, "    extends: [role-%d]\n", i-1)
+		}
+	}
+	b.WriteString("default:\n  project: other\n  action: enforce\n")
+	return []byte(b.String())
+}
+
+func BenchmarkLoadLargeACL(b *testing.B) {
+	yaml := generatedACL(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := loadYAML(yaml); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecideLargeACL(b *testing.B) {
+	acl, err := loadYAML(generatedACL(50000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		role := i % 50000
+		host := fmt.Sprintf("www.svc-%d.example.net", role-role%10)
+		d, err := acl.Decide(fmt.Sprintf("role-%d", role), host)
+		if err != nil || d.Result != Allow {
+			b.Fatalf("%s: %v %v", host, d.Result, err)
+		}
+	}
+	b.StopTimer()
+	stats := acl.Stats()
+	b.ReportMetric(float64(stats.CompiledMatchers), "matchers")
+	b.ReportMetric(float64(stats.MatcherBytes), "matcher-bytes")
+}
+
+func TestDecideNormalizesGlobs(t *testing.T) {
+	a := assert.New(t)
+
+	acl := &ACL{
+		Rules: map[string]Rule{
+			"svc": {
+				Policy:      Enforce,
+				DomainGlobs: []string{"API.Example.com", "*.Corp.Example", "bücher.example", "trailing.example."},
+			},
+		},
+		GlobalAllowList: []string{"Global.Example"},
+		GlobalDenyList:  []string{"*.Blocked.Example"},
+	}
+	for host, want := range map[string]DecisionResult{
+		"api.example.com":        Allow,
+		"API.EXAMPLE.COM":        Allow,
+		"www.corp.example":       Allow,
+		"xn--bcher-kva.example":  Allow,
+		"bücher.example":         Allow,
+		"trailing.example":       Allow,
+		"global.example":         Allow,
+		"www.blocked.example":    Deny,
+		"www.example.com":        Deny,
+		"xn--bcher-kva.example2": Deny,
+	} {
+		d, err := acl.Decide("svc", host)
+		a.NoError(err, host)
+		a.Equal(want, d.Result, host)
+	}
+}
@@ -0,0 +1,77 @@
+package acl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MitmRule opts a service into TLS inspection and restricts the HTTP requests
+// it may make, both inside inspected TLS connections and as plain HTTP.
+type MitmRule struct {
+	AllowedMethods []string // Any method is allowed if empty
+	AllowedPaths   []string // Path globs, which may end with "*" to match a prefix. Any path is allowed if empty
+}
+
+// Allows reports whether the rule allows a request with the given method and
+// path.
+func (m *MitmRule) Allows(method, path string) bool {
+	return m.allowsMethod(method) && m.allowsPath(path)
+}
+
+func (m *MitmRule) allowsMethod(method string) bool {
+	if len(m.AllowedMethods) == 0 {
+		return true
+	}
+	for _, am := range m.AllowedMethods {
+		if strings.EqualFold(am, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MitmRule) allowsPath(p string) bool {
+	if len(m.AllowedPaths) == 0 {
+		return true
+	}
+	p = cleanPath(p)
+	for _, glob := range m.AllowedPaths {
+		if pathMatchesGlob(p, glob) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath resolves the dot segments and repeated slashes of a decoded
+// request path the way destinations do, so that /public/../admin and
+// /public/%2e%2e/admin are checked as the /admin they end up at.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func pathMatchesGlob(path, glob string) bool {
+	if strings.HasSuffix(glob, "*") {
+		return strings.HasPrefix(path, glob[:len(glob)-1])
+	}
+	return path == glob
+}
+
+// Validate checks that the rule's path globs are absolute and only use a
+// trailing wildcard.
+func (m *MitmRule) Validate() error {
+	for _, p := range m.AllowedPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("%v: path globs must start with /", p)
+		}
+		if strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+			return fmt.Errorf("%v: path globs are only supported as suffix", p)
+		}
+	}
+	return nil
+}
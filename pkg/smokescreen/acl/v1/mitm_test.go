@@ -0,0 +1,28 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMitmRuleAllowsPath(t *testing.T) {
+	a := assert.New(t)
+
+	m := &MitmRule{AllowedPaths: []string{"/public/*", "/status"}}
+	for path, allowed := range map[string]bool{
+		"/public/":               true,
+		"/public/docs":           true,
+		"/public//docs":          true,
+		"/public/./docs/../faq":  true,
+		"/status":                true,
+		"/status/../status":      true,
+		"/public":                false,
+		"/public/../admin":       false,
+		"/public/../../admin":    false,
+		"/public/docs/../../etc": false,
+		"/admin":                 false,
+	} {
+		a.Equal(allowed, m.Allows("GET", path), path)
+	}
+}
@@ -0,0 +1,40 @@
+package acl
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Parse decodes a YAML ACL file into its YAMLConfig, which tooling can modify
+// and write back with Serialize. Groups and extends are kept as written
+// rather than resolved. The file must load, so a config that parses is one
+// Smokescreen would accept. Comments are not kept.
+func Parse(yamlFile []byte) (*YAMLConfig, error) {
+	var cfg YAMLConfig
+	if err := yaml.Unmarshal(yamlFile, &cfg); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.load(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Serialize encodes cfg as a YAML ACL file that Parse and the loaders read
+// back as the same ACL. It refuses to encode a config that wouldn't load.
+func Serialize(cfg *YAMLConfig) ([]byte, error) {
+	if _, err := cfg.load(); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(cfg)
+}
+
+// load checks the version, which Load leaves to the file loaders, and loads
+// cfg.
+func (cfg *YAMLConfig) load() (*ACL, error) {
+	if cfg.Version != "v1" {
+		return nil, fmt.Errorf("expected version \"v1\" got %#v", cfg.Version)
+	}
+	return cfg.Load()
+}
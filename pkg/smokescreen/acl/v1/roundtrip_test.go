@@ -0,0 +1,73 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSerializeRoundTrip(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	original := []byte(`
+version: v1
+connect_only: true
+groups:
+  mirrors: [pypi.org, "*.npmjs.org"]
+services:
+  - name: builder
+    project: ci
+    action: enforce
+    allowed_domains: [github.com]
+    allowed_groups: [mirrors]
+    connect_only: false
+    address_family: ipv4
+    rate_limit: {requests: 10, per: 1m}
+    valid_until: 2030-01-01T00:00:00Z
+  - name: deployer
+    id: deploy-egress
+    action: report
+    extends: [builder]
+    upstream_proxy: http://gateway:3128
+    mitm: {allowed_methods: [GET]}
+default:
+  project: other
+  action: open
+global_deny_list: [evil.example.com]
+`)
+
+	cfg, err := Parse(original)
+	r.NoError(err)
+	a.Equal([]string{"mirrors"}, cfg.Services[0].AllowedGroups)
+
+	out, err := Serialize(cfg)
+	r.NoError(err)
+
+	reparsed, err := Parse(out)
+	r.NoError(err)
+	a.Equal(cfg, reparsed)
+
+	before, err := loadYAML(original)
+	r.NoError(err)
+	after, err := loadYAML(out)
+	r.NoError(err)
+	a.Empty(Diff(before, after))
+}
+
+func TestParseSerializeReject(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := Parse([]byte(`{version: v2, services: []}`))
+	a.EqualError(err, `expected version "v1" got "v2"`)
+
+	_, err = Parse([]byte(`{version: v1, services: [{name: a, action: nope}]}`))
+	a.EqualError(err, "unknown action nope")
+
+	cfg, err := Parse([]byte(`{version: v1, services: [{name: a, action: open}]}`))
+	a.NoError(err)
+	cfg.Services[0].AllowedGroups = []string{"missing"}
+	_, err = Serialize(cfg)
+	a.EqualError(err, "service a: unknown group missing")
+}
@@ -0,0 +1,166 @@
+package acl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// EmbeddedSignaturePrefix starts the line carrying an embedded signature. The
+// line must be the last one in the bundle, and the signature covers every
+// byte preceding it. Since it is a YAML comment, a signed bundle is still a
+// valid ACL file.
+const EmbeddedSignaturePrefix = "# smokescreen-signature: "
+
+// BundleFetcher retrieves the raw contents of an ACL bundle. The signature is
+// nil unless the bundle is distributed with a detached signature.
+type BundleFetcher interface {
+	Fetch() (bundle, signature []byte, err error)
+}
+
+// FileBundleFetcher reads a bundle from Path. If a file named Path + ".sig"
+// exists, it is read as the bundle's detached signature.
+type FileBundleFetcher struct {
+	Path string
+}
+
+func (f FileBundleFetcher) Fetch() ([]byte, []byte, error) {
+	bundle, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := ioutil.ReadFile(f.Path + ".sig")
+	if os.IsNotExist(err) {
+		return bundle, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return bundle, signature, nil
+}
+
+// SignedLoader loads YAML ACL bundles that are signed with a trusted key. A
+// bundle without a valid signature is never loaded.
+//
+// Signatures are base64 encoded and computed over the bundle contents: with
+// Ed25519 directly, and over the SHA-256 digest for RSA (PKCS #1 v1.5) and
+// ECDSA (ASN.1) keys.
+//
+// If fetching the bundle fails, the most recently verified bundle is loaded
+// instead so that a temporarily unavailable source doesn't take the ACL away.
+// A bundle that fails verification is always an error.
+type SignedLoader struct {
+	fetcher BundleFetcher
+	key     crypto.PublicKey
+
+	sync.Mutex
+	lastVerified []byte
+}
+
+func NewSignedLoader(fetcher BundleFetcher, key crypto.PublicKey) *SignedLoader {
+	return &SignedLoader{fetcher: fetcher, key: key}
+}
+
+func (sl *SignedLoader) Load() (*ACL, error) {
+	sl.Lock()
+	defer sl.Unlock()
+
+	bundle, signature, err := sl.fetcher.Fetch()
+	if err != nil {
+		if sl.lastVerified == nil {
+			return nil, err
+		}
+		return loadYAML(sl.lastVerified)
+	}
+
+	contents, err := VerifyBundle(sl.key, bundle, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := loadYAML(contents)
+	if err != nil {
+		return nil, err
+	}
+	sl.lastVerified = contents
+	return acl, nil
+}
+
+// VerifyBundle checks bundle against a detached signature or, if signature is
+// nil, against the signature embedded in its last line. It returns the signed
+// contents of the bundle.
+func VerifyBundle(key crypto.PublicKey, bundle, signature []byte) ([]byte, error) {
+	contents := bundle
+	if signature == nil {
+		var err error
+		contents, signature, err = splitEmbeddedSignature(bundle)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed ACL signature: %v", err)
+	}
+
+	if err := verifySignature(key, contents, sig); err != nil {
+		return nil, fmt.Errorf("ACL signature verification failed: %v", err)
+	}
+	return contents, nil
+}
+
+func splitEmbeddedSignature(bundle []byte) ([]byte, []byte, error) {
+	trimmed := bytes.TrimRight(bundle, "\n")
+	i := bytes.LastIndexByte(trimmed, '\n') + 1
+	if !bytes.HasPrefix(trimmed[i:], []byte(EmbeddedSignaturePrefix)) {
+		return nil, nil, errors.New("ACL bundle is not signed")
+	}
+	return bundle[:i], trimmed[i+len(EmbeddedSignaturePrefix):], nil
+}
+
+func verifySignature(key crypto.PublicKey, contents, sig []byte) error {
+	digest := sha256.Sum256(contents)
+
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, contents, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// LoadPublicKeyFile reads a PEM encoded PKIX public key.
+func LoadPublicKeyFile(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,122 @@
+package acl
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedLoader(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	r.NoError(err)
+
+	contents, err := ioutil.ReadFile("testdata/sample_config.yaml")
+	r.NoError(err)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, contents))
+
+	dir, err := ioutil.TempDir("", "signed-acl")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		r.NoError(ioutil.WriteFile(path, data, 0600))
+		return path
+	}
+
+	// Embedded signature
+	{
+		path := write("embedded.yaml", append(append([]byte{}, contents...), EmbeddedSignaturePrefix+sig+"\n"...))
+		acl, err := New(logrus.New(), NewSignedLoader(FileBundleFetcher{path}, pub), []string{})
+		a.NoError(err)
+		a.Equal(4, len(acl.Rules))
+	}
+
+	// Detached signature
+	{
+		path := write("detached.yaml", contents)
+		write("detached.yaml.sig", []byte(sig+"\n"))
+		acl, err := New(logrus.New(), NewSignedLoader(FileBundleFetcher{path}, pub), []string{})
+		a.NoError(err)
+		a.Equal(4, len(acl.Rules))
+	}
+
+	// Unsigned
+	{
+		path := write("unsigned.yaml", contents)
+		_, err := New(logrus.New(), NewSignedLoader(FileBundleFetcher{path}, pub), []string{})
+		a.EqualError(err, "ACL bundle is not signed")
+	}
+
+	// Tampered
+	{
+		tampered := append([]byte("# injected\n"), contents...)
+		path := write("tampered.yaml", append(tampered, EmbeddedSignaturePrefix+sig+"\n"...))
+		_, err := New(logrus.New(), NewSignedLoader(FileBundleFetcher{path}, pub), []string{})
+		a.Error(err)
+		a.Contains(err.Error(), "signature verification failed")
+	}
+
+	// The last verified bundle is used when the source is unavailable, but a
+	// bad signature is never tolerated.
+	{
+		path := write("fallback.yaml", contents)
+		write("fallback.yaml.sig", []byte(sig))
+		loader := NewSignedLoader(FileBundleFetcher{path}, pub)
+		_, err := loader.Load()
+		r.NoError(err)
+
+		r.NoError(os.Remove(path))
+		acl, err := loader.Load()
+		a.NoError(err)
+		a.Equal(4, len(acl.Rules))
+
+		write("fallback.yaml", append([]byte("# injected\n"), contents...))
+		_, err = loader.Load()
+		a.Error(err)
+	}
+}
+
+func TestLoadPublicKeyFileECDSA(t *testing.T) {
+	r := require.New(t)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	r.NoError(err)
+
+	f, err := ioutil.TempFile("", "acl-key")
+	r.NoError(err)
+	defer os.Remove(f.Name())
+	r.NoError(pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	f.Close()
+
+	key, err := LoadPublicKeyFile(f.Name())
+	r.NoError(err)
+
+	contents := []byte("version: v1\nservices: []\n")
+	digest := sha256.Sum256(contents)
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	r.NoError(err)
+
+	_, err = VerifyBundle(key, contents, []byte(base64.StdEncoding.EncodeToString(sig)))
+	r.NoError(err)
+	_, err = VerifyBundle(key, append(contents, '\n'), []byte(base64.StdEncoding.EncodeToString(sig)))
+	r.Error(err)
+}
@@ -1,10 +1,15 @@
 package acl
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -18,18 +23,59 @@ func NewYAMLLoader(path string) *YAMLLoader {
 }
 
 type YAMLConfig struct {
-	Services        []YAMLRule `yaml:"services"`
-	Default         *YAMLRule  `yaml:"default"`
 	Version         string     `yaml:"version"`
-	GlobalDenyList  []string   `yaml:"global_deny_list"`  // domains which will be blocked even in report mode
-	GlobalAllowList []string   `yaml:"global_allow_list"` // domains which will be allowed for every host type
+	Services        []YAMLRule `yaml:"services"`
+	Default         *YAMLRule  `yaml:"default,omitempty"`
+	GlobalDenyList  []string   `yaml:"global_deny_list,omitempty"`  // domains which will be blocked even in report mode
+	GlobalAllowList []string   `yaml:"global_allow_list,omitempty"` // domains which will be allowed for every host type
+	FallbackRole    string     `yaml:"fallback_role,omitempty"`     // service whose rule applies to services without one, instead of the default rule
+
+	Groups map[string][]string `yaml:"groups,omitempty"` // named lists of domains which rules can allow with allowed_groups
+
+	ConnectOnly bool `yaml:"connect_only,omitempty"` // whether rules that don't say otherwise deny plain HTTP proxying
+
+	servicesByName map[string]int // index of each service in Services, built by service
 }
 
 type YAMLRule struct {
-	Name         string   `yaml:"name"`
-	Project      string   `yaml:"project"` // owner
-	Action       string   `yaml:"action"`
-	AllowedHosts []string `yaml:"allowed_domains"`
+	Name             string         `yaml:"name,omitempty"`
+	ID               string         `yaml:"id,omitempty"`
+	Project          string         `yaml:"project,omitempty"` // owner
+	Action           string         `yaml:"action,omitempty"`
+	AllowedHosts     []string       `yaml:"allowed_domains,omitempty"`
+	AllowedGroups    []string       `yaml:"allowed_groups,omitempty"` // groups whose domains are also allowed
+	Extends          []string       `yaml:"extends,omitempty"`        // services whose allowed domains and groups are also allowed
+	ConnectOnly      *bool          `yaml:"connect_only,omitempty"`   // overrides the top level connect_only
+	UpstreamProxy    string         `yaml:"upstream_proxy,omitempty"`
+	AddressFamily    string         `yaml:"address_family,omitempty"`   // any, ipv4, ipv6, prefer_ipv4 or prefer_ipv6
+	ResolverAddress  string         `yaml:"resolver_address,omitempty"` // host:port of the DNS server resolving this service's destinations
+	RateLimit        *YAMLRateLimit `yaml:"rate_limit,omitempty"`
+	Mitm             *YAMLMitmRule  `yaml:"mitm,omitempty"`
+	InspectPlaintext bool           `yaml:"inspect_plaintext,omitempty"` // parse the HTTP requests sent through CONNECT tunnels to port 80
+	ValidUntil       *time.Time     `yaml:"valid_until,omitempty"`
+	DenyLogInterval  time.Duration  `yaml:"deny_log_interval,omitempty"` // log repeated denials to the same host once per interval
+	ConnectPorts     []string       `yaml:"connect_ports,omitempty"`     // ports CONNECT may target, overriding the proxy's list; "*" allows any
+	FollowRedirects  int            `yaml:"follow_redirects,omitempty"`  // redirects of plain HTTP requests smokescreen follows itself, re-checking each target
+	ALPNProtocols    []string       `yaml:"alpn_protocols,omitempty"`    // the only ALPN protocols TLS connections may offer, such as h2 and http/1.1
+
+	Exceptions []YAMLException `yaml:"exceptions,omitempty"` // domains allowed until an expiry, with who approved them and why
+}
+
+type YAMLException struct {
+	AllowedHosts []string   `yaml:"allowed_domains,omitempty"`
+	Expires      *time.Time `yaml:"expires,omitempty"`
+	Approver     string     `yaml:"approver,omitempty"`
+	Ticket       string     `yaml:"ticket,omitempty"`
+}
+
+type YAMLMitmRule struct {
+	AllowedMethods []string `yaml:"allowed_methods,omitempty"`
+	AllowedPaths   []string `yaml:"allowed_paths,omitempty"`
+}
+
+type YAMLRateLimit struct {
+	Requests int           `yaml:"requests,omitempty"`
+	Per      time.Duration `yaml:"per,omitempty"`
 }
 
 func (yc *YAMLConfig) ValidateConfig() error {
@@ -44,22 +90,24 @@ func (yl *YAMLLoader) Load() (*ACL, error) {
 	}
 	defer f.Close()
 
-	yamlFile, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, fmt.Errorf("could not load acl configuration")
-	}
+	// Decode as the file is read, rather than reading it into memory first,
+	// as very large ACLs would otherwise be held twice.
+	return decodeYAML(bufio.NewReader(f))
+}
+
+// loadYAML parses a YAML ACL configuration.
+func loadYAML(yamlFile []byte) (*ACL, error) {
+	return decodeYAML(bytes.NewReader(yamlFile))
+}
 
+func decodeYAML(r io.Reader) (*ACL, error) {
 	yamlConfig := YAMLConfig{}
-	err = yaml.Unmarshal(yamlFile, &yamlConfig)
-	if err != nil {
+	err := yaml.NewDecoder(r).Decode(&yamlConfig)
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
-	if yamlConfig.Version != "v1" {
-		return nil, fmt.Errorf("expected version \"v1\" got %#v", yamlConfig.Version)
-	}
-
-	return yamlConfig.Load()
+	return yamlConfig.load()
 }
 
 func (cfg *YAMLConfig) Load() (*ACL, error) {
@@ -71,16 +119,61 @@ func (cfg *YAMLConfig) Load() (*ACL, error) {
 		return nil, errors.New("Top level list 'services' is missing")
 	}
 
+	resolved := make(map[string][]string)
+
 	for _, v := range cfg.Services {
 		p, err := PolicyFromAction(v.Action)
 		if err != nil {
 			return nil, err
 		}
 
+		upstream, err := ParseUpstreamProxy(v.UpstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+
+		rateLimit, err := parseRateLimit(v.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", v.Name, err)
+		}
+
+		domains, err := cfg.resolveDomains(v, []string{v.Name}, resolved)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", v.Name, err)
+		}
+
+		family, err := AddressFamilyFromString(v.AddressFamily)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", v.Name, err)
+		}
+
+		connectPorts, err := ParseConnectPorts(v.ConnectPorts)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", v.Name, err)
+		}
+
+		if err := ValidateFollowRedirects(v.FollowRedirects); err != nil {
+			return nil, fmt.Errorf("service %s: %v", v.Name, err)
+		}
+
 		r := Rule{
-			Project:     v.Project,
-			Policy:      p,
-			DomainGlobs: v.AllowedHosts,
+			ID:               v.ID,
+			Project:          v.Project,
+			Policy:           p,
+			DomainGlobs:      domains,
+			UpstreamProxy:    upstream,
+			RateLimit:        rateLimit,
+			Mitm:             v.Mitm.rule(),
+			InspectPlaintext: v.InspectPlaintext,
+			ValidUntil:       v.validUntil(),
+			ConnectOnly:      cfg.connectOnly(v),
+			AddressFamily:    family,
+			ResolverAddress:  v.ResolverAddress,
+			DenyLogInterval:  v.DenyLogInterval,
+			ConnectPorts:     connectPorts,
+			FollowRedirects:  v.FollowRedirects,
+			ALPNProtocols:    v.ALPNProtocols,
+			Exceptions:       v.exceptions(),
 		}
 
 		err = acl.Add(v.Name, r)
@@ -95,10 +188,67 @@ func (cfg *YAMLConfig) Load() (*ACL, error) {
 			return nil, err
 		}
 
+		upstream, err := ParseUpstreamProxy(cfg.Default.UpstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+
+		rateLimit, err := parseRateLimit(cfg.Default.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
+		}
+
+		domains, err := cfg.resolveDomains(*cfg.Default, nil, resolved)
+		if err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
+		}
+
+		family, err := AddressFamilyFromString(cfg.Default.AddressFamily)
+		if err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
+		}
+
+		connectPorts, err := ParseConnectPorts(cfg.Default.ConnectPorts)
+		if err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
+		}
+
+		if err := ValidateFollowRedirects(cfg.Default.FollowRedirects); err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
+		}
+
 		acl.DefaultRule = &Rule{
-			Project:     cfg.Default.Project,
-			Policy:      p,
-			DomainGlobs: cfg.Default.AllowedHosts,
+			ID:               cfg.Default.ID,
+			Project:          cfg.Default.Project,
+			Policy:           p,
+			DomainGlobs:      domains,
+			UpstreamProxy:    upstream,
+			RateLimit:        rateLimit,
+			Mitm:             cfg.Default.Mitm.rule(),
+			InspectPlaintext: cfg.Default.InspectPlaintext,
+			ValidUntil:       cfg.Default.validUntil(),
+			ConnectOnly:      cfg.connectOnly(*cfg.Default),
+			AddressFamily:    family,
+			ResolverAddress:  cfg.Default.ResolverAddress,
+			DenyLogInterval:  cfg.Default.DenyLogInterval,
+			ConnectPorts:     connectPorts,
+			FollowRedirects:  cfg.Default.FollowRedirects,
+			ALPNProtocols:    cfg.Default.ALPNProtocols,
+			Exceptions:       cfg.Default.exceptions(),
+		}
+		if acl.DefaultRule.Mitm != nil {
+			if err := acl.DefaultRule.Mitm.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		if err := ValidateResolverAddress(acl.DefaultRule.ResolverAddress); err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
+		}
+		if err := validateExceptions(acl.DefaultRule.Exceptions); err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
+		}
+		if err := ValidateALPNProtocols(acl.DefaultRule.ALPNProtocols); err != nil {
+			return nil, fmt.Errorf("default rule: %v", err)
 		}
 	}
 
@@ -111,6 +261,141 @@ func (cfg *YAMLConfig) Load() (*ACL, error) {
 	if cfg.GlobalDenyList != nil {
 		acl.GlobalDenyList = cfg.GlobalDenyList
 	}
+	acl.FallbackRole = cfg.FallbackRole
 
 	return &acl, nil
 }
+
+// resolveDomains returns the domains r allows: its own, those of the groups
+// it lists, and those of the services it extends, recursively. path holds the
+// services being resolved, to detect cycles. The domains of the services
+// resolved so far are kept in resolved, so that services extended by many
+// others, directly or not, are only resolved once.
+func (cfg *YAMLConfig) resolveDomains(r YAMLRule, path []string, resolved map[string][]string) ([]string, error) {
+	domains := append([]string(nil), r.AllowedHosts...)
+
+	for _, g := range r.AllowedGroups {
+		globs, ok := cfg.Groups[g]
+		if !ok {
+			return nil, fmt.Errorf("unknown group %s", g)
+		}
+		domains = append(domains, globs...)
+	}
+
+	for _, name := range r.Extends {
+		for _, p := range path {
+			if p == name {
+				return nil, fmt.Errorf("extends cycle: %s -> %s", strings.Join(path, " -> "), name)
+			}
+		}
+
+		inherited, ok := resolved[name]
+		if !ok {
+			base, found := cfg.service(name)
+			if !found {
+				return nil, fmt.Errorf("extends unknown service %s", name)
+			}
+			var err error
+			inherited, err = cfg.resolveDomains(base, append(path[:len(path):len(path)], name), resolved)
+			if err != nil {
+				return nil, err
+			}
+			resolved[name] = inherited
+		}
+		domains = append(domains, inherited...)
+	}
+
+	if len(r.AllowedGroups) == 0 && len(r.Extends) == 0 {
+		return domains, nil
+	}
+
+	// Bases often share groups; keep one copy of each domain.
+	seen := make(map[string]bool, len(domains))
+	unique := domains[:0]
+	for _, d := range domains {
+		if !seen[d] {
+			seen[d] = true
+			unique = append(unique, d)
+		}
+	}
+	return unique, nil
+}
+
+// service returns the first service named name. Services are indexed by name,
+// as scanning them for each service another extends is quadratic in the size
+// of machine-generated ACLs. The index is rebuilt if Services has changed
+// since.
+func (cfg *YAMLConfig) service(name string) (YAMLRule, bool) {
+	i, ok := cfg.servicesByName[name]
+	if !ok || i >= len(cfg.Services) || cfg.Services[i].Name != name {
+		cfg.servicesByName = make(map[string]int, len(cfg.Services))
+		for i := len(cfg.Services) - 1; i >= 0; i-- {
+			cfg.servicesByName[cfg.Services[i].Name] = i
+		}
+		if i, ok = cfg.servicesByName[name]; !ok {
+			return YAMLRule{}, false
+		}
+	}
+	return cfg.Services[i], true
+}
+
+// ParseUpstreamProxy validates an upstream proxy URL. Plain HTTP proxies and
+// SOCKS5 proxies are supported.
+func ParseUpstreamProxy(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %v", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "socks5") || u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream proxy %q must be an http:// or socks5:// URL", s)
+	}
+	return u, nil
+}
+
+// parseRateLimit validates a rule's rate limit.
+func parseRateLimit(yrl *YAMLRateLimit) (*RateLimit, error) {
+	if yrl == nil {
+		return nil, nil
+	}
+	if yrl.Requests <= 0 || yrl.Per <= 0 {
+		return nil, fmt.Errorf("rate_limit requires positive 'requests' and 'per'")
+	}
+	return &RateLimit{Requests: yrl.Requests, Per: yrl.Per}, nil
+}
+
+func (ym *YAMLMitmRule) rule() *MitmRule {
+	if ym == nil {
+		return nil
+	}
+	return &MitmRule{AllowedMethods: ym.AllowedMethods, AllowedPaths: ym.AllowedPaths}
+}
+
+func (yr *YAMLRule) validUntil() time.Time {
+	if yr.ValidUntil == nil {
+		return time.Time{}
+	}
+	return *yr.ValidUntil
+}
+
+func (yr *YAMLRule) exceptions() []Exception {
+	var exceptions []Exception
+	for _, ye := range yr.Exceptions {
+		e := Exception{DomainGlobs: ye.AllowedHosts, Approver: ye.Approver, Ticket: ye.Ticket}
+		if ye.Expires != nil {
+			e.Expires = *ye.Expires
+		}
+		exceptions = append(exceptions, e)
+	}
+	return exceptions
+}
+
+func (cfg *YAMLConfig) connectOnly(yr YAMLRule) bool {
+	if yr.ConnectOnly != nil {
+		return *yr.ConnectOnly
+	}
+	return cfg.ConnectOnly
+}
@@ -1,10 +1,14 @@
 package acl
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestYAMLLoader(t *testing.T) {
@@ -75,3 +79,466 @@ func TestYAMLLoaderDisabledAclAction(t *testing.T) {
 	a.NotNil(err)
 	a.Nil(acl)
 }
+
+func TestYAMLLoaderUpstreamProxy(t *testing.T) {
+	a := assert.New(t)
+
+	cfg := YAMLConfig{
+		Services: []YAMLRule{
+			{Name: "partner", Action: "enforce", AllowedHosts: []string{"partner.example.com"}, UpstreamProxy: "http://corp-gateway:3128"},
+			{Name: "direct", Action: "enforce", AllowedHosts: []string{"example.com"}},
+		},
+	}
+	acl, err := cfg.Load()
+	a.NoError(err)
+
+	d, err := acl.Decide("partner", "partner.example.com")
+	a.NoError(err)
+	if a.NotNil(d.UpstreamProxy) {
+		a.Equal("corp-gateway:3128", d.UpstreamProxy.Host)
+	}
+
+	d, err = acl.Decide("direct", "example.com")
+	a.NoError(err)
+	a.Nil(d.UpstreamProxy)
+
+	cfg.Services[1].UpstreamProxy = "socks5://bastion:1080"
+	acl, err = cfg.Load()
+	a.NoError(err)
+	d, err = acl.Decide("direct", "example.com")
+	a.NoError(err)
+	if a.NotNil(d.UpstreamProxy) {
+		a.Equal("socks5", d.UpstreamProxy.Scheme)
+	}
+
+	cfg.Services[1].UpstreamProxy = "https://corp-gateway:3128"
+	_, err = cfg.Load()
+	a.Error(err)
+}
+
+func TestYAMLLoaderRateLimit(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - name: chatty
+    project: partners
+    action: enforce
+    allowed_domains: [partner.example.com]
+    rate_limit: {requests: 100, per: 1s}
+`))
+	a.NoError(err)
+	d, err := acl.Decide("chatty", "partner.example.com")
+	a.NoError(err)
+	if a.NotNil(d.RateLimit) {
+		a.Equal(RateLimit{Requests: 100, Per: time.Second}, *d.RateLimit)
+	}
+
+	_, err = loadYAML([]byte(`
+version: v1
+services:
+  - name: chatty
+    project: partners
+    action: enforce
+    rate_limit: {requests: 100}
+`))
+	a.Error(err)
+}
+
+func TestYAMLLoaderMitm(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - name: inspected
+    project: payments
+    action: enforce
+    allowed_domains: [api.partner.example.com]
+    mitm:
+      allowed_methods: [GET, HEAD]
+      allowed_paths: [/v1/*, /status]
+`))
+	a.NoError(err)
+	d, err := acl.Decide("inspected", "api.partner.example.com")
+	a.NoError(err)
+	if a.NotNil(d.Mitm) {
+		a.True(d.Mitm.Allows("GET", "/v1/charges"))
+		a.True(d.Mitm.Allows("head", "/status"))
+		a.False(d.Mitm.Allows("GET", "/status/detail"))
+		a.False(d.Mitm.Allows("POST", "/v1/charges"))
+		a.False(d.Mitm.Allows("GET", "/admin"))
+	}
+
+	for _, paths := range []string{"[v1/*]", "[/v1/*/charges]"} {
+		_, err = loadYAML([]byte(`
+version: v1
+services:
+  - name: inspected
+    project: payments
+    action: enforce
+    mitm: {allowed_paths: ` + paths + `}
+`))
+		a.Error(err, paths)
+	}
+}
+
+func TestYAMLLoaderRuleID(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - name: payments
+    id: payments-egress-v2
+    project: payments
+    action: enforce
+    allowed_domains: [api.partner.example.com]
+  - name: search
+    project: search
+    action: enforce
+default:
+  project: other
+  action: enforce
+global_deny_list: ["*.evil.example.com"]
+global_allow_list: [status.example.com]
+`))
+	a.NoError(err)
+
+	for _, c := range []struct{ service, host, ruleID string }{
+		{"payments", "api.partner.example.com", "payments-egress-v2"},
+		{"payments", "www.example.com", "payments-egress-v2"},
+		{"search", "www.example.com", "search"},
+		{"unknown", "www.example.com", "default"},
+		{"search", "www.evil.example.com", "global_deny_list/*.evil.example.com"},
+		{"search", "status.example.com", "global_allow_list/status.example.com"},
+	} {
+		d, err := acl.Decide(c.service, c.host)
+		a.NoError(err)
+		a.Equal(c.ruleID, d.RuleID, "%s -> %s", c.service, c.host)
+	}
+}
+
+func TestYAMLLoaderValidUntil(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - name: expired
+    project: payments
+    action: enforce
+    allowed_domains: [api.partner.example.com]
+    valid_until: 2020-01-01T00:00:00Z
+  - name: current
+    project: payments
+    action: enforce
+    allowed_domains: [api.partner.example.com]
+    valid_until: 2999-01-01
+default:
+  project: other
+  action: report
+`))
+	a.NoError(err)
+	a.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), acl.Rules["expired"].ValidUntil)
+	a.True(acl.DefaultRule.ValidUntil.IsZero())
+
+	d, err := acl.Decide("current", "api.partner.example.com")
+	a.NoError(err)
+	a.Equal(Allow, d.Result)
+	a.Empty(d.ExpiredRuleID)
+
+	// The expired rule falls back to the default rule.
+	d, err = acl.Decide("expired", "api.partner.example.com")
+	a.NoError(err)
+	a.Equal(AllowAndReport, d.Result)
+	a.True(d.Default)
+	a.Equal("default", d.RuleID)
+	a.Equal("expired", d.ExpiredRuleID)
+
+	// Without a default rule, it denies.
+	acl.DefaultRule = nil
+	d, err = acl.Decide("expired", "api.partner.example.com")
+	a.NoError(err)
+	a.Equal(Deny, d.Result)
+	a.Equal("matched rule has expired", d.Reason)
+	a.Equal("expired", d.ExpiredRuleID)
+}
+
+func TestYAMLLoaderExceptions(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - name: payments
+    project: payments
+    action: enforce
+    allowed_domains: [api.partner.example.com]
+    exceptions:
+      - allowed_domains: [legacy.partner.example.com]
+        expires: 2999-01-01
+        approver: security
+        ticket: SEC-2
+      - allowed_domains: [old.partner.example.com, legacy.partner.example.com]
+        expires: 2020-01-01T00:00:00Z
+        approver: security
+        ticket: SEC-1
+`))
+	r.NoError(err)
+	r.Len(acl.Rules["payments"].Exceptions, 2)
+
+	d, err := acl.Decide("payments", "legacy.partner.example.com")
+	a.NoError(err)
+	a.Equal(Allow, d.Result)
+	a.Equal("host matched exception in rule", d.Reason)
+	r.NotNil(d.Exception)
+	a.Equal("SEC-2", d.Exception.Ticket)
+	a.Nil(d.ExpiredException)
+
+	// Expired exceptions stop matching.
+	d, err = acl.Decide("payments", "old.partner.example.com")
+	a.NoError(err)
+	a.Equal(Deny, d.Result)
+	a.Nil(d.Exception)
+	r.NotNil(d.ExpiredException)
+	a.Equal("SEC-1", d.ExpiredException.Ticket)
+
+	for _, missing := range []string{"expires: 2999-01-01", "approver: security", "ticket: SEC-1", "allowed_domains: [old.example.com]"} {
+		exception := strings.Replace(`
+      - allowed_domains: [old.example.com]
+        expires: 2999-01-01
+        approver: security
+        ticket: SEC-1`, missing, "", 1)
+		_, err = loadYAML([]byte(`
+version: v1
+services:
+  - name: payments
+    project: payments
+    action: enforce
+    exceptions:` + exception))
+		a.Error(err, "without %s", missing)
+	}
+}
+
+func TestYAMLLoaderALPNProtocols(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - name: web
+    project: web
+    action: enforce
+    allowed_domains: [api.example.com]
+    alpn_protocols: [h2, http/1.1]
+`))
+	a.NoError(err)
+	d, err := acl.Decide("web", "api.example.com")
+	a.NoError(err)
+	a.Equal([]string{"h2", "http/1.1"}, d.ALPNProtocols)
+
+	_, err = loadYAML([]byte(`
+version: v1
+services:
+  - name: web
+    project: web
+    action: enforce
+    alpn_protocols: [""]
+`))
+	a.Error(err)
+}
+
+func TestYAMLLoaderExtends(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+groups:
+  mirrors: [pypi.mirror.example.com, "*.artifacts.example.com"]
+  monitoring: [metrics.example.com]
+services:
+  - name: base
+    project: infra
+    action: enforce
+    allowed_domains: [github.com]
+    allowed_groups: [mirrors]
+  - name: observed
+    project: infra
+    action: enforce
+    extends: [base]
+    allowed_groups: [monitoring, mirrors]
+  - name: payments
+    project: payments
+    action: report
+    extends: [observed]
+    allowed_domains: [api.partner.example.com]
+default:
+  project: other
+  action: enforce
+  allowed_groups: [mirrors]
+`))
+	a.NoError(err)
+
+	a.Equal([]string{"github.com", "pypi.mirror.example.com", "*.artifacts.example.com"}, acl.Rules["base"].DomainGlobs)
+	a.Equal([]string{"metrics.example.com", "pypi.mirror.example.com", "*.artifacts.example.com", "github.com"}, acl.Rules["observed"].DomainGlobs)
+	a.ElementsMatch([]string{"api.partner.example.com", "metrics.example.com", "pypi.mirror.example.com", "*.artifacts.example.com", "github.com"}, acl.Rules["payments"].DomainGlobs)
+	a.Equal([]string{"pypi.mirror.example.com", "*.artifacts.example.com"}, acl.DefaultRule.DomainGlobs)
+
+	// Only domains are inherited.
+	a.Equal(Report, acl.Rules["payments"].Policy)
+	a.Equal("payments", acl.Rules["payments"].Project)
+
+	d, err := acl.Decide("payments", "npm.artifacts.example.com")
+	a.NoError(err)
+	a.Equal(Allow, d.Result)
+	a.Equal("payments", d.RuleID)
+
+	for _, c := range []struct{ yaml, err string }{
+		{`
+version: v1
+services:
+  - {name: a, action: enforce, extends: [b]}
+  - {name: b, action: enforce, extends: [c]}
+  - {name: c, action: enforce, extends: [a]}
+`, "service a: extends cycle: a -> b -> c -> a"},
+		{`
+version: v1
+services:
+  - {name: a, action: enforce, extends: [missing]}
+`, "service a: extends unknown service missing"},
+		{`
+version: v1
+services:
+  - {name: a, action: enforce, allowed_groups: [missing]}
+`, "service a: unknown group missing"},
+		{`
+version: v1
+services: []
+default: {action: enforce, extends: [missing]}
+`, "default rule: extends unknown service missing"},
+		{`
+version: v1
+groups:
+  bad: [ex*ample.com]
+services:
+  - {name: a, action: enforce, allowed_groups: [bad]}
+`, "ex*ample.com: domain globs are only supported as prefix"},
+	} {
+		_, err := loadYAML([]byte(c.yaml))
+		a.EqualError(err, c.err)
+	}
+}
+
+func TestYAMLLoaderExtendsShared(t *testing.T) {
+	a := assert.New(t)
+
+	// Each level extends both services of the one below, which would take
+	// 2^40 resolutions if shared bases weren't resolved once.
+	var b strings.Builder
+	b.WriteString("version: v1\nservices:\n")
+	b.WriteString("  - {name: a0, action: enforce, allowed_domains: [a.example.com]}\n")
+	b.WriteString("  - {name: b0, action: enforce, allowed_domains: [b.example.com]}\n")
+	for i := 1; i <= 40; i++ {
+		for _, name := range []string{"a", "b"} {
+			fmt.Fprintf(&b, "  - {name: %s%d, action: enforce, extends: [a%d, b%d]}\n", name, i, i-1, i-1)
+		}
+	}
+
+	acl, err := loadYAML([]byte(b.String()))
+	a.NoError(err)
+	a.ElementsMatch([]string{"a.example.com", "b.example.com"}, acl.Rules["a40"].DomainGlobs)
+}
+
+func TestYAMLLoaderConnectOnly(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+connect_only: true
+services:
+  - name: modern
+    project: payments
+    action: open
+  - name: legacy
+    project: payments
+    action: open
+    connect_only: false
+default:
+  project: other
+  action: open
+`))
+	a.NoError(err)
+	a.True(acl.Rules["modern"].ConnectOnly)
+	a.False(acl.Rules["legacy"].ConnectOnly)
+	a.True(acl.DefaultRule.ConnectOnly)
+
+	d, err := acl.Decide("modern", "example.com")
+	a.NoError(err)
+	a.True(d.ConnectOnly)
+
+	acl, err = loadYAML([]byte(`
+version: v1
+services:
+  - {name: modern, action: open, connect_only: true}
+  - {name: legacy, action: open}
+`))
+	a.NoError(err)
+	a.True(acl.Rules["modern"].ConnectOnly)
+	a.False(acl.Rules["legacy"].ConnectOnly)
+}
+
+func TestYAMLLoaderAddressFamily(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - {name: partner, action: open, address_family: ipv4}
+  - {name: other, action: open}
+default:
+  action: open
+  address_family: prefer_ipv6
+`))
+	a.NoError(err)
+	a.Equal(IPv4Only, acl.Rules["partner"].AddressFamily)
+	a.Equal(AnyFamily, acl.Rules["other"].AddressFamily)
+	a.Equal(PreferIPv6, acl.DefaultRule.AddressFamily)
+
+	d, err := acl.Decide("partner", "example.com")
+	a.NoError(err)
+	a.Equal(IPv4Only, d.AddressFamily)
+
+	_, err = loadYAML([]byte(`
+version: v1
+services:
+  - {name: partner, action: open, address_family: ipv5}
+`))
+	a.EqualError(err, "service partner: unknown address family ipv5")
+}
+
+func TestYAMLLoaderConnectPorts(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := loadYAML([]byte(`
+version: v1
+services:
+  - {name: mailer, action: enforce, connect_ports: [587, 465]}
+  - {name: tunnel, action: enforce, connect_ports: ["*"]}
+  - {name: web, action: enforce}
+`))
+	a.NoError(err)
+	a.Equal([]int{587, 465}, acl.Rules["mailer"].ConnectPorts)
+	a.NotNil(acl.Rules["tunnel"].ConnectPorts)
+	a.Empty(acl.Rules["tunnel"].ConnectPorts)
+	a.Nil(acl.Rules["web"].ConnectPorts)
+
+	_, err = loadYAML([]byte(`
+version: v1
+services:
+  - {name: mailer, action: enforce, connect_ports: [70000]}
+`))
+	a.EqualError(err, `service mailer: invalid connect port "70000"`)
+}
@@ -0,0 +1,121 @@
+package smokescreen
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+// DefaultEgressAclPollInterval is how often an egress ACL loaded from a URL
+// is checked for changes unless configured otherwise.
+const DefaultEgressAclPollInterval = time.Minute
+
+// PollingACL is an egress ACL that is reloaded from its loader, such as an
+// acl.HTTPLoader, every interval. A reloaded ACL is swapped in atomically,
+// so each request is decided by either the old ACL or the new one. If a
+// reload fails, the current ACL is kept.
+type PollingACL struct {
+	config   *Config
+	loader   acl.Loader
+	interval time.Duration
+	current  atomic.Value // Stores the *acl.ACL requests are decided by
+}
+
+// NewPollingACL loads the ACL from loader, failing if it can't be loaded.
+func NewPollingACL(config *Config, loader acl.Loader, interval time.Duration) (*PollingACL, error) {
+	p := &PollingACL{config: config, loader: loader, interval: interval}
+	if _, err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PollingACL) Decide(service, host string) (acl.Decision, error) {
+	return p.current.Load().(*acl.ACL).Decide(service, host)
+}
+
+// Reload loads the ACL again and swaps it in if it has changed, reporting
+// whether it did.
+func (p *PollingACL) Reload() (bool, error) {
+	a, err := acl.New(p.config.Log, p.loader, p.config.DisabledAclPolicyActions)
+	if err == acl.ErrNotModified {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	p.current.Store(a)
+	return true, nil
+}
+
+// lastFetcher is implemented by loaders that know when the ACL was last
+// confirmed current by its source, such as acl.HTTPLoader.
+type lastFetcher interface {
+	LastFetched() time.Time
+}
+
+// reportStaleness reports how long ago the loaded ACL was last confirmed
+// current, if the loader knows.
+func (p *PollingACL) reportStaleness() {
+	lf, ok := p.loader.(lastFetcher)
+	if !ok {
+		return
+	}
+	if fetched := lf.LastFetched(); !fetched.IsZero() {
+		p.config.MetricsClient.Gauge("acl.staleness_seconds", time.Since(fetched).Seconds(), []string{}, 1)
+	}
+}
+
+// poll reloads the ACL every interval until the proxy shuts down.
+func (p *PollingACL) poll() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if shuttingDown, _ := p.config.ShuttingDown.Load().(bool); shuttingDown {
+			return
+		}
+
+		changed, err := p.Reload()
+		p.reportStaleness()
+		if err != nil {
+			p.config.MetricsClient.Incr("acl.reload_error", []string{}, 1)
+			p.config.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("failed to reload egress ACL")
+			continue
+		}
+		if changed {
+			p.config.MetricsClient.Incr("acl.reload", []string{}, 1)
+			p.config.Log.WithFields(logrus.Fields{
+				"acl_hash": aclHash(p),
+			}).Info("reloaded egress ACL")
+		}
+	}
+}
+
+// SetupEgressAclURL loads the egress ACL from url, and reloads it every
+// interval once the proxy is started. Unless the ACL must be signed, url
+// must use https. If EgressAclCacheFile is set, the ACL is cached there.
+func (config *Config) SetupEgressAclURL(url string, interval time.Duration) error {
+	if config.EgressAclPublicKey == nil && !strings.HasPrefix(url, "https://") {
+		return errors.New("an egress ACL URL must use https unless the ACL is signed")
+	}
+	if interval <= 0 {
+		return errors.New("the egress ACL poll interval must be positive")
+	}
+
+	loader := acl.NewHTTPLoader(url, config.EgressAclPublicKey, &http.Client{Timeout: 30 * time.Second})
+	loader.CacheFile = config.EgressAclCacheFile
+	p, err := NewPollingACL(config, loader, interval)
+	if err != nil {
+		return err
+	}
+	config.EgressACL = p
+	return nil
+}
@@ -0,0 +1,74 @@
+package smokescreen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestPollingACL(t *testing.T) {
+	r := require.New(t)
+
+	var mu sync.Mutex
+	body := `
+version: v1
+services:
+  - name: payments
+    project: payments
+    action: enforce
+    allowed_domains: [api.partner.example.com]
+`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	conf := NewConfig()
+	p, err := NewPollingACL(conf, acl.NewHTTPLoader(srv.URL, nil, nil), time.Minute)
+	r.NoError(err)
+
+	d, err := p.Decide("payments", "api.partner.example.com")
+	r.NoError(err)
+	assert.Equal(t, acl.Allow, d.Result)
+
+	mu.Lock()
+	body = "version: v1\nservices: []\n"
+	mu.Unlock()
+	changed, err := p.Reload()
+	r.NoError(err)
+	assert.True(t, changed)
+
+	d, err = p.Decide("payments", "api.partner.example.com")
+	r.NoError(err)
+	assert.Equal(t, acl.Deny, d.Result)
+
+	// A broken ACL leaves the current one in place.
+	mu.Lock()
+	body = "version: v1\nservices: [{name: payments, action: block}]\n"
+	mu.Unlock()
+	_, err = p.Reload()
+	assert.Error(t, err)
+
+	d, err = p.Decide("payments", "api.partner.example.com")
+	r.NoError(err)
+	assert.Equal(t, acl.Deny, d.Result)
+	assert.Equal(t, "no rule matched", d.Reason)
+}
+
+func TestSetupEgressAclURL(t *testing.T) {
+	conf := NewConfig()
+	err := conf.SetupEgressAclURL("http://acl.example.com/acl.yaml", time.Minute)
+	assert.EqualError(t, err, "an egress ACL URL must use https unless the ACL is signed")
+
+	err = conf.SetupEgressAclURL("https://acl.example.com/acl.yaml", 0)
+	assert.EqualError(t, err, "the egress ACL poll interval must be positive")
+	assert.Nil(t, conf.EgressACL)
+}
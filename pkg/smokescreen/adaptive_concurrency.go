@@ -0,0 +1,196 @@
+package smokescreen
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults of AdaptiveConcurrencyConfig.
+const (
+	defaultConcurrencyMinLimit         = 10
+	defaultConcurrencyMaxLimit         = 1000
+	defaultConcurrencyLatencyThreshold = time.Second
+	defaultConcurrencyBackoff          = 0.9
+)
+
+// AdaptiveConcurrencyConfig configures SetupAdaptiveConcurrency.
+type AdaptiveConcurrencyConfig struct {
+	MinLimit         int           // The limit is never lowered below this. Defaults to 10.
+	MaxLimit         int           // The limit is never raised above this, which is also where it starts. Defaults to 1000.
+	LatencyThreshold time.Duration // Dials taking longer than this count as congestion. Defaults to one second.
+	Backoff          float64       // The limit is multiplied by this on congestion. Defaults to 0.9.
+}
+
+// adaptiveConcurrency limits how many dials to destinations may be in
+// progress at once, adjusting the limit with additive increase and
+// multiplicative decrease (AIMD), as TCP does its congestion window: every
+// dial that succeeds quickly while at least half the limit is in use raises
+// the limit by one, and a dial that fails or is slower than the latency
+// threshold lowers it by the backoff factor. Dials beyond the limit are
+// rejected, so a degraded network, or a degraded upstream proxy, is given
+// less work rather than a growing pile of connection attempts.
+type adaptiveConcurrency struct {
+	config AdaptiveConcurrencyConfig
+	now    func() time.Time
+
+	sync.Mutex
+	limit        float64
+	inFlight     int
+	lastDecrease time.Time
+}
+
+// SetupAdaptiveConcurrency limits how many dials to destinations may be in
+// progress at once, adapting the limit to the latency and failures of
+// recent dials. Requests whose dials are beyond the limit are rejected with
+// a retryable 503.
+func (config *Config) SetupAdaptiveConcurrency(ac AdaptiveConcurrencyConfig) error {
+	if ac.MinLimit == 0 {
+		ac.MinLimit = defaultConcurrencyMinLimit
+	}
+	if ac.MaxLimit == 0 {
+		ac.MaxLimit = defaultConcurrencyMaxLimit
+	}
+	if ac.LatencyThreshold == 0 {
+		ac.LatencyThreshold = defaultConcurrencyLatencyThreshold
+	}
+	if ac.Backoff == 0 {
+		ac.Backoff = defaultConcurrencyBackoff
+	}
+	if ac.MinLimit < 1 || ac.MaxLimit < ac.MinLimit {
+		return fmt.Errorf("adaptive concurrency limits must satisfy 1 <= min (%d) <= max (%d)", ac.MinLimit, ac.MaxLimit)
+	}
+	if ac.LatencyThreshold < 0 {
+		return fmt.Errorf("adaptive concurrency latency threshold must be positive, not %v", ac.LatencyThreshold)
+	}
+	if ac.Backoff <= 0 || ac.Backoff >= 1 {
+		return fmt.Errorf("adaptive concurrency backoff must be between 0 and 1, not %v", ac.Backoff)
+	}
+
+	config.concurrency = &adaptiveConcurrency{
+		config: ac,
+		now:    time.Now,
+		limit:  float64(ac.MaxLimit),
+	}
+	return nil
+}
+
+// atLimit reports whether a dial started now would be rejected.
+func (c *adaptiveConcurrency) atLimit() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.inFlight >= int(c.limit)
+}
+
+func (c *adaptiveConcurrency) currentLimit() int {
+	c.Lock()
+	defer c.Unlock()
+	return int(c.limit)
+}
+
+// acquire counts a dial as in progress, unless as many as the limit already
+// are. It returns the dials in progress, including this one.
+func (c *adaptiveConcurrency) acquire() (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.inFlight >= int(c.limit) {
+		return c.inFlight, false
+	}
+	c.inFlight++
+	return c.inFlight, true
+}
+
+// cancel ends a dial without adjusting the limit.
+func (c *adaptiveConcurrency) cancel() {
+	c.Lock()
+	defer c.Unlock()
+	c.inFlight--
+}
+
+// release ends a dial that took latency and failed if failed is set, and
+// adjusts the limit. It returns the new limit, and the cause of congestion
+// if the limit was lowered.
+func (c *adaptiveConcurrency) release(latency time.Duration, failed bool) (int, string) {
+	c.Lock()
+	defer c.Unlock()
+	inFlight := c.inFlight
+	c.inFlight--
+
+	var cause string
+	switch {
+	case failed:
+		cause = "error"
+	case latency > c.config.LatencyThreshold:
+		cause = "latency"
+	}
+
+	if cause == "" {
+		// Only raise a limit that's being used, or a quiet spell would
+		// raise it to the maximum regardless of how dials fare.
+		if 2*inFlight >= int(c.limit) && c.limit < float64(c.config.MaxLimit) {
+			c.limit++
+		}
+		return int(c.limit), ""
+	}
+
+	// Dials that were in progress together tend to fail together, so
+	// lower the limit once for them rather than once each.
+	now := c.now()
+	if now.Sub(c.lastDecrease) < c.config.LatencyThreshold {
+		return int(c.limit), cause
+	}
+	c.lastDecrease = now
+	c.limit *= c.config.Backoff
+	if c.limit < float64(c.config.MinLimit) {
+		c.limit = float64(c.config.MinLimit)
+	}
+	return int(c.limit), cause
+}
+
+func concurrencyLimitError(config *Config, role string) error {
+	config.MetricsClient.Incr("concurrency.rejected", []string{fmt.Sprintf("role:%s", role)}, 1)
+	return connLimitError{
+		error: fmt.Errorf("too many connections being established (adaptive limit %d)", config.concurrency.currentLimit()),
+		limit: limitConcurrency,
+	}
+}
+
+// acquireDialSlot counts a dial as in progress, if adaptive concurrency
+// limiting is set up, and returns a connLimitError if the limit is reached.
+// The returned function takes the outcome of the dial, whose latency and
+// errors adjust the limit.
+func acquireDialSlot(config *Config, role string) (func(err error), error) {
+	c := config.concurrency
+	if c == nil {
+		return func(error) {}, nil
+	}
+	inFlight, ok := c.acquire()
+	config.MetricsClient.Gauge("concurrency.in_flight", float64(inFlight), []string{}, 1)
+	if !ok {
+		return nil, concurrencyLimitError(config, role)
+	}
+
+	start := c.now()
+	return func(err error) {
+		// Dials we refused ourselves say nothing about the network.
+		if _, refused := err.(connLimitError); refused {
+			c.cancel()
+			return
+		}
+		limit, cause := c.release(c.now().Sub(start), err != nil)
+		if cause != "" {
+			config.MetricsClient.Incr("concurrency.congestion", []string{"cause:" + cause}, 1)
+		}
+		config.MetricsClient.Gauge("concurrency.limit", float64(limit), []string{}, 1)
+	}, nil
+}
+
+// checkConcurrencyLimit rejects CONNECT requests while as many dials as the
+// adaptive limit allows are in progress.
+func checkConcurrencyLimit(config *Config, decision *aclDecision) error {
+	c := config.concurrency
+	if c == nil || !c.atLimit() {
+		return nil
+	}
+	return concurrencyLimitError(config, decision.role)
+}
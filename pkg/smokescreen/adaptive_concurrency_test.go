@@ -0,0 +1,120 @@
+package smokescreen
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	a.Error(conf.SetupAdaptiveConcurrency(AdaptiveConcurrencyConfig{MinLimit: 10, MaxLimit: 5}))
+	a.Error(conf.SetupAdaptiveConcurrency(AdaptiveConcurrencyConfig{Backoff: 1.5}))
+	r.NoError(conf.SetupAdaptiveConcurrency(AdaptiveConcurrencyConfig{MinLimit: 2, MaxLimit: 4, LatencyThreshold: time.Second, Backoff: 0.5}))
+	c := conf.concurrency
+	now := time.Unix(1000000, 0)
+	c.now = func() time.Time { return now }
+
+	// The limit starts at the maximum.
+	for i := 0; i < 4; i++ {
+		_, ok := c.acquire()
+		a.True(ok)
+	}
+	_, ok := c.acquire()
+	a.False(ok)
+	a.True(c.atLimit())
+
+	// A failure halves the limit, and the failures of dials in progress
+	// at the same time don't lower it further.
+	limit, cause := c.release(10*time.Millisecond, true)
+	a.Equal(2, limit)
+	a.Equal("error", cause)
+	limit, _ = c.release(2*time.Second, false)
+	a.Equal(2, limit)
+	_, ok = c.acquire()
+	a.False(ok, "3 dials in progress, limit 2")
+
+	// Slow dials lower the limit too, but not below the minimum.
+	now = now.Add(time.Second)
+	limit, cause = c.release(2*time.Second, false)
+	a.Equal(2, limit)
+	a.Equal("latency", cause)
+
+	// Quick successes while the limit is in use raise it again, up to the
+	// maximum.
+	limit, cause = c.release(10*time.Millisecond, false)
+	a.Equal(3, limit)
+	a.Equal("", cause)
+	for i := 0; i < 3; i++ {
+		_, ok := c.acquire()
+		a.True(ok)
+	}
+	for i := 0; i < 3; i++ {
+		limit, _ = c.release(10*time.Millisecond, false)
+	}
+	a.Equal(4, limit)
+	a.Equal(0, c.inFlight)
+
+	// Dials rejected by the proxy's own limits don't lower the limit.
+	done, err := acquireDialSlot(conf, "test")
+	r.NoError(err)
+	now = now.Add(time.Minute)
+	done(connLimitError{error: errors.New("too many"), limit: limitHost})
+	a.Equal(4, c.currentLimit())
+	a.Equal(0, c.inFlight)
+	done, err = acquireDialSlot(conf, "test")
+	r.NoError(err)
+	done(errors.New("connection refused"))
+	a.Equal(2, c.currentLimit())
+}
+
+func TestAdaptiveConcurrencyShed(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+
+	conf := NewConfig()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(conf.SetupAdaptiveConcurrency(AdaptiveConcurrencyConfig{MinLimit: 1, MaxLimit: 1}))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+	resp, err := client.Get(upstream.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+
+	// Take the only slot, as a dial in progress would.
+	_, ok := conf.concurrency.acquire()
+	r.True(ok)
+	resp, err = client.Get(upstream.URL)
+	r.NoError(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	r.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	a.Equal(limitConcurrency, resp.Header.Get(limitHeader))
+	a.Equal("true", resp.Header.Get(retryableHeader))
+	a.Contains(string(body), "adaptive limit 1")
+}
@@ -0,0 +1,243 @@
+package smokescreen
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// AddressSelection sets which address is dialed when a destination resolves
+// to several allowed addresses.
+type AddressSelection int
+
+const (
+	AddressSelectFirst        AddressSelection = iota // The first address, in the order the resolver returned them
+	AddressSelectRandom                               // A random address for every connection
+	AddressSelectRoundRobin                           // Each address in turn, separately for every destination
+	AddressSelectClientSubnet                         // The first address of an answer tailored to the client subnet sent with queries
+)
+
+var addressSelections = map[string]AddressSelection{
+	"first":       AddressSelectFirst,
+	"random":      AddressSelectRandom,
+	"round-robin": AddressSelectRoundRobin,
+	"ecs":         AddressSelectClientSubnet,
+}
+
+func (s AddressSelection) String() string {
+	return [...]string{"first", "random", "round-robin", "ecs"}[s]
+}
+
+// AddressSelectionFromString parses an address selection strategy. An empty
+// string is AddressSelectFirst.
+func AddressSelectionFromString(s string) (AddressSelection, error) {
+	if s == "" {
+		return AddressSelectFirst, nil
+	}
+	if sel, ok := addressSelections[s]; ok {
+		return sel, nil
+	}
+	return AddressSelectFirst, fmt.Errorf("unknown address selection strategy %v", s)
+}
+
+// SetupAddressSelection sets the address selection strategy. With
+// clientSubnet, a CIDR, every DNS query carries it as an EDNS Client Subnet
+// option, so authoritative servers that tailor answers to the client's
+// network can spread fleets in different networks across their addresses.
+// The "ecs" strategy requires it. It must be called after
+// SetResolverAddresses.
+func (config *Config) SetupAddressSelection(strategy, clientSubnet string) error {
+	selection, err := AddressSelectionFromString(strategy)
+	if err != nil {
+		return err
+	}
+	if selection == AddressSelectClientSubnet && clientSubnet == "" {
+		return fmt.Errorf("address selection strategy %v requires a client subnet", selection)
+	}
+
+	if clientSubnet != "" {
+		_, subnet, err := net.ParseCIDR(clientSubnet)
+		if err != nil {
+			return err
+		}
+		config.Resolver = clientSubnetResolver(config.Resolver, subnet)
+	}
+	config.AddressSelection = selection
+	return nil
+}
+
+// selectAddress picks the address to dial among the allowed addresses addr
+// resolved to, keeping to the preferred family if the first one is of it.
+func (config *Config) selectAddress(addr string, allowed []*net.TCPAddr, preferFamily bool) int {
+	candidates := len(allowed)
+	if preferFamily {
+		v4 := allowed[0].IP.To4() != nil
+		candidates = 1
+		for candidates < len(allowed) && (allowed[candidates].IP.To4() != nil) == v4 {
+			candidates++
+		}
+	}
+	if candidates == 1 {
+		return 0
+	}
+
+	switch config.AddressSelection {
+	case AddressSelectRandom:
+		return rand.Intn(candidates)
+	case AddressSelectRoundRobin:
+		if config.addressRotation != nil {
+			return config.addressRotation.next(addr) % candidates
+		}
+	}
+	return 0
+}
+
+const maxRotatedDestinations = 10000
+
+// addressRotation counts the connections made to each destination, to take
+// their addresses in turn.
+type addressRotation struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func newAddressRotation() *addressRotation {
+	return &addressRotation{counts: make(map[string]int)}
+}
+
+func (r *addressRotation) next(addr string) int {
+	r.Lock()
+	defer r.Unlock()
+
+	n, ok := r.counts[addr]
+	if !ok && len(r.counts) >= maxRotatedDestinations {
+		// Starting over only makes some destinations begin their rotation
+		// from the first address again.
+		r.counts = make(map[string]int)
+	}
+	r.counts[addr] = n + 1
+	return n
+}
+
+// ednsClientSubnet is the option code of EDNS Client Subnet, RFC 7871.
+const ednsClientSubnet = 8
+
+// clientSubnetResolver returns a resolver that sends its queries like
+// resolver, adding subnet to each of them.
+func clientSubnetResolver(resolver *net.Resolver, subnet *net.IPNet) *net.Resolver {
+	dial := (&net.Dialer{}).DialContext
+	if resolver != nil && resolver.Dial != nil {
+		dial = resolver.Dial
+	}
+	option := clientSubnetOption(subnet)
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// The resolver frames its queries depending on whether the
+			// connection is a net.PacketConn, so the wrapper must be one too.
+			if pc, ok := conn.(net.PacketConn); ok {
+				return &clientSubnetPacketConn{
+					clientSubnetConn: &clientSubnetConn{Conn: conn, option: option},
+					pc:               pc,
+				}, nil
+			}
+			return &clientSubnetConn{Conn: conn, option: option, stream: true}, nil
+		},
+	}
+}
+
+func clientSubnetOption(subnet *net.IPNet) dnsmessage.Option {
+	family, ip := uint16(2), subnet.IP.To16()
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		family, ip = 1, ip4
+	}
+	prefix, _ := subnet.Mask.Size()
+
+	data := make([]byte, 4, 4+len(ip))
+	binary.BigEndian.PutUint16(data, family)
+	data[2] = byte(prefix) // Source prefix length; the scope is left to the server
+	data = append(data, ip[:(prefix+7)/8]...)
+	return dnsmessage.Option{Code: ednsClientSubnet, Data: data}
+}
+
+// clientSubnetConn adds an EDNS Client Subnet option to the DNS queries
+// written to it. Over stream connections, queries are prefixed with their
+// length.
+type clientSubnetConn struct {
+	net.Conn
+	option dnsmessage.Option
+	stream bool
+}
+
+func (c *clientSubnetConn) Write(b []byte) (int, error) {
+	query := b
+	if c.stream {
+		if len(b) < 2 {
+			return c.Conn.Write(b)
+		}
+		query = b[2:]
+	}
+
+	msg, err := addDNSOption(query, c.option)
+	if err != nil {
+		// Not a query we understand; send it as is.
+		return c.Conn.Write(b)
+	}
+	if c.stream {
+		msg = append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	}
+	if _, err := c.Conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// clientSubnetPacketConn is a clientSubnetConn for datagram connections.
+type clientSubnetPacketConn struct {
+	*clientSubnetConn
+	pc net.PacketConn
+}
+
+func (c *clientSubnetPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.pc.ReadFrom(b)
+}
+
+func (c *clientSubnetPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
+
+// addDNSOption adds option to the OPT record of the DNS message query,
+// adding the record if there is none.
+func addDNSOption(query []byte, option dnsmessage.Option) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+
+	for i := range msg.Additionals {
+		if opt, ok := msg.Additionals[i].Body.(*dnsmessage.OPTResource); ok {
+			opt.Options = append(opt.Options, option)
+			return msg.Pack()
+		}
+	}
+
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: rh,
+		Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{option}},
+	})
+	return msg.Pack()
+}
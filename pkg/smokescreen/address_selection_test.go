@@ -0,0 +1,85 @@
+package smokescreen
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestAddressSelection(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("many.test", "8.8.9.1", "8.8.9.2", "8.8.9.3")
+	dns.Set("dual.test", "8.8.9.1", "8.8.9.2", "2001:4860:4860::8888")
+
+	config := NewConfig()
+	config.Resolver = dns.Resolver()
+
+	pick := func(addr string, family acl.AddressFamily) string {
+		resolved, _, err := safeResolve(config, "tcp", addr, family, "")
+		r.NoError(err)
+		return resolved.IP.String()
+	}
+
+	a.Equal("8.8.9.1", pick("many.test:443", acl.AnyFamily))
+	a.Equal("8.8.9.1", pick("many.test:443", acl.AnyFamily))
+
+	r.NoError(config.SetupAddressSelection("round-robin", ""))
+	a.Equal("8.8.9.1", pick("many.test:443", acl.AnyFamily))
+	a.Equal("8.8.9.2", pick("many.test:443", acl.AnyFamily))
+	a.Equal("8.8.9.1", pick("many.test:80", acl.AnyFamily), "each destination has its own rotation")
+	a.Equal("8.8.9.3", pick("many.test:443", acl.AnyFamily))
+	a.Equal("8.8.9.1", pick("many.test:443", acl.AnyFamily))
+
+	// Preferring a family keeps to its addresses.
+	for i := 0; i < 4; i++ {
+		a.NotEqual("2001:4860:4860::8888", pick("dual.test:443", acl.PreferIPv4))
+	}
+
+	r.NoError(config.SetupAddressSelection("random", ""))
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[pick("many.test:443", acl.AnyFamily)] = true
+	}
+	a.Len(seen, 3)
+
+	a.EqualError(config.SetupAddressSelection("nearest", ""), "unknown address selection strategy nearest")
+	a.EqualError(config.SetupAddressSelection("ecs", ""), "address selection strategy ecs requires a client subnet")
+}
+
+func TestResolverClientSubnet(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("geo.test", "8.8.9.1")
+
+	config := NewConfig()
+	config.Resolver = dns.Resolver()
+	r.NoError(config.SetupAddressSelection("ecs", "203.0.113.0/24"))
+	a.Equal(AddressSelectClientSubnet, config.AddressSelection)
+
+	resolved, _, err := safeResolve(config, "tcp", "geo.test:443", acl.IPv4Only, "")
+	r.NoError(err)
+	a.Equal("8.8.9.1", resolved.IP.String())
+
+	var subnet []byte
+	for _, option := range dns.Options() {
+		if option.Code == ednsClientSubnet {
+			subnet = option.Data
+		}
+	}
+	a.Equal([]byte{0, 1, 24, 0, 203, 0, 113}, subnet)
+
+	_, v6Subnet, err := net.ParseCIDR("2001:db8:8000::/33")
+	r.NoError(err)
+	a.Equal(dnsmessage.Option{Code: ednsClientSubnet, Data: []byte{0, 2, 33, 0, 0x20, 0x01, 0x0d, 0xb8, 0x80}}, clientSubnetOption(v6Subnet))
+}
@@ -0,0 +1,206 @@
+package smokescreen
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+// AdminServer serves the admin API on its own listener, separate from the
+// proxy. Every request must carry the configured token as a bearer token.
+//
+// /connections lists the tracked connections as JSON, oldest first, and
+// /metrics serves the OpenMetrics decision metrics when they are enabled.
+// /decisions lists the recent decisions kept by Config.DecisionHistory as
+// JSON, most recent first.
+//
+// With Config.AdminDebug, /debug/pprof/ serves net/http/pprof's profiles,
+// /debug/vars the expvar variables, and /debug/summary a JSON summary of
+// the goroutines, memory and connections, to clients connecting from
+// loopback addresses only.
+type AdminServer struct {
+	config *Config
+	ln     net.Listener
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+func newAdminServer(config *Config) *AdminServer {
+	s := &AdminServer{
+		config: config,
+		mux:    http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/connections", s.connections)
+	if config.DecisionHistory != nil {
+		s.mux.HandleFunc("/decisions", s.decisions)
+	}
+	if config.OpenMetrics != nil {
+		s.mux.Handle("/metrics", config.OpenMetrics)
+	}
+	if config.AdminDebug {
+		s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+		s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		s.mux.Handle("/debug/vars", expvar.Handler())
+		s.mux.HandleFunc("/debug/summary", s.summary)
+	}
+
+	s.server = &http.Server{Handler: s}
+	return s
+}
+
+// StartAdminServer starts serving the admin API on config.AdminAddr.
+func StartAdminServer(config *Config) (*AdminServer, error) {
+	if config.AdminToken == "" {
+		return nil, errors.New("the admin API requires a token")
+	}
+
+	s := newAdminServer(config)
+
+	ln, err := net.Listen("tcp", config.AdminAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.ln = ln
+
+	go func() {
+		if err := s.server.Serve(ln); err != http.ErrServerClosed {
+			config.Log.Errorf("admin API serve error: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *AdminServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *AdminServer) Shutdown() {
+	s.server.Close()
+}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	want := "Bearer " + s.config.AdminToken
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="smokescreen admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Profiles and memory statistics reveal more than the rest of the API,
+	// and profiling slows the proxy down, so they stay on the host.
+	if strings.HasPrefix(req.URL.Path, "/debug/") && !fromLoopback(req) {
+		http.Error(w, "debug endpoints are only served to loopback clients", http.StatusForbidden)
+		return
+	}
+	s.mux.ServeHTTP(w, req)
+}
+
+func fromLoopback(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *AdminServer) connections(w http.ResponseWriter, req *http.Request) {
+	conns := openConnections(s.config)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(conns); err != nil {
+		s.config.Log.Error(err)
+	}
+}
+
+// decisions serves the recent decisions matching the role, host, allow,
+// max_age and limit query parameters, e.g.
+// /decisions?allow=false&max_age=5m.
+func (s *AdminServer) decisions(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	f := DecisionFilter{Role: q.Get("role"), Host: q.Get("host")}
+	if v := q.Get("allow"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid allow: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.Allow = &allow
+	}
+	if v := q.Get("max_age"); v != "" {
+		age, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid max_age: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.Since = time.Now().Add(-age)
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.config.DecisionHistory.Recent(f)); err != nil {
+		s.config.Log.Error(err)
+	}
+}
+
+// DebugSummary is what /debug/summary reports.
+type DebugSummary struct {
+	Goroutines        int            `json:"goroutines"`
+	HeapAllocBytes    uint64         `json:"heap_alloc_bytes"`
+	HeapObjects       uint64         `json:"heap_objects"`
+	SysBytes          uint64         `json:"sys_bytes"`
+	NumGC             uint32         `json:"num_gc"`
+	Connections       int            `json:"connections"`
+	ConnectionsByRole map[string]int `json:"connections_by_role"`
+}
+
+func (s *AdminServer) summary(w http.ResponseWriter, req *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	summary := DebugSummary{
+		Goroutines:        runtime.NumGoroutine(),
+		HeapAllocBytes:    mem.HeapAlloc,
+		HeapObjects:       mem.HeapObjects,
+		SysBytes:          mem.Sys,
+		NumGC:             mem.NumGC,
+		ConnectionsByRole: make(map[string]int),
+	}
+	if s.config.ConnTracker != nil {
+		s.config.ConnTracker.Range(func(k, v interface{}) bool {
+			summary.Connections++
+			summary.ConnectionsByRole[k.(*conntrack.InstrumentedConn).Role]++
+			return true
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		s.config.Log.Error(err)
+	}
+}
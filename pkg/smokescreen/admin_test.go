@@ -0,0 +1,127 @@
+package smokescreen
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestAdminServer(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	conf.AdminAddr = "127.0.0.1:0"
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+
+	_, err := StartAdminServer(conf)
+	a.Error(err, "the admin API must not start without a token")
+
+	conf.AdminToken = "s3cr3t"
+	admin, err := StartAdminServer(conf)
+	r.NoError(err)
+	defer admin.Shutdown()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	ic := conf.ConnTracker.NewInstrumentedConn(client, "some-role", "example.com:443")
+	defer ic.Close()
+
+	url := "http://" + admin.Addr().String() + "/connections"
+
+	resp, err := http.Get(url)
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest("GET", url, nil)
+	r.NoError(err)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	resp, err = http.DefaultClient.Do(req)
+	r.NoError(err)
+	defer resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+
+	var conns []conntrack.InstrumentedConnStats
+	r.NoError(json.NewDecoder(resp.Body).Decode(&conns))
+	if a.Len(conns, 1) {
+		a.Equal("some-role", conns[0].Role)
+		a.Equal("example.com:443", conns[0].Rhost)
+		a.False(conns[0].LastActivity.IsZero())
+	}
+}
+
+func TestAdminServerDebug(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	conf.AdminAddr = "127.0.0.1:0"
+	conf.AdminToken = "s3cr3t"
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+
+	get := func(admin *AdminServer, path string) *http.Response {
+		req, err := http.NewRequest("GET", "http://"+admin.Addr().String()+path, nil)
+		r.NoError(err)
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		resp, err := http.DefaultClient.Do(req)
+		r.NoError(err)
+		return resp
+	}
+
+	// The debug endpoints are off by default.
+	admin, err := StartAdminServer(conf)
+	r.NoError(err)
+	resp := get(admin, "/debug/summary")
+	resp.Body.Close()
+	a.Equal(http.StatusNotFound, resp.StatusCode)
+	admin.Shutdown()
+
+	conf.AdminDebug = true
+	admin, err = StartAdminServer(conf)
+	r.NoError(err)
+	defer admin.Shutdown()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	ic := conf.ConnTracker.NewInstrumentedConn(client, "some-role", "example.com:443")
+	defer ic.Close()
+
+	resp = get(admin, "/debug/summary")
+	var summary DebugSummary
+	r.NoError(json.NewDecoder(resp.Body).Decode(&summary))
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.True(summary.Goroutines > 0)
+	a.True(summary.HeapAllocBytes > 0)
+	a.Equal(1, summary.Connections)
+	a.Equal(map[string]int{"some-role": 1}, summary.ConnectionsByRole)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline", "/debug/vars"} {
+		resp = get(admin, path)
+		resp.Body.Close()
+		a.Equal(http.StatusOK, resp.StatusCode, path)
+	}
+
+	// Clients that aren't on the host are turned away.
+	req := httptest.NewRequest("GET", "/debug/pprof/heap", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	a.Equal(http.StatusForbidden, rec.Code)
+
+	req = httptest.NewRequest("GET", "/connections", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	a.Equal(http.StatusOK, rec.Code)
+}
@@ -0,0 +1,79 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ALPN restrictions
+//
+// A role whose ACL rule lists alpn_protocols may only use those protocols
+// over TLS, so that an allowed host on port 443 can't be used to tunnel
+// something else, such as a VPN or a protocol the host merely happens to
+// accept. The TLS ClientHello of each of the role's CONNECT tunnels is read
+// before it reaches the destination, as with VerifySNI, and the tunnel is
+// closed if the ClientHello offers any other protocol, or isn't TLS at all.
+// Clients connecting to smokescreen itself over TLS must likewise have
+// negotiated one of the protocols. Tunnels whose requests are inspected, as
+// plain HTTP or by MITM, carry HTTP by construction and aren't checked.
+
+func alpnAllowed(allowed []string, protocol string) bool {
+	for _, p := range allowed {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClientALPN denies requests from roles with ALPN restrictions that
+// came over a TLS connection to smokescreen negotiating another protocol.
+func checkClientALPN(config *Config, req *http.Request, decision *aclDecision) error {
+	if len(decision.alpnProtocols) == 0 || req.TLS == nil || req.TLS.NegotiatedProtocol == "" {
+		return nil
+	}
+	protocol := req.TLS.NegotiatedProtocol
+	if alpnAllowed(decision.alpnProtocols, protocol) {
+		return nil
+	}
+
+	decision.allow = false
+	decision.enforceWouldDeny = true
+	decision.reason = fmt.Sprintf("ALPN protocol %q is not allowed for the role", protocol)
+	config.MetricsClient.Incr("acl.alpn_deny", []string{
+		fmt.Sprintf("role:%s", decision.role),
+		fmt.Sprintf("protocol:%s", protocol),
+	}, 1)
+	return denyError{error: errors.New(decision.reason), rule: decision.ruleID}
+}
+
+// checkTunnelALPN checks the protocols offered by the ClientHello of a
+// tunnel against its role's ALPN restrictions.
+func checkTunnelALPN(config *Config, tunnel *ctxUserData, offered []string) error {
+	decision := tunnel.decision
+	if len(decision.alpnProtocols) == 0 {
+		return nil
+	}
+	for _, protocol := range offered {
+		if alpnAllowed(decision.alpnProtocols, protocol) {
+			continue
+		}
+		reason := fmt.Sprintf("TLS ClientHello offers ALPN protocol %q, which is not allowed for the role", protocol)
+		config.Log.WithFields(logrus.Fields{
+			"role":            decision.role,
+			"requested_host":  decision.outboundHost,
+			"alpn_protocols":  offered,
+			"decision_reason": reason,
+			"trace_id":        tunnel.traceId,
+		}).Warn("denied CONNECT tunnel offering a forbidden ALPN protocol")
+		config.MetricsClient.Incr("acl.alpn_deny", []string{
+			fmt.Sprintf("role:%s", decision.role),
+			fmt.Sprintf("protocol:%s", protocol),
+		}, 1)
+		return denyError{error: errors.New(reason), rule: decision.ruleID}
+	}
+	return nil
+}
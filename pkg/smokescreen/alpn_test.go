@@ -0,0 +1,113 @@
+package smokescreen
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestTunnelALPN(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var hellos int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	upstream.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			atomic.AddInt32(&hellos, 1)
+			return nil, nil
+		},
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	upstreamAddr := strings.TrimPrefix(upstream.URL, "https://")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.ConnectTimeout = 5 * time.Second
+	conf.IgnoreProxyEnvironment = true
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return "web", nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"web": {Policy: acl.Open, ALPNProtocols: []string{"h2", "http/1.1"}},
+		},
+	}
+
+	proxy := httptest.NewServer(buildHandler(conf))
+	defer proxy.Close()
+
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		r.NoError(err)
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamAddr, upstreamAddr)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		return conn
+	}
+
+	// Allowed protocols, or none at all, go through.
+	for _, protos := range [][]string{{"http/1.1"}, nil} {
+		conn := tls.Client(connect(), &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		r.NoError(conn.Handshake())
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamAddr)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		r.NoError(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		a.Equal("OK", string(body))
+		conn.Close()
+	}
+
+	// Any other protocol on offer, or traffic that isn't TLS, ends the
+	// tunnel before the destination sees anything.
+	exotic := tls.Client(connect(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "imap"}})
+	defer exotic.Close()
+	a.Error(exotic.Handshake())
+
+	plain := connect()
+	defer plain.Close()
+	fmt.Fprintf(plain, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamAddr)
+	_, err := ioutil.ReadAll(plain)
+	a.NoError(err)
+
+	a.Equal(int32(2), atomic.LoadInt32(&hellos))
+}
+
+func TestClientALPN(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	decision := &aclDecision{allow: true, alpnProtocols: []string{"http/1.1"}}
+
+	a.NoError(checkClientALPN(conf, req, decision))
+	req.TLS = &tls.ConnectionState{NegotiatedProtocol: "http/1.1"}
+	a.NoError(checkClientALPN(conf, req, decision))
+	a.True(decision.allow)
+
+	req.TLS.NegotiatedProtocol = "h2"
+	a.Error(checkClientALPN(conf, req, decision))
+	a.False(decision.allow)
+	a.Equal(`ALPN protocol "h2" is not allowed for the role`, decision.reason)
+}
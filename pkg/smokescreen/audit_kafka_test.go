@@ -0,0 +1,47 @@
+package smokescreen
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaRESTAuditSink(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var path, contentType string
+	var published []map[string]interface{}
+	response := `{"offsets": [{"partition": 0, "offset": 1}, {"partition": 1, "offset": 7}]}`
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path, contentType = req.URL.Path, req.Header.Get("Content-Type")
+		var body struct {
+			Records []map[string]interface{}
+		}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		published = body.Records
+		w.Write([]byte(response))
+	}))
+	defer proxy.Close()
+
+	sink := &KafkaRESTAuditSink{URL: proxy.URL + "/", Topic: "smokescreen-audit"}
+	r.NoError(sink.Send([][]byte{
+		[]byte(`{"msg":"CANONICAL-PROXY-DECISION","role":"billing","allow":true}`),
+		[]byte(`{"msg":"CANONICAL-PROXY-CN-CLOSE"}`),
+	}))
+	a.Equal("/topics/smokescreen-audit", path)
+	a.Equal("application/vnd.kafka.json.v2+json", contentType)
+	r.Len(published, 2)
+	a.Equal("billing", published[0]["key"])
+	a.Equal(map[string]interface{}{"msg": "CANONICAL-PROXY-DECISION", "role": "billing", "allow": true}, published[0]["value"])
+	a.NotContains(published[1], "key")
+	a.Equal(map[string]interface{}{"msg": "CANONICAL-PROXY-CN-CLOSE"}, published[1]["value"])
+
+	// Records Kafka didn't accept fail the batch, so it's sent again.
+	response = `{"offsets": [{"partition": 0, "offset": 2}, {"error_code": 50003, "error": "leader not available"}]}`
+	a.Error(sink.Send([][]byte{[]byte(`{"msg":"a"}`), []byte(`{"msg":"b"}`)}))
+}
@@ -0,0 +1,331 @@
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditSink receives batches of access log records, each a JSON object, on
+// their way to another region. HTTPAuditSink posts them to an HTTP bulk
+// endpoint; message buses can be plugged in by implementing Send with their
+// client library.
+type AuditSink interface {
+	// Send delivers events, returning an error if any of them may not have
+	// been delivered. Failed batches are sent again, so sinks should
+	// tolerate duplicates.
+	Send(events [][]byte) error
+}
+
+// HTTPAuditSink posts each batch to URL as newline-delimited JSON.
+type HTTPAuditSink struct {
+	URL    string
+	Client *http.Client // Defaults to http.DefaultClient
+}
+
+func (s *HTTPAuditSink) Send(events [][]byte) error {
+	body := bytes.Join(events, []byte("\n"))
+	body = append(body, '\n')
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(s.URL, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("replicating audit events to %s: unexpected status %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+const (
+	defaultAuditBatchSize     = 500
+	defaultAuditFlushInterval = time.Second
+	auditQueueSize            = 10000
+)
+
+// AuditReplicator copies every access log record to an AuditSink in the
+// background, so replication never holds up proxying. Records are sent in
+// batches of up to BatchSize, at least every FlushInterval. While the sink
+// is failing, records are appended to SpoolFile instead, and sent before any
+// newer ones once it recovers, so an outage of the other region, or of the
+// link to it, loses nothing as long as the spool has room.
+type AuditReplicator struct {
+	Sink          AuditSink
+	SpoolFile     string        // Records that couldn't be sent are kept here until they can be
+	MaxSpoolBytes int64         // Records that would grow the spool past this are dropped; zero means no limit
+	BatchSize     int           // Defaults to 500
+	FlushInterval time.Duration // Defaults to 1s
+
+	config *Config
+	events chan []byte
+	done   chan struct{}
+
+	spoolMu   sync.Mutex
+	spoolSize int64
+}
+
+// SetupAuditReplication starts replicating the access log through r. The
+// access log doesn't have to be written locally: if it isn't set up, records
+// are only replicated.
+func (config *Config) SetupAuditReplication(r *AuditReplicator) error {
+	if r.Sink == nil {
+		return errors.New("audit replication requires a sink")
+	}
+	if r.SpoolFile == "" {
+		return errors.New("audit replication requires a spool file")
+	}
+	if info, err := os.Stat(r.SpoolFile); err == nil {
+		r.spoolSize = info.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	r.config = config
+
+	if config.AccessLog == nil {
+		logger := log.New()
+		logger.Out = ioutil.Discard
+		logger.Formatter = &log.JSONFormatter{}
+		logger.Level = log.InfoLevel
+		config.AccessLog = logger
+	}
+	config.AccessLog.AddHook(r)
+	config.AuditReplicator = r
+	r.start()
+	return nil
+}
+
+func (r *AuditReplicator) start() {
+	if r.BatchSize <= 0 {
+		r.BatchSize = defaultAuditBatchSize
+	}
+	if r.FlushInterval <= 0 {
+		r.FlushInterval = defaultAuditFlushInterval
+	}
+	r.events = make(chan []byte, auditQueueSize)
+	r.done = make(chan struct{})
+	go r.run()
+}
+
+func (r *AuditReplicator) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire queues entry for replication. If the queue is full, because the sink
+// is slow, the record goes straight to the spool.
+func (r *AuditReplicator) Fire(entry *log.Entry) error {
+	formatter := &log.JSONFormatter{}
+	line, err := formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	event := bytes.TrimRight(line, "\n")
+
+	select {
+	case r.events <- event:
+		return nil
+	default:
+		return r.spool([][]byte{event})
+	}
+}
+
+// Close sends the records still queued, or spools them if the sink fails.
+func (r *AuditReplicator) Close() {
+	close(r.events)
+	<-r.done
+}
+
+func (r *AuditReplicator) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.FlushInterval)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case event, ok := <-r.events:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) < r.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		r.flush(batch)
+		batch = nil
+	}
+}
+
+// flush sends batch, after any spooled records so they arrive in order.
+func (r *AuditReplicator) flush(batch [][]byte) {
+	if !r.replaySpool() {
+		r.spool(batch)
+		return
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := r.send(batch); err != nil {
+		r.spool(batch)
+	}
+}
+
+func (r *AuditReplicator) send(batch [][]byte) error {
+	err := r.Sink.Send(batch)
+	if err != nil {
+		r.config.MetricsClient.Incr("audit.replication.error", []string{}, 1)
+		r.config.Log.WithFields(log.Fields{
+			"error":  err,
+			"events": len(batch),
+		}).Warn("failed to replicate audit events")
+		return err
+	}
+	r.config.MetricsClient.Count("audit.replication.sent", int64(len(batch)), []string{}, 1)
+	return nil
+}
+
+// spool appends events to the spool file, dropping those that don't fit.
+func (r *AuditReplicator) spool(events [][]byte) error {
+	if len(events) == 0 {
+		return nil
+	}
+	r.spoolMu.Lock()
+	defer r.spoolMu.Unlock()
+
+	f, err := os.OpenFile(r.SpoolFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		r.dropped(len(events), err)
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var written int64
+	for i, event := range events {
+		size := int64(len(event)) + 1
+		if r.MaxSpoolBytes > 0 && r.spoolSize+written+size > r.MaxSpoolBytes {
+			r.dropped(len(events)-i, fmt.Errorf("spool file %s is full", r.SpoolFile))
+			break
+		}
+		w.Write(event)
+		w.WriteByte('\n')
+		written += size
+	}
+	err = w.Flush()
+	r.spoolSize += written
+	r.reportSpool()
+	return err
+}
+
+// replaySpool sends the spooled records, reporting whether the spool is now
+// empty. Records the sink didn't take are kept for the next attempt.
+func (r *AuditReplicator) replaySpool() bool {
+	r.spoolMu.Lock()
+	defer r.spoolMu.Unlock()
+
+	if r.spoolSize == 0 {
+		return true
+	}
+	f, err := os.Open(r.SpoolFile)
+	if os.IsNotExist(err) {
+		r.spoolSize = 0
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var batch [][]byte
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 1 {
+			batch = append(batch, bytes.TrimRight(line, "\n"))
+		}
+		if len(batch) == r.BatchSize || (readErr != nil && len(batch) > 0) {
+			if err := r.send(batch); err != nil {
+				r.rewriteSpool(batch, reader)
+				return false
+			}
+			batch = nil
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return false
+		}
+	}
+
+	if err := os.Truncate(r.SpoolFile, 0); err != nil {
+		return false
+	}
+	r.spoolSize = 0
+	r.reportSpool()
+	return true
+}
+
+// rewriteSpool replaces the spool with unsent followed by the rest of the
+// spool, which rest reads.
+func (r *AuditReplicator) rewriteSpool(unsent [][]byte, rest io.Reader) {
+	tmp, err := ioutil.TempFile(filepath.Dir(r.SpoolFile), filepath.Base(r.SpoolFile)+".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	for _, event := range unsent {
+		w.Write(event)
+		w.WriteByte('\n')
+	}
+	if _, err := io.Copy(w, rest); err != nil {
+		return
+	}
+	if err := w.Flush(); err != nil {
+		return
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return
+	}
+	if err := os.Rename(tmp.Name(), r.SpoolFile); err != nil {
+		return
+	}
+	r.spoolSize = info.Size()
+	r.reportSpool()
+}
+
+func (r *AuditReplicator) dropped(n int, err error) {
+	r.config.MetricsClient.Count("audit.replication.dropped", int64(n), []string{}, 1)
+	r.config.Log.WithFields(log.Fields{
+		"error":  err,
+		"events": n,
+	}).Error("dropped audit events")
+}
+
+func (r *AuditReplicator) reportSpool() {
+	r.config.MetricsClient.Gauge("audit.replication.spool_bytes", float64(r.spoolSize), []string{}, 1)
+}
@@ -0,0 +1,176 @@
+package smokescreen
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAuditSink struct {
+	mu     sync.Mutex
+	fail   bool
+	events []string
+}
+
+func (s *testAuditSink) Send(events [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("region unreachable")
+	}
+	for _, event := range events {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(event, &fields); err != nil {
+			return err
+		}
+		s.events = append(s.events, fields["msg"].(string))
+	}
+	return nil
+}
+
+func (s *testAuditSink) setFailing(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *testAuditSink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+// waitUntil polls cond for up to a second, reporting whether it became true.
+func waitUntil(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestAuditReplicationSpoolsDuringOutage(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "audit-replication")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	spoolFile := filepath.Join(dir, "spool")
+
+	sink := &testAuditSink{fail: true}
+	conf := NewConfig()
+	replicator := &AuditReplicator{
+		Sink:          sink,
+		SpoolFile:     spoolFile,
+		FlushInterval: 10 * time.Millisecond,
+	}
+	r.NoError(conf.SetupAuditReplication(replicator))
+	r.NotNil(conf.AccessLog)
+
+	conf.AccessLog.Info("first")
+	conf.AccessLog.Info("second")
+	r.True(waitUntil(func() bool {
+		info, err := os.Stat(spoolFile)
+		return err == nil && info.Size() > 0
+	}))
+	a.Empty(sink.received())
+
+	// Once the sink recovers, spooled records go out first.
+	sink.setFailing(false)
+	conf.AccessLog.Info("third")
+	r.True(waitUntil(func() bool {
+		return len(sink.received()) == 3
+	}))
+	a.Equal([]string{"first", "second", "third"}, sink.received())
+
+	replicator.Close()
+	info, err := os.Stat(spoolFile)
+	r.NoError(err)
+	a.Zero(info.Size())
+}
+
+func TestAuditReplicationCloseFlushes(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "audit-replication")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	sink := &testAuditSink{}
+	conf := NewConfig()
+	replicator := &AuditReplicator{
+		Sink:          sink,
+		SpoolFile:     filepath.Join(dir, "spool"),
+		FlushInterval: time.Hour,
+	}
+	r.NoError(conf.SetupAuditReplication(replicator))
+
+	conf.AccessLog.WithFields(logrus.Fields{"role": "foo"}).Info("decision")
+	replicator.Close()
+	a.Equal([]string{"decision"}, sink.received())
+}
+
+func TestAuditReplicationSpoolLimit(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "audit-replication")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	spoolFile := filepath.Join(dir, "spool")
+
+	conf := NewConfig()
+	replicator := &AuditReplicator{
+		Sink:          &testAuditSink{fail: true},
+		SpoolFile:     spoolFile,
+		MaxSpoolBytes: 1,
+		FlushInterval: time.Hour,
+	}
+	r.NoError(conf.SetupAuditReplication(replicator))
+
+	conf.AccessLog.Info("dropped")
+	replicator.Close()
+	info, err := os.Stat(spoolFile)
+	r.NoError(err)
+	a.Zero(info.Size())
+}
+
+func TestHTTPAuditSink(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	var body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+		a.Equal("application/x-ndjson", req.Header.Get("Content-Type"))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := &HTTPAuditSink{URL: server.URL}
+	r.NoError(sink.Send([][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}))
+	a.Equal("{\"a\":1}\n{\"b\":2}\n", body)
+
+	status = http.StatusServiceUnavailable
+	err := sink.Send([][]byte{[]byte(`{"a":1}`)})
+	r.Error(err)
+	a.True(strings.Contains(err.Error(), "503"))
+}
@@ -0,0 +1,123 @@
+package smokescreen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+// buildInfoInterval is how often build info and uptime are sent to statsd,
+// so they show up on dashboards however long the process has been running.
+const buildInfoInterval = time.Minute
+
+// buildInfo identifies the build a proxy is running and the configuration
+// and ACL it serves, so dashboards can spot version skew and stale policies
+// across a fleet.
+type buildInfo struct {
+	version    string
+	gitSHA     string
+	goVersion  string
+	configHash string
+	aclHash    string
+	start      time.Time
+}
+
+func currentBuildInfo(config *Config) buildInfo {
+	return buildInfo{
+		version:    Version(),
+		gitSHA:     GitSHA(),
+		goVersion:  runtime.Version(),
+		configHash: config.ConfigHash,
+		aclHash:    aclHash(config.EgressACL),
+		start:      config.started,
+	}
+}
+
+func (bi buildInfo) fields() logrus.Fields {
+	return logrus.Fields{
+		"version":     bi.version,
+		"git_sha":     bi.gitSHA,
+		"go_version":  bi.goVersion,
+		"config_hash": bi.configHash,
+		"acl_hash":    bi.aclHash,
+		"start_time":  bi.start.Unix(),
+	}
+}
+
+func (bi buildInfo) tags() []string {
+	return []string{
+		fmt.Sprintf("version:%s", bi.version),
+		fmt.Sprintf("git_sha:%s", bi.gitSHA),
+		fmt.Sprintf("go_version:%s", bi.goVersion),
+		fmt.Sprintf("config_hash:%s", bi.configHash),
+		fmt.Sprintf("acl_hash:%s", bi.aclHash),
+	}
+}
+
+// aclHash returns the hash of the ACL d decides by, if it is one whose rules
+// are known.
+func aclHash(d acl.Decider) string {
+	switch a := d.(type) {
+	case *acl.ACL:
+		return a.Hash()
+	case *PollingACL:
+		return a.current.Load().(*acl.ACL).Hash()
+	}
+	return ""
+}
+
+// aclStats returns the size of the ACL d decides by, if it is one whose rules
+// are known.
+func aclStats(d acl.Decider) (acl.Stats, bool) {
+	switch a := d.(type) {
+	case *acl.ACL:
+		return a.Stats(), true
+	case *PollingACL:
+		return a.current.Load().(*acl.ACL).Stats(), true
+	}
+	return acl.Stats{}, false
+}
+
+// HashConfig returns the digest identifying a configuration: the hash of its
+// file, if any, as set by LoadConfig, and the command line arguments applied
+// on top of it.
+func HashConfig(fileHash string, args []string) string {
+	return shortHash([]byte(fileHash + "\x00" + strings.Join(args, "\x00")))
+}
+
+func shortHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// reportBuildInfo sends build info, as a build_info gauge whose tags carry
+// it, and uptime to statsd every interval until the proxy shuts down.
+func reportBuildInfo(config *Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		bi := currentBuildInfo(config)
+		config.MetricsClient.Gauge("build_info", 1, bi.tags(), 1)
+		config.MetricsClient.Gauge("start_time_seconds", float64(bi.start.Unix()), []string{}, 1)
+		config.MetricsClient.Gauge("uptime_seconds", time.Since(bi.start).Seconds(), []string{}, 1)
+		if stats, ok := aclStats(config.EgressACL); ok {
+			config.MetricsClient.Gauge("acl.rules", float64(stats.Rules), []string{}, 1)
+			config.MetricsClient.Gauge("acl.domain_globs", float64(stats.DomainGlobs), []string{}, 1)
+			config.MetricsClient.Gauge("acl.domain_glob_bytes", float64(stats.DomainGlobBytes), []string{}, 1)
+			config.MetricsClient.Gauge("acl.compiled_matchers", float64(stats.CompiledMatchers), []string{}, 1)
+			config.MetricsClient.Gauge("acl.matcher_bytes", float64(stats.MatcherBytes), []string{}, 1)
+		}
+
+		<-ticker.C
+		if shuttingDown, _ := config.ShuttingDown.Load().(bool); shuttingDown {
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package smokescreen
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestBuildInfo(t *testing.T) {
+	a := assert.New(t)
+
+	a.Len(GitSHA(), 40)
+	a.Contains(Version(), GitSHA()[:8])
+
+	newACL := func(domains ...string) *acl.ACL {
+		return &acl.ACL{
+			Rules: map[string]acl.Rule{
+				"svc": {Policy: acl.Enforce, DomainGlobs: domains},
+			},
+		}
+	}
+	a.Equal(newACL("example.com").Hash(), newACL("example.com").Hash())
+	a.NotEqual(newACL("example.com").Hash(), newACL("example.org").Hash())
+
+	a.Equal(HashConfig("abc", []string{"--port", "4750"}), HashConfig("abc", []string{"--port", "4750"}))
+	a.NotEqual(HashConfig("abc", []string{"--port", "4750"}), HashConfig("abc", []string{"--port", "4751"}))
+	a.NotEqual(HashConfig("abc", nil), HashConfig("abd", nil))
+
+	conf := NewConfig()
+	conf.ConfigHash = "0123456789abcdef"
+	conf.EgressACL = newACL("example.com")
+	conf.started = time.Unix(1700000000, 0)
+
+	bi := currentBuildInfo(conf)
+	a.Equal(newACL("example.com").Hash(), bi.aclHash)
+	a.Equal(runtime.Version(), bi.goVersion)
+	a.Contains(bi.tags(), "config_hash:0123456789abcdef")
+	a.Equal(int64(1700000000), bi.fields()["start_time"])
+}
+
+func TestOpenMetricsBuildInfo(t *testing.T) {
+	a := assert.New(t)
+
+	om := NewOpenMetrics()
+	om.buildInfo = func() buildInfo {
+		return buildInfo{
+			version:    "1.2.3",
+			gitSHA:     "f00",
+			goVersion:  "go1.21",
+			configHash: "c0ffee",
+			aclHash:    "ac1",
+			start:      time.Unix(1700000000, 0),
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err := om.WriteTo(&buf)
+	require.NoError(t, err)
+	out := buf.String()
+
+	a.Contains(out, "# TYPE smokescreen_build info\n")
+	a.Contains(out, `smokescreen_build_info{version="1.2.3",git_sha="f00",go_version="go1.21",config_hash="c0ffee",acl_hash="ac1"} 1`+"\n")
+	a.Contains(out, "smokescreen_start_time_seconds 1700000000\n")
+}
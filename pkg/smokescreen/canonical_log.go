@@ -0,0 +1,71 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ProxyContext describes the request a canonical proxy decision log line is
+// about to a CanonicalLogEnricher.
+type ProxyContext struct {
+	Request   *http.Request // The client's request: the CONNECT request, or the plain HTTP request
+	ProxyType string        // "connect", "http", or "mitm"
+	Role      string        // Empty if the client's role couldn't be determined
+	Allow     bool
+	Reason    string // Why the request was allowed or denied
+	Error     error  // Set if the request failed or was denied
+}
+
+// enrichCanonicalLog has the configured CanonicalLogEnricher, if any, add its
+// fields to those of a canonical proxy decision log line.
+func enrichCanonicalLog(config *Config, fields logrus.Fields, pctx *ProxyContext) logrus.Fields {
+	if config.CanonicalLogEnricher == nil {
+		return fields
+	}
+	entry := logrus.NewEntry(config.Log).WithFields(fields)
+	config.CanonicalLogEnricher(entry, pctx)
+	return entry.Data
+}
+
+// SetupCanonicalLogKeys renames fields of canonical proxy decision log
+// lines, so they can follow an established logging schema: each field named
+// by a key of keys is logged under its value instead, e.g. "requested_host"
+// under "dst.host". Fields added by a CanonicalLogEnricher can be renamed
+// too.
+func (config *Config) SetupCanonicalLogKeys(keys map[string]string) error {
+	renamed := make(map[string]string, len(keys))
+	for from, to := range keys {
+		if from == "" || to == "" {
+			return fmt.Errorf("invalid canonical log key mapping %q to %q", from, to)
+		}
+		if other, ok := renamed[to]; ok {
+			return fmt.Errorf("canonical log keys %q and %q are both renamed to %q", other, from, to)
+		}
+		renamed[to] = from
+	}
+	config.CanonicalLogKeys = keys
+	return nil
+}
+
+// renameCanonicalLogKeys returns fields with their keys renamed as
+// CanonicalLogKeys says. Renamed fields take the place of any field that
+// already had their new name.
+func renameCanonicalLogKeys(config *Config, fields logrus.Fields) logrus.Fields {
+	if len(config.CanonicalLogKeys) == 0 {
+		return fields
+	}
+	renamed := make(logrus.Fields, len(fields))
+	for k, v := range fields {
+		if _, ok := config.CanonicalLogKeys[k]; !ok {
+			renamed[k] = v
+		}
+	}
+	for from, to := range config.CanonicalLogKeys {
+		if v, ok := fields[from]; ok {
+			renamed[to] = v
+		}
+	}
+	return renamed
+}
@@ -0,0 +1,94 @@
+package smokescreen
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalLogEnricher(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	logHook := logrustest.NewLocal(conf.Log)
+	conf.AccessLog = logrus.New()
+	accessHook := logrustest.NewLocal(conf.AccessLog)
+
+	var seen []*ProxyContext
+	conf.CanonicalLogEnricher = func(entry *logrus.Entry, pctx *ProxyContext) {
+		seen = append(seen, pctx)
+		entry.Data["pod"] = "smokescreen-7"
+		if pctx.Role == "billing" {
+			entry.Data["customer_id"] = pctx.Request.Header.Get("X-Customer")
+		}
+	}
+
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	req.Header.Set("X-Customer", "cus_123")
+	ctx := &goproxy.ProxyCtx{Req: req}
+	decision := &aclDecision{role: "billing", allow: true, reason: "rule has enforce policy"}
+	logProxy(conf, ctx, "connect", nil, decision, "", time.Now(), nil)
+
+	r.Len(seen, 1)
+	a.Equal(&ProxyContext{Request: req, ProxyType: "connect", Role: "billing", Allow: true, Reason: "rule has enforce policy"}, seen[0])
+	for _, hook := range []*logrustest.Hook{logHook, accessHook} {
+		entry := hook.LastEntry()
+		r.NotNil(entry)
+		a.Equal(LOGLINE_CANONICAL_PROXY_DECISION, entry.Message)
+		a.Equal("smokescreen-7", entry.Data["pod"])
+		a.Equal("cus_123", entry.Data["customer_id"])
+		a.Equal("billing", entry.Data["role"])
+	}
+
+	// Failed requests are described too.
+	err := errors.New("boom")
+	logProxy(conf, &goproxy.ProxyCtx{Req: httptest.NewRequest("GET", "http://example.com/", nil)}, "http", nil, nil, "", time.Now(), err)
+	r.Len(seen, 2)
+	a.Equal("http", seen[1].ProxyType)
+	a.Equal(err, seen[1].Error)
+	a.Empty(seen[1].Role)
+	a.Equal("smokescreen-7", logHook.LastEntry().Data["pod"])
+}
+
+func TestCanonicalLogKeys(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	logHook := logrustest.NewLocal(conf.Log)
+	conf.CanonicalLogEnricher = func(entry *logrus.Entry, pctx *ProxyContext) {
+		entry.Data["pod"] = "smokescreen-7"
+	}
+	r.NoError(conf.SetupCanonicalLogKeys(map[string]string{
+		"requested_host": "destination.domain",
+		"role":           "service.name",
+		"pod":            "k8s.pod.name",
+		"proxy_type":     "role", // Takes the place of the original role field
+	}))
+
+	ctx := &goproxy.ProxyCtx{Req: httptest.NewRequest("CONNECT", "example.com:443", nil)}
+	decision := &aclDecision{role: "billing", allow: true}
+	logProxy(conf, ctx, "connect", nil, decision, "", time.Now(), nil)
+
+	data := logHook.LastEntry().Data
+	a.Equal("example.com:443", data["destination.domain"])
+	a.Equal("billing", data["service.name"])
+	a.Equal("smokescreen-7", data["k8s.pod.name"])
+	a.Equal("connect", data["role"])
+	a.Equal(true, data["allow"])
+	for _, k := range []string{"requested_host", "pod", "proxy_type"} {
+		a.NotContains(data, k)
+	}
+
+	a.Error(conf.SetupCanonicalLogKeys(map[string]string{"requested_host": ""}))
+	a.Error(conf.SetupCanonicalLogKeys(map[string]string{"requested_host": "host", "dest_ip": "host"}))
+	a.NoError(conf.SetupCanonicalLogKeys(nil))
+}
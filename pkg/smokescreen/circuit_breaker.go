@@ -0,0 +1,222 @@
+package smokescreen
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults of CircuitBreakerConfig.
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitOpenDuration     = 30 * time.Second
+)
+
+// CircuitBreakerConfig configures SetupCircuitBreaker.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           // Consecutive failed dials to a destination that open its circuit. Defaults to 5.
+	OpenDuration     time.Duration // How long an open circuit fails requests before a probe is let through. Defaults to 30 seconds.
+}
+
+// circuitOpenError is returned for requests to a destination whose circuit
+// is open, after retryAfter.
+type circuitOpenError struct {
+	error
+	retryAfter time.Duration
+}
+
+// circuit is the state of a destination that dials have recently failed to.
+// It is closed while openedAt is zero.
+type circuit struct {
+	failures int       // Consecutive failed dials
+	openedAt time.Time // When the circuit last opened
+	probing  bool      // Whether the dial probing the half-open circuit is in progress
+}
+
+// circuitBreaker fails requests to destinations that dials keep failing to
+// right away, rather than having each of them wait out the connect timeout
+// while holding a client connection, a file descriptor and a goroutine.
+// Once FailureThreshold dials in a row to a destination have failed, its
+// circuit opens and requests to it are rejected. After OpenDuration the
+// circuit is half-open: a single dial is let through as a probe, and closes
+// the circuit if it succeeds, or opens it again if it fails, while other
+// requests are still rejected.
+//
+// Destinations are told apart by the host and port requested. Only failures
+// of the dial itself count; dials refused by the proxy's own limits don't.
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+	now    func() time.Time
+
+	sync.Mutex
+	circuits map[string]*circuit // Destinations with failed dials since their last successful one
+}
+
+// SetupCircuitBreaker fails requests to destinations that dials keep
+// failing to with a retryable 502, rather than dialing them again, until a
+// probe dial succeeds.
+func (config *Config) SetupCircuitBreaker(cb CircuitBreakerConfig) error {
+	if cb.FailureThreshold == 0 {
+		cb.FailureThreshold = defaultCircuitFailureThreshold
+	}
+	if cb.OpenDuration == 0 {
+		cb.OpenDuration = defaultCircuitOpenDuration
+	}
+	if cb.FailureThreshold < 1 {
+		return fmt.Errorf("circuit breaker failure threshold must be positive, not %d", cb.FailureThreshold)
+	}
+	if cb.OpenDuration < 0 {
+		return fmt.Errorf("circuit breaker open duration must be positive, not %v", cb.OpenDuration)
+	}
+
+	config.circuits = &circuitBreaker{
+		config:   cb,
+		now:      time.Now,
+		circuits: make(map[string]*circuit),
+	}
+	return nil
+}
+
+// open reports whether a dial to dest started now would be rejected, and
+// how long until a probe may be let through.
+func (b *circuitBreaker) open(dest string) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+	c := b.circuits[dest]
+	if c == nil || c.openedAt.IsZero() {
+		return 0, false
+	}
+	if wait := c.openedAt.Add(b.config.OpenDuration).Sub(b.now()); wait > 0 {
+		return wait, true
+	}
+	return 0, c.probing
+}
+
+// acquire lets a dial to dest go ahead, unless its circuit is open. A dial
+// to a half-open circuit is its probe.
+func (b *circuitBreaker) acquire(dest string) (retryAfter time.Duration, probe bool, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	c := b.circuits[dest]
+	if c == nil || c.openedAt.IsZero() {
+		return 0, false, true
+	}
+	if wait := c.openedAt.Add(b.config.OpenDuration).Sub(b.now()); wait > 0 {
+		return wait, false, false
+	}
+	if c.probing {
+		return 0, false, false
+	}
+	c.probing = true
+	return 0, true, true
+}
+
+// cancel ends a dial that wasn't made, leaving the circuit as it was.
+func (b *circuitBreaker) cancel(dest string, probe bool) {
+	if !probe {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if c := b.circuits[dest]; c != nil {
+		c.probing = false
+	}
+}
+
+// release ends a dial to dest, which failed if failed is set. It reports
+// whether the dial opened the circuit, or closed it.
+func (b *circuitBreaker) release(dest string, probe, failed bool) (opened, closed bool) {
+	b.Lock()
+	defer b.Unlock()
+	c := b.circuits[dest]
+	if !failed {
+		if c != nil {
+			delete(b.circuits, dest)
+			closed = !c.openedAt.IsZero()
+		}
+		return false, closed
+	}
+
+	if c == nil {
+		c = &circuit{}
+		b.circuits[dest] = c
+	}
+	c.failures++
+	if probe {
+		c.probing = false
+		c.openedAt = b.now()
+		return true, false
+	}
+	if c.openedAt.IsZero() && c.failures >= b.config.FailureThreshold {
+		c.openedAt = b.now()
+		return true, false
+	}
+	return false, false
+}
+
+func circuitKey(outboundHost string) string {
+	return strings.ToLower(outboundHost)
+}
+
+func circuitOpenErr(config *Config, role, outboundHost string, retryAfter time.Duration) error {
+	config.MetricsClient.Incr("circuit.rejected", []string{fmt.Sprintf("role:%s", role)}, 1)
+	return circuitOpenError{
+		error:      fmt.Errorf("circuit open: recent connections to %s failed", outboundHost),
+		retryAfter: retryAfter,
+	}
+}
+
+// acquireCircuit lets a dial to outboundHost go ahead, if circuit breaking
+// is set up, and returns a circuitOpenError if its circuit is open. The
+// returned function counts the outcome of the dial towards the circuit.
+func acquireCircuit(config *Config, role, outboundHost string) (func(err error), error) {
+	b := config.circuits
+	if b == nil || outboundHost == "" {
+		return func(error) {}, nil
+	}
+	dest := circuitKey(outboundHost)
+	retryAfter, probe, ok := b.acquire(dest)
+	if !ok {
+		return nil, circuitOpenErr(config, role, outboundHost, retryAfter)
+	}
+
+	return func(err error) {
+		// Dials we refused ourselves say nothing about the destination.
+		if _, refused := err.(connLimitError); refused {
+			b.cancel(dest, probe)
+			return
+		}
+		opened, closed := b.release(dest, probe, err != nil)
+		if opened {
+			config.MetricsClient.Incr("circuit.open", []string{}, 1)
+			config.Log.WithFields(logrus.Fields{
+				"destination": outboundHost,
+				"error":       err,
+				"probe":       probe,
+			}).Warn("opened circuit to failing destination")
+		}
+		if closed {
+			config.MetricsClient.Incr("circuit.close", []string{}, 1)
+			config.Log.WithFields(logrus.Fields{
+				"destination": outboundHost,
+			}).Info("closed circuit to recovered destination")
+		}
+	}, nil
+}
+
+// checkCircuit rejects CONNECT requests to a destination whose circuit is
+// open, telling clients how long to wait before retrying.
+func checkCircuit(config *Config, decision *aclDecision) error {
+	b := config.circuits
+	if b == nil || decision.outboundHost == "" {
+		return nil
+	}
+	retryAfter, open := b.open(circuitKey(decision.outboundHost))
+	if !open {
+		return nil
+	}
+	return circuitOpenErr(config, decision.role, decision.outboundHost, retryAfter)
+}
@@ -0,0 +1,149 @@
+package smokescreen
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	a.Error(conf.SetupCircuitBreaker(CircuitBreakerConfig{FailureThreshold: -1}))
+	a.Error(conf.SetupCircuitBreaker(CircuitBreakerConfig{OpenDuration: -time.Second}))
+	r.NoError(conf.SetupCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute}))
+	b := conf.circuits
+	now := time.Unix(1000000, 0)
+	b.now = func() time.Time { return now }
+
+	const dest = "partner.example.com:443"
+	dial := func(failed bool) (opened, closed bool) {
+		_, probe, ok := b.acquire(dest)
+		r.True(ok)
+		return b.release(dest, probe, failed)
+	}
+
+	// A success in between resets the count of failures.
+	dial(true)
+	dial(false)
+	opened, _ := dial(true)
+	a.False(opened)
+	opened, _ = dial(true)
+	a.True(opened)
+
+	retryAfter, open := b.open(dest)
+	a.True(open)
+	a.Equal(time.Minute, retryAfter)
+	_, _, ok := b.acquire(dest)
+	a.False(ok)
+	_, open = b.open("other.example.com:443")
+	a.False(open)
+
+	// Once half-open, one probe is let through at a time, and reopens the
+	// circuit if it fails.
+	now = now.Add(time.Minute)
+	_, open = b.open(dest)
+	a.False(open)
+	_, probe, ok := b.acquire(dest)
+	a.True(ok)
+	a.True(probe)
+	_, _, ok = b.acquire(dest)
+	a.False(ok, "probe in progress")
+	opened, _ = b.release(dest, probe, true)
+	a.True(opened)
+	_, _, ok = b.acquire(dest)
+	a.False(ok)
+
+	// A probe that isn't dialed leaves the circuit half-open.
+	now = now.Add(time.Minute)
+	_, probe, ok = b.acquire(dest)
+	a.True(ok && probe)
+	b.cancel(dest, probe)
+
+	// A successful probe closes the circuit.
+	_, probe, ok = b.acquire(dest)
+	a.True(ok && probe)
+	_, closed := b.release(dest, probe, false)
+	a.True(closed)
+	a.Empty(b.circuits)
+}
+
+func TestCircuitBreakerProxy(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	// Nothing listens at the destination.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	dest := ln.Addr().String()
+	ln.Close()
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(conf.SetupCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute}))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func() (*http.Response, string) {
+		resp, err := client.Get("http://" + dest)
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		return resp, string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, body := get()
+		a.NotContains(body, "circuit open")
+	}
+
+	resp, body := get()
+	a.Equal(http.StatusBadGateway, resp.StatusCode)
+	a.Equal("true", resp.Header.Get(retryableHeader))
+	a.Equal("60", resp.Header.Get("Retry-After"))
+	a.Contains(body, "circuit open")
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	r.NoError(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	r.NoError(err)
+	a.Equal(http.StatusBadGateway, resp.StatusCode)
+	a.Contains(resp.Header.Get(errorHeader), "circuit open")
+}
+
+func TestCircuitBreakerIgnoresRefusedDials(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	r.NoError(conf.SetupCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1}))
+
+	done, err := acquireCircuit(conf, "role", "example.com:443")
+	r.NoError(err)
+	done(connLimitError{error: errors.New("too many connections"), limit: limitHost})
+	_, err = acquireCircuit(conf, "role", "example.com:443")
+	a.NoError(err)
+}
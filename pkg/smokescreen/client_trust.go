@@ -0,0 +1,152 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientTrust is the material used to authenticate clients: the CA pool and
+// the CRLs of those CAs. It is replaced wholesale on reload so in-flight
+// handshakes always see a consistent snapshot.
+type clientTrust struct {
+	pool                *x509.CertPool
+	crlByAuthorityKeyId map[string]*pkix.CertificateList
+}
+
+func (config *Config) storeClientTrust() {
+	crls := make(map[string]*pkix.CertificateList, len(config.CrlByAuthorityKeyId))
+	for k, v := range config.CrlByAuthorityKeyId {
+		crls[k] = v
+	}
+	config.clientTrust.Store(&clientTrust{
+		pool:                config.clientCAPool,
+		crlByAuthorityKeyId: crls,
+	})
+}
+
+func (config *Config) currentClientTrust() *clientTrust {
+	trust, _ := config.clientTrust.Load().(*clientTrust)
+	return trust
+}
+
+// ReloadClientTrust re-reads the client CA and CRL files given to SetupTls and
+// SetupCrls. New handshakes are validated against the reloaded material
+// immediately. If any file can't be loaded, the current material is kept.
+func (config *Config) ReloadClientTrust() error {
+	cas := make(map[string]*x509.Certificate)
+	pool := x509.NewCertPool()
+	for _, caFile := range config.clientCAFiles {
+		if err := addCertsFromFile(cas, pool, caFile); err != nil {
+			return err
+		}
+	}
+
+	crls := make(map[string]*pkix.CertificateList)
+	if err := loadCrls(config.crlFiles, cas, crls); err != nil {
+		return err
+	}
+
+	config.clientCasBySubjectKeyId = cas
+	config.CrlByAuthorityKeyId = crls
+	config.clientCAPool = pool
+	config.storeClientTrust()
+	return nil
+}
+
+// staleCrls returns the loaded CRLs whose next update time has passed, so
+// revocations issued since then may be missing.
+func (trust *clientTrust) staleCrls(now time.Time) []*pkix.CertificateList {
+	var stale []*pkix.CertificateList
+	for _, crl := range trust.crlByAuthorityKeyId {
+		if next := crl.TBSCertList.NextUpdate; !next.IsZero() && now.After(next) {
+			stale = append(stale, crl)
+		}
+	}
+	return stale
+}
+
+// reportStaleCrls reports how many loaded CRLs are past their next update
+// time, warning about each of them.
+func (config *Config) reportStaleCrls() {
+	trust := config.currentClientTrust()
+	if trust == nil {
+		return
+	}
+
+	stale := trust.staleCrls(time.Now())
+	config.MetricsClient.Gauge("tls.crl.stale", float64(len(stale)), []string{}, 1)
+	for _, crl := range stale {
+		config.Log.WithFields(logrus.Fields{
+			"issuer":      crl.TBSCertList.Issuer.String(),
+			"next_update": crl.TBSCertList.NextUpdate,
+		}).Warn("CRL is past its next update time; newer revocations may be missing")
+	}
+}
+
+// watchClientTrust polls the client CA and CRL files every interval and
+// reloads them when any of them changes, until the proxy shuts down. Loaded
+// CRLs that have gone stale are reported on every poll.
+func (config *Config) watchClientTrust(interval time.Duration) {
+	files := append(append([]string{}, config.clientCAFiles...), config.crlFiles...)
+	w := newFileWatcher(config, files, "tls.client_trust", "client CAs and CRLs", config.ReloadClientTrust)
+	w.onPoll = config.reportStaleCrls
+	w.watch(interval)
+}
+
+// tlsConfigForClient returns the server's TLS configuration with the current
+// server certificate and client CA pool.
+func (config *Config) tlsConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	trust := config.currentClientTrust()
+	if trust == nil {
+		return nil, nil
+	}
+
+	tc := config.TlsConfig.Clone()
+	tc.ClientCAs = trust.pool
+	if cert := config.currentServerCert(); cert != nil {
+		tc.Certificates = []tls.Certificate{*cert}
+	}
+	return tc, nil
+}
+
+// revokedCertError is returned by verifyClientRevocation, carrying the
+// revoked certificate so handshake failures can be reported with its subject.
+type revokedCertError struct {
+	cert *x509.Certificate
+}
+
+func (e revokedCertError) Error() string {
+	return "client certificate has been revoked"
+}
+
+// verifyClientRevocation rejects client certificates that have been revoked
+// by a CRL of their issuing CA.
+func (config *Config) verifyClientRevocation(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	trust := config.currentClientTrust()
+	if trust == nil {
+		return nil
+	}
+
+	for _, chain := range verifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		leaf := chain[0]
+
+		crl, ok := trust.crlByAuthorityKeyId[string(leaf.AuthorityKeyId)]
+		if !ok {
+			continue
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				config.MetricsClient.Incr("tls.client_cert_revoked", []string{}, 1)
+				return revokedCertError{cert: leaf}
+			}
+		}
+	}
+	return nil
+}
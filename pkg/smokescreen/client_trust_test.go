@@ -0,0 +1,128 @@
+package smokescreen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPkiDir = "../../cmd/testdata/pki/"
+
+type testPKI struct {
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+	dir   string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-pki")
+	r.NoError(err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	r.NoError(err)
+	ca, err := x509.ParseCertificate(der)
+	r.NoError(err)
+
+	pki := &testPKI{ca: ca, caKey: key, dir: dir}
+	pki.write(t, "ca.pem", "CERTIFICATE", der)
+	return pki
+}
+
+func (p *testPKI) write(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(p.dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func (p *testPKI) issue(t *testing.T, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func (p *testPKI) writeCRL(t *testing.T, revoked ...*x509.Certificate) string {
+	var entries []pkix.RevokedCertificate
+	for _, c := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: c.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := p.ca.CreateCRL(rand.Reader, p.caKey, entries, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	return p.write(t, "crl.pem", "X509 CRL", der)
+}
+
+func TestClientTrustRevocation(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	pki := newTestPKI(t)
+	defer os.RemoveAll(pki.dir)
+
+	valid := pki.issue(t, 10)
+	revoked := pki.issue(t, 11)
+	validChains := [][]*x509.Certificate{{valid, pki.ca}}
+	revokedChains := [][]*x509.Certificate{{revoked, pki.ca}}
+
+	conf := NewConfig()
+	r.NoError(conf.SetupTls(testPkiDir+"server.pem", testPkiDir+"server-key.pem", []string{filepath.Join(pki.dir, "ca.pem")}))
+
+	// No CRL loaded yet, so nothing is revoked.
+	a.NoError(conf.verifyClientRevocation(nil, revokedChains))
+
+	crlFile := pki.writeCRL(t)
+	r.NoError(conf.SetupCrls([]string{crlFile}))
+	a.NoError(conf.verifyClientRevocation(nil, revokedChains))
+
+	// Revoking the certificate takes effect on reload.
+	pki.writeCRL(t, revoked)
+	r.NoError(conf.ReloadClientTrust())
+	a.Error(conf.verifyClientRevocation(nil, revokedChains))
+	a.NoError(conf.verifyClientRevocation(nil, validChains))
+
+	tc, err := conf.tlsConfigForClient(nil)
+	r.NoError(err)
+	a.Equal(conf.clientCAPool, tc.ClientCAs)
+
+	// The test CRLs must be updated within the hour.
+	trust := conf.currentClientTrust()
+	a.Empty(trust.staleCrls(time.Now()))
+	a.Len(trust.staleCrls(time.Now().Add(2*time.Hour)), 1)
+}
@@ -0,0 +1,62 @@
+package smokescreen
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Cloud instance metadata services hand out credentials to anything that can
+// reach them, so they are always denied unless AllowCloudMetadataAccess is
+// set. This check runs before the user-configured allow ranges are consulted.
+var cloudMetadataStrings = [...]string{
+	"169.254.169.254/32", // AWS, GCP, Azure, OpenStack, DigitalOcean, Oracle
+	"fd00:ec2::254/128",  // AWS IMDS over IPv6
+	"169.254.170.2/32",   // AWS ECS task metadata and credentials
+	"169.254.170.23/32",  // AWS EKS Pod Identity agent
+	"fd00:ec2::23/128",   // AWS EKS Pod Identity agent over IPv6
+	"168.63.129.16/32",   // Azure WireServer
+	"100.100.100.200/32", // Alibaba Cloud
+}
+
+var CloudMetadataRuleRanges []RuleRange
+
+// cloudMetadataHeaders are request headers that are only meaningful to a
+// metadata service, along with the value they must have, if any. A request
+// carrying one of them is trying to reach a metadata service, whatever its
+// destination claims to be.
+var cloudMetadataHeaders = map[string]string{
+	"X-Aws-Ec2-Metadata-Token":             "",
+	"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": "",
+	"Metadata-Flavor":                      "Google",
+	"Metadata":                             "true", // Azure
+}
+
+func init() {
+	CloudMetadataRuleRanges = make([]RuleRange, len(cloudMetadataStrings))
+	for i, s := range cloudMetadataStrings {
+		_, rng, err := net.ParseCIDR(s)
+		if err != nil {
+			panic("Couldn't parse cloud metadata network string")
+		}
+		CloudMetadataRuleRanges[i].Net = *rng
+	}
+}
+
+func isCloudMetadataRequest(req *http.Request) bool {
+	for h, want := range cloudMetadataHeaders {
+		values, ok := req.Header[h]
+		if !ok {
+			continue
+		}
+		if want == "" {
+			return true
+		}
+		for _, v := range values {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
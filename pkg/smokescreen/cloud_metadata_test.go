@@ -0,0 +1,51 @@
+package smokescreen
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudMetadataAddresses(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	// Even a range allowing every address doesn't expose metadata services.
+	a.NoError(conf.SetAllowRanges([]string{"0.0.0.0/0", "::/0"}))
+
+	for _, ip := range []string{"169.254.169.254", "fd00:ec2::254", "169.254.170.2", "100.100.100.200", "::ffff:169.254.169.254"} {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 80}
+		a.Equal(ipDenyCloudMetadata, classifyAddr(conf, addr), ip)
+	}
+	a.Equal(ipAllowUserConfigured, classifyAddr(conf, &net.TCPAddr{IP: net.ParseIP("169.254.169.253"), Port: 80}))
+
+	conf.AllowCloudMetadataAccess = true
+	a.Equal(ipAllowUserConfigured, classifyAddr(conf, &net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 80}))
+}
+
+func TestCloudMetadataRequest(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	newRequest := func(header, value string) *http.Request {
+		req, err := http.NewRequest("PUT", "http://example.com/latest/api/token", nil)
+		a.NoError(err)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return req
+	}
+
+	a.True(isCloudMetadataRequest(newRequest("X-aws-ec2-metadata-token-ttl-seconds", "21600")))
+	a.True(isCloudMetadataRequest(newRequest("Metadata-Flavor", "Google")))
+	a.True(isCloudMetadataRequest(newRequest("Metadata", "true")))
+	a.False(isCloudMetadataRequest(newRequest("Metadata", "v2")))
+	a.False(isCloudMetadataRequest(newRequest("", "")))
+
+	decision, err := checkIfRequestShouldBeProxied(conf, newRequest("X-aws-ec2-metadata-token", "token"), "example.com:80")
+	a.NoError(err)
+	a.False(decision.allow)
+	a.Equal("request carries cloud metadata service headers", decision.reason)
+}
@@ -2,6 +2,7 @@ package smokescreen
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -13,8 +14,9 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -22,11 +24,15 @@ import (
 	log "github.com/sirupsen/logrus"
 	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
 	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+	"github.com/stripe/smokescreen/pkg/smokescreen/metrics"
 )
 
 type RuleRange struct {
-	Net  net.IPNet
-	Port int
+	Net    net.IPNet
+	Port   int
+	Label  string // If set, names the range in deny messages, decision logs and metric tags, e.g. "RFC1918"
+	Reason string // If set, explains why the range is allowed or denied, e.g. "incident-2024-17"
 }
 
 type Config struct {
@@ -34,27 +40,133 @@ type Config struct {
 	Port                         uint16
 	DenyRanges                   []RuleRange
 	AllowRanges                  []RuleRange
+	DenyRangeSet                 *RangeSet // Denied ranges loaded from range files
+	AllowRangeSet                *RangeSet // Allowed ranges loaded from range files
+	RangeFileMaxEntries          int       // Refuse to load range files with more entries than this; zero means no limit
 	Resolver                     *net.Resolver
 	ConnectTimeout               time.Duration
+	TunnelConnectTimeout         time.Duration // If positive, overrides ConnectTimeout for CONNECT requests
+	HTTPConnectTimeout           time.Duration // If positive, overrides ConnectTimeout for plain HTTP requests
+	UpstreamConnectTimeout       time.Duration // If positive, overrides the others for requests sent through an upstream proxy
 	ExitTimeout                  time.Duration
-	StatsdClient                 *statsd.Client
+	TransientRetryAfter          time.Duration         // Retry-After sent to clients when a request fails temporarily
+	MetricsClient                metrics.MetricsClient // Where metrics are reported. NewConfig discards them; SetupStatsd sends them to statsd.
+	StatsdClient                 *statsd.Client        // Deprecated: set MetricsClient instead. Used as MetricsClient if that is unset or discards metrics.
+	StatsdTags                   []string              // Tags added to every metric, e.g. "datacenter:us-east-1"
+	StatsdDestinationTags        bool                  // Whether ACL decision metrics are tagged with the destination host
 	EgressACL                    acl.Decider
 	SupportProxyProtocol         bool
 	TlsConfig                    *tls.Config
 	CrlByAuthorityKeyId          map[string]*pkix.CertificateList
 	RoleFromRequest              func(subject *http.Request) (string, error)
+	RoleChain                    *RoleChain   // If set, determines roles instead of RoleFromRequest, and the source of each role is logged
+	RoleAliases                  *RoleAliases // If set, translates the identities clients present to the roles ACL rules are written for
+	RoleConfig                   *RoleConfig  // If set, determines roles instead of RoleChain and RoleFromRequest, from a reloadable file
+	RoleHeaders                  []string     // Headers clients send roles or credentials for the proxy in, besides X-Smokescreen-Role and Proxy-Authorization, which are removed from plain HTTP requests before they're forwarded
 	clientCasBySubjectKeyId      map[string]*x509.Certificate
 	AdditionalErrorMessageOnDeny string
 	Log                          *log.Logger
+	AccessLog                    *log.Logger      // If set, proxy decisions and closed connections are also logged here
+	AuditReplicator              *AuditReplicator // If set, access log records are also replicated to another region
+	DenyNotifier                 *DenyNotifier    // If set, denied requests are also posted to a webhook
+	RequestLog                   *RequestLog      // If set, proxied requests and tunnels are also logged here in Common Log Format or W3C format
 	DisabledAclPolicyActions     []string
 	AllowMissingRole             bool
 	StatsSocketDir               string
 	StatsSocketFileMode          os.FileMode
 	StatsServer                  *StatsServer // StatsServer
 	ConnTracker                  *conntrack.Tracker
-	IdleThreshold                time.Duration // Consider a connection idle if it has been inactive (no bytes transferred) for this many seconds.
-	Healthcheck                  http.Handler  // User defined http.Handler for optional requests to a /healthcheck endpoint
-	ShuttingDown                 atomic.Value  // Stores a boolean value indicating whether the proxy is actively shutting down
+	IdleThreshold                time.Duration    // Consider a connection idle if it has been inactive (no bytes transferred) for this many seconds.
+	ReadIdleThreshold            time.Duration    // If set, also consider a connection idle if nothing has been received on it for this long.
+	WriteIdleThreshold           time.Duration    // If set, also consider a connection idle if nothing has been sent on it for this long.
+	ReapIdleConnections          bool             // Close connections once they have been inactive for IdleThreshold, rather than only waiting for them to go idle at shutdown
+	MaxConnsPerHost              int              // If positive, requests to a destination host with this many connections open or being dialed are rejected
+	MaxConns                     int              // If positive, CONNECT requests are shed as overloaded while this many connections are open
+	MaxConnLifetime              time.Duration    // If positive, connections are closed once they have been open this long, however active they are
+	BytesReportInterval          time.Duration    // If positive, bytes transferred by open connections are reported this often, not only when they close
+	DenyLogInterval              time.Duration    // If positive, repeated denials of a role's requests to the same host are logged once this often, unless the role's ACL rule says otherwise
+	MaxConnBytes                 int64            // If positive, connections are closed once they have transferred more than this many bytes
+	MaxConnBandwidth             int64            // If positive, each direction of a connection is held to this many bytes per second
+	Healthcheck                  http.Handler     // User defined http.Handler for optional requests to a /healthcheck endpoint
+	HealthEndpoints              bool             // Answer /healthz and /readyz requests for liveness and readiness probes
+	ShuttingDown                 atomic.Value     // Stores a boolean value indicating whether the proxy is actively shutting down
+	Tenants                      []*Tenant        // Additional enforcement domains served from this process, each on its own listener
+	Listener                     net.Listener     // Pre-opened listener to serve on instead of binding Ip and Port
+	TlsClientCAReloadInterval    time.Duration    // Check client CA and CRL files for changes this often. Zero disables reloading.
+	TlsServerCertReloadInterval  time.Duration    // Check the server certificate and key files for changes this often. Zero disables reloading.
+	OpenMetrics                  *OpenMetrics     // If set, decision metrics with trace ID exemplars are served at /metrics on the stats socket
+	DialOnlyAllowedAddresses     bool             // When a destination resolves to both allowed and denied addresses, dial an allowed one instead of denying the request
+	DialGuardMode                DialGuardMode    // What happens when the dialer is asked to connect to a denied address despite the proxy decision
+	AddressSelection             AddressSelection // Which address is dialed when a destination resolves to several allowed ones; see SetupAddressSelection
+	EgressAclPublicKey           crypto.PublicKey // If set, egress ACL files are only loaded if they are signed by this key
+	EgressAclCacheFile           string           // If set, an egress ACL loaded from a URL is cached in this file, to start from when the URL can't be fetched
+	AllowCloudMetadataAccess     bool             // Disables the built-in denial of cloud instance metadata services. Dangerous: exposes instance credentials.
+	AdminAddr                    string           // Address to serve the admin API on; disabled if empty
+	AdminToken                   string           // Bearer token required by the admin API
+	AdminDebug                   bool             // Serve pprof profiles, expvar and a runtime summary on the admin API, to loopback clients
+	DecisionHistory              *DecisionHistory // If set, recent decisions are kept for the admin API's /decisions; see SetupDecisionHistory
+	AdminServer                  *AdminServer
+	ExtAuthzAddr                 string // Address to answer Envoy external authorization checks on; disabled if empty
+	ExtAuthzServer               *ExtAuthzServer
+	DNSAnomalyDetector           *DNSAnomalyDetector // If set, unexpected changes in the addresses destinations resolve to are logged and counted
+	DNSCache                     *DNSCache           // If set, DNS answers are cached for as long as their TTLs allow; see SetupDNSCache
+	ResolverFailureMode          ResolverFailureMode // How requests are answered when the resolver is unavailable
+	Tracer                       Tracer              // If set, proxy decisions and dials are traced
+	IPClassifier                 IPClassifier        // If set, consulted before the built-in classification of resolved addresses
+	PolicyEngine                 PolicyEngine        // If set, also decides whether requests the egress ACL allows are proxied
+	PolicyTimeout                time.Duration       // If positive, requests the policy engine takes longer than this to decide are denied
+	MitmCa                       *tls.Certificate    // Signs the certificates presented to clients whose TLS connections are inspected
+	MitmUpstreamRootCAs          *x509.CertPool      // Verifies destinations of inspected connections. Defaults to the system roots.
+	UpstreamProxy                *url.URL            // If set, traffic of roles without an upstream proxy in the egress ACL is chained through this HTTP or SOCKS5 proxy
+	UpstreamProxyBypassDomains   []string            // Destinations in these domains are connected to directly, even for roles with an upstream proxy; see SetupUpstreamProxyBypass
+	UpstreamProxyBypassRanges    []RuleRange         // Destinations resolving to addresses in these ranges are connected to directly, even for roles with an upstream proxy
+	UpstreamProxyIdentity        UpstreamIdentity    // How the original client is identified to upstream proxies
+	ZoneRoutes                   []ZoneRoute         // If set, route destinations in these zones as they say, in place of the upstream proxy settings; see SetupZoneRoutes
+	IgnoreProxyEnvironment       bool                // Don't chain traffic through the proxies named in the http_proxy and https_proxy environment variables
+	AllowedConnectPorts          []int               // Ports CONNECT requests may target, unless the role's ACL rule lists its own; empty allows any. NewConfig allows 443.
+	VerifySNI                    bool                // Close CONNECT tunnels whose TLS ClientHello names a server other than their destination
+	ListenBacklog                int                 // If set, the accept queue of the listener is resized to this many connections (Linux only)
+	ListenQueueStatsInterval     time.Duration       // If set, accept queue depth and overflows are reported this often (Linux only)
+	MaxHeaderBytes               int                 // Limits the size of each client request's headers. Defaults to net/http's 1MB.
+	MemoryBudget                 int64               // If set, client connections are shed once the buffers they could take would exceed this many bytes
+	ConfigHash                   string              // Identifies the configuration in build info metrics and logs; see HashConfig
+	ResponseInstanceID           string              // If set, plain HTTP responses carry it and their trace ID in headers; see SetupResponseIdentity
+	CanonicalLogKeys             map[string]string   // Fields of canonical proxy decision log lines logged under other names; see SetupCanonicalLogKeys
+
+	// If set, called with each canonical proxy decision log line before it
+	// is logged, to add fields of its own to entry.Data.
+	CanonicalLogEnricher func(entry *log.Entry, pctx *ProxyContext)
+
+	// Called in order when Smokescreen starts shutting down, once it stops
+	// being ready and before it stops accepting connections; see
+	// RegisterShutdownHook.
+	OnShutdown []ShutdownHook
+
+	memoryBudget *memoryBudget // Enforces MemoryBudget across the listener and tenants
+	started      time.Time     // When StartWithConfig was called
+	health       *healthState  // What /readyz reports about the proxy's lifecycle; shared with tenants
+
+	tenant        string             // Name of the tenant this configuration was derived for, if any
+	tenantConfigs []*Config          // The configurations derived for tenants, which shut down along with this one
+	rateLimiter   *roleRateLimiter   // Enforces the rate limits set in the egress ACL
+	denyLogs      *denyLogAggregator // Aggregates the logs of repeated denials; shared with tenants
+
+	addressRotation *addressRotation // Tracks the next address of each destination for AddressSelectRoundRobin
+	roleResolvers   *roleResolvers   // The resolvers of the DNS servers ACL rules name
+	resolverPool    *resolverPool    // Picks among the DNS servers when several are configured
+	portUsage       *portUsage       // Limits the ephemeral ports connections to each destination take; see SetupPortExhaustionProtection
+
+	concurrency *adaptiveConcurrency // Limits the dials in progress at once, across tenants; see SetupAdaptiveConcurrency
+	circuits    *circuitBreaker      // Fails requests to destinations dials keep failing to; see SetupCircuitBreaker
+
+	clientCAFiles []string
+	clientCAPool  *x509.CertPool
+	crlFiles      []string
+	clientTrust   atomic.Value // Stores the *clientTrust used to authenticate clients
+
+	serverCertFile string
+	serverKeyFile  string
+	serverCert     atomic.Value // Stores the *tls.Certificate presented to clients
 }
 
 type missingRoleError struct {
@@ -97,8 +209,8 @@ func parseAddresses(addressStrings []string) ([]RuleRange, error) {
 				return outRanges, fmt.Errorf("invalid IP address '%s'", ipStr)
 			}
 
-			port, err := strconv.Atoi(portStr)
-			if err != nil {
+			port, err := hostport.ParsePort(portStr)
+			if err != nil || port == 0 {
 				return outRanges, fmt.Errorf("invalid port number '%s'", portStr)
 			}
 
@@ -160,32 +272,65 @@ func (config *Config) SetAllowAddresses(addressStrings []string) error {
 	return nil
 }
 
-func (config *Config) SetResolverAddresses(resolverAddresses []string) error {
-	// TODO: support round-robin between multiple addresses
-	if len(resolverAddresses) > 1 {
-		return fmt.Errorf("only one resolver address allowed, %d provided", len(resolverAddresses))
+// SetupConnectPorts sets the ports CONNECT requests may target, for roles
+// whose ACL rule doesn't list its own. The entry "*" allows any port. An
+// empty list keeps the current ports.
+func (config *Config) SetupConnectPorts(entries []string) error {
+	ports, err := acl.ParseConnectPorts(entries)
+	if err != nil {
+		return err
+	}
+	if ports != nil {
+		config.AllowedConnectPorts = ports
+	}
+	return nil
+}
+
+// SetupUpstreamProxy chains the traffic of roles without an upstream proxy in
+// the egress ACL through the HTTP or SOCKS5 proxy at proxyURL.
+func (config *Config) SetupUpstreamProxy(proxyURL string) error {
+	u, err := acl.ParseUpstreamProxy(proxyURL)
+	if err != nil {
+		return err
 	}
+	config.UpstreamProxy = u
+	return nil
+}
 
+// SetResolverAddresses sends DNS queries to the servers at resolverAddresses,
+// given as host:port, rather than the system resolver. With several servers,
+// each query goes to the fastest healthy one; see resolverPool.
+func (config *Config) SetResolverAddresses(resolverAddresses []string) error {
 	// No resolver specified, use the system resolver
 	if len(resolverAddresses) == 0 {
 		return nil
 	}
 
-	addr := resolverAddresses[0]
-	_, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return err
+	for _, addr := range resolverAddresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
 	}
 
-	r := net.Resolver{
+	if len(resolverAddresses) == 1 {
+		config.Resolver = newResolver(resolverAddresses[0])
+		return nil
+	}
+	config.resolverPool = newResolverPool(config, resolverAddresses)
+	config.Resolver = config.resolverPool.resolver()
+	return nil
+}
+
+// newResolver returns a resolver that sends every query to the DNS server at
+// addr.
+func newResolver(addr string) *net.Resolver {
+	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
 			d := net.Dialer{}
 			return d.DialContext(ctx, "udp", addr)
 		},
 	}
-	config.Resolver = &r
-	return nil
 }
 
 // RFC 5280,  4.2.1.1
@@ -200,13 +345,37 @@ func NewConfig() *Config {
 		Log:                     log.New(),
 		Port:                    4750,
 		ExitTimeout:             500 * time.Minute,
+		TransientRetryAfter:     time.Second,
+		RangeFileMaxEntries:     DefaultRangeFileMaxEntries,
 		StatsSocketFileMode:     os.FileMode(0700),
 		IdleThreshold:           10 * time.Second,
 		ShuttingDown:            atomic.Value{},
+		rateLimiter:             newRoleRateLimiter(),
+		addressRotation:         newAddressRotation(),
+		roleResolvers:           newRoleResolvers(),
+		denyLogs:                newDenyLogAggregator(),
+		health:                  &healthState{},
+		MetricsClient:           metrics.NoOpMetricsClient{},
+		AllowedConnectPorts:     []int{443},
 	}
 }
 
 func (config *Config) SetupCrls(crlFiles []string) error {
+	config.crlFiles = append(config.crlFiles, crlFiles...)
+
+	err := loadCrls(crlFiles, config.clientCasBySubjectKeyId, config.CrlByAuthorityKeyId)
+	if err != nil {
+		return err
+	}
+
+	config.storeClientTrust()
+	return nil
+}
+
+// loadCrls adds the CRLs in crlFiles to crls, keyed by the ID of the CA in cas
+// that issued them. CRLs that can't be associated with a CA or whose signature
+// doesn't verify are ignored.
+func loadCrls(crlFiles []string, cas map[string]*x509.Certificate, crls map[string]*pkix.CertificateList) error {
 	for _, crlFile := range crlFiles {
 		crlBytes, err := ioutil.ReadFile(crlFile)
 		if err != nil {
@@ -216,6 +385,7 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 		certList, err := x509.ParseCRL(crlBytes)
 		if err != nil {
 			log.Printf("Failed to parse CRL in '%s': %#v\n", crlFile, err)
+			continue
 		}
 
 		// find the X509v3 Authority Key Identifier in the extensions (2.5.29.35)
@@ -240,11 +410,11 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 		}
 
 		// Make sure we have a CA for this CRL or warn
-		caCert, ok := config.clientCasBySubjectKeyId[crlIssuerId]
+		caCert, ok := cas[crlIssuerId]
 
 		if !ok {
 			log.Printf("warn: CRL loaded for issuer '%s' but no such CA loaded: ignoring it\n", hex.EncodeToString([]byte(crlIssuerId)))
-			fmt.Printf("%#v loaded certs\n", len(config.clientCasBySubjectKeyId))
+			fmt.Printf("%#v loaded certs\n", len(cas))
 			continue
 		}
 
@@ -256,13 +426,13 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 		}
 
 		// At this point, we have a new CRL which we trust. Let's evict the old one.
-		config.CrlByAuthorityKeyId[crlIssuerId] = certList
+		crls[crlIssuerId] = certList
 		fmt.Printf("info: Loaded CRL for Authority ID '%s'\n", hex.EncodeToString([]byte(crlIssuerId)))
 	}
 
 	// Verify that all CAs loaded have a CRL
-	for k, _ := range config.clientCasBySubjectKeyId {
-		_, ok := config.CrlByAuthorityKeyId[k]
+	for k, _ := range cas {
+		_, ok := crls[k]
 		if !ok {
 			fmt.Printf("warn: no CRL loaded for Authority ID '%s'\n", hex.EncodeToString([]byte(k)))
 		}
@@ -270,8 +440,11 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 	return nil
 }
 
+// SetupStatsdWithNamespace sends metrics to the statsd server at addr,
+// prefixed with namespace, or discards them if addr is empty.
 func (config *Config) SetupStatsdWithNamespace(addr, namespace string) error {
 	if addr == "" {
+		config.MetricsClient = metrics.NoOpMetricsClient{}
 		config.StatsdClient = nil
 		return nil
 	}
@@ -281,10 +454,50 @@ func (config *Config) SetupStatsdWithNamespace(addr, namespace string) error {
 		return err
 	}
 
+	if namespace != "" && !strings.HasSuffix(namespace, ".") {
+		namespace += "."
+	}
+	client.Namespace = namespace
+	client.Tags = config.StatsdTags
+	config.MetricsClient = client
 	config.StatsdClient = client
 
-	config.StatsdClient.Namespace = namespace
+	return nil
+}
+
+// useStatsdClient reports metrics to StatsdClient, for programs written
+// before MetricsClient replaced it, unless another MetricsClient was set.
+func (config *Config) useStatsdClient() {
+	if config.StatsdClient == nil {
+		return
+	}
+	if config.MetricsClient == nil || config.MetricsClient == (metrics.NoOpMetricsClient{}) {
+		config.MetricsClient = config.StatsdClient
+	}
+}
 
+// statsdNamespace returns the prefix of the metrics sent to statsd, if they
+// are.
+func (config *Config) statsdNamespace() string {
+	if client, ok := config.MetricsClient.(*statsd.Client); ok {
+		return client.Namespace
+	}
+	return DefaultStatsdNamespace
+}
+
+// SetupStatsdTags adds tags, such as "datacenter:us-east-1" or
+// "cluster:blue", to every metric, so that dashboards can slice metrics
+// from many proxies by where they run.
+func (config *Config) SetupStatsdTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, "|,#\n") {
+			return fmt.Errorf("invalid statsd tag %q", tag)
+		}
+	}
+	config.StatsdTags = tags
+	if client, ok := config.MetricsClient.(*statsd.Client); ok {
+		client.Tags = tags
+	}
 	return nil
 }
 
@@ -292,6 +505,22 @@ func (config *Config) SetupStatsd(addr string) error {
 	return config.SetupStatsdWithNamespace(addr, DefaultStatsdNamespace)
 }
 
+// SetupAdminToken reads the admin API's bearer token from tokenFile.
+func (config *Config) SetupAdminToken(tokenFile string) error {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("admin token file %s is empty", tokenFile)
+	}
+	config.AdminToken = token
+
+	return nil
+}
+
 func (config *Config) SetupEgressAcl(aclFile string) error {
 	if aclFile == "" {
 		config.EgressACL = nil
@@ -300,7 +529,7 @@ func (config *Config) SetupEgressAcl(aclFile string) error {
 
 	log.Printf("Loading egress ACL from %s", aclFile)
 
-	egressACL, err := acl.New(config.Log, acl.NewYAMLLoader(aclFile), config.DisabledAclPolicyActions)
+	egressACL, err := acl.New(config.Log, config.egressAclLoader(aclFile), config.DisabledAclPolicyActions)
 	if err != nil {
 		log.Print(err)
 		return err
@@ -310,11 +539,35 @@ func (config *Config) SetupEgressAcl(aclFile string) error {
 	return nil
 }
 
-func addCertsFromFile(config *Config, pool *x509.CertPool, fileName string) error {
+// SetupEgressAclPublicKey requires egress ACL files loaded afterwards to be
+// signed by the PEM encoded public key in keyFile.
+func (config *Config) SetupEgressAclPublicKey(keyFile string) error {
+	if keyFile == "" {
+		config.EgressAclPublicKey = nil
+		return nil
+	}
+
+	key, err := acl.LoadPublicKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+	config.EgressAclPublicKey = key
+
+	return nil
+}
+
+func (config *Config) egressAclLoader(aclFile string) acl.Loader {
+	if config.EgressAclPublicKey != nil {
+		return acl.NewSignedLoader(acl.FileBundleFetcher{Path: aclFile}, config.EgressAclPublicKey)
+	}
+	return acl.NewYAMLLoader(aclFile)
+}
+
+func addCertsFromFile(cas map[string]*x509.Certificate, pool *x509.CertPool, fileName string) error {
 	data, err := ioutil.ReadFile(fileName)
 
 	//TODO this is a bit awkward
-	config.populateClientCaMap(data)
+	populateCaMap(cas, data)
 
 	if err != nil {
 		return err
@@ -343,23 +596,32 @@ func (config *Config) SetupTls(certFile, keyFile string, clientCAFiles []string)
 	if len(clientCAFiles) != 0 {
 		clientAuth = tls.VerifyClientCertIfGiven
 		for _, caFile := range clientCAFiles {
-			err = addCertsFromFile(config, clientCAs, caFile)
+			err = addCertsFromFile(config.clientCasBySubjectKeyId, clientCAs, caFile)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	config.clientCAFiles = clientCAFiles
+	config.clientCAPool = clientCAs
+	config.serverCertFile = certFile
+	config.serverKeyFile = keyFile
+	config.serverCert.Store(&serverCert)
+
 	config.TlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   clientAuth,
-		ClientCAs:    clientCAs,
+		Certificates:          []tls.Certificate{serverCert},
+		ClientAuth:            clientAuth,
+		ClientCAs:             clientCAs,
+		GetConfigForClient:    config.tlsConfigForClient,
+		VerifyPeerCertificate: config.verifyClientRevocation,
 	}
+	config.storeClientTrust()
 
 	return nil
 }
 
-func (config *Config) populateClientCaMap(pemCerts []byte) (ok bool) {
+func populateCaMap(cas map[string]*x509.Certificate, pemCerts []byte) (ok bool) {
 
 	for len(pemCerts) > 0 {
 		var block *pem.Block
@@ -376,7 +638,7 @@ func (config *Config) populateClientCaMap(pemCerts []byte) (ok bool) {
 			continue
 		}
 		fmt.Printf("info: Loaded CA with Authority ID '%s'\n", hex.EncodeToString(cert.SubjectKeyId))
-		config.clientCasBySubjectKeyId[string(cert.SubjectKeyId)] = cert
+		cas[string(cert.SubjectKeyId)] = cert
 		ok = true
 	}
 	return
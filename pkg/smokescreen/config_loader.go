@@ -2,11 +2,17 @@ package smokescreen
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/DataDog/datadog-go/statsd"
+	log "github.com/sirupsen/logrus"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
 	"gopkg.in/yaml.v2"
 )
 
@@ -15,6 +21,372 @@ type yamlConfigTls struct {
 	KeyFile       string   `yaml:"key_file"`
 	ClientCAFiles []string `yaml:"client_ca_files"`
 	CRLFiles      []string `yaml:"crl_files"`
+	MinVersion    string   `yaml:"min_version"`
+	MaxVersion    string   `yaml:"max_version"`
+	CipherSuites  []string `yaml:"cipher_suites"`
+	HTTP2         bool     `yaml:"http2"`
+
+	ClientCAReloadInterval time.Duration `yaml:"client_ca_reload_interval"`
+	CertReloadInterval     time.Duration `yaml:"cert_reload_interval"`
+}
+
+type yamlConfigAccessLog struct {
+	File       string
+	MaxSizeMB  int64 `yaml:"max_size_mb"`
+	MaxBackups int   `yaml:"max_backups"`
+	Compress   bool
+}
+
+type yamlConfigRequestLog struct {
+	yamlConfigAccessLog `yaml:",inline"`
+	Format              string // common or w3c
+}
+
+type yamlConfigAuditReplication struct {
+	URL           string
+	KafkaTopic    string        `yaml:"kafka_topic"`
+	SpoolFile     string        `yaml:"spool_file"`
+	MaxSpoolMB    int64         `yaml:"max_spool_mb"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type yamlConfigDenyWebhook struct {
+	URL           string
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	MaxRetries    int           `yaml:"max_retries"`
+}
+
+type yamlConfigDNSCache struct {
+	MaxEntries     int           `yaml:"max_entries"`
+	MaxTTL         time.Duration `yaml:"max_ttl"`
+	MaxNegativeTTL time.Duration `yaml:"max_negative_ttl"`
+}
+
+type yamlConfigPortExhaustion struct {
+	Threshold float64
+	Mode      string
+}
+
+type yamlConfigAdaptiveConcurrency struct {
+	MinLimit         int           `yaml:"min_limit"`
+	MaxLimit         int           `yaml:"max_limit"`
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+	Backoff          float64
+}
+
+type yamlConfigCircuitBreaker struct {
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+}
+
+type yamlConfigZoneRoute struct {
+	Zone          string
+	Domains       []string
+	Ranges        []string
+	Direct        bool
+	UpstreamProxy string `yaml:"upstream_proxy"`
+	SourceIP      string `yaml:"source_ip"`
+}
+
+func (y *yamlConfigZoneRoute) route() (ZoneRoute, error) {
+	r := ZoneRoute{Zone: y.Zone, Domains: y.Domains, Direct: y.Direct}
+	var err error
+	if r.Ranges, err = parseRanges(y.Ranges); err != nil {
+		return ZoneRoute{}, fmt.Errorf("zone %s: invalid range: %v", y.Zone, err)
+	}
+	if y.UpstreamProxy != "" {
+		if r.UpstreamProxy, err = acl.ParseUpstreamProxy(y.UpstreamProxy); err != nil {
+			return ZoneRoute{}, fmt.Errorf("zone %s: %v", y.Zone, err)
+		}
+	}
+	if y.SourceIP != "" {
+		if r.SourceIP = net.ParseIP(y.SourceIP); r.SourceIP == nil {
+			return ZoneRoute{}, fmt.Errorf("zone %s: invalid source_ip %q", y.Zone, y.SourceIP)
+		}
+	}
+	return r, nil
+}
+
+type yamlConfigMitm struct {
+	CACertFile string `yaml:"ca_cert_file"`
+	CAKeyFile  string `yaml:"ca_key_file"`
+}
+
+type yamlConfigJWTRole struct {
+	Header          string
+	JWKSURL         string `yaml:"jwks_url"`
+	Issuer          string
+	Audience        string
+	RoleClaim       string        `yaml:"role_claim"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+type yamlConfigK8sTokenRole struct {
+	Header    string
+	APIServer string        `yaml:"api_server"`
+	Audiences []string      `yaml:"audiences"`
+	CacheTTL  time.Duration `yaml:"cache_ttl"`
+	TokenFile string        `yaml:"token_file"`
+	CAFile    string        `yaml:"ca_file"`
+}
+
+type yamlConfigSPIFFERole struct {
+	TrustDomains []string `yaml:"trust_domains"`
+	Template     string
+}
+
+type yamlConfigHeaderRole struct {
+	Header        string
+	Strict        bool
+	TrustedRanges []string `yaml:"trusted_ranges"`
+}
+
+type roleFromRequestFunc = func(req *http.Request) (string, error)
+
+func (y *yamlConfigJWTRole) roleFromRequest() (roleFromRequestFunc, error) {
+	resolver, err := NewJWTRoleResolver(JWTRoleConfig{
+		Header:          y.Header,
+		JWKSURL:         y.JWKSURL,
+		Issuer:          y.Issuer,
+		Audience:        y.Audience,
+		RoleClaim:       y.RoleClaim,
+		RefreshInterval: y.RefreshInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolver.RoleFromRequest, nil
+}
+
+func (y *yamlConfigHeaderRole) roleFromRequest() (roleFromRequestFunc, error) {
+	resolver, err := NewHeaderRoleResolver(HeaderRoleConfig{
+		Header:        y.Header,
+		Strict:        y.Strict,
+		TrustedRanges: y.TrustedRanges,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolver.RoleFromRequest, nil
+}
+
+func (y *yamlConfigSPIFFERole) roleFromRequest() (roleFromRequestFunc, error) {
+	resolver, err := NewSPIFFERoleResolver(SPIFFERoleConfig{
+		TrustDomains: y.TrustDomains,
+		Template:     y.Template,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolver.RoleFromRequest, nil
+}
+
+func (y *yamlConfigK8sTokenRole) roleFromRequest() (roleFromRequestFunc, error) {
+	resolver, err := NewK8sTokenRoleResolver(K8sTokenRoleConfig{
+		Header:    y.Header,
+		APIServer: y.APIServer,
+		Audiences: y.Audiences,
+		CacheTTL:  y.CacheTTL,
+		TokenFile: y.TokenFile,
+		CAFile:    y.CAFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolver.RoleFromRequest, nil
+}
+
+// yamlConfigRoleSource is one entry of role_chain, which sets exactly one of
+// its fields.
+type yamlConfigRoleSource struct {
+	ClientCert   bool                    `yaml:"client_cert"`
+	JWTRole      *yamlConfigJWTRole      `yaml:"jwt_role"`
+	HeaderRole   *yamlConfigHeaderRole   `yaml:"header_role"`
+	SPIFFERole   *yamlConfigSPIFFERole   `yaml:"spiffe_role"`
+	K8sTokenRole *yamlConfigK8sTokenRole `yaml:"k8s_token_role"`
+	StaticRole   string                  `yaml:"static_role"`
+}
+
+func (y *yamlConfigRoleSource) source() (RoleSource, error) {
+	set := 0
+	for _, isSet := range []bool{y.ClientCert, y.JWTRole != nil, y.HeaderRole != nil, y.SPIFFERole != nil, y.K8sTokenRole != nil, y.StaticRole != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return RoleSource{}, errors.New("each entry must set exactly one of client_cert, jwt_role, header_role, spiffe_role, k8s_token_role or static_role")
+	}
+
+	var s RoleSource
+	var err error
+	switch {
+	case y.ClientCert:
+		s = RoleSource{Name: "client_cert", RoleFromRequest: RoleFromClientCert}
+	case y.JWTRole != nil:
+		s.Name = "jwt"
+		s.RoleFromRequest, err = y.JWTRole.roleFromRequest()
+	case y.HeaderRole != nil:
+		s.Name = "header"
+		s.RoleFromRequest, err = y.HeaderRole.roleFromRequest()
+	case y.SPIFFERole != nil:
+		s.Name = "spiffe"
+		s.RoleFromRequest, err = y.SPIFFERole.roleFromRequest()
+	case y.K8sTokenRole != nil:
+		s.Name = "k8s_token"
+		s.RoleFromRequest, err = y.K8sTokenRole.roleFromRequest()
+	default:
+		s = RoleSource{Name: "static", RoleFromRequest: StaticRole(y.StaticRole)}
+	}
+	if err != nil {
+		return RoleSource{}, fmt.Errorf("%s: %v", s.Name, err)
+	}
+	return s, nil
+}
+
+// yamlConfigRoles are the settings determining roles, which may be given in
+// the configuration file or in a role config file of their own.
+type yamlConfigRoles struct {
+	// Configures RoleFromRequest to authenticate clients with a JWT
+	JWTRole *yamlConfigJWTRole `yaml:"jwt_role"`
+
+	// Configures RoleFromRequest to take the role from a request header
+	HeaderRole *yamlConfigHeaderRole `yaml:"header_role"`
+
+	// Configures RoleFromRequest to take the role from the SPIFFE ID of the
+	// client's certificate
+	SPIFFERole *yamlConfigSPIFFERole `yaml:"spiffe_role"`
+
+	// Configures RoleFromRequest to take the role from a Kubernetes service
+	// account token
+	K8sTokenRole *yamlConfigK8sTokenRole `yaml:"k8s_token_role"`
+
+	// Configures RoleChain to try several of the above, and more, in turn
+	RoleChain []yamlConfigRoleSource `yaml:"role_chain"`
+}
+
+func (y *yamlConfigRoles) isSet() bool {
+	return y.JWTRole != nil || y.HeaderRole != nil || y.SPIFFERole != nil || y.K8sTokenRole != nil || len(y.RoleChain) > 0
+}
+
+// headers returns the headers other than the defaults that y reads roles or
+// credentials from, for Config.RoleHeaders.
+func (y *yamlConfigRoles) headers() []string {
+	sources := append([]yamlConfigRoleSource{{JWTRole: y.JWTRole, HeaderRole: y.HeaderRole, K8sTokenRole: y.K8sTokenRole}}, y.RoleChain...)
+	var headers []string
+	for _, s := range sources {
+		if s.JWTRole != nil && s.JWTRole.Header != "" {
+			headers = append(headers, s.JWTRole.Header)
+		}
+		if s.HeaderRole != nil && s.HeaderRole.Header != "" {
+			headers = append(headers, s.HeaderRole.Header)
+		}
+		if s.K8sTokenRole != nil && s.K8sTokenRole.Header != "" {
+			headers = append(headers, s.K8sTokenRole.Header)
+		}
+	}
+	return headers
+}
+
+// roleResolver returns the RoleFromRequest or the RoleChain y configures, or
+// neither if it sets nothing.
+func (y *yamlConfigRoles) roleResolver() (roleFromRequestFunc, *RoleChain, error) {
+	var roleFromRequest roleFromRequestFunc
+
+	if y.JWTRole != nil {
+		f, err := y.JWTRole.roleFromRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+		roleFromRequest = f
+	}
+
+	if y.HeaderRole != nil {
+		if y.JWTRole != nil {
+			return nil, nil, errors.New("jwt_role and header_role can't both be set")
+		}
+		f, err := y.HeaderRole.roleFromRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+		roleFromRequest = f
+	}
+
+	if y.SPIFFERole != nil {
+		if y.JWTRole != nil || y.HeaderRole != nil {
+			return nil, nil, errors.New("spiffe_role can't be set along with jwt_role or header_role")
+		}
+		f, err := y.SPIFFERole.roleFromRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+		roleFromRequest = f
+	}
+
+	if y.K8sTokenRole != nil {
+		if y.JWTRole != nil || y.HeaderRole != nil || y.SPIFFERole != nil {
+			return nil, nil, errors.New("k8s_token_role can't be set along with jwt_role, header_role or spiffe_role")
+		}
+		f, err := y.K8sTokenRole.roleFromRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+		roleFromRequest = f
+	}
+
+	if len(y.RoleChain) > 0 {
+		if y.JWTRole != nil || y.HeaderRole != nil || y.SPIFFERole != nil || y.K8sTokenRole != nil {
+			return nil, nil, errors.New("role_chain can't be set along with jwt_role, header_role, spiffe_role or k8s_token_role")
+		}
+		chain := &RoleChain{}
+		for i, entry := range y.RoleChain {
+			source, err := entry.source()
+			if err != nil {
+				return nil, nil, fmt.Errorf("role_chain entry %d: %v", i, err)
+			}
+			chain.Sources = append(chain.Sources, source)
+		}
+		return nil, chain, nil
+	}
+
+	return roleFromRequest, nil, nil
+}
+
+type yamlConfigTenant struct {
+	Name            string
+	Ip              string
+	Port            uint16
+	EgressAclFile   string `yaml:"acl_file"`
+	StatsdNamespace string `yaml:"statsd_namespace"`
+	LogFile         string `yaml:"log_file"`
+}
+
+// yamlRange is an entry of deny_ranges or allow_ranges: either a CIDR range,
+// or a mapping giving the range a label and a reason.
+type yamlRange struct {
+	Range  string `yaml:"range"`
+	Label  string `yaml:"label"`
+	Reason string `yaml:"reason"`
+}
+
+func (r *yamlRange) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&r.Range); err == nil {
+		return nil
+	}
+	type plain yamlRange
+	return unmarshal((*plain)(r))
+}
+
+func (r yamlRange) ruleRange() (RuleRange, error) {
+	ranges, err := parseRanges([]string{r.Range})
+	if err != nil {
+		return RuleRange{}, err
+	}
+	ranges[0].Label = r.Label
+	ranges[0].Reason = r.Reason
+	return ranges[0], nil
 }
 
 // Port and ExitTimeout use a pointer so we can distinguish unset vs explicit
@@ -22,23 +394,118 @@ type yamlConfigTls struct {
 type yamlConfig struct {
 	Ip                   string
 	Port                 *uint16
-	DenyRanges           []string       `yaml:"deny_ranges"`
-	AllowRanges          []string       `yaml:"allow_ranges"`
+	DenyRanges           []yamlRange    `yaml:"deny_ranges"`
+	AllowRanges          []yamlRange    `yaml:"allow_ranges"`
+	DenyRangeFiles       []string       `yaml:"deny_range_files"`
+	AllowRangeFiles      []string       `yaml:"allow_range_files"`
+	RangeFileMaxEntries  *int           `yaml:"range_file_max_entries"`
 	Resolvers            []string       `yaml:"resolver_addresses"`
 	ConnectTimeout       time.Duration  `yaml:"connect_timeout"`
 	ExitTimeout          *time.Duration `yaml:"exit_timeout"`
+	TransientRetryAfter  *time.Duration `yaml:"transient_retry_after"`
 	StatsdAddress        string         `yaml:"statsd_address"`
 	EgressAclFile        string         `yaml:"acl_file"`
+	EgressAclPublicKey   string         `yaml:"acl_public_key_file"`
+	EgressAclURL         string         `yaml:"acl_url"`
+	EgressAclPoll        *time.Duration `yaml:"acl_poll_interval"`
+	EgressAclCacheFile   string         `yaml:"acl_cache_file"`
+	RoleAliasFile        string         `yaml:"role_alias_file"`
+	RoleAliasReload      *time.Duration `yaml:"role_alias_reload_interval"`
+	RoleConfigFile       string         `yaml:"role_config_file"`
+	RoleConfigReload     *time.Duration `yaml:"role_config_reload_interval"`
 	SupportProxyProtocol bool           `yaml:"support_proxy_protocol"`
 	DenyMessageExtra     string         `yaml:"deny_message_extra"`
+	DenyLogInterval      time.Duration  `yaml:"deny_log_interval"`
+	IdentifyResponses    bool           `yaml:"identify_responses"`
+	InstanceID           string         `yaml:"instance_id"`
 	AllowMissingRole     bool           `yaml:"allow_missing_role"`
+	HealthEndpoints      bool           `yaml:"health_endpoints"`
+
+	// Override connect_timeout for CONNECT requests, plain HTTP requests
+	// and requests sent through upstream proxies
+	TunnelConnectTimeout   time.Duration `yaml:"tunnel_connect_timeout"`
+	HTTPConnectTimeout     time.Duration `yaml:"http_connect_timeout"`
+	UpstreamConnectTimeout time.Duration `yaml:"upstream_connect_timeout"`
+
+	// Prefix and tags of every metric, e.g. "datacenter:us-east-1"
+	StatsdNamespace       *string  `yaml:"statsd_namespace"`
+	StatsdTags            []string `yaml:"statsd_tags"`
+	StatsdDestinationTags bool     `yaml:"statsd_destination_tags"`
+
+	DialOnlyAllowedAddresses bool   `yaml:"dial_only_allowed_addresses"`
+	DialGuardMode            string `yaml:"dial_guard_mode"`
+	ResolverFailureMode      string `yaml:"resolver_failure_mode"`
+	AddressSelection         string `yaml:"address_selection"`
+	ResolverClientSubnet     string `yaml:"resolver_client_subnet"`
+	AllowCloudMetadataAccess bool   `yaml:"danger_allow_access_to_cloud_metadata"`
+	DNSAnomalyDetection      bool   `yaml:"dns_anomaly_detection"`
+	IgnoreProxyEnvironment   bool   `yaml:"ignore_proxy_environment"`
+	VerifySNI                bool   `yaml:"verify_sni"`
+
+	ConnectPorts []string `yaml:"connect_ports"`
+
+	CanonicalLogKeys map[string]string `yaml:"canonical_log_keys"`
+
+	UpstreamProxy         string   `yaml:"upstream_proxy"`
+	UpstreamProxyBypass   []string `yaml:"upstream_proxy_bypass"`
+	UpstreamProxyIdentity string   `yaml:"upstream_proxy_identity"`
+
+	// Routes destinations by the zone they are in, in place of the above
+	ZoneRoutes []yamlConfigZoneRoute `yaml:"zone_routes"`
 
 	StatsSocketDir      string `yaml:"stats_socket_dir"`
 	StatsSocketFileMode string `yaml:"stats_socket_file_mode"`
+	StatsOpenMetrics    bool   `yaml:"stats_openmetrics"`
+
+	IdleThreshold       *time.Duration `yaml:"idle_threshold"`
+	ReapIdleConnections bool           `yaml:"reap_idle_connections"`
+	ReadIdleThreshold   time.Duration  `yaml:"read_idle_threshold"`
+	WriteIdleThreshold  time.Duration  `yaml:"write_idle_threshold"`
+	MaxConnsPerHost     int            `yaml:"max_conns_per_host"`
+	MaxConns            int            `yaml:"max_conns"`
+	MaxConnLifetime     time.Duration  `yaml:"max_conn_lifetime"`
+	BytesReportInterval time.Duration  `yaml:"bytes_report_interval"`
+	MaxConnTransferMb   int64          `yaml:"max_conn_transfer_mb"`
+	MaxConnBandwidthKb  int64          `yaml:"max_conn_bandwidth_kb"`
+
+	ListenBacklog            int           `yaml:"listen_backlog"`
+	ListenQueueStatsInterval time.Duration `yaml:"listen_queue_stats_interval"`
+
+	MaxHeaderBytes int   `yaml:"max_header_bytes"`
+	MemoryBudgetMB int64 `yaml:"memory_budget_mb"`
+
+	AdminAddress   string `yaml:"admin_address"`
+	AdminTokenFile string `yaml:"admin_token_file"`
+	AdminDebug     bool   `yaml:"admin_debug"`
+
+	DecisionHistorySize int `yaml:"decision_history_size"`
+
+	ExtAuthzAddress string `yaml:"ext_authz_address"`
+
+	OPAURL         string        `yaml:"opa_url"`
+	PolicyTimeout  time.Duration `yaml:"policy_timeout"`
+	PolicyCacheTTL time.Duration `yaml:"policy_cache_ttl"`
 
 	Tls *yamlConfigTls
 
-	// Currently not configurable via YAML: RoleFromRequest, Log, DisabledAclPolicyActions
+	AccessLog        *yamlConfigAccessLog        `yaml:"access_log"`
+	RequestLog       *yamlConfigRequestLog       `yaml:"request_log"`
+	AuditReplication *yamlConfigAuditReplication `yaml:"audit_replication"`
+	DenyWebhook      *yamlConfigDenyWebhook      `yaml:"deny_webhook"`
+	DNSCache         *yamlConfigDNSCache         `yaml:"dns_cache"`
+	PortExhaustion   *yamlConfigPortExhaustion   `yaml:"port_exhaustion"`
+
+	AdaptiveConcurrency *yamlConfigAdaptiveConcurrency `yaml:"adaptive_concurrency"`
+	CircuitBreaker      *yamlConfigCircuitBreaker      `yaml:"circuit_breaker"`
+
+	// Configures TLS inspection for roles with a "mitm" ACL rule
+	Mitm *yamlConfigMitm
+
+	Tenants []yamlConfigTenant
+
+	yamlConfigRoles `yaml:",inline"`
+
+	// Currently not configurable via YAML: Log, DisabledAclPolicyActions
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -56,14 +523,34 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		c.Port = *yc.Port
 	}
 
-	err = c.SetDenyRanges(yc.DenyRanges)
-	if err != nil {
-		return err
+	for _, r := range yc.DenyRanges {
+		rng, err := r.ruleRange()
+		if err != nil {
+			return err
+		}
+		c.DenyRanges = append(c.DenyRanges, rng)
 	}
 
-	err = c.SetAllowRanges(yc.AllowRanges)
-	if err != nil {
-		return err
+	for _, r := range yc.AllowRanges {
+		rng, err := r.ruleRange()
+		if err != nil {
+			return err
+		}
+		c.AllowRanges = append(c.AllowRanges, rng)
+	}
+
+	if yc.RangeFileMaxEntries != nil {
+		c.RangeFileMaxEntries = *yc.RangeFileMaxEntries
+	}
+	if len(yc.DenyRangeFiles) > 0 {
+		if err := c.SetupDenyRangeFiles(yc.DenyRangeFiles); err != nil {
+			return err
+		}
+	}
+	if len(yc.AllowRangeFiles) > 0 {
+		if err := c.SetupAllowRangeFiles(yc.AllowRangeFiles); err != nil {
+			return err
+		}
 	}
 
 	err = c.SetResolverAddresses(yc.Resolvers)
@@ -71,12 +558,50 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if err := c.SetupAddressSelection(yc.AddressSelection, yc.ResolverClientSubnet); err != nil {
+		return err
+	}
+
+	if yc.DNSCache != nil {
+		cache := NewDNSCache()
+		if yc.DNSCache.MaxEntries > 0 {
+			cache.MaxEntries = yc.DNSCache.MaxEntries
+		}
+		if yc.DNSCache.MaxTTL > 0 {
+			cache.MaxTTL = yc.DNSCache.MaxTTL
+		}
+		if yc.DNSCache.MaxNegativeTTL > 0 {
+			cache.MaxNegativeTTL = yc.DNSCache.MaxNegativeTTL
+		}
+		c.SetupDNSCache(cache)
+	}
+
 	c.ConnectTimeout = yc.ConnectTimeout
+	c.TunnelConnectTimeout = yc.TunnelConnectTimeout
+	c.HTTPConnectTimeout = yc.HTTPConnectTimeout
+	c.UpstreamConnectTimeout = yc.UpstreamConnectTimeout
 	if yc.ExitTimeout != nil {
 		c.ExitTimeout = *yc.ExitTimeout
 	}
+	if yc.TransientRetryAfter != nil {
+		c.TransientRetryAfter = *yc.TransientRetryAfter
+	}
+
+	err = c.SetupStatsdTags(yc.StatsdTags)
+	if err != nil {
+		return err
+	}
+	namespace := DefaultStatsdNamespace
+	if yc.StatsdNamespace != nil {
+		namespace = *yc.StatsdNamespace
+	}
+	err = c.SetupStatsdWithNamespace(yc.StatsdAddress, namespace)
+	if err != nil {
+		return err
+	}
+	c.StatsdDestinationTags = yc.StatsdDestinationTags
 
-	err = c.SetupStatsd(yc.StatsdAddress)
+	err = c.SetupEgressAclPublicKey(yc.EgressAclPublicKey)
 	if err != nil {
 		return err
 	}
@@ -88,12 +613,142 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 	}
 
+	if yc.EgressAclURL != "" {
+		interval := DefaultEgressAclPollInterval
+		if yc.EgressAclPoll != nil {
+			interval = *yc.EgressAclPoll
+		}
+		c.EgressAclCacheFile = yc.EgressAclCacheFile
+		err = c.SetupEgressAclURL(yc.EgressAclURL, interval)
+		if err != nil {
+			return err
+		}
+	}
+
+	if yc.RoleAliasFile != "" {
+		interval := DefaultRoleAliasReloadInterval
+		if yc.RoleAliasReload != nil {
+			interval = *yc.RoleAliasReload
+		}
+		err = c.SetupRoleAliases(yc.RoleAliasFile, interval)
+		if err != nil {
+			return err
+		}
+	}
+
 	c.SupportProxyProtocol = yc.SupportProxyProtocol
+	c.DialOnlyAllowedAddresses = yc.DialOnlyAllowedAddresses
+	c.DialGuardMode, err = DialGuardModeFromString(yc.DialGuardMode)
+	if err != nil {
+		return err
+	}
+	c.ResolverFailureMode, err = ResolverFailureModeFromString(yc.ResolverFailureMode)
+	if err != nil {
+		return err
+	}
+	c.AllowCloudMetadataAccess = yc.AllowCloudMetadataAccess
+	c.IgnoreProxyEnvironment = yc.IgnoreProxyEnvironment
+	c.VerifySNI = yc.VerifySNI
+	if err := c.SetupConnectPorts(yc.ConnectPorts); err != nil {
+		return err
+	}
+	if err := c.SetupUpstreamProxy(yc.UpstreamProxy); err != nil {
+		return err
+	}
+	if err := c.SetupUpstreamProxyBypass(yc.UpstreamProxyBypass); err != nil {
+		return err
+	}
+	c.UpstreamProxyIdentity, err = UpstreamIdentityFromString(yc.UpstreamProxyIdentity)
+	if err != nil {
+		return err
+	}
+	if len(yc.ZoneRoutes) > 0 {
+		routes := make([]ZoneRoute, len(yc.ZoneRoutes))
+		for i := range yc.ZoneRoutes {
+			if routes[i], err = yc.ZoneRoutes[i].route(); err != nil {
+				return err
+			}
+		}
+		if err := c.SetupZoneRoutes(routes); err != nil {
+			return err
+		}
+	}
+	if yc.DNSAnomalyDetection {
+		c.DNSAnomalyDetector = NewDNSAnomalyDetector()
+	}
 
 	if yc.StatsSocketDir != "" {
 		c.StatsSocketDir = yc.StatsSocketDir
 	}
 
+	if yc.IdleThreshold != nil {
+		c.IdleThreshold = *yc.IdleThreshold
+	}
+	c.ReapIdleConnections = yc.ReapIdleConnections
+	c.ReadIdleThreshold = yc.ReadIdleThreshold
+	c.WriteIdleThreshold = yc.WriteIdleThreshold
+	c.MaxConnsPerHost = yc.MaxConnsPerHost
+	c.MaxConns = yc.MaxConns
+	if yc.PortExhaustion != nil {
+		if err := c.SetupPortExhaustionProtection(yc.PortExhaustion.Threshold, yc.PortExhaustion.Mode); err != nil {
+			return err
+		}
+	}
+	if yc.AdaptiveConcurrency != nil {
+		if err := c.SetupAdaptiveConcurrency(AdaptiveConcurrencyConfig{
+			MinLimit:         yc.AdaptiveConcurrency.MinLimit,
+			MaxLimit:         yc.AdaptiveConcurrency.MaxLimit,
+			LatencyThreshold: yc.AdaptiveConcurrency.LatencyThreshold,
+			Backoff:          yc.AdaptiveConcurrency.Backoff,
+		}); err != nil {
+			return err
+		}
+	}
+	if yc.CircuitBreaker != nil {
+		if err := c.SetupCircuitBreaker(CircuitBreakerConfig{
+			FailureThreshold: yc.CircuitBreaker.FailureThreshold,
+			OpenDuration:     yc.CircuitBreaker.OpenDuration,
+		}); err != nil {
+			return err
+		}
+	}
+	c.MaxConnLifetime = yc.MaxConnLifetime
+	c.BytesReportInterval = yc.BytesReportInterval
+	c.MaxConnBytes = yc.MaxConnTransferMb << 20
+	c.MaxConnBandwidth = yc.MaxConnBandwidthKb << 10
+
+	c.ListenBacklog = yc.ListenBacklog
+	c.ListenQueueStatsInterval = yc.ListenQueueStatsInterval
+	c.MaxHeaderBytes = yc.MaxHeaderBytes
+	c.MemoryBudget = yc.MemoryBudgetMB << 20
+
+	c.AdminAddr = yc.AdminAddress
+	c.AdminDebug = yc.AdminDebug
+	if yc.DecisionHistorySize > 0 {
+		if err := c.SetupDecisionHistory(yc.DecisionHistorySize); err != nil {
+			return err
+		}
+	}
+	c.ExtAuthzAddr = yc.ExtAuthzAddress
+	if yc.OPAURL != "" {
+		c.PolicyEngine = &OPAPolicyEngine{URL: yc.OPAURL}
+	}
+	c.PolicyTimeout = yc.PolicyTimeout
+	if yc.PolicyCacheTTL > 0 {
+		if err := c.SetupPolicyCache(&PolicyCache{TTL: yc.PolicyCacheTTL}); err != nil {
+			return err
+		}
+	}
+	if yc.AdminTokenFile != "" {
+		if err := c.SetupAdminToken(yc.AdminTokenFile); err != nil {
+			return err
+		}
+	}
+
+	if yc.StatsOpenMetrics {
+		c.OpenMetrics = NewOpenMetrics()
+	}
+
 	if yc.StatsSocketFileMode != "" {
 		filemode, err := strconv.ParseInt(yc.StatsSocketFileMode, 8, 9)
 
@@ -121,14 +776,181 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 
 		c.SetupCrls(yc.Tls.CRLFiles)
+		if err := c.SetupTlsVersions(yc.Tls.MinVersion, yc.Tls.MaxVersion, yc.Tls.CipherSuites); err != nil {
+			return err
+		}
+		if yc.Tls.HTTP2 {
+			if err := c.SetupHTTP2(); err != nil {
+				return err
+			}
+		}
+		c.TlsClientCAReloadInterval = yc.Tls.ClientCAReloadInterval
+		c.TlsServerCertReloadInterval = yc.Tls.CertReloadInterval
+	}
+
+	if yc.AccessLog != nil {
+		if yc.AccessLog.File == "" {
+			return errors.New("'access_log' section requires 'file'")
+		}
+		err = c.SetupAccessLog(yc.AccessLog.File, yc.AccessLog.MaxSizeMB<<20, yc.AccessLog.MaxBackups, yc.AccessLog.Compress)
+		if err != nil {
+			return err
+		}
+	}
+
+	if yc.RequestLog != nil {
+		if yc.RequestLog.File == "" {
+			return errors.New("'request_log' section requires 'file'")
+		}
+		err = c.SetupRequestLog(yc.RequestLog.File, yc.RequestLog.Format, yc.RequestLog.MaxSizeMB<<20, yc.RequestLog.MaxBackups, yc.RequestLog.Compress)
+		if err != nil {
+			return err
+		}
+	}
+
+	if yc.AuditReplication != nil {
+		if yc.AuditReplication.URL == "" {
+			return errors.New("'audit_replication' section requires 'url'")
+		}
+		var sink AuditSink = &HTTPAuditSink{URL: yc.AuditReplication.URL}
+		if yc.AuditReplication.KafkaTopic != "" {
+			sink = &KafkaRESTAuditSink{URL: yc.AuditReplication.URL, Topic: yc.AuditReplication.KafkaTopic}
+		}
+		err = c.SetupAuditReplication(&AuditReplicator{
+			Sink:          sink,
+			SpoolFile:     yc.AuditReplication.SpoolFile,
+			MaxSpoolBytes: yc.AuditReplication.MaxSpoolMB << 20,
+			BatchSize:     yc.AuditReplication.BatchSize,
+			FlushInterval: yc.AuditReplication.FlushInterval,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if yc.DenyWebhook != nil {
+		err = c.SetupDenyNotifier(&DenyNotifier{
+			URL:           yc.DenyWebhook.URL,
+			BatchSize:     yc.DenyWebhook.BatchSize,
+			FlushInterval: yc.DenyWebhook.FlushInterval,
+			MaxRetries:    yc.DenyWebhook.MaxRetries,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if yc.Mitm != nil {
+		if yc.Mitm.CACertFile == "" {
+			return errors.New("'mitm' section requires 'ca_cert_file'")
+		}
+		if err := c.SetupMitmCa(yc.Mitm.CACertFile, yc.Mitm.CAKeyFile); err != nil {
+			return err
+		}
+	}
+
+	if yc.RoleConfigFile != "" {
+		if yc.yamlConfigRoles.isSet() {
+			return errors.New("role_config_file can't be set along with jwt_role, header_role, spiffe_role, k8s_token_role or role_chain")
+		}
+		interval := DefaultRoleConfigReloadInterval
+		if yc.RoleConfigReload != nil {
+			interval = *yc.RoleConfigReload
+		}
+		if err := c.SetupRoleConfigFile(yc.RoleConfigFile, interval); err != nil {
+			return err
+		}
+	} else {
+		f, chain, err := yc.yamlConfigRoles.roleResolver()
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			c.RoleFromRequest = f
+		}
+		c.RoleChain = chain
+		c.RoleHeaders = yc.yamlConfigRoles.headers()
 	}
 
 	c.AllowMissingRole = yc.AllowMissingRole
 	c.AdditionalErrorMessageOnDeny = yc.DenyMessageExtra
+	c.DenyLogInterval = yc.DenyLogInterval
+	c.HealthEndpoints = yc.HealthEndpoints
+
+	if yc.IdentifyResponses {
+		if err := c.SetupResponseIdentity(yc.InstanceID); err != nil {
+			return err
+		}
+	}
+	if err := c.SetupCanonicalLogKeys(yc.CanonicalLogKeys); err != nil {
+		return err
+	}
+
+	for _, yt := range yc.Tenants {
+		t, err := c.loadTenant(yt, yc.StatsdAddress)
+		if err != nil {
+			return err
+		}
+		c.Tenants = append(c.Tenants, t)
+	}
 
 	return nil
 }
 
+func (c *Config) loadTenant(yt yamlConfigTenant, statsdAddr string) (*Tenant, error) {
+	if yt.Name == "" {
+		return nil, errors.New("'tenants' entries require a 'name'")
+	}
+	if yt.Port == 0 {
+		return nil, fmt.Errorf("tenant '%s' requires a 'port'", yt.Name)
+	}
+
+	t := &Tenant{
+		Name: yt.Name,
+		Ip:   yt.Ip,
+		Port: yt.Port,
+	}
+
+	if yt.LogFile != "" {
+		f, err := os.OpenFile(yt.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		t.Log = log.New()
+		t.Log.Out = f
+	}
+
+	logger := c.Log
+	if t.Log != nil {
+		logger = t.Log
+	}
+
+	if yt.EgressAclFile != "" {
+		egressACL, err := acl.New(logger, c.egressAclLoader(yt.EgressAclFile), c.DisabledAclPolicyActions)
+		if err != nil {
+			return nil, err
+		}
+		t.EgressACL = egressACL
+	}
+
+	if statsdAddr != "" {
+		namespace := yt.StatsdNamespace
+		if namespace == "" {
+			namespace = fmt.Sprintf("%s%s.", c.statsdNamespace(), yt.Name)
+		}
+
+		client, err := statsd.New(statsdAddr)
+		if err != nil {
+			return nil, err
+		}
+		client.Namespace = namespace
+		client.Tags = c.StatsdTags
+		t.MetricsClient = client
+	}
+
+	return t, nil
+}
+
 func LoadConfig(filePath string) (*Config, error) {
 	bytes, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -139,6 +961,7 @@ func LoadConfig(filePath string) (*Config, error) {
 	if err := yaml.UnmarshalStrict(bytes, config); err != nil {
 		return nil, err
 	}
+	config.ConfigHash = shortHash(bytes)
 
 	return config, nil
 }
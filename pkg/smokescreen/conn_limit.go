@@ -0,0 +1,70 @@
+package smokescreen
+
+import (
+	"fmt"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+const limitHeader = "X-Smokescreen-Limit"
+
+// The limits a connLimitError can be for, as named to clients in the
+// X-Smokescreen-Limit header of the response rejecting their request.
+const (
+	limitHost          = "host"
+	limitGlobal        = "global"
+	limitEphemeralPort = "ephemeral_ports"
+	limitConcurrency   = "adaptive_concurrency"
+)
+
+// connLimitError is returned when a connection can't be made without going
+// over one of the limits on connections, such as the connection tracker's
+// MaxConnsPerHost.
+type connLimitError struct {
+	error
+	limit string // The limit reached: limitHost, limitGlobal, limitEphemeralPort or limitConcurrency
+}
+
+// destinationHostKey is the key connections to outboundHost are counted
+// under: its host name or address, whatever the port.
+func destinationHostKey(outboundHost string) string {
+	return hostport.Host(outboundHost)
+}
+
+func hostConnLimitError(config *Config, role, host string) error {
+	config.MetricsClient.Incr("cn.host_limit_rejected", []string{fmt.Sprintf("role:%s", role)}, 1)
+	return connLimitError{
+		error: fmt.Errorf("too many connections to %s (limit %d)", host, config.ConnTracker.MaxConnsPerHost),
+		limit: limitHost,
+	}
+}
+
+// checkOverloaded sheds CONNECT requests while the connection tracker has
+// MaxConns connections open, so that a flood of tunnels is turned away
+// before the proxy runs out of file descriptors or memory.
+func checkOverloaded(config *Config, decision *aclDecision) error {
+	tr := config.ConnTracker
+	if !tr.Overloaded() {
+		return nil
+	}
+	config.MetricsClient.Incr("cn.overloaded", []string{fmt.Sprintf("role:%s", decision.role)}, 1)
+	return connLimitError{
+		error: fmt.Errorf("proxy overloaded: %d connections open (limit %d)", tr.Open(), tr.MaxConns),
+		limit: limitGlobal,
+	}
+}
+
+// checkHostConnLimit rejects requests to a destination host whose
+// connections are all taken. The limit itself is enforced when dialing, but
+// goproxy answers every failed CONNECT dial with the same generic 502, so it
+// is also checked when deciding CONNECT requests, where the deny response
+// tells the client which limit it hit. The other limits enforced when dialing,
+// such as the global connection cap, open circuits, port exhaustion and
+// adaptive concurrency, are checked up front the same way.
+func checkHostConnLimit(config *Config, decision *aclDecision) error {
+	host := destinationHostKey(decision.outboundHost)
+	if host == "" || !config.ConnTracker.HostAtLimit(host) {
+		return nil
+	}
+	return hostConnLimitError(config, decision.role, host)
+}
@@ -0,0 +1,125 @@
+package smokescreen
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestMaxConnsPerHost(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	conf.ConnTracker.MaxConnsPerHost = 1
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// Another connection to the destination takes its only slot.
+	r.True(conf.ConnTracker.AcquireHost("127.0.0.1"))
+
+	resp, err := client.Get(upstream.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	a.Equal("true", resp.Header.Get(retryableHeader))
+	a.Equal(limitHost, resp.Header.Get(limitHeader))
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	r.NoError(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamHost, upstreamHost)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	r.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	a.Equal(limitHost, resp.Header.Get(limitHeader))
+
+	// Once the slot is free, requests go through and give it back when their
+	// connection closes.
+	conf.ConnTracker.ReleaseHost("127.0.0.1")
+	resp, err = client.Get(upstream.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Get(upstream.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestMaxConns(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	conf.ConnTracker.MaxConns = 1
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+
+	connect := func() (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		r.NoError(err)
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamHost, upstreamHost)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		r.NoError(err)
+		return conn, resp
+	}
+
+	// The first tunnel takes the only connection.
+	first, resp := connect()
+	a.Equal(http.StatusOK, resp.StatusCode)
+
+	second, resp := connect()
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	a.Equal("true", resp.Header.Get(retryableHeader))
+	a.Equal(limitGlobal, resp.Header.Get(limitHeader))
+	a.Contains(resp.Header.Get(errorHeader), "proxy overloaded")
+	second.Close()
+
+	// Once it closes, tunnels are accepted again.
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for conf.ConnTracker.Open() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, resp := connect()
+	defer third.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+}
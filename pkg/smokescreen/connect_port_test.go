@@ -0,0 +1,73 @@
+package smokescreen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestConnectPorts(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("mail.example.com", "8.8.9.1")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"web":    {Policy: acl.Enforce, DomainGlobs: []string{"mail.example.com"}},
+			"mailer": {Policy: acl.Enforce, DomainGlobs: []string{"mail.example.com"}, ConnectPorts: []int{587}},
+			"any":    {Policy: acl.Enforce, DomainGlobs: []string{"mail.example.com"}, ConnectPorts: []int{}},
+		},
+	}
+
+	connect := func(role, host string) (*aclDecision, error) {
+		req := httptest.NewRequest("CONNECT", "http://"+host, nil)
+		req.Host = host
+		req.Header.Set("X-Smokescreen-Role", role)
+		ctx := &goproxy.ProxyCtx{Req: req, UserData: &ctxUserData{connect: true}}
+		err := handleConnect(conf, ctx)
+		return ctx.UserData.(*ctxUserData).decision, err
+	}
+
+	decision, err := connect("web", "mail.example.com:443")
+	r.NoError(err)
+	a.True(decision.allow)
+
+	decision, err = connect("web", "mail.example.com:25")
+	r.Error(err)
+	a.IsType(denyError{}, err)
+	a.False(decision.allow)
+	a.Equal("CONNECT to port 25 is not allowed", decision.reason)
+
+	// A role's ACL rule overrides the proxy's ports.
+	_, err = connect("mailer", "mail.example.com:587")
+	a.NoError(err)
+	_, err = connect("mailer", "mail.example.com:443")
+	a.Error(err)
+	_, err = connect("any", "mail.example.com:22")
+	a.NoError(err)
+
+	r.NoError(conf.SetupConnectPorts([]string{"*"}))
+	_, err = connect("web", "mail.example.com:25")
+	a.NoError(err)
+
+	r.NoError(conf.SetupConnectPorts([]string{"443", "8443"}))
+	a.Equal([]int{443, 8443}, conf.AllowedConnectPorts)
+	a.Error(conf.SetupConnectPorts([]string{"https"}))
+	a.Error(conf.SetupConnectPorts([]string{"*", "443"}))
+}
@@ -1,12 +1,13 @@
 package conntrack
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/metrics"
 )
 
 type Tracker struct {
@@ -14,34 +15,67 @@ type Tracker struct {
 	ShuttingDown  atomic.Value
 	Wg            *sync.WaitGroup
 	IdleThreshold time.Duration // A connection is idle if it has been inactive (no bytes in/out) for this many seconds.
-	Log           *logrus.Logger
-	statsc        *statsd.Client
+
+	// If set, a connection is also idle once nothing has been read from
+	// (ReadIdleThreshold) or written to (WriteIdleThreshold) it for this
+	// long, even if it is still active in the other direction.
+	ReadIdleThreshold  time.Duration
+	WriteIdleThreshold time.Duration
+
+	// If positive, at most this many connections to each destination host
+	// may be open or being dialed at once; see AcquireHost.
+	MaxConnsPerHost int
+
+	// If positive, the tracker is overloaded once this many connections are
+	// open; see Overloaded.
+	MaxConns int
+
+	// If positive, connections are closed once they have been open this
+	// long, however active they are.
+	MaxLifetime time.Duration
+
+	// If positive, connections are closed once they have transferred more
+	// than this many bytes, in both directions together.
+	MaxConnBytes int64
+
+	// If positive, each direction of a connection is held to this many
+	// bytes per second.
+	MaxConnBandwidth int64
+
+	Log       *logrus.Logger
+	AccessLog *logrus.Logger // If set, closed connections are also logged here
+	statsc    metrics.MetricsClient
+
+	hostMu    sync.Mutex
+	hostConns map[string]int
+
+	open int64 // Connections tracked, kept alongside the map so counting them is cheap
 }
 
-func NewTracker(idle time.Duration, statsc *statsd.Client, logger *logrus.Logger, sd atomic.Value) *Tracker {
+// NewTracker returns a Tracker reporting metrics to statsc. If statsc is nil,
+// metrics are discarded.
+func NewTracker(idle time.Duration, statsc metrics.MetricsClient, logger *logrus.Logger, sd atomic.Value) *Tracker {
 	return &Tracker{
 		Map:           &sync.Map{},
 		ShuttingDown:  sd,
 		Wg:            &sync.WaitGroup{},
 		IdleThreshold: idle,
 		Log:           logger,
-		statsc:        statsc,
+		statsc:        metrics.OrNoOp(statsc),
 	}
 }
 
 // MaybeIdleIn returns the longest amount of time it will take for all tracked
-// connections to become idle based on the configured IdleThreshold.
+// connections to become idle based on the configured idle thresholds.
 //
 // A duration of 0 indicates all connections are idle.
 func (tr *Tracker) MaybeIdleIn() time.Duration {
 	longest := 0 * time.Nanosecond
+	now := time.Now()
 	tr.Range(func(k, v interface{}) bool {
 		c := k.(*InstrumentedConn)
 
-		lastActivity := time.Unix(0, atomic.LoadInt64(c.LastActivity))
-		idleAt := lastActivity.Add(tr.IdleThreshold)
-		idleIn := idleAt.Sub(time.Now())
-
+		idleIn := c.idleAt().Sub(now)
 		if idleIn > longest {
 			longest = idleIn
 		}
@@ -49,3 +83,111 @@ func (tr *Tracker) MaybeIdleIn() time.Duration {
 	})
 	return longest
 }
+
+// AcquireHost takes one of the MaxConnsPerHost connection slots of host,
+// reporting false if they are all taken. A slot should be taken before
+// dialing, so that dials stuck on an unresponsive host count too, and is
+// released with ReleaseHost, or handed to the resulting connection with
+// InstrumentedConn.HoldHostSlot.
+func (tr *Tracker) AcquireHost(host string) bool {
+	tr.hostMu.Lock()
+	defer tr.hostMu.Unlock()
+
+	if tr.MaxConnsPerHost > 0 && tr.hostConns[host] >= tr.MaxConnsPerHost {
+		return false
+	}
+	if tr.hostConns == nil {
+		tr.hostConns = make(map[string]int)
+	}
+	tr.hostConns[host]++
+	return true
+}
+
+// ReleaseHost gives back a slot taken with AcquireHost.
+func (tr *Tracker) ReleaseHost(host string) {
+	tr.hostMu.Lock()
+	defer tr.hostMu.Unlock()
+
+	if tr.hostConns[host] <= 1 {
+		delete(tr.hostConns, host)
+		return
+	}
+	tr.hostConns[host]--
+}
+
+// HostAtLimit reports whether all the connection slots of host are taken.
+func (tr *Tracker) HostAtLimit(host string) bool {
+	tr.hostMu.Lock()
+	defer tr.hostMu.Unlock()
+
+	return tr.MaxConnsPerHost > 0 && tr.hostConns[host] >= tr.MaxConnsPerHost
+}
+
+// Open returns the number of connections tracked.
+func (tr *Tracker) Open() int {
+	return int(atomic.LoadInt64(&tr.open))
+}
+
+// Overloaded reports whether MaxConns connections are open, in which case
+// no more should be made.
+func (tr *Tracker) Overloaded() bool {
+	return tr.MaxConns > 0 && tr.Open() >= tr.MaxConns
+}
+
+// ReapIdle closes connections that have been inactive for longer than
+// IdleThreshold, checking every interval, so tunnels left open by clients that
+// crashed or lost their network don't linger forever. It never returns.
+func (tr *Tracker) ReapIdle(interval time.Duration) {
+	for range time.Tick(interval) {
+		tr.reapIdle()
+	}
+}
+
+// reapIdle closes the connections that are currently idle and returns how
+// many it closed.
+func (tr *Tracker) reapIdle() int {
+	now := time.Now()
+	var idle []*InstrumentedConn
+	tr.Range(func(k, v interface{}) bool {
+		ic := k.(*InstrumentedConn)
+		if now.Sub(time.Unix(0, atomic.LoadInt64(ic.LastActivity))) > tr.IdleThreshold {
+			idle = append(idle, ic)
+		}
+		return true
+	})
+
+	for _, ic := range idle {
+		idleFor := now.Sub(time.Unix(0, atomic.LoadInt64(ic.LastActivity)))
+		tr.statsc.Incr("cn.reaped", []string{fmt.Sprintf("role:%s", ic.Role)}, 1)
+		tr.Log.WithFields(logrus.Fields{
+			"role":      ic.Role,
+			"req_host":  ic.OutboundHost,
+			"bytes_in":  atomic.LoadUint64(ic.BytesIn),
+			"bytes_out": atomic.LoadUint64(ic.BytesOut),
+			"idle_for":  idleFor.Seconds(),
+		}).Info("closing idle connection")
+		ic.Close()
+	}
+	return len(idle)
+}
+
+// ReportBytes reports the bytes transferred by every open connection since
+// its last report every interval, so long-lived tunnels are accounted for
+// while they are open rather than only once they close. It never returns.
+func (tr *Tracker) ReportBytes(interval time.Duration) {
+	for range time.Tick(interval) {
+		tr.reportBytes()
+	}
+}
+
+func (tr *Tracker) reportBytes() {
+	tr.Range(func(k, v interface{}) bool {
+		ic := k.(*InstrumentedConn)
+		ic.Lock()
+		if !ic.closed {
+			ic.reportBytes(atomic.LoadUint64(ic.BytesIn), atomic.LoadUint64(ic.BytesOut))
+		}
+		ic.Unlock()
+		return true
+	})
+}
@@ -49,3 +49,107 @@ func NewTestTracker(idle time.Duration) *Tracker {
 
 	return NewTracker(idle, nil, logrus.New(), sd)
 }
+
+// TestConnTrackerMaybeIdleInDirection tests that a direction's threshold
+// shortens the wait when it expires before the overall idle threshold.
+func TestConnTrackerMaybeIdleInDirection(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	tr.WriteIdleThreshold = time.Second
+	ic := tr.NewInstrumentedConn(&net.UnixConn{}, "testMaybeIdleDirection", "localhost")
+	ic.Read(nil)
+
+	idleIn := tr.MaybeIdleIn().Round(time.Second)
+	assert.Equal(time.Second, idleIn)
+}
+
+// TestConnTrackerHostLimit tests that connection slots are limited per host
+// and released when the connection holding them closes.
+func TestConnTrackerHostLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Second)
+	tr.MaxConnsPerHost = 2
+
+	assert.True(tr.AcquireHost("example.com"))
+	assert.True(tr.AcquireHost("example.com"))
+	assert.True(tr.HostAtLimit("example.com"))
+	assert.False(tr.AcquireHost("example.com"))
+	assert.True(tr.AcquireHost("example.org"))
+
+	ic := tr.NewInstrumentedConn(&net.UnixConn{}, "testHostLimit", "example.com:443")
+	ic.HoldHostSlot("example.com")
+	ic.Close()
+	assert.False(tr.HostAtLimit("example.com"))
+	assert.True(tr.AcquireHost("example.com"))
+
+	tr.ReleaseHost("example.com")
+	tr.ReleaseHost("example.com")
+	assert.Empty(tr.hostConns["example.com"])
+}
+
+func TestConnTrackerOverloaded(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Second)
+	ic := tr.NewInstrumentedConn(&net.UnixConn{}, "testOverloaded", "example.com:443")
+	assert.Equal(1, tr.Open())
+	assert.False(tr.Overloaded(), "no limit by default")
+
+	tr.MaxConns = 2
+	ic2 := tr.NewInstrumentedConn(&net.UnixConn{}, "testOverloaded", "example.org:443")
+	assert.True(tr.Overloaded())
+
+	ic2.Close()
+	ic2.Close()
+	assert.Equal(1, tr.Open())
+	assert.False(tr.Overloaded())
+	ic.Close()
+	assert.Equal(0, tr.Open())
+}
+
+// TestConnTrackerReapIdle tests that only connections idle beyond the idle
+// threshold are closed.
+func TestConnTrackerReapIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	idle := tr.NewInstrumentedConn(&net.UnixConn{}, "testReapIdle", "idle.example.com:443")
+	active := tr.NewInstrumentedConn(&net.UnixConn{}, "testReapIdle", "active.example.com:443")
+	defer active.Close()
+	atomic.StoreInt64(idle.LastActivity, time.Now().Add(-2*time.Hour).UnixNano())
+
+	assert.Equal(1, tr.reapIdle())
+	idle.Lock()
+	assert.True(idle.closed)
+	idle.Unlock()
+	active.Lock()
+	assert.False(active.closed)
+	active.Unlock()
+
+	assert.Zero(tr.reapIdle())
+}
+
+func TestConnTrackerReportBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	ic := tr.NewInstrumentedConn(&net.UnixConn{}, "testReportBytes", "example.com:443")
+	atomic.AddUint64(ic.BytesIn, 100)
+	atomic.AddUint64(ic.BytesOut, 10)
+
+	tr.reportBytes()
+	assert.EqualValues(100, ic.reportedIn)
+	assert.EqualValues(10, ic.reportedOut)
+
+	// Later reports only carry what was transferred since.
+	atomic.AddUint64(ic.BytesIn, 50)
+	tr.reportBytes()
+	assert.EqualValues(150, ic.reportedIn)
+	assert.EqualValues(10, ic.reportedOut)
+
+	assert.Equal("example.com", destinationHost(ic.OutboundHost))
+	assert.Equal("example.com", destinationHost("example.com"))
+	assert.Equal("::1", destinationHost("[::1]:443"))
+}
@@ -0,0 +1,77 @@
+package conntrack
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	copyBufferSize = 32 * 1024
+
+	// ProgressInterval is how often Copy reports progress on the tunnels of
+	// instrumented connections. It bounds how stale their activity times
+	// can get while data is flowing.
+	ProgressInterval = 100 * time.Millisecond
+)
+
+var errInvalidWrite = errors.New("invalid write result")
+
+// Copy copies from src to dst until EOF or an error, like io.Copy. Each chunk
+// is written in full before the next one is read, so a slow dst holds back
+// reading from src instead of data piling up in memory.
+//
+// progress is called with the number of bytes copied since its previous
+// call, at most once per interval while data is flowing and once more when
+// copying stops. Blocking in progress holds copying back, which is how
+// bandwidth is throttled; returning an error from it stops the copy with that
+// error.
+func Copy(dst io.Writer, src io.Reader, interval time.Duration, progress func(n int64) error) (written int64, err error) {
+	buf := make([]byte, copyBufferSize)
+	var pending int64
+	lastReport := time.Now()
+
+	defer func() {
+		if pending > 0 {
+			if perr := progress(pending); err == nil {
+				err = perr
+			}
+		}
+	}()
+
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if werr == nil {
+					werr = errInvalidWrite
+				}
+			}
+			written += int64(nw)
+			pending += int64(nw)
+			if werr == nil && nw != nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				rerr = nil
+			}
+			return written, rerr
+		}
+
+		if pending > 0 && time.Since(lastReport) >= interval {
+			n := pending
+			pending = 0
+			if err := progress(n); err != nil {
+				return written, err
+			}
+			lastReport = time.Now()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package conntrack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowReader returns one byte per read, sleeping before each.
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	b[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestCopyReportsProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	var dst bytes.Buffer
+	var reports []int64
+	src := &slowReader{data: []byte("abcdef"), delay: 10 * time.Millisecond}
+	n, err := Copy(&dst, src, 25*time.Millisecond, func(n int64) error {
+		reports = append(reports, n)
+		return nil
+	})
+	assert.NoError(err)
+	assert.EqualValues(6, n)
+	assert.Equal("abcdef", dst.String())
+
+	// Progress is batched, but every byte is reported.
+	assert.True(len(reports) > 1 && len(reports) < 6, "reports: %v", reports)
+	var total int64
+	for _, r := range reports {
+		total += r
+	}
+	assert.EqualValues(6, total)
+}
+
+func TestCopyStopsOnProgressError(t *testing.T) {
+	assert := assert.New(t)
+
+	stop := errors.New("stop")
+	var dst bytes.Buffer
+	src := &slowReader{data: []byte("abcdef")}
+	n, err := Copy(&dst, src, 0, func(n int64) error {
+		return stop
+	})
+	assert.Equal(stop, err)
+	assert.EqualValues(1, n)
+
+	_, err = Copy(&dst, strings.NewReader("abc"), time.Hour, func(n int64) error {
+		return stop
+	})
+	assert.Equal(stop, err, "the final report can fail the copy too")
+}
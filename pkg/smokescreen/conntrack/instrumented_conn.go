@@ -2,15 +2,22 @@ package conntrack
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
 )
 
+// ErrConnQuotaExceeded is returned by reads and writes on a connection once
+// it has transferred more than its tracker's MaxConnBytes.
+var ErrConnQuotaExceeded = errors.New("connection exceeded its transfer quota")
+
 type InstrumentedConn struct {
 	net.Conn
 	Role         string
@@ -20,6 +27,8 @@ type InstrumentedConn struct {
 
 	Start        time.Time
 	LastActivity *int64 // Unix nano
+	LastRead     *int64 // Unix nano
+	LastWrite    *int64 // Unix nano
 
 	BytesIn  *uint64
 	BytesOut *uint64
@@ -28,30 +37,101 @@ type InstrumentedConn struct {
 
 	closed     bool
 	CloseError error
+
+	hostSlot      string      // Destination host whose connection slot is released on close
+	lifetimeTimer *time.Timer // Closes the connection once it reaches the tracker's MaxLifetime
+	onClose       func(end time.Time)
+	closedAt      time.Time
+	copying       int // Copies through ReadFrom and WriteTo in progress
+
+	// Byte counts already emitted by reportBytes.
+	reportedIn  uint64
+	reportedOut uint64
+
+	readThrottle  bandwidthThrottle
+	writeThrottle bandwidthThrottle
+	quotaOnce     sync.Once
 }
 
 func (t *Tracker) NewInstrumentedConn(conn net.Conn, role, outboundHost string) *InstrumentedConn {
 	now := time.Now().UnixNano()
+	lastRead, lastWrite := now, now
 	bytesIn := uint64(0)
 	bytesOut := uint64(0)
 
 	ic := &InstrumentedConn{
 		Conn:         conn,
 		Role:         role,
+		OutboundHost: outboundHost,
 		tracker:      t,
 		Start:        time.Now(),
 		LastActivity: &now,
+		LastRead:     &lastRead,
+		LastWrite:    &lastWrite,
 		BytesIn:      &bytesIn,
 		BytesOut:     &bytesOut,
 	}
 
 	ic.tracker.Store(ic, nil)
+	atomic.AddInt64(&ic.tracker.open, 1)
 	ic.tracker.Wg.Add(1)
 
+	if t.MaxLifetime > 0 {
+		ic.lifetimeTimer = time.AfterFunc(t.MaxLifetime, ic.expire)
+	}
+
 	return ic
 }
 
+// expire closes a connection that has reached the tracker's MaxLifetime. The
+// decision that let it be opened is never revisited, so this bounds how long
+// a tunnel outlives a change to the ACL that would now deny it.
+func (ic *InstrumentedConn) expire() {
+	ic.tracker.statsc.Incr("cn.lifetime_exceeded", []string{fmt.Sprintf("role:%s", ic.Role)}, 1)
+	ic.tracker.Log.WithFields(logrus.Fields{
+		"role":      ic.Role,
+		"req_host":  ic.OutboundHost,
+		"bytes_in":  atomic.LoadUint64(ic.BytesIn),
+		"bytes_out": atomic.LoadUint64(ic.BytesOut),
+		"lifetime":  ic.tracker.MaxLifetime.Seconds(),
+	}).Info("closing connection that reached its maximum lifetime")
+	ic.Close()
+}
+
+// HoldHostSlot hands ic the connection slot of host taken with
+// Tracker.AcquireHost, to be released when ic is closed.
+func (ic *InstrumentedConn) HoldHostSlot(host string) {
+	ic.Lock()
+	defer ic.Unlock()
+	ic.hostSlot = host
+}
+
+// OnClose has f called, with the time ic was closed, once it is and the
+// copies through it have stopped, so its byte counts are final.
+func (ic *InstrumentedConn) OnClose(f func(end time.Time)) {
+	ic.Lock()
+	defer ic.Unlock()
+	ic.onClose = f
+}
+
+// runOnClose returns the OnClose function to call now, if ic is closed and
+// no longer copied through. ic must be locked.
+func (ic *InstrumentedConn) runOnClose() func() {
+	if !ic.closed || ic.copying > 0 || ic.onClose == nil {
+		return nil
+	}
+	f, end := ic.onClose, ic.closedAt
+	ic.onClose = nil
+	return func() { f(end) }
+}
+
 func (ic *InstrumentedConn) Close() error {
+	var onClose func()
+	defer func() {
+		if onClose != nil {
+			onClose()
+		}
+	}()
 	ic.Lock()
 	defer ic.Unlock()
 
@@ -61,6 +141,13 @@ func (ic *InstrumentedConn) Close() error {
 
 	ic.closed = true
 	ic.tracker.Delete(ic)
+	atomic.AddInt64(&ic.tracker.open, -1)
+	if ic.lifetimeTimer != nil {
+		ic.lifetimeTimer.Stop()
+	}
+	if ic.hostSlot != "" {
+		ic.tracker.ReleaseHost(ic.hostSlot)
+	}
 
 	end := time.Now()
 	duration := end.Sub(ic.Start).Seconds()
@@ -71,29 +158,43 @@ func (ic *InstrumentedConn) Close() error {
 
 	ic.tracker.statsc.Incr("cn.close", tags, 1)
 	ic.tracker.statsc.Histogram("cn.duration", duration, tags, 1)
-	ic.tracker.statsc.Histogram("cn.bytes_in", float64(*ic.BytesIn), tags, 1)
-	ic.tracker.statsc.Histogram("cn.bytes_out", float64(*ic.BytesOut), tags, 1)
+	// Snapshot the counters once so the histograms, the traffic counters and
+	// the log line agree even if a copy is still finishing a write.
+	bytesIn := atomic.LoadUint64(ic.BytesIn)
+	bytesOut := atomic.LoadUint64(ic.BytesOut)
+	ic.tracker.statsc.Histogram("cn.bytes_in", float64(bytesIn), tags, 1)
+	ic.tracker.statsc.Histogram("cn.bytes_out", float64(bytesOut), tags, 1)
+	ic.reportBytes(bytesIn, bytesOut)
 
 	// Track when we terminate active connections during a shutdown
 	idle := true
+	idleDirection := ""
 	if ic.tracker.ShuttingDown.Load() == true {
-		idle = ic.Idle()
+		idleDirection = ic.IdleDirection()
+		idle = idleDirection != ""
 		if !idle {
 			ic.tracker.statsc.Incr("cn.active_at_termination", tags, 1)
 		}
 	}
 
-	ic.tracker.Log.WithFields(logrus.Fields{
-		"idle":        idle,
-		"bytes_in":    ic.BytesIn,
-		"bytes_out":   ic.BytesOut,
-		"role":        ic.Role,
-		"req_host":    ic.OutboundHost,
-		"remote_addr": ic.Conn.RemoteAddr(),
-		"start_time":  ic.Start.UTC(),
-		"end_time":    end.UTC(),
-		"duration":    duration,
-	}).Info("CANONICAL-PROXY-CN-CLOSE")
+	fields := logrus.Fields{
+		"idle":           idle,
+		"idle_direction": idleDirection,
+		"bytes_in":       bytesIn,
+		"bytes_out":      bytesOut,
+		"role":           ic.Role,
+		"req_host":       ic.OutboundHost,
+		"remote_addr":    ic.Conn.RemoteAddr(),
+		"start_time":     ic.Start.UTC(),
+		"end_time":       end.UTC(),
+		"duration":       duration,
+	}
+	ic.tracker.Log.WithFields(fields).Info("CANONICAL-PROXY-CN-CLOSE")
+	if ic.tracker.AccessLog != nil {
+		ic.tracker.AccessLog.WithFields(fields).Info("CANONICAL-PROXY-CN-CLOSE")
+	}
+	ic.closedAt = end
+	onClose = ic.runOnClose()
 
 	ic.tracker.Wg.Done()
 
@@ -101,47 +202,217 @@ func (ic *InstrumentedConn) Close() error {
 	return ic.CloseError
 }
 
-func (ic *InstrumentedConn) Read(b []byte) (int, error) {
-	atomic.StoreInt64(ic.LastActivity, time.Now().UnixNano())
+// reportBytes adds the bytes transferred since the last report, given the
+// current byte counters in and out, to the cn.traffic.bytes_in and
+// cn.traffic.bytes_out counters, tagged with the role and destination host, so traffic can be accounted per service and
+// destination while tunnels are still open.
+//
+// reportBytes should be called with the connection's lock held.
+func (ic *InstrumentedConn) reportBytes(in, out uint64) {
+	if in == ic.reportedIn && out == ic.reportedOut {
+		return
+	}
 
-	n, err := ic.Conn.Read(b)
-	atomic.AddUint64(ic.BytesIn, uint64(n))
+	tags := []string{
+		fmt.Sprintf("role:%s", ic.Role),
+		fmt.Sprintf("destination:%s", destinationHost(ic.OutboundHost)),
+	}
+	ic.tracker.statsc.Count("cn.traffic.bytes_in", int64(in-ic.reportedIn), tags, 1)
+	ic.tracker.statsc.Count("cn.traffic.bytes_out", int64(out-ic.reportedOut), tags, 1)
+	ic.reportedIn = in
+	ic.reportedOut = out
+}
+
+// destinationHost strips the port, if any, from outboundHost.
+func destinationHost(outboundHost string) string {
+	return hostport.Host(outboundHost)
+}
 
+func (ic *InstrumentedConn) Read(b []byte) (int, error) {
+	n, err := ic.Conn.Read(b)
+	if terr := ic.transferred(true, int64(n)); terr != nil && err == nil {
+		err = terr
+	}
 	return n, err
 }
 
 func (ic *InstrumentedConn) Write(b []byte) (int, error) {
-	atomic.StoreInt64(ic.LastActivity, time.Now().UnixNano())
-
 	n, err := ic.Conn.Write(b)
-	atomic.AddUint64(ic.BytesOut, uint64(n))
-
+	if terr := ic.transferred(false, int64(n)); terr != nil && err == nil {
+		err = terr
+	}
 	return n, err
 }
 
+// ReadFrom copies src to the connection with Copy, so that tunnels, which
+// io.Copy into the connection, account for their traffic in batches rather
+// than on every write.
+func (ic *InstrumentedConn) ReadFrom(src io.Reader) (int64, error) {
+	ic.startCopy()
+	defer ic.endCopy()
+	return Copy(ic.Conn, src, ProgressInterval, func(n int64) error {
+		return ic.transferred(false, n)
+	})
+}
+
+// WriteTo copies the connection to dst with Copy; see ReadFrom.
+func (ic *InstrumentedConn) WriteTo(dst io.Writer) (int64, error) {
+	ic.startCopy()
+	defer ic.endCopy()
+	return Copy(dst, ic.Conn, ProgressInterval, func(n int64) error {
+		return ic.transferred(true, n)
+	})
+}
+
+// startCopy and endCopy bracket copies, which account for the last of
+// their traffic once they stop, and so after ic is closed.
+func (ic *InstrumentedConn) startCopy() {
+	ic.Lock()
+	defer ic.Unlock()
+	ic.copying++
+}
+
+func (ic *InstrumentedConn) endCopy() {
+	ic.Lock()
+	ic.copying--
+	onClose := ic.runOnClose()
+	ic.Unlock()
+	if onClose != nil {
+		onClose()
+	}
+}
+
+// transferred accounts for n bytes read from (in) or written to the
+// connection, whether through Read and Write or Copy. It updates the
+// activity times and byte counts, closes the connection once it has
+// transferred more than the tracker's MaxConnBytes, and holds the caller back
+// to keep each direction within MaxConnBandwidth.
+func (ic *InstrumentedConn) transferred(in bool, n int64) error {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(ic.LastActivity, now)
+
+	throttle := &ic.writeThrottle
+	if in {
+		atomic.StoreInt64(ic.LastRead, now)
+		atomic.AddUint64(ic.BytesIn, uint64(n))
+		throttle = &ic.readThrottle
+	} else {
+		atomic.StoreInt64(ic.LastWrite, now)
+		atomic.AddUint64(ic.BytesOut, uint64(n))
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	tr := ic.tracker
+	if tr.MaxConnBytes > 0 && atomic.LoadUint64(ic.BytesIn)+atomic.LoadUint64(ic.BytesOut) > uint64(tr.MaxConnBytes) {
+		ic.quotaOnce.Do(ic.exceedQuota)
+		return ErrConnQuotaExceeded
+	}
+	if tr.MaxConnBandwidth > 0 {
+		throttle.wait(n, tr.MaxConnBandwidth)
+	}
+	return nil
+}
+
+// exceedQuota closes a connection that has transferred more than the
+// tracker's MaxConnBytes.
+func (ic *InstrumentedConn) exceedQuota() {
+	ic.tracker.statsc.Incr("cn.quota_exceeded", []string{fmt.Sprintf("role:%s", ic.Role)}, 1)
+	ic.tracker.Log.WithFields(logrus.Fields{
+		"role":      ic.Role,
+		"req_host":  ic.OutboundHost,
+		"bytes_in":  atomic.LoadUint64(ic.BytesIn),
+		"bytes_out": atomic.LoadUint64(ic.BytesOut),
+		"quota":     ic.tracker.MaxConnBytes,
+	}).Info("closing connection that exceeded its transfer quota")
+	ic.Close()
+}
+
+// bandwidthThrottle paces one direction of a connection.
+type bandwidthThrottle struct {
+	sync.Mutex
+	next time.Time // When the bytes transferred so far are paid for
+}
+
+// wait blocks until n more bytes fit within rate bytes per second, averaged
+// since the direction was last idle.
+func (t *bandwidthThrottle) wait(n, rate int64) {
+	t.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(n * int64(time.Second) / rate))
+	delay := t.next.Sub(now)
+	t.Unlock()
+
+	time.Sleep(delay)
+}
+
 // Idle returns true when the connection's last activity occured before the
-// configured idle threshold.
+// configured idle threshold, or when it has been inactive in one direction
+// for longer than that direction's threshold.
 //
 // Idle should be called with the connection's lock held.
 func (ic *InstrumentedConn) Idle() bool {
-	if time.Since(time.Unix(0, *ic.LastActivity)) > ic.tracker.IdleThreshold {
-		return true
+	return ic.IdleDirection() != ""
+}
+
+// IdleDirection returns the direction in which the connection is idle:
+// "both" if it has been inactive for IdleThreshold, "read" or "write" if it
+// has been inactive in that direction for its threshold, and "" if the
+// connection is not idle.
+func (ic *InstrumentedConn) IdleDirection() string {
+	now := time.Now()
+	tr := ic.tracker
+
+	if now.Sub(time.Unix(0, atomic.LoadInt64(ic.LastActivity))) > tr.IdleThreshold {
+		return "both"
 	}
-	return false
+	if tr.ReadIdleThreshold > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(ic.LastRead))) > tr.ReadIdleThreshold {
+		return "read"
+	}
+	if tr.WriteIdleThreshold > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(ic.LastWrite))) > tr.WriteIdleThreshold {
+		return "write"
+	}
+	return ""
+}
+
+// idleAt returns when the connection will become idle if it sees no more
+// activity.
+func (ic *InstrumentedConn) idleAt() time.Time {
+	tr := ic.tracker
+
+	at := time.Unix(0, atomic.LoadInt64(ic.LastActivity)).Add(tr.IdleThreshold)
+	if tr.ReadIdleThreshold > 0 {
+		if readAt := time.Unix(0, atomic.LoadInt64(ic.LastRead)).Add(tr.ReadIdleThreshold); readAt.Before(at) {
+			at = readAt
+		}
+	}
+	if tr.WriteIdleThreshold > 0 {
+		if writeAt := time.Unix(0, atomic.LoadInt64(ic.LastWrite)).Add(tr.WriteIdleThreshold); writeAt.Before(at) {
+			at = writeAt
+		}
+	}
+	return at
 }
 
 func (ic *InstrumentedConn) Stats() *InstrumentedConnStats {
 	ic.Lock()
 	defer ic.Unlock()
 
+	lastActivity := time.Unix(0, atomic.LoadInt64(ic.LastActivity))
+
 	return &InstrumentedConnStats{
-		Id:                       fmt.Sprintf("%d", &ic),
+		Id:                       fmt.Sprintf("%p", ic),
 		Role:                     ic.Role,
 		Rhost:                    ic.OutboundHost,
 		Created:                  ic.Start,
-		BytesIn:                  *ic.BytesIn,
-		BytesOut:                 *ic.BytesOut,
-		SecondsSinceLastActivity: time.Now().Sub(time.Unix(0, *ic.LastActivity)).Seconds(),
+		BytesIn:                  atomic.LoadUint64(ic.BytesIn),
+		BytesOut:                 atomic.LoadUint64(ic.BytesOut),
+		LastActivity:             lastActivity,
+		SecondsSinceLastActivity: time.Now().Sub(lastActivity).Seconds(),
 	}
 }
 
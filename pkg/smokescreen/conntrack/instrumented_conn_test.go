@@ -2,8 +2,10 @@ package conntrack
 
 import (
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -84,3 +86,131 @@ func TestInstrumentedConnIdle(t *testing.T) {
 	time.Sleep(time.Second)
 	assert.True(ic.Idle())
 }
+
+func TestInstrumentedConnIdleDirection(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	tr.WriteIdleThreshold = 50 * time.Millisecond
+	ic := tr.NewInstrumentedConn(&net.UnixConn{}, "testIdleDirection", "localhost")
+
+	assert.Equal("", ic.IdleDirection())
+
+	// Reading alone doesn't keep the connection from going write-idle.
+	time.Sleep(60 * time.Millisecond)
+	ic.Read(nil)
+	assert.Equal("write", ic.IdleDirection())
+	assert.True(ic.Idle())
+
+	ic.Write(nil)
+	assert.False(ic.Idle())
+
+	tr.ReadIdleThreshold = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	assert.Equal("read", ic.IdleDirection())
+}
+
+func TestInstrumentedConnMaxLifetime(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	tr.MaxLifetime = 10 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer server.Close()
+	ic := tr.NewInstrumentedConn(client, "testMaxLifetime", "example.com:443")
+
+	// Activity doesn't keep the connection open.
+	go io.Copy(ioutil.Discard, server)
+	ic.Write([]byte("egress"))
+
+	time.Sleep(50 * time.Millisecond)
+	ic.Lock()
+	assert.True(ic.closed)
+	ic.Unlock()
+	_, err := ic.Write([]byte("egress"))
+	assert.Error(err)
+}
+
+func TestInstrumentedConnQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	tr.MaxConnBytes = 10
+
+	server, client := net.Pipe()
+	defer server.Close()
+	ic := tr.NewInstrumentedConn(client, "testQuota", "example.com:443")
+	go io.Copy(ioutil.Discard, server)
+
+	_, err := ic.Write([]byte("egress"))
+	assert.NoError(err)
+	_, err = ic.Write([]byte("egress"))
+	assert.Equal(ErrConnQuotaExceeded, err)
+
+	ic.Lock()
+	assert.True(ic.closed)
+	ic.Unlock()
+}
+
+func TestInstrumentedConnBandwidth(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	tr.MaxConnBandwidth = 1000
+
+	server, client := net.Pipe()
+	defer server.Close()
+	ic := tr.NewInstrumentedConn(client, "testBandwidth", "example.com:443")
+	defer ic.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	// Tunnels copy into the connection through ReadFrom.
+	start := time.Now()
+	n, err := io.Copy(ic, io.LimitReader(zeroReader{}, 200))
+	assert.NoError(err)
+	assert.EqualValues(200, n)
+	assert.EqualValues(200, atomic.LoadUint64(ic.BytesOut))
+	assert.True(time.Since(start) >= 200*time.Millisecond, "copy wasn't throttled")
+}
+
+func TestInstrumentedConnOnClose(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(time.Hour)
+	server, client := net.Pipe()
+	ic := tr.NewInstrumentedConn(client, "testOnClose", "example.com:443")
+
+	closed := make(chan uint64, 1)
+	ic.OnClose(func(end time.Time) {
+		closed <- atomic.LoadUint64(ic.BytesIn)
+	})
+
+	// Tunnels copy out of the connection through WriteTo, which accounts
+	// for what it copied once it stops, after the connection is closed.
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ic)
+		close(copied)
+	}()
+	server.Write([]byte("ingress"))
+	ic.Close()
+	server.Close()
+	<-copied
+
+	select {
+	case n := <-closed:
+		assert.EqualValues(7, n)
+	case <-time.After(time.Second):
+		t.Fatal("OnClose function not called")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -9,5 +9,6 @@ type InstrumentedConnStats struct {
 	Created                  time.Time `json:"created"`
 	BytesIn                  uint64    `json:"bytesIn"`
 	BytesOut                 uint64    `json:"bytesOut"`
+	LastActivity             time.Time `json:"lastActivity"`
 	SecondsSinceLastActivity float64   `json:"secondsSinceLastActivity"`
 }
@@ -2,7 +2,7 @@ package smokescreen
 
 import (
 	"net"
-	"regexp"
+	"strings"
 )
 
 const versionSemantic = "0.0.1"
@@ -11,6 +11,11 @@ func Version() string {
 	return versionSemantic + "-" + versionHash[5:13]
 }
 
+// GitSHA returns the commit smokescreen was built from.
+func GitSHA() string {
+	return strings.TrimSuffix(versionHash[5:], " $")
+}
+
 const DefaultStatsdNamespace = "smokescreen."
 
 var privateNetworkStrings = [...]string{
@@ -22,14 +27,6 @@ var privateNetworkStrings = [...]string{
 
 var PrivateRuleRanges []RuleRange
 
-// Using a globally-shared Regexp can impact performace due to lock contention,
-// but calling Copy() for each connection is much worse, and it looks like
-// handing out Regexps from a pool doesn't save us anything either, so we'll
-// just live with it.
-const hostExtractPattern = "^([^:]*)(:\\d+)?$"
-
-var hostExtractRE *regexp.Regexp
-
 func init() {
 	PrivateRuleRanges = make([]RuleRange, len(privateNetworkStrings))
 	for i, s := range privateNetworkStrings {
@@ -39,6 +36,4 @@ func init() {
 		}
 		PrivateRuleRanges[i].Net = *rng
 	}
-
-	hostExtractRE = regexp.MustCompile(hostExtractPattern)
 }
@@ -0,0 +1,134 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DecisionEvent is a proxy decision kept by a DecisionHistory.
+type DecisionEvent struct {
+	Time          time.Time `json:"time"`
+	ProxyType     string    `json:"proxy_type"`
+	Role          string    `json:"role"`
+	SrcHost       string    `json:"src_host"`
+	RequestedHost string    `json:"requested_host"`
+	Allow         bool      `json:"allow"`
+	Reason        string    `json:"decision_reason"`
+	RuleID        string    `json:"rule_id,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	TraceID       string    `json:"trace_id,omitempty"`
+}
+
+// DecisionFilter selects events from a DecisionHistory. Zero fields match
+// every event.
+type DecisionFilter struct {
+	Role  string
+	Host  string // Matches events whose requested host, without its port, is this or a subdomain of it
+	Allow *bool
+	Since time.Time
+	Limit int // The most events returned, the most recent ones
+}
+
+// DecisionHistory keeps the most recent proxy decisions in memory, so that
+// what was just denied can be found on the host through the admin API even
+// when logs are sampled, rate limited or slow to arrive. Once full, each
+// decision takes the place of the oldest.
+type DecisionHistory struct {
+	mu     sync.Mutex
+	events []DecisionEvent
+	next   int // Where the next event goes
+	full   bool
+}
+
+// SetupDecisionHistory keeps the last size decisions in memory.
+func (config *Config) SetupDecisionHistory(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("decision history size must be positive, not %d", size)
+	}
+	config.DecisionHistory = &DecisionHistory{events: make([]DecisionEvent, size)}
+	return nil
+}
+
+func (h *DecisionHistory) record(e DecisionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events[h.next] = e
+	h.next++
+	if h.next == len(h.events) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Recent returns the events matching f, most recent first.
+func (h *DecisionHistory) Recent(f DecisionFilter) []DecisionEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := h.next
+	if h.full {
+		n = len(h.events)
+	}
+	matched := []DecisionEvent{}
+	for i := 0; i < n; i++ {
+		e := h.events[(h.next-1-i+len(h.events))%len(h.events)]
+		if !f.Since.IsZero() && e.Time.Before(f.Since) {
+			// Events are in order, so the rest are older still.
+			break
+		}
+		if f.matches(e) {
+			matched = append(matched, e)
+			if f.Limit > 0 && len(matched) == f.Limit {
+				break
+			}
+		}
+	}
+	return matched
+}
+
+func (f DecisionFilter) matches(e DecisionEvent) bool {
+	if f.Role != "" && e.Role != f.Role {
+		return false
+	}
+	if f.Allow != nil && e.Allow != *f.Allow {
+		return false
+	}
+	if f.Host != "" {
+		host := e.RequestedHost
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		want := strings.ToLower(f.Host)
+		if host != want && !strings.HasSuffix(host, "."+want) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordDecisionEvent adds a decision to the configured DecisionHistory, if
+// any.
+func recordDecisionEvent(config *Config, proxyType, srcHost, requestedHost, traceID string, decision *aclDecision, err error) {
+	if config.DecisionHistory == nil {
+		return
+	}
+	e := DecisionEvent{
+		Time:          time.Now(),
+		ProxyType:     proxyType,
+		SrcHost:       srcHost,
+		RequestedHost: requestedHost,
+		TraceID:       traceID,
+	}
+	if decision != nil {
+		e.Role, e.Allow, e.Reason, e.RuleID = decision.role, decision.allow, decision.reason, decision.ruleID
+	}
+	if err != nil {
+		e.Allow = false
+		e.Error = err.Error()
+	}
+	config.DecisionHistory.record(e)
+}
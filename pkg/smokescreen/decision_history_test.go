@@ -0,0 +1,139 @@
+package smokescreen
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestDecisionHistory(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	a.Error(conf.SetupDecisionHistory(0))
+	r.NoError(conf.SetupDecisionHistory(3))
+	h := conf.DecisionHistory
+
+	a.Empty(h.Recent(DecisionFilter{}))
+
+	now := time.Now()
+	for i, host := range []string{"a.example.com:443", "b.example.com:443", "example.org:80", "c.example.com:443"} {
+		role := "web"
+		if i%2 == 1 {
+			role = "batch"
+		}
+		h.record(DecisionEvent{
+			Time:          now.Add(time.Duration(i-3) * time.Minute),
+			Role:          role,
+			RequestedHost: host,
+			Allow:         i%2 == 0,
+		})
+	}
+
+	hosts := func(events []DecisionEvent) []string {
+		var hosts []string
+		for _, e := range events {
+			hosts = append(hosts, e.RequestedHost)
+		}
+		return hosts
+	}
+
+	// The oldest decision was dropped.
+	a.Equal([]string{"c.example.com:443", "example.org:80", "b.example.com:443"}, hosts(h.Recent(DecisionFilter{})))
+
+	denied := false
+	a.Equal([]string{"c.example.com:443", "b.example.com:443"}, hosts(h.Recent(DecisionFilter{Allow: &denied})))
+	a.Equal([]string{"example.org:80"}, hosts(h.Recent(DecisionFilter{Role: "web"})))
+	a.Equal([]string{"c.example.com:443", "b.example.com:443"}, hosts(h.Recent(DecisionFilter{Host: "EXAMPLE.com"})))
+	a.Equal([]string{"b.example.com:443"}, hosts(h.Recent(DecisionFilter{Host: "b.example.com"})))
+	a.Equal([]string{"c.example.com:443"}, hosts(h.Recent(DecisionFilter{Limit: 1})))
+	a.Equal([]string{"c.example.com:443", "example.org:80"}, hosts(h.Recent(DecisionFilter{Since: now.Add(-90 * time.Second)})))
+}
+
+func TestAdminServerDecisions(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+
+	conf := NewConfig()
+	conf.AdminToken = "s3cr3t"
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(conf.SetupDecisionHistory(10))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"allowed": {Policy: acl.Open},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, role := range []string{"allowed", "denied"} {
+		req, err := http.NewRequest("GET", upstream.URL, nil)
+		r.NoError(err)
+		req.Header.Set("X-Smokescreen-Role", role)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		resp.Body.Close()
+	}
+
+	admin := newAdminServer(conf)
+	get := func(path string) (int, []DecisionEvent) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		var events []DecisionEvent
+		if rec.Code == http.StatusOK {
+			r.NoError(json.NewDecoder(rec.Body).Decode(&events))
+		}
+		return rec.Code, events
+	}
+
+	status, events := get("/decisions")
+	a.Equal(http.StatusOK, status)
+	if a.Len(events, 2) {
+		a.Equal("denied", events[0].Role)
+		a.False(events[0].Allow)
+		a.NotEmpty(events[0].Reason)
+		a.Equal("allowed", events[1].Role)
+		a.True(events[1].Allow)
+		a.Equal("http", events[1].ProxyType)
+	}
+
+	status, events = get("/decisions?allow=false&max_age=1m")
+	a.Equal(http.StatusOK, status)
+	if a.Len(events, 1) {
+		a.Equal("denied", events[0].Role)
+	}
+
+	status, events = get("/decisions?role=allowed&limit=5")
+	a.Equal(http.StatusOK, status)
+	a.Len(events, 1)
+
+	status, _ = get("/decisions?allow=maybe")
+	a.Equal(http.StatusBadRequest, status)
+	status, _ = get("/decisions?max_age=soon")
+	a.Equal(http.StatusBadRequest, status)
+}
@@ -0,0 +1,143 @@
+package smokescreen
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// denyLogFlushInterval is how often summaries of suppressed denials whose
+// interval has passed are logged.
+const denyLogFlushInterval = time.Second
+
+// denyLogAggregator bounds the log volume of clients retrying denied
+// requests in a loop. The first denial of a role's requests to a host is
+// logged as usual; further ones within the interval are only counted, and
+// logged as a single summary line once it has passed. Tenants share the
+// aggregator, but each logs its summaries with its own logger.
+type denyLogAggregator struct {
+	sync.Mutex
+	windows map[denyLogKey]*denyLogWindow
+	now     func() time.Time
+}
+
+type denyLogKey struct {
+	tenant string
+	role   string
+	host   string
+}
+
+type denyLogWindow struct {
+	config     *Config // The configuration of the tenant denying the requests, if any
+	end        time.Time
+	suppressed int
+	firstSeen  time.Time
+	lastSeen   time.Time
+	reason     string
+}
+
+func newDenyLogAggregator() *denyLogAggregator {
+	return &denyLogAggregator{
+		windows: make(map[denyLogKey]*denyLogWindow),
+		now:     time.Now,
+	}
+}
+
+// admit reports whether a denial of role's request to host should be logged,
+// counting it towards the next summary if not.
+func (dl *denyLogAggregator) admit(config *Config, role, host, reason string, interval time.Duration) bool {
+	key := denyLogKey{tenant: config.tenant, role: role, host: host}
+
+	dl.Lock()
+	now := dl.now()
+	w, ok := dl.windows[key]
+	if ok && now.Before(w.end) {
+		if w.suppressed == 0 {
+			w.firstSeen = now
+		}
+		w.suppressed++
+		w.lastSeen = now
+		w.reason = reason
+		dl.Unlock()
+		return false
+	}
+	dl.windows[key] = &denyLogWindow{config: config, end: now.Add(interval)}
+	dl.Unlock()
+
+	if ok {
+		logDenySummary(key, w)
+	}
+	return true
+}
+
+// flush logs the summaries of the windows that have ended and forgets them.
+func (dl *denyLogAggregator) flush() {
+	ended := make(map[denyLogKey]*denyLogWindow)
+
+	dl.Lock()
+	now := dl.now()
+	for key, w := range dl.windows {
+		if !now.Before(w.end) {
+			ended[key] = w
+			delete(dl.windows, key)
+		}
+	}
+	dl.Unlock()
+
+	for key, w := range ended {
+		logDenySummary(key, w)
+	}
+}
+
+func logDenySummary(key denyLogKey, w *denyLogWindow) {
+	if w.suppressed == 0 {
+		return
+	}
+
+	config := w.config
+	config.MetricsClient.Count("acl.deny_log_suppressed", int64(w.suppressed), []string{"role:" + key.role}, 1)
+	fields := logrus.Fields{
+		"role":            key.role,
+		"requested_host":  key.host,
+		"count":           w.suppressed,
+		"first_seen":      w.firstSeen.Unix(),
+		"last_seen":       w.lastSeen.Unix(),
+		"decision_reason": w.reason,
+	}
+	if key.tenant != "" {
+		fields["tenant"] = key.tenant
+	}
+	config.Log.WithFields(fields).Warn("suppressed repeated proxy denials")
+}
+
+// denyLogInterval returns the interval repeated denials like decision are
+// aggregated over, if any.
+func denyLogInterval(config *Config, decision *aclDecision, err error) time.Duration {
+	if decision == nil || decision.allow || config.denyLogs == nil {
+		return 0
+	}
+	switch err.(type) {
+	case nil, denyError, rateLimitError:
+	default:
+		return 0
+	}
+	if decision.denyLogInterval > 0 {
+		return decision.denyLogInterval
+	}
+	return config.DenyLogInterval
+}
+
+// reportDenyLogs logs the summaries of suppressed denials as their intervals
+// end, until the proxy shuts down.
+func reportDenyLogs(config *Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config.denyLogs.flush()
+		if shuttingDown, _ := config.ShuttingDown.Load().(bool); shuttingDown {
+			return
+		}
+	}
+}
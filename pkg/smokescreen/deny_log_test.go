@@ -0,0 +1,78 @@
+package smokescreen
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenyLogAggregation(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	conf.DenyLogInterval = time.Minute
+	logHook := logrustest.NewLocal(conf.Log)
+
+	now := time.Unix(1700000000, 0)
+	conf.denyLogs.now = func() time.Time { return now }
+
+	deny := func(role, host string, err error) {
+		ctx := &goproxy.ProxyCtx{Req: httptest.NewRequest("CONNECT", host, nil)}
+		decision := &aclDecision{role: role, reason: "host not allowed"}
+		logProxy(conf, ctx, "connect", nil, decision, "", now, err)
+	}
+	messages := func() []string {
+		var msgs []string
+		for _, e := range logHook.AllEntries() {
+			msgs = append(msgs, e.Message)
+		}
+		logHook.Reset()
+		return msgs
+	}
+
+	// Only the first of a flood of denials is logged.
+	for i := 0; i < 5; i++ {
+		deny("svc", "example.com:443", nil)
+		now = now.Add(time.Second)
+	}
+	a.Equal([]string{LOGLINE_CANONICAL_PROXY_DECISION}, messages())
+
+	// Other hosts, and unexpected errors, are logged apart.
+	deny("svc", "example.org:443", nil)
+	deny("svc", "example.com:443", errors.New("boom"))
+	a.Equal([]string{LOGLINE_CANONICAL_PROXY_DECISION, LOGLINE_CANONICAL_PROXY_DECISION}, messages())
+
+	// The rest are summarized once the interval has passed.
+	conf.denyLogs.flush()
+	a.Empty(messages())
+	now = now.Add(time.Minute)
+	conf.denyLogs.flush()
+	entries := logHook.AllEntries()
+	a.Len(entries, 1)
+	a.Equal("suppressed repeated proxy denials", entries[0].Message)
+	a.Equal("svc", entries[0].Data["role"])
+	a.Equal("example.com:443", entries[0].Data["requested_host"])
+	a.Equal(4, entries[0].Data["count"])
+	a.Equal(int64(1700000001), entries[0].Data["first_seen"])
+	a.Equal(int64(1700000004), entries[0].Data["last_seen"])
+	logHook.Reset()
+
+	deny("svc", "example.com:443", nil)
+	a.Equal([]string{LOGLINE_CANONICAL_PROXY_DECISION}, messages())
+
+	// A role's ACL rule can set its own interval.
+	conf.DenyLogInterval = 0
+	ctx := &goproxy.ProxyCtx{Req: httptest.NewRequest("CONNECT", "example.net:443", nil)}
+	decision := &aclDecision{role: "other", denyLogInterval: time.Hour}
+	for i := 0; i < 3; i++ {
+		logProxy(conf, ctx, "connect", nil, decision, "", now, nil)
+	}
+	deny("svc", "example.net:443", nil)
+	deny("svc", "example.net:443", nil)
+	a.Len(messages(), 3)
+}
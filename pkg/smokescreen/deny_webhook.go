@@ -0,0 +1,219 @@
+package smokescreen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DenyEvent describes a denied proxy request to a deny webhook.
+type DenyEvent struct {
+	Time          time.Time `json:"time"`
+	Role          string    `json:"role"`
+	Project       string    `json:"project,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	ProxyType     string    `json:"proxy_type"`
+	RequestedHost string    `json:"requested_host"`
+	SrcHost       string    `json:"src_host"`
+	RuleID        string    `json:"rule_id,omitempty"`
+	Reason        string    `json:"decision_reason"`
+	Mode          string    `json:"mode"` // "enforce" if the request was denied, "report" if the role's policy would have denied it
+	TraceID       string    `json:"trace_id,omitempty"`
+}
+
+const (
+	defaultDenyWebhookBatchSize     = 100
+	defaultDenyWebhookFlushInterval = 5 * time.Second
+	defaultDenyWebhookMaxRetries    = 3
+	defaultDenyWebhookRetryBackoff  = time.Second
+	denyWebhookQueueSize            = 10000
+)
+
+// DenyNotifier posts DenyEvents to a webhook in the background, so security
+// teams can be alerted to unexpected egress attempts without scraping logs.
+// Events are posted as a JSON array in batches of up to BatchSize, at least
+// every FlushInterval. A batch that fails is retried up to MaxRetries times,
+// waiting RetryBackoff before the first retry and twice as long before each
+// one after, and then dropped. Events arriving while the queue is full are
+// dropped too: notifications are best effort, and the logs remain the
+// record of every denial.
+type DenyNotifier struct {
+	URL           string
+	Client        *http.Client  // Defaults to http.DefaultClient
+	BatchSize     int           // Defaults to 100
+	FlushInterval time.Duration // Defaults to 5s
+	MaxRetries    int           // Defaults to 3; negative means batches aren't retried
+	RetryBackoff  time.Duration // Defaults to 1s
+
+	config *Config
+	events chan *DenyEvent
+	done   chan struct{}
+}
+
+// SetupDenyNotifier starts posting the proxy's denials through n.
+func (config *Config) SetupDenyNotifier(n *DenyNotifier) error {
+	if n.URL == "" {
+		return errors.New("deny webhook requires a URL")
+	}
+	n.config = config
+	config.DenyNotifier = n
+	n.start()
+	return nil
+}
+
+func (n *DenyNotifier) start() {
+	if n.BatchSize <= 0 {
+		n.BatchSize = defaultDenyWebhookBatchSize
+	}
+	if n.FlushInterval <= 0 {
+		n.FlushInterval = defaultDenyWebhookFlushInterval
+	}
+	if n.MaxRetries == 0 {
+		n.MaxRetries = defaultDenyWebhookMaxRetries
+	}
+	if n.RetryBackoff <= 0 {
+		n.RetryBackoff = defaultDenyWebhookRetryBackoff
+	}
+	n.events = make(chan *DenyEvent, denyWebhookQueueSize)
+	n.done = make(chan struct{})
+	go n.run()
+}
+
+// Notify queues event to be posted, dropping it if the queue is full.
+func (n *DenyNotifier) Notify(event *DenyEvent) {
+	select {
+	case n.events <- event:
+	default:
+		n.config.MetricsClient.Incr("deny_webhook.dropped", []string{}, 1)
+	}
+}
+
+// Close posts the events still queued.
+func (n *DenyNotifier) Close() {
+	close(n.events)
+	<-n.done
+}
+
+func (n *DenyNotifier) run() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(n.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*DenyEvent
+	for {
+		select {
+		case event, ok := <-n.events:
+			if !ok {
+				n.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) < n.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		n.flush(batch)
+		batch = nil
+	}
+}
+
+// flush posts batch, retrying with exponential backoff until it succeeds or
+// the retries run out.
+func (n *DenyNotifier) flush(batch []*DenyEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		n.dropped(len(batch), err)
+		return
+	}
+
+	backoff := n.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = n.post(body)
+		if err == nil {
+			n.config.MetricsClient.Count("deny_webhook.sent", int64(len(batch)), []string{}, 1)
+			return
+		}
+		n.config.MetricsClient.Incr("deny_webhook.error", []string{}, 1)
+		if attempt >= n.MaxRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	n.dropped(len(batch), err)
+}
+
+func (n *DenyNotifier) post(body []byte) error {
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting deny events to %s: unexpected status %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+func (n *DenyNotifier) dropped(count int, err error) {
+	n.config.MetricsClient.Count("deny_webhook.dropped", int64(count), []string{}, 1)
+	n.config.Log.WithFields(log.Fields{
+		"error":  err,
+		"events": count,
+	}).Error("dropped deny webhook events")
+}
+
+// notifyDeny posts a DenyEvent for req if decision denied it, or would have
+// if its role's policy were enforced. Requests that failed for other reasons,
+// or were rate limited, aren't reported.
+func notifyDeny(config *Config, req *http.Request, proxyType string, decision *aclDecision, traceID string, err error) {
+	if config.DenyNotifier == nil || decision == nil {
+		return
+	}
+	var mode string
+	switch {
+	case !decision.allow && !decision.rateLimited:
+		mode = "enforce"
+	case decision.allow && decision.enforceWouldDeny:
+		mode = "report"
+	default:
+		return
+	}
+	if _, ok := err.(denyError); !ok && err != nil {
+		return
+	}
+
+	srcHost, _, _ := net.SplitHostPort(req.RemoteAddr)
+	config.DenyNotifier.Notify(&DenyEvent{
+		Time:          time.Now(),
+		Role:          decision.role,
+		Project:       decision.project,
+		Tenant:        config.tenant,
+		ProxyType:     proxyType,
+		RequestedHost: req.Host,
+		SrcHost:       srcHost,
+		RuleID:        decision.ruleID,
+		Reason:        decision.reason,
+		Mode:          mode,
+		TraceID:       traceID,
+	})
+}
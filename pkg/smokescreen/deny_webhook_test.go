@@ -0,0 +1,82 @@
+package smokescreen
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDenyNotifier(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var mu sync.Mutex
+	var events []DenyEvent
+	failures := 1
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var batch []DenyEvent
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events = append(events, batch...)
+	}))
+	defer webhook.Close()
+
+	conf := NewConfig()
+	r.Error(conf.SetupDenyNotifier(&DenyNotifier{}))
+	r.NoError(conf.SetupDenyNotifier(&DenyNotifier{
+		URL:           webhook.URL,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	}))
+
+	request := func(host string) *goproxy.ProxyCtx {
+		req := httptest.NewRequest("CONNECT", host, nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+		return &goproxy.ProxyCtx{Req: req}
+	}
+	denied := &aclDecision{role: "billing", project: "payments", ruleID: "billing", reason: "host did not match any allowed domain"}
+	logProxy(conf, request("evil.example.com:443"), "connect", nil, denied, "trace-1", time.Now(), denyError{errors.New(denied.reason), "billing"})
+	reported := &aclDecision{role: "web", allow: true, enforceWouldDeny: true, reason: "rule has report policy"}
+	logProxy(conf, request("new.example.com:443"), "connect", nil, reported, "", time.Now(), nil)
+
+	// Allowed, rate limited and failed requests aren't reported.
+	logProxy(conf, request("api.example.com:443"), "connect", nil, &aclDecision{role: "web", allow: true}, "", time.Now(), nil)
+	limited := &aclDecision{role: "web", rateLimited: true}
+	logProxy(conf, request("api.example.com:443"), "connect", nil, limited, "", time.Now(), limited.denyErr())
+	logProxy(conf, request("api.example.com:443"), "connect", nil, &aclDecision{role: "web"}, "", time.Now(), errors.New("boom"))
+
+	// Closing posts the queued events, retrying after the webhook fails.
+	conf.DenyNotifier.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Len(events, 2)
+	a.Equal("billing", events[0].Role)
+	a.Equal("payments", events[0].Project)
+	a.Equal("evil.example.com:443", events[0].RequestedHost)
+	a.Equal("10.0.0.1", events[0].SrcHost)
+	a.Equal("billing", events[0].RuleID)
+	a.Equal("enforce", events[0].Mode)
+	a.Equal("trace-1", events[0].TraceID)
+	a.Equal("connect", events[0].ProxyType)
+	a.Equal("web", events[1].Role)
+	a.Equal("report", events[1].Mode)
+	a.Equal(0, failures)
+}
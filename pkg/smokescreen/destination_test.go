@@ -0,0 +1,49 @@
+package smokescreen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestDestinationNormalization(t *testing.T) {
+	a := assert.New(t)
+
+	// Destinations are decided on in their normalized form, however clients
+	// spell them, and invalid ones are denied.
+	conf := NewConfig()
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"svc": {Policy: acl.Enforce, DomainGlobs: []string{"2001:db8::1", "example.com", "xn--bcher-kva.example"}},
+		},
+	}
+	conf.RoleFromRequest = func(*http.Request) (string, error) {
+		return "svc", nil
+	}
+	req := httptest.NewRequest("CONNECT", "http://example.com/", nil)
+
+	a.True(checkACLsForRequest(conf, req, "[2001:db8::1]:443").allow)
+	a.True(checkACLsForRequest(conf, req, "[2001:DB8:0::1]:443").allow)
+	a.True(checkACLsForRequest(conf, req, "Example.COM.:443").allow)
+	a.True(checkACLsForRequest(conf, req, "bücher.example:443").allow)
+	decision := checkACLsForRequest(conf, req, "exa mple.com:443")
+	a.False(decision.allow)
+	a.Contains(decision.reason, "invalid destination")
+}
+
+func TestParseAddressesPorts(t *testing.T) {
+	a := assert.New(t)
+
+	ranges, err := parseAddresses([]string{"127.0.0.1:8080", "[::1]:443"})
+	a.NoError(err)
+	a.Equal(8080, ranges[0].Port)
+	a.Equal(443, ranges[1].Port)
+
+	for _, addr := range []string{"127.0.0.1:-1", "127.0.0.1:+80", "127.0.0.1:65536", "127.0.0.1:0"} {
+		_, err := parseAddresses([]string{addr})
+		a.Error(err, addr)
+	}
+}
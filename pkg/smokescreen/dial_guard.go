@@ -0,0 +1,62 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DialGuardMode sets what the dialer does when asked to connect to an address
+// the range and classification rules deny.
+type DialGuardMode int
+
+const (
+	DialGuardEnforce DialGuardMode = iota // The dial is refused
+	DialGuardLog                          // The dial goes ahead, but is logged and counted
+)
+
+var dialGuardModes = map[string]DialGuardMode{
+	"enforce": DialGuardEnforce,
+	"log":     DialGuardLog,
+}
+
+func (m DialGuardMode) String() string {
+	return [...]string{"enforce", "log"}[m]
+}
+
+// DialGuardModeFromString parses a dial guard mode. An empty string is
+// DialGuardEnforce.
+func DialGuardModeFromString(s string) (DialGuardMode, error) {
+	if s == "" {
+		return DialGuardEnforce, nil
+	}
+	if m, ok := dialGuardModes[s]; ok {
+		return m, nil
+	}
+	return DialGuardEnforce, fmt.Errorf("unknown dial guard mode %v", s)
+}
+
+// guardDial classifies addr again just before it is dialed. The decision
+// layer should never let a denied address get this far, so a violation here
+// means it has a bug; this second, independent check keeps such a bug from
+// turning into a connection to a private address.
+func guardDial(config *Config, addr *net.TCPAddr) error {
+	classification := classifyAddr(config, addr)
+	if classification.IsAllowed() {
+		return nil
+	}
+
+	mode := config.DialGuardMode
+	config.MetricsClient.Incr("dial_guard.violation", []string{"mode:" + mode.String()}, 1)
+	config.Log.WithFields(logrus.Fields{
+		"address":        addr.String(),
+		"classification": classification.String(),
+		"mode":           mode.String(),
+	}).Error("dialer asked to connect to a denied address")
+
+	if mode == DialGuardLog {
+		return nil
+	}
+	return denyError{error: fmt.Errorf("The destination address (%s) was denied by rule '%s' when dialing", addr.IP, classification)}
+}
@@ -0,0 +1,73 @@
+package smokescreen
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestDialGuard(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// A decision that pinned a loopback address without it being allowed,
+	// as a bug in the decision layer might.
+	addr := ln.Addr().(*net.TCPAddr)
+	userData := func() *ctxUserData {
+		return &ctxUserData{decision: &aclDecision{
+			outboundHost: addr.String(),
+			resolvedAddr: addr,
+		}}
+	}
+
+	conf := NewConfig()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+
+	_, err = dial(conf, "tcp", addr.String(), userData())
+	r.Error(err)
+	_, ok := err.(denyError)
+	a.True(ok)
+
+	conf.DialGuardMode = DialGuardLog
+	conn, err := dial(conf, "tcp", addr.String(), userData())
+	r.NoError(err)
+	conn.Close()
+
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	conf.DialGuardMode = DialGuardEnforce
+	conn, err = dial(conf, "tcp", addr.String(), userData())
+	r.NoError(err)
+	conn.Close()
+}
+
+func TestDialGuardModeFromString(t *testing.T) {
+	a := assert.New(t)
+
+	mode, err := DialGuardModeFromString("")
+	a.NoError(err)
+	a.Equal(DialGuardEnforce, mode)
+
+	mode, err = DialGuardModeFromString("log")
+	a.NoError(err)
+	a.Equal(DialGuardLog, mode)
+
+	_, err = DialGuardModeFromString("warn")
+	a.Error(err)
+}
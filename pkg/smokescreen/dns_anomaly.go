@@ -0,0 +1,185 @@
+package smokescreen
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDNSAnomalyMaxHosts = 10000
+
+	LOGLINE_DNS_ANOMALY = "DNS-ANSWER-ANOMALY"
+)
+
+// AddrInfo describes who announces an address and where it is located.
+type AddrInfo struct {
+	ASN     uint32
+	Country string
+}
+
+// DNSAnomalyDetector remembers the addresses each destination resolved to and
+// reports, as a log line and a metric, when a new answer differs from the
+// previous one in a way that suggests a DNS hijack or rebinding attempt:
+//
+// The destination moved between public, private and mixed address space.
+//
+// No address is announced by the same ASN, or located in the same country,
+// as before. These checks need Lookup to be set, e.g. to a GeoIP database.
+type DNSAnomalyDetector struct {
+	Lookup   func(ip net.IP) (AddrInfo, bool)
+	MaxHosts int // Number of destinations to remember. Defaults to 10000.
+
+	sync.Mutex
+	hosts map[string]*list.Element
+	lru   *list.List
+}
+
+type dnsAnswer struct {
+	host string
+	ips  []net.IP
+}
+
+func NewDNSAnomalyDetector() *DNSAnomalyDetector {
+	return &DNSAnomalyDetector{
+		MaxHosts: defaultDNSAnomalyMaxHosts,
+		hosts:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Observe records the addresses host resolved to and reports any anomaly
+// compared to the previous answer.
+func (d *DNSAnomalyDetector) Observe(config *Config, host string, addrs []*net.TCPAddr) {
+	if net.ParseIP(host) != nil {
+		return
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+
+	previous := d.swap(host, ips)
+	if previous == nil {
+		return
+	}
+
+	for _, kind := range d.anomalies(previous, ips) {
+		config.MetricsClient.Incr("resolver.anomaly", []string{fmt.Sprintf("kind:%s", kind)}, 1)
+		config.Log.WithFields(logrus.Fields{
+			"kind":         kind,
+			"host":         host,
+			"previous_ips": ipStrings(previous),
+			"current_ips":  ipStrings(ips),
+		}).Warn(LOGLINE_DNS_ANOMALY)
+	}
+}
+
+// swap stores the latest answer for host and returns the previous one.
+func (d *DNSAnomalyDetector) swap(host string, ips []net.IP) []net.IP {
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.hosts[host]; ok {
+		answer := e.Value.(*dnsAnswer)
+		previous := answer.ips
+		answer.ips = ips
+		d.lru.MoveToFront(e)
+		return previous
+	}
+
+	d.hosts[host] = d.lru.PushFront(&dnsAnswer{host: host, ips: ips})
+	for d.MaxHosts > 0 && d.lru.Len() > d.MaxHosts {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.hosts, oldest.Value.(*dnsAnswer).host)
+	}
+	return nil
+}
+
+func (d *DNSAnomalyDetector) anomalies(previous, current []net.IP) []string {
+	var kinds []string
+
+	if answerScope(previous) != answerScope(current) {
+		kinds = append(kinds, "scope_changed")
+	}
+
+	if d.Lookup == nil {
+		return kinds
+	}
+
+	prevASNs, prevCountries := d.lookupAll(previous)
+	curASNs, curCountries := d.lookupAll(current)
+	if disjoint(prevASNs, curASNs) {
+		kinds = append(kinds, "asn_changed")
+	}
+	if disjoint(prevCountries, curCountries) {
+		kinds = append(kinds, "country_changed")
+	}
+	return kinds
+}
+
+func (d *DNSAnomalyDetector) lookupAll(ips []net.IP) (map[string]bool, map[string]bool) {
+	asns := make(map[string]bool)
+	countries := make(map[string]bool)
+	for _, ip := range ips {
+		info, ok := d.Lookup(ip)
+		if !ok {
+			continue
+		}
+		if info.ASN != 0 {
+			asns[fmt.Sprint(info.ASN)] = true
+		}
+		if info.Country != "" {
+			countries[info.Country] = true
+		}
+	}
+	return asns, countries
+}
+
+// disjoint reports whether a and b are both known and have nothing in common.
+func disjoint(a, b map[string]bool) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for k := range a {
+		if b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// answerScope reports whether ips are all public, all private, or mixed.
+func answerScope(ips []net.IP) string {
+	var public, private bool
+	for _, ip := range ips {
+		addr := &net.TCPAddr{IP: ip}
+		if ip.IsGlobalUnicast() && !ip.IsLoopback() && !addrIsInRuleRange(PrivateRuleRanges, addr) {
+			public = true
+		} else {
+			private = true
+		}
+	}
+
+	switch {
+	case public && private:
+		return "mixed"
+	case private:
+		return "private"
+	default:
+		return "public"
+	}
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
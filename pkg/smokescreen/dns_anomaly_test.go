@@ -0,0 +1,69 @@
+package smokescreen
+
+import (
+	"net"
+	"testing"
+
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSAnomalyDetector(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	logHook := logrustest.NewLocal(conf.Log)
+
+	d := NewDNSAnomalyDetector()
+	d.Lookup = func(ip net.IP) (AddrInfo, bool) {
+		switch ip.String() {
+		case "8.8.9.1", "8.8.9.2":
+			return AddrInfo{ASN: 15169, Country: "US"}, true
+		case "8.8.10.1":
+			return AddrInfo{ASN: 64500, Country: "US"}, true
+		}
+		return AddrInfo{}, false
+	}
+
+	observe := func(ips ...string) []string {
+		logHook.Reset()
+		addrs := make([]*net.TCPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = &net.TCPAddr{IP: net.ParseIP(ip), Port: 443}
+		}
+		d.Observe(conf, "example.com", addrs)
+
+		var kinds []string
+		for _, entry := range logHook.AllEntries() {
+			if entry.Message == LOGLINE_DNS_ANOMALY {
+				kinds = append(kinds, entry.Data["kind"].(string))
+			}
+		}
+		return kinds
+	}
+
+	a.Empty(observe("8.8.9.1"), "the first answer has nothing to compare to")
+	a.Empty(observe("8.8.9.2"), "a new address in the same network is expected")
+	a.Equal([]string{"asn_changed"}, observe("8.8.10.1"))
+	a.Equal([]string{"scope_changed"}, observe("8.8.10.1", "10.0.0.1"))
+	a.Equal([]string{"scope_changed"}, observe("127.0.0.1"))
+
+	// IP literals are not DNS answers.
+	logHook.Reset()
+	d.Observe(conf, "8.8.9.1", []*net.TCPAddr{{IP: net.ParseIP("8.8.9.1")}})
+	a.Empty(logHook.AllEntries())
+}
+
+func TestDNSAnomalyDetectorBounded(t *testing.T) {
+	d := NewDNSAnomalyDetector()
+	d.MaxHosts = 2
+
+	conf := NewConfig()
+	addrs := []*net.TCPAddr{{IP: net.ParseIP("8.8.9.1")}}
+	for _, host := range []string{"a.test", "b.test", "c.test"} {
+		d.Observe(conf, host, addrs)
+	}
+
+	assert.Len(t, d.hosts, 2)
+	assert.NotContains(t, d.hosts, "a.test")
+}
@@ -0,0 +1,273 @@
+package smokescreen
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSCacheMaxEntries     = 10000
+	defaultDNSCacheMaxTTL         = time.Hour
+	defaultDNSCacheMaxNegativeTTL = 30 * time.Second
+)
+
+// DNSCache keeps the answers to the DNS queries made by the resolver for as
+// long as their TTLs allow, so busy destinations aren't looked up again for
+// every connection. Failed lookups, for names or record types that don't
+// exist, are cached too, for as long as the zone's SOA record allows. Errors
+// and truncated answers are never cached.
+//
+// Answers are cached as the DNS server sent them, under the queried name and
+// record type, so everything built on the resolver, including address
+// classification, sees exactly what it would have without the cache.
+type DNSCache struct {
+	MaxEntries     int           // Number of answers to keep. Defaults to 10000.
+	MaxTTL         time.Duration // Answers are kept at most this long, whatever their TTL. Defaults to 1h.
+	MaxNegativeTTL time.Duration // Failed lookups are kept at most this long. Defaults to 30s.
+
+	config *Config
+
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	lru     *list.List
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	key      dnsCacheKey
+	response []byte
+	expires  time.Time
+}
+
+func NewDNSCache() *DNSCache {
+	return &DNSCache{
+		MaxEntries:     defaultDNSCacheMaxEntries,
+		MaxTTL:         defaultDNSCacheMaxTTL,
+		MaxNegativeTTL: defaultDNSCacheMaxNegativeTTL,
+	}
+}
+
+// SetupDNSCache puts cache in front of the resolver. It must be called after
+// SetResolverAddresses and SetupAddressSelection.
+func (config *Config) SetupDNSCache(cache *DNSCache) {
+	if cache.entries == nil {
+		cache.entries = make(map[dnsCacheKey]*list.Element)
+		cache.lru = list.New()
+	}
+	cache.config = config
+
+	dial := (&net.Dialer{}).DialContext
+	if config.Resolver != nil && config.Resolver.Dial != nil {
+		dial = config.Resolver.Dial
+	}
+	config.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// Truncated answers are retried over TCP, and aren't cached.
+			if pc, ok := conn.(net.PacketConn); ok {
+				return &dnsCacheConn{Conn: conn, pc: pc, cache: cache}, nil
+			}
+			return conn, nil
+		},
+	}
+	config.DNSCache = cache
+}
+
+// queryKey returns the cache key of the DNS query msg.
+func queryKey(msg []byte) (dnsCacheKey, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return dnsCacheKey{}, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsCacheKey{}, false
+	}
+	return dnsCacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		class: q.Class,
+	}, true
+}
+
+// lookup returns the cached answer to query, with query's ID.
+func (c *DNSCache) lookup(key dnsCacheKey, query []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.config.MetricsClient.Incr("resolver.cache.miss", []string{}, 1)
+		return nil, false
+	}
+	entry := elem.Value.(*dnsCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.config.MetricsClient.Incr("resolver.cache.miss", []string{}, 1)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.config.MetricsClient.Incr("resolver.cache.hit", []string{}, 1)
+
+	response := append([]byte(nil), entry.response...)
+	copy(response[:2], query[:2])
+	return response, true
+}
+
+// store caches response, the answer to the query with key, for as long as
+// its TTLs allow.
+func (c *DNSCache) store(key dnsCacheKey, response []byte) {
+	ttl, ok := c.cacheTTL(key, response)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &dnsCacheEntry{
+		key:      key,
+		response: append([]byte(nil), response...),
+		expires:  time.Now().Add(ttl),
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+	c.config.MetricsClient.Gauge("resolver.cache.entries", float64(c.lru.Len()), []string{}, 1)
+}
+
+// cacheTTL returns how long response may be cached, if at all: the lowest
+// TTL of its answers or, if the name or record type doesn't exist, the
+// negative caching TTL of the zone's SOA record (RFC 2308).
+func (c *DNSCache) cacheTTL(key dnsCacheKey, response []byte) (time.Duration, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(response)
+	if err != nil || !header.Response || header.Truncated {
+		return 0, false
+	}
+	q, err := p.Question()
+	if err != nil || strings.ToLower(q.Name.String()) != key.name || q.Type != key.qtype || q.Class != key.class {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return 0, false
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return 0, false
+	}
+	if header.RCode == dnsmessage.RCodeSuccess && len(answers) > 0 {
+		ttl := answers[0].Header.TTL
+		for _, a := range answers[1:] {
+			if a.Header.TTL < ttl {
+				ttl = a.Header.TTL
+			}
+		}
+		return minDuration(time.Duration(ttl)*time.Second, c.MaxTTL), true
+	}
+
+	authorities, err := p.AllAuthorities()
+	if err != nil {
+		return 0, false
+	}
+	for _, a := range authorities {
+		if soa, ok := a.Body.(*dnsmessage.SOAResource); ok {
+			ttl := a.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return minDuration(time.Duration(ttl)*time.Second, c.MaxNegativeTTL), true
+		}
+	}
+	// Without an SOA record, there's no telling how long the name will
+	// stay missing.
+	return 0, false
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if b > 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// dnsCacheConn answers the DNS queries written to it from the cache when it
+// can, and caches the answers it reads otherwise. It must stay a
+// net.PacketConn so the resolver keeps framing messages as datagrams.
+type dnsCacheConn struct {
+	net.Conn
+	pc    net.PacketConn
+	cache *DNSCache
+
+	key     dnsCacheKey
+	miss    bool
+	pending [][]byte // Cached answers not read yet
+}
+
+func (c *dnsCacheConn) Write(b []byte) (int, error) {
+	key, ok := queryKey(b)
+	if !ok {
+		c.miss = false
+		return c.Conn.Write(b)
+	}
+	if response, ok := c.cache.lookup(key, b); ok {
+		c.pending = append(c.pending, response)
+		return len(b), nil
+	}
+	c.key, c.miss = key, true
+	return c.Conn.Write(b)
+}
+
+func (c *dnsCacheConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending[0])
+		c.pending = c.pending[1:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if err == nil && c.miss {
+		c.cache.store(c.key, b[:n])
+	}
+	return n, err
+}
+
+func (c *dnsCacheConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.pc.ReadFrom(b)
+}
+
+func (c *dnsCacheConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
@@ -0,0 +1,108 @@
+package smokescreen
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestDNSCache(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("cached.test", "8.8.9.1")
+
+	config := NewConfig()
+	config.Resolver = dns.Resolver()
+	cache := NewDNSCache()
+	config.SetupDNSCache(cache)
+
+	resolve := func(addr string) (string, error) {
+		resolved, _, err := safeResolve(config, "tcp", addr, acl.AnyFamily, "")
+		if err != nil {
+			return "", err
+		}
+		return resolved.IP.String(), nil
+	}
+
+	ip, err := resolve("cached.test:443")
+	r.NoError(err)
+	a.Equal("8.8.9.1", ip)
+	queries := dns.Queries()
+
+	// Answers are served from the cache until they expire, even once the
+	// name resolves elsewhere.
+	dns.Set("cached.test", "8.8.9.2")
+	ip, err = resolve("cached.test:443")
+	r.NoError(err)
+	a.Equal("8.8.9.1", ip)
+	a.Equal(queries, dns.Queries())
+
+	// So are failed lookups.
+	_, err = resolve("missing.test:443")
+	a.Error(err)
+	queries = dns.Queries()
+	_, err = resolve("missing.test:443")
+	a.Error(err)
+	a.Equal(queries, dns.Queries())
+
+	// Answers are kept no longer than MaxTTL...
+	cache.MaxTTL = 50 * time.Millisecond
+	dns.Set("short.test", "8.8.9.1")
+	_, err = resolve("short.test:443")
+	r.NoError(err)
+	dns.Set("short.test", "8.8.9.2")
+	time.Sleep(100 * time.Millisecond)
+	queries = dns.Queries()
+	ip, err = resolve("short.test:443")
+	r.NoError(err)
+	a.Equal("8.8.9.2", ip)
+	a.True(dns.Queries() > queries)
+
+	// ...and not at all with a zero TTL.
+	dns.Lock()
+	dns.ttl = 0
+	dns.Unlock()
+	dns.Set("uncached.test", "8.8.9.1")
+	_, err = resolve("uncached.test:443")
+	r.NoError(err)
+	queries = dns.Queries()
+	_, err = resolve("uncached.test:443")
+	r.NoError(err)
+	a.True(dns.Queries() > queries)
+}
+
+func TestDNSCacheMaxEntries(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("one.test", "8.8.9.1")
+	dns.Set("two.test", "8.8.9.2")
+
+	config := NewConfig()
+	config.Resolver = dns.Resolver()
+	cache := NewDNSCache()
+	cache.MaxEntries = 2
+	config.SetupDNSCache(cache)
+
+	for _, host := range []string{"one.test", "two.test"} {
+		_, err := config.Resolver.LookupIPAddr(context.Background(), host)
+		r.NoError(err)
+	}
+	a.Len(cache.entries, 2)
+	a.Equal(2, cache.lru.Len())
+
+	// The A and AAAA answers of one.test were evicted.
+	queries := dns.Queries()
+	_, err := config.Resolver.LookupIPAddr(context.Background(), "one.test")
+	r.NoError(err)
+	a.True(dns.Queries() > queries)
+}
@@ -0,0 +1,302 @@
+package smokescreen
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSServer is a minimal UDP DNS server answering A and AAAA queries from
+// a mutable table, used to control what the proxy resolves in tests.
+type testDNSServer struct {
+	conn net.PacketConn
+
+	sync.Mutex
+	answers map[string][]net.IP
+	ttl     uint32
+	queries int
+	options []dnsmessage.Option // EDNS options of the last query
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &testDNSServer{
+		conn:    conn,
+		answers: make(map[string][]net.IP),
+		ttl:     60,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testDNSServer) Close() {
+	s.conn.Close()
+}
+
+// Set replaces the addresses returned for host.
+func (s *testDNSServer) Set(host string, ips ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	var parsed []net.IP
+	for _, ip := range ips {
+		parsed = append(parsed, net.ParseIP(ip))
+	}
+	s.answers[strings.ToLower(strings.TrimSuffix(host, "."))] = parsed
+}
+
+func (s *testDNSServer) Queries() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries
+}
+
+func (s *testDNSServer) Options() []dnsmessage.Option {
+	s.Lock()
+	defer s.Unlock()
+	return s.options
+}
+
+// Resolver returns a net.Resolver that sends every query to this server.
+func (s *testDNSServer) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		q, err := p.Question()
+		if err != nil {
+			continue
+		}
+		s.recordOptions(&p)
+
+		resp, err := s.answer(header, q)
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+func (s *testDNSServer) recordOptions(p *dnsmessage.Parser) {
+	var options []dnsmessage.Option
+	p.SkipAllQuestions()
+	p.SkipAllAnswers()
+	p.SkipAllAuthorities()
+	additionals, _ := p.AllAdditionals()
+	for _, r := range additionals {
+		if opt, ok := r.Body.(*dnsmessage.OPTResource); ok {
+			options = append(options, opt.Options...)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.options = options
+}
+
+func (s *testDNSServer) answer(header dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.queries++
+
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	ips, ok := s.answers[name]
+
+	header.Response = true
+	header.Authoritative = true
+	if !ok {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	answered := false
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			if err := b.AResource(rh, a); err != nil {
+				return nil, err
+			}
+			answered = true
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			if err := b.AAAAResource(rh, aaaa); err != nil {
+				return nil, err
+			}
+			answered = true
+		}
+	}
+
+	if !answered {
+		// Lets resolvers cache that the name or record type doesn't exist.
+		if err := b.StartAuthorities(); err != nil {
+			return nil, err
+		}
+		soa := dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.test."),
+			MBox:   dnsmessage.MustNewName("hostmaster.test."),
+			MinTTL: s.ttl,
+		}
+		if err := b.SOAResource(rh, soa); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func TestDialPinsVettedAddress(t *testing.T) {
+	r := require.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	r.NoError(err)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("rebind.test", "127.0.0.1")
+
+	config := NewConfig()
+	config.Resolver = dns.Resolver()
+	config.ConnTracker = conntrack.NewTracker(config.IdleThreshold, nil, config.Log, atomic.Value{})
+	r.NoError(config.SetAllowRanges([]string{"127.0.0.1/32"}))
+
+	outboundHost := net.JoinHostPort("rebind.test", port)
+	resolved, _, err := safeResolve(config, "tcp", outboundHost, acl.AnyFamily, "")
+	r.NoError(err)
+	queries := dns.Queries()
+
+	// The name now points somewhere that would not pass classification.
+	dns.Set("rebind.test", "127.0.0.2")
+
+	userData := &ctxUserData{
+		start: time.Now(),
+		decision: &aclDecision{
+			allow:        true,
+			outboundHost: outboundHost,
+			resolvedAddr: resolved,
+		},
+	}
+
+	conn, err := dial(config, "tcp", net.JoinHostPort("Rebind.Test.", port), userData)
+	r.NoError(err)
+	conn.Close()
+	r.Equal(ln.Addr().String(), conn.RemoteAddr().String())
+	r.Equal(queries, dns.Queries(), "dial should not resolve the vetted host again")
+
+	// Anything other than the vetted destination is resolved and checked again.
+	dns.Set("other.test", "127.0.0.2")
+	_, err = dial(config, "tcp", net.JoinHostPort("other.test", port), userData)
+	r.Error(err)
+	r.IsType(denyError{}, err)
+}
+
+func TestSafeResolveChecksEveryAddress(t *testing.T) {
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("mixed.test", "8.8.9.1", "10.0.0.5")
+	dns.Set("public.test", "8.8.9.1", "8.8.9.2")
+
+	config := NewConfig()
+	config.Resolver = dns.Resolver()
+
+	_, _, err := safeResolve(config, "tcp", "mixed.test:443", acl.AnyFamily, "")
+	r.Error(err)
+	r.IsType(denyError{}, err)
+	r.Contains(err.Error(), "10.0.0.5")
+
+	resolved, reason, err := safeResolve(config, "tcp", "public.test:443", acl.AnyFamily, "")
+	r.NoError(err)
+	r.Equal(ipAllowDefault.String(), reason)
+	r.Equal(443, resolved.Port)
+
+	config.DialOnlyAllowedAddresses = true
+	resolved, _, err = safeResolve(config, "tcp", "mixed.test:443", acl.AnyFamily, "")
+	r.NoError(err)
+	r.Equal("8.8.9.1", resolved.IP.String())
+}
+
+func TestSafeResolveAddressFamily(t *testing.T) {
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("dual.test", "2001:4860:4860::8888", "8.8.9.1")
+	dns.Set("v6.test", "2001:4860:4860::8888")
+
+	config := NewConfig()
+	config.Resolver = dns.Resolver()
+
+	resolved, _, err := safeResolve(config, "tcp", "dual.test:443", acl.IPv4Only, "")
+	r.NoError(err)
+	r.Equal("8.8.9.1", resolved.IP.String())
+
+	resolved, _, err = safeResolve(config, "tcp", "dual.test:443", acl.IPv6Only, "")
+	r.NoError(err)
+	r.Equal("2001:4860:4860::8888", resolved.IP.String())
+
+	resolved, _, err = safeResolve(config, "tcp", "dual.test:443", acl.PreferIPv4, "")
+	r.NoError(err)
+	r.Equal("8.8.9.1", resolved.IP.String())
+
+	resolved, _, err = safeResolve(config, "tcp", "dual.test:443", acl.PreferIPv6, "")
+	r.NoError(err)
+	r.Equal("2001:4860:4860::8888", resolved.IP.String())
+
+	_, _, err = safeResolve(config, "tcp", "v6.test:443", acl.IPv4Only, "")
+	r.Error(err)
+}
@@ -0,0 +1,40 @@
+package smokescreen
+
+import (
+	"bytes"
+	"net"
+)
+
+var (
+	prefix6to4   = []byte{0x20, 0x02}                                     // 2002::/16
+	prefixTeredo = []byte{0x20, 0x01, 0x00, 0x00}                         // 2001::/32
+	prefixNAT64  = []byte{0x00, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0} // 64:ff9b::/96
+)
+
+// embeddedIPv4 returns the IPv4 address that traffic to ip ends up at, for
+// IPv6 addresses that encode one: IPv4-mapped (::ffff:a.b.c.d), 6to4,
+// Teredo (the client's obfuscated address) and the NAT64 well-known prefix.
+// Otherwise it returns nil.
+//
+// Such addresses are classified by their IPv4 address, so that the deny
+// ranges, which are usually only written for IPv4, can't be bypassed by
+// resolving a name to one of these encodings. Deny ranges written for the
+// IPv6 address itself apply too.
+func embeddedIPv4(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	switch {
+	case bytes.HasPrefix(ip, prefixNAT64):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+	case bytes.HasPrefix(ip, prefixTeredo):
+		return net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15]).To4()
+	case bytes.HasPrefix(ip, prefix6to4):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4()
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package smokescreen
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// ExtAuthzServer lets a service mesh enforce smokescreen's egress policy
+// without routing traffic through the proxy. It implements the HTTP variant
+// of Envoy's external authorization service (ext_authz with http_service):
+// Envoy sends it the headers of every egress request, and it answers 200 if
+// the ACL allows the request, or the response the client should get if not.
+//
+// The checked request's Host header names the destination, and its method
+// and path are checked against the role's TLS inspection rule, if any. The
+// role is taken from the check request with RoleFromRequest, so Envoy must
+// be configured to pass along whatever that relies on, such as the
+// X-Smokescreen-Role header.
+type ExtAuthzServer struct {
+	config *Config
+	ln     net.Listener
+	server *http.Server
+}
+
+// StartExtAuthzServer starts answering authorization checks on
+// config.ExtAuthzAddr.
+func StartExtAuthzServer(config *Config) (*ExtAuthzServer, error) {
+	s := &ExtAuthzServer{config: config}
+	s.server = &http.Server{Handler: s}
+
+	ln, err := net.Listen("tcp", config.ExtAuthzAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.ln = ln
+
+	go func() {
+		if err := s.server.Serve(ln); err != http.ErrServerClosed {
+			config.Log.Errorf("ext_authz serve error: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *ExtAuthzServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *ExtAuthzServer) Shutdown() {
+	s.server.Close()
+}
+
+func (s *ExtAuthzServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	config := s.config
+
+	traceCtx, span := startRequestSpan(config, req, "smokescreen.ext_authz")
+	req = req.WithContext(traceCtx)
+	userData := &ctxUserData{
+		start:    time.Now(),
+		traceId:  req.Header.Get(traceHeader),
+		traceCtx: traceCtx,
+		span:     span,
+	}
+	ctx := &goproxy.ProxyCtx{Req: req, UserData: userData}
+
+	decision, err := checkIfRequestShouldBeProxied(config, req, extAuthzOutboundHost(req))
+	userData.decision = decision
+	if err == nil && decision.allow {
+		// A denial is recorded in the decision.
+		checkHTTPRules(config, decision, req)
+	}
+	logProxy(config, ctx, "ext_authz", decision.resolvedAddr, decision, userData.traceId, userData.start, err)
+
+	if err == nil && !decision.allow {
+		err = decision.denyErr()
+	}
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	resp := rejectResponse(req, config, err)
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	status := resp.StatusCode
+	if status == http.StatusProxyAuthRequired {
+		// Envoy passes the status on to the client, which isn't talking to
+		// a proxy as far as it knows.
+		status = http.StatusForbidden
+	}
+	w.WriteHeader(status)
+	io.Copy(w, resp.Body)
+}
+
+// extAuthzOutboundHost returns the destination of the checked request as an
+// address parsable by net.ResolveTCPAddr, defaulting the port from the
+// X-Forwarded-Proto header Envoy sets.
+func extAuthzOutboundHost(req *http.Request) string {
+	if strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "http") {
+		return hostport.WithDefaultPort(req.Host, "http")
+	}
+	return hostport.WithDefaultPort(req.Host, "https")
+}
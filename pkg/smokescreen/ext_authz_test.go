@@ -0,0 +1,91 @@
+package smokescreen
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestExtAuthz(t *testing.T) {
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("api.partner.test", "8.8.9.1")
+	dns.Set("internal.test", "10.0.0.1")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"payments": {
+				Policy:      acl.Enforce,
+				DomainGlobs: []string{"api.partner.test", "internal.test"},
+				Mitm:        &acl.MitmRule{AllowedPaths: []string{"/v1/*"}},
+			},
+		},
+	}
+
+	srv := httptest.NewServer(&ExtAuthzServer{config: conf})
+	defer srv.Close()
+
+	check := func(host, path string) (int, string) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		r.NoError(err)
+		req.Host = host
+		req.Header.Set("X-Smokescreen-Role", "payments")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		resp, err := http.DefaultClient.Do(req)
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		status, _ := check("api.partner.test", "/v1/charges")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("domain not in ACL", func(t *testing.T) {
+		status, body := check("example.test", "/v1/charges")
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Contains(t, body, "Egress proxying is denied to host 'example.test'")
+	})
+
+	t.Run("private address", func(t *testing.T) {
+		status, _ := check("internal.test", "/v1/charges")
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("path not allowed", func(t *testing.T) {
+		status, body := check("api.partner.test", "/admin")
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Contains(t, body, "GET /admin is not allowed for role")
+	})
+}
+
+func TestExtAuthzOutboundHost(t *testing.T) {
+	a := assert.New(t)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	a.Equal("example.com:443", extAuthzOutboundHost(req))
+
+	req.Header.Set("X-Forwarded-Proto", "http")
+	a.Equal("example.com:80", extAuthzOutboundHost(req))
+
+	req.Host = "example.com:8443"
+	a.Equal("example.com:8443", extAuthzOutboundHost(req))
+
+	req.Host = "[2001:db8::1]"
+	a.Equal("[2001:db8::1]:80", extAuthzOutboundHost(req))
+}
@@ -0,0 +1,89 @@
+package smokescreen
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileWatcher reloads what was loaded from a set of files, such as the
+// client CAs or the role alias file, when any of them changes. Changes are
+// spotted by modification time and size. A reload that fails is retried on
+// every poll until one succeeds, so files replaced one after the other, like
+// a certificate and its key, are picked up once they're consistent.
+type fileWatcher struct {
+	config *Config
+	files  []string
+	reload func() error
+	metric string // The prefix of the <metric>.reload and <metric>.reload_error counters
+	what   string // What the files hold, for logs
+	onPoll func() // If set, called on every poll
+
+	lastMod string // The modification times of the files as of the last successful load
+}
+
+// newFileWatcher returns a watcher calling reload when files change. It
+// takes the modification times of files as they are now, so it should be
+// created before they're first loaded for a change made meanwhile to be
+// picked up.
+func newFileWatcher(config *Config, files []string, metric, what string, reload func() error) *fileWatcher {
+	return &fileWatcher{
+		config:  config,
+		files:   files,
+		reload:  reload,
+		metric:  metric,
+		what:    what,
+		lastMod: fileModTimes(files),
+	}
+}
+
+// watch polls the files every interval until the proxy shuts down.
+func (w *fileWatcher) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if shuttingDown, _ := w.config.ShuttingDown.Load().(bool); shuttingDown {
+			return
+		}
+		if w.onPoll != nil {
+			w.onPoll()
+		}
+		w.poll()
+	}
+}
+
+// poll reloads the files if they have changed since they were last loaded.
+func (w *fileWatcher) poll() {
+	modTimes := fileModTimes(w.files)
+	if modTimes == w.lastMod {
+		return
+	}
+
+	if err := w.reload(); err != nil {
+		w.config.MetricsClient.Incr(w.metric+".reload_error", []string{}, 1)
+		w.config.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorf("failed to reload %s", w.what)
+		return
+	}
+	w.lastMod = modTimes
+	w.config.MetricsClient.Incr(w.metric+".reload", []string{}, 1)
+	w.config.Log.Printf("reloaded %s", w.what)
+}
+
+// fileModTimes summarizes the modification times and sizes of files so
+// changes to any of them can be detected with a single comparison.
+func fileModTimes(files []string) string {
+	var sum string
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			sum += f + ":missing;"
+			continue
+		}
+		sum += fmt.Sprintf("%s:%d:%d;", f, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return sum
+}
@@ -0,0 +1,83 @@
+package smokescreen
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileWatcher(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-watch")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watched")
+	r.NoError(ioutil.WriteFile(path, []byte("a"), 0644))
+
+	var reloads int
+	var reloadErr error
+	conf := NewConfig()
+	w := newFileWatcher(conf, []string{path}, "test", "test file", func() error {
+		reloads++
+		return reloadErr
+	})
+
+	// Unchanged files aren't reloaded.
+	w.poll()
+	a.Equal(0, reloads)
+
+	r.NoError(ioutil.WriteFile(path, []byte("ab"), 0644))
+	w.poll()
+	a.Equal(1, reloads)
+	w.poll()
+	a.Equal(1, reloads)
+
+	// A failed reload is retried until it succeeds.
+	reloadErr = errors.New("not yet")
+	r.NoError(ioutil.WriteFile(path, []byte("abc"), 0644))
+	w.poll()
+	w.poll()
+	a.Equal(3, reloads)
+	reloadErr = nil
+	w.poll()
+	w.poll()
+	a.Equal(4, reloads)
+
+	// Removing a file counts as a change.
+	r.NoError(os.Remove(path))
+	w.poll()
+	a.Equal(5, reloads)
+}
+
+func TestFileWatcherStopsOnShutdown(t *testing.T) {
+	conf := NewConfig()
+	polls := make(chan struct{}, 1)
+	w := newFileWatcher(conf, nil, "test", "test file", func() error { return nil })
+	w.onPoll = func() {
+		select {
+		case polls <- struct{}{}:
+		default:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.watch(time.Millisecond)
+		close(done)
+	}()
+	<-polls
+	conf.ShuttingDown.Store(true)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher didn't stop on shutdown")
+	}
+}
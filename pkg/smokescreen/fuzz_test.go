@@ -0,0 +1,96 @@
+//go:build fuzz
+// +build fuzz
+
+package smokescreen
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// FuzzCheckDestination checks that deciding on CONNECT targets, which
+// clients control, never crashes, and never allows one that isn't valid.
+func FuzzCheckDestination(f *testing.F) {
+	for _, seed := range []string{
+		"example.com:443",
+		"Example.COM.:80",
+		"api.example.com:443",
+		"bücher.example.com:443",
+		"127.0.0.1:8080",
+		"[::1]:443",
+		"[fe80::1%eth0]:443",
+		"example.com",
+		":443",
+		"example.com:-1",
+		"exa mple.com:443",
+	} {
+		f.Add(seed)
+	}
+
+	conf := NewConfig()
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"svc": {Policy: acl.Enforce, DomainGlobs: []string{"*.example.com"}},
+		},
+	}
+	conf.RoleFromRequest = func(*http.Request) (string, error) {
+		return "svc", nil
+	}
+
+	f.Fuzz(func(t *testing.T, target string) {
+		_, _, err := hostport.Split(target)
+		req := httptest.NewRequest("CONNECT", "http://example.com/", nil)
+		decision := checkACLsForRequest(conf, req, target)
+		if decision.allow && err != nil {
+			t.Fatalf("invalid target %q allowed: %v", target, err)
+		}
+	})
+}
+
+// FuzzParseRanges checks that the parsers of the configured ranges and
+// addresses never crash, and only accept ranges that contain themselves and
+// ports that exist.
+func FuzzParseRanges(f *testing.F) {
+	for _, seed := range []string{
+		"10.0.0.0/8",
+		"10.0.0.1/8",
+		"2001:db8::/32",
+		"::ffff:10.0.0.0/104",
+		"10.0.0.0/33",
+		"127.0.0.1",
+		"127.0.0.1:8080",
+		"[::1]:8080",
+		"127.0.0.1:-1",
+		"127.0.0.1:99999",
+		"example.com",
+		"*.example.com",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		if ranges, err := parseRanges([]string{s}); err == nil {
+			if !ranges[0].Net.Contains(ranges[0].Net.IP) {
+				t.Fatalf("range %q doesn't contain its own address", s)
+			}
+		}
+		if ranges, err := parseAddresses([]string{s}); err == nil {
+			if ranges[0].Port < 0 || ranges[0].Port > 65535 {
+				t.Fatalf("address %q parsed with port %d", s, ranges[0].Port)
+			}
+			if !ranges[0].Net.Contains(ranges[0].Net.IP) {
+				t.Fatalf("address %q doesn't match itself", s)
+			}
+		}
+
+		conf := NewConfig()
+		if err := conf.SetupUpstreamProxyBypass([]string{s}); err == nil {
+			conf.bypassesUpstreamProxy(s, net.ParseIP(s))
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package smokescreen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readinessResolverTimeout bounds the lookup /readyz checks the resolver with.
+const readinessResolverTimeout = 2 * time.Second
+
+// healthState tracks what /readyz reports about the proxy's lifecycle. It is
+// shared with tenants, which become ready and start draining along with the
+// main listener.
+type healthState struct {
+	listening int32 // 0 if the proxy wasn't started by StartWithConfig, 1 while it is serving, 2 once it has stopped
+	draining  int32 // Set once the proxy has started shutting down
+}
+
+func (h *healthState) setListening(listening bool) {
+	if listening {
+		atomic.StoreInt32(&h.listening, 1)
+	} else {
+		atomic.StoreInt32(&h.listening, 2)
+	}
+}
+
+func (h *healthState) setDraining() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// ReadinessCheck is the outcome of one of the checks /readyz makes.
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthEndpoints answers the /healthz and /readyz requests made to the
+// proxy itself, rather than through it, and passes the rest to proxy.
+// Proxy requests name their destination in the request URI, so they can't
+// be mistaken for these.
+func healthEndpoints(config *Config, proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Host == "" && req.Method != http.MethodConnect {
+			switch req.URL.Path {
+			case "/healthz":
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Write([]byte("ok\n"))
+				return
+			case "/readyz":
+				serveReadiness(config, w, req)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, req)
+	})
+}
+
+func serveReadiness(config *Config, w http.ResponseWriter, req *http.Request) {
+	checks := readinessChecks(config, req.Context())
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		config.MetricsClient.Incr("health.not_ready", []string{}, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Ready  bool             `json:"ready"`
+		Checks []ReadinessCheck `json:"checks"`
+	}{ready, checks})
+}
+
+// readinessChecks reports whether the proxy should be sent traffic: its
+// egress ACL, if one is configured, has been loaded, its resolver answers,
+// its listener is being served and it isn't shutting down.
+func readinessChecks(config *Config, ctx context.Context) []ReadinessCheck {
+	var checks []ReadinessCheck
+	add := func(name string, err error) {
+		check := ReadinessCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	// The ACL is loaded before the listener is served, but a polling ACL
+	// may have been set up without one.
+	var aclErr error
+	if p, ok := config.EgressACL.(*PollingACL); ok && p.current.Load() == nil {
+		aclErr = errors.New("egress ACL not loaded")
+	}
+	add("acl", aclErr)
+
+	add("resolver", checkResolver(config, ctx))
+
+	var listenErr, drainErr error
+	if h := config.health; h != nil {
+		if atomic.LoadInt32(&h.listening) == 2 {
+			listenErr = errors.New("listener closed")
+		}
+		if atomic.LoadInt32(&h.draining) == 1 {
+			drainErr = errors.New("shutting down")
+		}
+	}
+	if shuttingDown, _ := config.ShuttingDown.Load().(bool); shuttingDown {
+		drainErr = errors.New("shutting down")
+	}
+	add("listener", listenErr)
+	add("draining", drainErr)
+	return checks
+}
+
+// checkResolver asks the resolver for the root zone's name servers, which
+// any resolver able to resolve destinations can answer. A name that isn't
+// found still means the resolver answered.
+func checkResolver(config *Config, ctx context.Context) error {
+	resolver := config.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessResolverTimeout)
+	defer cancel()
+
+	_, err := resolver.LookupNS(ctx, ".")
+	if err != nil && isResolverOutage(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package smokescreen
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.HealthEndpoints = true
+	proxy := httptest.NewServer(buildHandler(conf))
+	defer proxy.Close()
+
+	readiness := func() (int, map[string]string) {
+		resp, err := http.Get(proxy.URL + "/readyz")
+		r.NoError(err)
+		defer resp.Body.Close()
+		var body struct {
+			Ready  bool
+			Checks []ReadinessCheck
+		}
+		r.NoError(json.NewDecoder(resp.Body).Decode(&body))
+		a.Equal(resp.StatusCode == http.StatusOK, body.Ready)
+		failed := make(map[string]string)
+		for _, check := range body.Checks {
+			if !check.OK {
+				failed[check.Name] = check.Error
+			}
+		}
+		return resp.StatusCode, failed
+	}
+
+	resp, err := http.Get(proxy.URL + "/healthz")
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+
+	status, failed := readiness()
+	a.Equal(http.StatusOK, status)
+	a.Empty(failed)
+
+	// Draining proxies aren't ready, but are still alive.
+	conf.health.setListening(true)
+	conf.health.setDraining()
+	status, failed = readiness()
+	a.Equal(http.StatusServiceUnavailable, status)
+	a.Equal(map[string]string{"draining": "shutting down"}, failed)
+
+	conf.health.setListening(false)
+	dns.Close()
+	status, failed = readiness()
+	a.Equal(http.StatusServiceUnavailable, status)
+	a.Contains(failed, "listener")
+	a.Contains(failed, "resolver")
+
+	resp, err = http.Get(proxy.URL + "/healthz")
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,48 @@
+//go:build fuzz
+// +build fuzz
+
+package hostport
+
+import (
+	"testing"
+)
+
+// FuzzSplit checks that destinations, which clients control, either split
+// into a normalized host and port that survive a round trip, or are
+// rejected.
+func FuzzSplit(f *testing.F) {
+	for _, seed := range []string{
+		"example.com:443",
+		"Example.COM.:80",
+		"bücher.example:443",
+		"127.0.0.1:8080",
+		"[::1]:443",
+		"[::ffff:127.0.0.1]:443",
+		"[fe80::1%eth0]:443",
+		"example.com",
+		":443",
+		"example.com:-1",
+		"example.com:99999",
+		"exa mple.com:443",
+		"user@example.com:443",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, target string) {
+		host, port, err := Split(target)
+		if err != nil {
+			return
+		}
+		if host == "" || port < 0 || port > 65535 {
+			t.Fatalf("%q split into host %q and port %d", target, host, port)
+		}
+		again, againPort, err := Split(Join(host, port))
+		if err != nil || again != host || againPort != port {
+			t.Fatalf("%q split into %q:%d, which doesn't round trip: %v", target, host, port, err)
+		}
+		if normalized, err := Normalize(host); err != nil || normalized != host {
+			t.Fatalf("%q split into host %q, which isn't normalized: %q, %v", target, host, normalized, err)
+		}
+	})
+}
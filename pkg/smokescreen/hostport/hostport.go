@@ -0,0 +1,168 @@
+// Package hostport parses, validates and normalizes the host:port
+// destinations of proxy requests. Clients control the CONNECT target and
+// Host header, so every part of the proxy that looks at a destination, from
+// the ACL to the dialer and the logs, goes through this package to see the
+// same host.
+package hostport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Split splits hostport, a destination such as "example.com:443" or
+// "[2001:db8::1]:443", into its normalized host, as returned by Normalize,
+// and its port. It rejects anything that isn't a plausible destination: a
+// missing or empty host, a port that isn't a number between 0 and 65535,
+// an IPv6 address with a zone, or a name DNS names can't be.
+func Split(hostport string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := ParsePort(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%q has an invalid port", hostport)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("%q has no host", hostport)
+	}
+	host, err = Normalize(host)
+	if err != nil {
+		return "", 0, fmt.Errorf("%q has an invalid host", hostport)
+	}
+	return host, port, nil
+}
+
+// ParsePort parses a port number between 0 and 65535, in decimal.
+func ParsePort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return int(port), nil
+}
+
+// Join joins host and port into a destination, bracketing IPv6 addresses.
+func Join(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Normalize returns the canonical form of host, a DNS name or IP address:
+// names are lowercased, internationalized ones converted to their ASCII
+// form, and stripped of any trailing dot, and addresses are stripped of
+// brackets and formatted as net.IP does. Zoned IPv6 addresses and names with
+// characters DNS names can't have are rejected.
+func Normalize(host string) (string, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		ip := net.ParseIP(host[1 : len(host)-1])
+		if ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("invalid IPv6 address %q", host)
+		}
+		return ip.String(), nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	name := host
+	if !isASCII(name) {
+		var err error
+		name, err = idna.Lookup.ToASCII(name)
+		if err != nil {
+			return "", fmt.Errorf("invalid internationalized name %q: %v", host, err)
+		}
+	}
+	if !ValidHostname(name) {
+		return "", fmt.Errorf("invalid host name %q", host)
+	}
+	return strings.ToLower(strings.TrimSuffix(name, ".")), nil
+}
+
+// ValidHostname reports whether host could be a DNS name: dot-separated
+// labels of at most 63 letters, digits, hyphens and underscores, with an
+// optional trailing dot.
+func ValidHostname(host string) bool {
+	if host == "" || len(host) > 254 || (len(host) == 254 && host[253] != '.') {
+		return false
+	}
+	label := 0
+	for i := 0; i < len(host); i++ {
+		switch c := host[i]; {
+		case c == '.':
+			if label == 0 {
+				return false
+			}
+			label = 0
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+			label++
+			if label > 63 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WithDefaultPort returns hostport with the default port of scheme added if
+// it has none: 80 for http and ws, 443 for https and wss, and 0 otherwise.
+// Bracketed IPv6 addresses without a port are recognized as such.
+func WithDefaultPort(hostport, scheme string) string {
+	if strings.LastIndex(hostport, ":") > strings.LastIndex(hostport, "]") {
+		return hostport
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	switch strings.ToLower(scheme) {
+	case "http", "ws":
+		return net.JoinHostPort(host, "80")
+	case "https", "wss":
+		return net.JoinHostPort(host, "443")
+	default:
+		return net.JoinHostPort(host, "0")
+	}
+}
+
+// Host returns the normalized host of hostport, whatever its port, or of
+// hostport itself if it has no port. Unlike Split, it doesn't reject
+// invalid hosts, which are only lowercased and stripped of any trailing dot,
+// so it suits keying and matching destinations that have already been
+// vetted or that only need to be reported.
+func Host(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if normalized, err := Normalize(host); err == nil {
+		return normalized
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Equal reports whether a and b are the same destination: the same port,
+// and hosts that normalize to the same.
+func Equal(a, b string) bool {
+	aHost, aPort, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	bHost, bPort, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+	return aPort == bPort && Host(aHost) == Host(bHost)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
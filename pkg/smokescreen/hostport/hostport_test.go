@@ -0,0 +1,181 @@
+package hostport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	a := assert.New(t)
+
+	for target, want := range map[string]struct {
+		host string
+		port int
+	}{
+		"example.com:443":              {"example.com", 443},
+		"Example.COM.:80":              {"example.com", 80},
+		"_srv.example.com:0":           {"_srv.example.com", 0},
+		"localhost:65535":              {"localhost", 65535},
+		"127.0.0.1:8080":               {"127.0.0.1", 8080},
+		"[2001:db8::1]:443":            {"2001:db8::1", 443},
+		"[2001:DB8:0:0:0:0:0:1]:443":   {"2001:db8::1", 443},
+		"[::ffff:127.0.0.1]:443":       {"127.0.0.1", 443},
+		"bücher.example:443":           {"xn--bcher-kva.example", 443},
+		"BÜCHER.example.:443":          {"xn--bcher-kva.example", 443},
+		"xn--bcher-kva.example:443":    {"xn--bcher-kva.example", 443},
+		"例え.テスト:443":                   {"xn--r8jz45g.xn--zckzah", 443},
+		"a.b.c.d.e.f.example.com:443":  {"a.b.c.d.e.f.example.com", 443},
+		"example.com:0443":             {"example.com", 443},
+		"123.example.com:1":            {"123.example.com", 1},
+		"a-b.example.com:443":          {"a-b.example.com", 443},
+		"EXAMPLE.com.:443":             {"example.com", 443},
+		"[fe80::1]:443":                {"fe80::1", 443},
+		"[::]:443":                     {"::", 443},
+		"0.0.0.0:443":                  {"0.0.0.0", 443},
+		"xn--r8jz45g.xn--zckzah.:8443": {"xn--r8jz45g.xn--zckzah", 8443},
+		"sub_domain.example.com:443":   {"sub_domain.example.com", 443},
+		"1.example.com.:80":            {"1.example.com", 80},
+		"[2001:db8::1.2.3.4]:443":      {"2001:db8::102:304", 443},
+		"[2001:db8:0::0:1]:443":        {"2001:db8::1", 443},
+		"a.example.com:443":            {"a.example.com", 443},
+		"example:443":                  {"example", 443},
+		"com.:443":                     {"com", 443},
+		"xn--nxasmq6b.example.com:443": {"xn--nxasmq6b.example.com", 443},
+		"[0:0:0:0:0:0:0:1]:80":         {"::1", 80},
+		"2130706433.example.com:80":    {"2130706433.example.com", 80},
+		"EXAMPLE-123.COM:80":           {"example-123.com", 80},
+		"ex--ample.com:80":             {"ex--ample.com", 80},
+		"[127.0.0.1]:443":              {"127.0.0.1", 443},
+		"[Example.com]:443":            {"example.com", 443},
+		"a23456789012345678901234567890123456789012345678901234567890123.com:80": {
+			"a23456789012345678901234567890123456789012345678901234567890123.com", 80,
+		},
+	} {
+		host, port, err := Split(target)
+		if a.NoError(err, target) {
+			a.Equal(want.host, host, target)
+			a.Equal(want.port, port, target)
+		}
+	}
+
+	for _, target := range []string{
+		"",
+		"example.com",
+		"example.com:",
+		":443",
+		"[]:443",
+		"example.com:+443",
+		"example.com:-1",
+		"example.com:65536",
+		"example.com:99999999999999999999",
+		"example.com:https",
+		"example.com:0x1bb",
+		"example.com:443:443",
+		"2001:db8::1:443",
+		"[2001:db8::1]",
+		"[fe80::1%eth0]:443",
+		"[fe80::1%25eth0]:443",
+		"exa mple.com:443",
+		"user@example.com:443",
+		"example.com/path:443",
+		"example..com:443",
+		".example.com:443",
+		"example.com..:443",
+		"*.example.com:443",
+		"exa\x00mple.com:443",
+		"exa%2Emple.com:443",
+		"a234567890123456789012345678901234567890123456789012345678901234.com:80",
+	} {
+		_, _, err := Split(target)
+		a.Error(err, target)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	a := assert.New(t)
+
+	for host, want := range map[string]string{
+		"Example.COM":     "example.com",
+		"example.com.":    "example.com",
+		"[2001:db8::1]":   "2001:db8::1",
+		"2001:DB8::1":     "2001:db8::1",
+		"bücher.example":  "xn--bcher-kva.example",
+		"Bücher.Example.": "xn--bcher-kva.example",
+		"127.0.0.1":       "127.0.0.1",
+	} {
+		got, err := Normalize(host)
+		if a.NoError(err, host) {
+			a.Equal(want, got, host)
+		}
+	}
+
+	for _, host := range []string{"", ".", "[127.0.0.1]", "[2001:db8::1", "fe80::1%eth0", "exa mple.com"} {
+		_, err := Normalize(host)
+		a.Error(err, host)
+	}
+
+	long := ""
+	for i := 0; i < 4; i++ {
+		long += "a23456789012345678901234567890123456789012345678901234567890123."
+	}
+	a.Len(long, 256)
+	_, err := Normalize(long[:253])
+	a.NoError(err)
+	_, err = Normalize(long[:253] + ".")
+	a.NoError(err)
+	_, err = Normalize(long[:253] + "a")
+	a.Error(err)
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	a := assert.New(t)
+
+	for _, c := range []struct{ hostport, scheme, want string }{
+		{"example.com", "http", "example.com:80"},
+		{"example.com", "HTTPS", "example.com:443"},
+		{"example.com", "ws", "example.com:80"},
+		{"example.com", "wss", "example.com:443"},
+		{"example.com", "ftp", "example.com:0"},
+		{"example.com:8080", "http", "example.com:8080"},
+		{"[2001:db8::1]", "https", "[2001:db8::1]:443"},
+		{"[2001:db8::1]:8443", "https", "[2001:db8::1]:8443"},
+		{"127.0.0.1", "http", "127.0.0.1:80"},
+	} {
+		a.Equal(c.want, WithDefaultPort(c.hostport, c.scheme), c.hostport)
+	}
+}
+
+func TestHostAndEqual(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("example.com", Host("Example.COM.:443"))
+	a.Equal("example.com", Host("example.com"))
+	a.Equal("2001:db8::1", Host("[2001:db8::1]:443"))
+	a.Equal("xn--bcher-kva.example", Host("bücher.example:443"))
+	a.Equal("exa mple.com", Host("Exa Mple.com.:443"), "invalid hosts are still keyed")
+
+	a.True(Equal("example.com:443", "EXAMPLE.com.:443"))
+	a.True(Equal("bücher.example:443", "xn--bcher-kva.example:443"))
+	a.True(Equal("[2001:db8::1]:443", "[2001:DB8:0::1]:443"))
+	a.False(Equal("example.com:443", "example.com:80"))
+	a.False(Equal("example.com:443", "example.org:443"))
+	a.False(Equal("example.com", "example.com"))
+
+	a.Equal("example.com:443", Join("example.com", 443))
+	a.Equal("[2001:db8::1]:443", Join("2001:db8::1", 443))
+}
+
+func TestParsePort(t *testing.T) {
+	a := assert.New(t)
+
+	for s, want := range map[string]int{"0": 0, "80": 80, "65535": 65535, "00443": 443} {
+		port, err := ParsePort(s)
+		a.NoError(err, s)
+		a.Equal(want, port, s)
+	}
+	for _, s := range []string{"", "-1", "+80", "65536", "http", " 80", "8 0"} {
+		_, err := ParsePort(s)
+		a.Error(err, s)
+	}
+}
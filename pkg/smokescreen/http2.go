@@ -0,0 +1,139 @@
+package smokescreen
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/transport"
+	"github.com/sirupsen/logrus"
+)
+
+// SetupHTTP2 lets TLS clients negotiate HTTP/2, so that they can multiplex
+// many CONNECT tunnels over one connection to the proxy instead of setting up
+// a connection, and TLS handshake, for each.
+func (config *Config) SetupHTTP2() error {
+	if config.TlsConfig == nil {
+		return errors.New("HTTP/2 requires TLS to be set up")
+	}
+	config.TlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	return nil
+}
+
+// withHTTP2Connect serves the CONNECT requests made over HTTP/2, whose
+// tunnels are streams rather than connections, itself: goproxy hijacks the
+// connection of CONNECT requests, which HTTP/2 doesn't allow.
+func withHTTP2Connect(config *Config, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && req.Method == http.MethodConnect {
+			serveHTTP2Connect(config, w, req)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// serveHTTP2Connect decides a CONNECT request made over HTTP/2 like any
+// other, and tunnels the request's stream to the destination.
+func serveHTTP2Connect(config *Config, w http.ResponseWriter, req *http.Request) {
+	traceCtx, span := startRequestSpan(config, req, "smokescreen.connect")
+	req = req.WithContext(traceCtx)
+	userData := &ctxUserData{start: time.Now(), traceCtx: traceCtx, span: span, connect: true}
+	ctx := &goproxy.ProxyCtx{Req: req, UserData: userData}
+	config.MetricsClient.Incr("http2.connect", []string{}, 1)
+
+	if err := handleConnect(config, ctx); err != nil {
+		writeResponse(w, rejectResponse(req, config, err))
+		return
+	}
+	if mitmTunnel(ctx) != nil {
+		// Intercepting the tunnel's TLS needs the connection to itself.
+		http.Error(w, "TLS inspection requires CONNECT over HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	conn, err := dialHTTP2Tunnel(config, req.Host, userData)
+	if err != nil {
+		config.Log.WithFields(logrus.Fields{
+			"requested_host": req.Host,
+			"error":          err,
+		}).Warn("failed to dial HTTP/2 CONNECT destination")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Like goproxy's tunnels, the tunnel ends once either side is done.
+	go func() {
+		io.Copy(conn, req.Body)
+		conn.Close()
+	}()
+	io.Copy(&flushWriter{w: w, f: flusher}, conn)
+}
+
+// dialHTTP2Tunnel connects to the destination of an HTTP/2 CONNECT request.
+// goproxy honors the https_proxy environment variable for the CONNECT
+// requests it serves, so these do too.
+func dialHTTP2Tunnel(config *Config, host string, userData *ctxUserData) (net.Conn, error) {
+	var envProxy *url.URL
+	if userData.decision.upstreamProxy == nil && !config.IgnoreProxyEnvironment {
+		var err error
+		envProxy, err = transport.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: host}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if envProxy == nil {
+		return dial(config, "tcp", host, userData)
+	}
+
+	conn, err := dial(config, "tcp", upstreamProxyAddr(envProxy), userData)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := connectThroughProxy(conn, envProxy, host, make(http.Header), connectTimeout(config, true, true))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// writeResponse writes resp, built for goproxy, to w.
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// flushWriter flushes each write to the client, so that tunneled data isn't
+// held back in the HTTP/2 server's buffers.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
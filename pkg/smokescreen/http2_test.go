@@ -0,0 +1,126 @@
+package smokescreen
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestHTTP2Connect(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fmt.Fprintf(conn, "echo %s", line)
+				}
+			}()
+		}
+	}()
+
+	_, echoPort, err := net.SplitHostPort(echo.Addr().String())
+	r.NoError(err)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("echo.test", "127.0.0.1")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.Resolver = dns.Resolver()
+	conf.ConnectTimeout = 5 * time.Second
+	conf.IgnoreProxyEnvironment = true
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return "web", nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"web": {Policy: acl.Enforce, DomainGlobs: []string{"echo.test"}},
+		},
+	}
+	a.EqualError(conf.SetupHTTP2(), "HTTP/2 requires TLS to be set up")
+	r.NoError(conf.SetupTls(testPkiDir+"server.pem", testPkiDir+"server-key.pem", nil))
+	r.NoError(conf.SetupHTTP2())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	server := &http.Server{Handler: buildHandler(conf)}
+	go server.Serve(wrapListener(conf, ln))
+	defer server.Close()
+
+	var dials int32
+	client := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	connect := func(host string) (*http.Response, io.WriteCloser) {
+		pr, pw := io.Pipe()
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Scheme: "https", Host: ln.Addr().String()},
+			Host:   host,
+			Header: make(http.Header),
+			Body:   pr,
+		}
+		resp, err := client.RoundTrip(req)
+		r.NoError(err)
+		return resp, pw
+	}
+
+	// Several tunnels share one connection to the proxy.
+	for i := 0; i < 3; i++ {
+		resp, pw := connect("echo.test:" + echoPort)
+		a.Equal(2, resp.ProtoMajor)
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		fmt.Fprintf(pw, "hello %d\n", i)
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		r.NoError(err)
+		a.Equal(fmt.Sprintf("echo hello %d\n", i), line)
+		pw.Close()
+		resp.Body.Close()
+	}
+	a.EqualValues(1, atomic.LoadInt32(&dials))
+
+	// Denied tunnels are refused like over HTTP/1.1.
+	resp, pw := connect("other.test:" + echoPort)
+	defer pw.Close()
+	defer resp.Body.Close()
+	a.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+}
@@ -0,0 +1,76 @@
+package smokescreen
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// responseWriterKey is the request context key under which
+// withResponseWriter stores the client's http.ResponseWriter.
+type responseWriterKey struct{}
+
+// withResponseWriter makes the ResponseWriter of each request available to
+// the proxy's handlers, which goproxy doesn't give access to, so that
+// upstream response trailers can be forwarded and WebSocket upgrades can
+// take over the client's connection.
+func withResponseWriter(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isWebSocketUpgrade(req) {
+			uw := &upgradeResponseWriter{ResponseWriter: w}
+			defer uw.finish()
+			w = uw
+		}
+		ctx := context.WithValue(req.Context(), responseWriterKey{}, w)
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// prepareForwardedRequest adjusts a plain HTTP request that is about to be
+// forwarded upstream.
+func prepareForwardedRequest(req *http.Request) {
+	// The proxy's own server answers "Expect: 100-continue" as soon as the
+	// body is read to be forwarded. Passing the expectation on would have the
+	// upstream server send a second 100 Continue, which goproxy's transport
+	// takes for the final response, leaving the client with an empty body.
+	req.Header.Del("Expect")
+}
+
+// forwardTrailers arranges for the trailers of resp, which are only known
+// once its body has been read, to be sent to the client after the body.
+func forwardTrailers(req *http.Request, resp *http.Response) {
+	if resp == nil || len(resp.Trailer) == 0 {
+		return
+	}
+	w, ok := req.Context().Value(responseWriterKey{}).(http.ResponseWriter)
+	if !ok {
+		return
+	}
+
+	// Declaring the trailers, which the transport strips from the headers,
+	// also keeps the response chunked so they can follow the body.
+	for k := range resp.Trailer {
+		resp.Header.Add("Trailer", k)
+	}
+	resp.Body = &trailerForwardingBody{ReadCloser: resp.Body, resp: resp, w: w}
+}
+
+// trailerForwardingBody copies the trailers of resp into the client's
+// response once the body has been read to the end.
+type trailerForwardingBody struct {
+	io.ReadCloser
+	resp *http.Response
+	w    http.ResponseWriter
+	done bool
+}
+
+func (b *trailerForwardingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		for k, vv := range b.resp.Trailer {
+			b.w.Header()[k] = vv
+		}
+	}
+	return n, err
+}
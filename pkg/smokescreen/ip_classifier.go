@@ -0,0 +1,97 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPClassifier lets embedders sort addresses into their own network zones,
+// such as a partner VPN or a cardholder data environment, rather than
+// overloading the allow and deny ranges with them.
+//
+// ClassifyIP is consulted for every resolved address after the cloud metadata
+// check and before the built-in classification. Returning false defers to the
+// built-in classification.
+type IPClassifier interface {
+	ClassifyIP(addr *net.TCPAddr) (IPClass, bool)
+}
+
+// IPClassifierFunc adapts an ordinary function to the IPClassifier interface.
+type IPClassifierFunc func(addr *net.TCPAddr) (IPClass, bool)
+
+func (f IPClassifierFunc) ClassifyIP(addr *net.TCPAddr) (IPClass, bool) {
+	return f(addr)
+}
+
+// IPClass is a custom classification. Its name appears in the proxy decision
+// reason and in the "resolver.allow.<name>" or "resolver.deny.<name>" metric.
+type IPClass struct {
+	Name    string
+	Allowed bool
+}
+
+// ipClassification is the result of classifying an address: either one of
+// the built-in ipTypes or an IPClass.
+type ipClassification interface {
+	IsAllowed() bool
+	String() string
+	statsdString() string
+}
+
+func (c IPClass) IsAllowed() bool {
+	return c.Allowed
+}
+
+func (c IPClass) String() string {
+	if c.Allowed {
+		return "Allow: " + c.Name
+	}
+	return "Deny: " + c.Name
+}
+
+func (c IPClass) statsdString() string {
+	if c.Allowed {
+		return "resolver.allow." + c.Name
+	}
+	return "resolver.deny." + c.Name
+}
+
+// labeledRange is the classification of an address in an allow or deny range
+// with a label or reason, which are added to the built-in classification.
+type labeledRange struct {
+	ipType
+	rng *RuleRange
+}
+
+// rangeClassification returns the classification of an address t is the
+// type of because it is in rng, which may be nil.
+func rangeClassification(t ipType, rng *RuleRange) ipClassification {
+	if rng == nil || (rng.Label == "" && rng.Reason == "") {
+		return t
+	}
+	return labeledRange{ipType: t, rng: rng}
+}
+
+func (c labeledRange) String() string {
+	switch {
+	case c.rng.Label == "":
+		return fmt.Sprintf("%s (%s)", c.ipType, c.rng.Reason)
+	case c.rng.Reason == "":
+		return fmt.Sprintf("%s (%s)", c.ipType, c.rng.Label)
+	default:
+		return fmt.Sprintf("%s (%s: %s)", c.ipType, c.rng.Label, c.rng.Reason)
+	}
+}
+
+// tagValueReplacer replaces the characters that would break a DogStatsD tag.
+var tagValueReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// classificationTags returns the metric tags of c: the label of the range
+// the address is in, if it has one.
+func classificationTags(c ipClassification) []string {
+	if r, ok := c.(labeledRange); ok && r.rng.Label != "" {
+		return []string{"range:" + tagValueReplacer.Replace(r.rng.Label)}
+	}
+	return []string{}
+}
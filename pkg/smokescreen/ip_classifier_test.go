@@ -0,0 +1,104 @@
+package smokescreen
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func TestIPClassifier(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	_, partnerVPN, _ := net.ParseCIDR("10.20.0.0/16")
+	_, cde, _ := net.ParseCIDR("8.8.9.0/24")
+
+	conf := NewConfig()
+	conf.IPClassifier = IPClassifierFunc(func(addr *net.TCPAddr) (IPClass, bool) {
+		switch {
+		case partnerVPN.Contains(addr.IP):
+			return IPClass{Name: "partner-vpn", Allowed: true}, true
+		case cde.Contains(addr.IP):
+			return IPClass{Name: "cde"}, true
+		}
+		return IPClass{}, false
+	})
+
+	got := classifyAddr(conf, &net.TCPAddr{IP: net.ParseIP("10.20.1.1"), Port: 443})
+	a.True(got.IsAllowed())
+	a.Equal("Allow: partner-vpn", got.String())
+	a.Equal("resolver.allow.partner-vpn", got.statsdString())
+
+	got = classifyAddr(conf, &net.TCPAddr{IP: net.ParseIP("8.8.9.1"), Port: 443})
+	a.False(got.IsAllowed())
+	a.Equal("resolver.deny.cde", got.statsdString())
+
+	// Addresses the classifier doesn't claim get the built-in classification.
+	a.Equal(ipDenyPrivateRange, classifyAddr(conf, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}))
+
+	// Cloud metadata services stay denied.
+	a.Equal(ipDenyCloudMetadata, classifyAddr(conf, &net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 80}))
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("partner.test", "10.20.1.1")
+	dns.Set("cde.test", "8.8.9.1")
+	conf.Resolver = dns.Resolver()
+
+	_, reason, err := safeResolve(conf, "tcp", "partner.test:443", acl.AnyFamily, "")
+	r.NoError(err)
+	a.Equal("Allow: partner-vpn", reason)
+
+	_, _, err = safeResolve(conf, "tcp", "cde.test:443", acl.AnyFamily, "")
+	r.Error(err)
+	a.Contains(err.Error(), "Deny: cde")
+}
+
+func TestLabeledRanges(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var conf Config
+	r.NoError(yaml.UnmarshalStrict([]byte(`
+deny_ranges:
+  - 8.8.4.0/24
+  - range: 8.8.8.0/24
+    label: incident-2024-17
+    reason: exfiltration target
+allow_ranges:
+  - range: 10.20.0.0/16
+    label: partner VPN
+`), &conf))
+	r.Len(conf.DenyRanges, 2)
+	a.Equal("", conf.DenyRanges[0].Label)
+	a.Equal("incident-2024-17", conf.DenyRanges[1].Label)
+	a.Equal("exfiltration target", conf.DenyRanges[1].Reason)
+
+	var bad Config
+	a.Error(yaml.UnmarshalStrict([]byte("deny_ranges: [{range: 8.8.8.0/24, lable: typo}]"), &bad))
+	a.Error(yaml.UnmarshalStrict([]byte("deny_ranges: [{range: 8.8.8.0}]"), &bad))
+
+	// Unlabeled ranges are classified as before.
+	a.Equal(ipDenyUserConfigured, classifyAddr(&conf, &net.TCPAddr{IP: net.ParseIP("8.8.4.4"), Port: 443}))
+
+	got := classifyAddr(&conf, &net.TCPAddr{IP: net.ParseIP("10.20.1.1"), Port: 443})
+	a.True(got.IsAllowed())
+	a.Equal("Allow: User Configured (partner VPN)", got.String())
+	a.Equal("resolver.allow.user_configured", got.statsdString())
+
+	mc := &recordingMetricsClient{incrs: make(map[string][]string)}
+	conf.MetricsClient = mc
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("denied.test", "8.8.8.8")
+	conf.Resolver = dns.Resolver()
+
+	_, _, err := safeResolve(&conf, "tcp", "denied.test:443", acl.AnyFamily, "")
+	r.Error(err)
+	a.Contains(err.Error(), "Deny: User Configured (incident-2024-17: exfiltration target)")
+	a.Equal([]string{"range:incident-2024-17"}, mc.incrs["resolver.deny.user_configured"])
+}
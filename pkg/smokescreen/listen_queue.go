@@ -0,0 +1,72 @@
+package smokescreen
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const LOGLINE_LISTEN_QUEUE_OVERFLOW = "LISTEN-QUEUE-OVERFLOW"
+
+// listenQueueStats describes the accept queue of a listening socket.
+type listenQueueStats struct {
+	Queued  uint32 // Connections waiting to be accepted
+	Backlog uint32 // Maximum number of connections the queue can hold
+}
+
+// listenDropStats counts connections the kernel dropped because an accept
+// queue was full. These counters are system wide, not per listener.
+type listenDropStats struct {
+	Overflows uint64
+	Drops     uint64
+}
+
+// monitorListenQueue periodically reports the depth of listener's accept
+// queue, and any connections dropped because it overflowed. When the proxy
+// can't keep up with a spike in connections, clients see nothing but
+// timeouts, so this is the only place the problem shows up.
+func monitorListenQueue(config *Config, listener net.Listener, interval time.Duration) {
+	var lastDrops listenDropStats
+	haveDrops := false
+
+	for range time.Tick(interval) {
+		if stats, err := listenQueue(listener); err == nil {
+			config.MetricsClient.Gauge("listener.accept_queue.depth", float64(stats.Queued), []string{}, 1)
+			config.MetricsClient.Gauge("listener.accept_queue.backlog", float64(stats.Backlog), []string{}, 1)
+		}
+
+		drops, err := listenDrops()
+		if err != nil {
+			continue
+		}
+		if haveDrops && (drops.Overflows > lastDrops.Overflows || drops.Drops > lastDrops.Drops) {
+			overflows := drops.Overflows - lastDrops.Overflows
+			dropped := drops.Drops - lastDrops.Drops
+			config.MetricsClient.Count("listener.overflows", int64(overflows), []string{}, 1)
+			config.MetricsClient.Count("listener.drops", int64(dropped), []string{}, 1)
+			config.Log.WithFields(logrus.Fields{
+				"overflows": overflows,
+				"drops":     dropped,
+			}).Warn(LOGLINE_LISTEN_QUEUE_OVERFLOW)
+		}
+		lastDrops, haveDrops = drops, true
+	}
+}
+
+// rawListener returns the socket underlying listener, if it has one.
+func rawListener(listener net.Listener) (syscall.RawConn, bool) {
+	if el, ok := listener.(*einhornListener); ok {
+		listener = el.Listener
+	}
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	return rc, true
+}
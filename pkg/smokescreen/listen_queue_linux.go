@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package smokescreen
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const somaxconnPath = "/proc/sys/net/core/somaxconn"
+
+// setListenBacklog grows the accept queue of listener to backlog. Calling
+// listen(2) again on a listening socket only updates its backlog. The kernel
+// silently caps the backlog at net.core.somaxconn, which Go already uses by
+// default, so this is only useful together with a higher sysctl.
+func setListenBacklog(listener net.Listener, backlog int) error {
+	rc, ok := rawListener(listener)
+	if !ok {
+		return errors.New("listener has no underlying socket")
+	}
+
+	if max, err := readSomaxconn(); err == nil && backlog > max {
+		return fmt.Errorf("listen backlog %d exceeds net.core.somaxconn (%d); raise the sysctl first", backlog, max)
+	}
+
+	var listenErr error
+	err := rc.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
+
+func readSomaxconn() (int, error) {
+	b, err := ioutil.ReadFile(somaxconnPath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// listenQueue reads the accept queue of listener. For listening sockets,
+// TCP_INFO reports the queue depth in tcpi_unacked and the backlog in
+// tcpi_sacked.
+func listenQueue(listener net.Listener) (listenQueueStats, error) {
+	rc, ok := rawListener(listener)
+	if !ok {
+		return listenQueueStats{}, errors.New("listener has no underlying socket")
+	}
+
+	var info *unix.TCPInfo
+	var infoErr error
+	err := rc.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return listenQueueStats{}, err
+	}
+	if infoErr != nil {
+		return listenQueueStats{}, infoErr
+	}
+	return listenQueueStats{Queued: info.Unacked, Backlog: info.Sacked}, nil
+}
+
+// listenDrops reads the ListenOverflows and ListenDrops counters from the
+// TcpExt section of /proc/net/netstat.
+func listenDrops() (listenDropStats, error) {
+	f, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return listenDropStats{}, err
+	}
+	defer f.Close()
+	return parseNetstat(f)
+}
+
+func parseNetstat(r io.Reader) (listenDropStats, error) {
+	var stats listenDropStats
+
+	// The file is made of pairs of lines: one naming the fields of a
+	// section, and the next holding their values.
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		names := strings.Fields(scanner.Text())
+		if !scanner.Scan() {
+			break
+		}
+		values := strings.Fields(scanner.Text())
+		if len(names) == 0 || names[0] != "TcpExt:" || len(values) != len(names) {
+			continue
+		}
+
+		found := 0
+		for i, name := range names {
+			var dst *uint64
+			switch name {
+			case "ListenOverflows":
+				dst = &stats.Overflows
+			case "ListenDrops":
+				dst = &stats.Drops
+			default:
+				continue
+			}
+			v, err := strconv.ParseUint(values[i], 10, 64)
+			if err != nil {
+				return stats, err
+			}
+			*dst = v
+			found++
+		}
+		if found == 2 {
+			return stats, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	return stats, errors.New("ListenOverflows and ListenDrops not found in /proc/net/netstat")
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package smokescreen
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenQueue(t *testing.T) {
+	r := require.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer ln.Close()
+
+	r.NoError(setListenBacklog(ln, 8))
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		r.NoError(err)
+		defer conn.Close()
+	}
+
+	// The handshake completes asynchronously on the listening side.
+	var stats listenQueueStats
+	for i := 0; i < 50; i++ {
+		stats, err = listenQueue(ln)
+		r.NoError(err)
+		if stats.Queued == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Equal(listenQueueStats{Queued: 2, Backlog: 8}, stats)
+
+	// The same statistics are available through an einhorn listener.
+	stats, err = listenQueue(&einhornListener{Listener: ln})
+	r.NoError(err)
+	r.Equal(uint32(8), stats.Backlog)
+}
+
+func TestParseNetstat(t *testing.T) {
+	a := assert.New(t)
+
+	netstat := `TcpExt: SyncookiesSent SyncookiesRecv ListenOverflows ListenDrops TCPHPHits
+TcpExt: 0 0 17 19 12345
+IpExt: InNoRoutes InTruncatedPkts
+IpExt: 0 0
+`
+	stats, err := parseNetstat(strings.NewReader(netstat))
+	a.NoError(err)
+	a.Equal(listenDropStats{Overflows: 17, Drops: 19}, stats)
+
+	_, err = parseNetstat(strings.NewReader("IpExt: InNoRoutes\nIpExt: 0\n"))
+	a.Error(err)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package smokescreen
+
+import (
+	"errors"
+	"net"
+)
+
+var errListenQueueUnsupported = errors.New("accept queue statistics are only available on Linux")
+
+func setListenBacklog(listener net.Listener, backlog int) error {
+	return errors.New("setting the listen backlog is only supported on Linux")
+}
+
+func listenQueue(listener net.Listener) (listenQueueStats, error) {
+	return listenQueueStats{}, errListenQueueUnsupported
+}
+
+func listenDrops() (listenDropStats, error) {
+	return listenDropStats{}, errListenQueueUnsupported
+}
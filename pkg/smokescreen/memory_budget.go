@@ -0,0 +1,104 @@
+package smokescreen
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// connMemoryOverhead estimates the buffers a client connection holds besides
+// its request headers: net/http's 4KB read and write buffers, and the 32KB
+// buffers goproxy copies tunnelled traffic with in each direction.
+const connMemoryOverhead = 2*4<<10 + 2*32<<10
+
+// memoryBudget bounds the memory the buffers of all client connections may
+// take, shared by the main listener and every tenant's.
+type memoryBudget struct {
+	limit int64
+	used  int64 // Accessed atomically
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// reserve takes n bytes from the budget, reporting whether they were
+// available.
+func (b *memoryBudget) reserve(n int64) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used+n > b.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	atomic.AddInt64(&b.used, -n)
+}
+
+func (b *memoryBudget) inUse() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// connMemory is the memory reserved for each client connection: the fixed
+// buffers, plus the most its request headers may take.
+func connMemory(config *Config) int64 {
+	headerBytes := config.MaxHeaderBytes
+	if headerBytes <= 0 {
+		headerBytes = http.DefaultMaxHeaderBytes
+	}
+	return connMemoryOverhead + int64(headerBytes)
+}
+
+// budgetListener sheds client connections, closing them as soon as they are
+// accepted, when the memory they could take doesn't fit in the budget. This
+// bounds the proxy's memory no matter how large the requests clients send,
+// rather than leaving a few of them to get the process OOM killed.
+type budgetListener struct {
+	net.Listener
+	config *Config
+	budget *memoryBudget
+}
+
+func (l *budgetListener) Accept() (net.Conn, error) {
+	n := connMemory(l.config)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.budget.reserve(n) {
+			l.config.MetricsClient.Incr("memory.shed", []string{}, 1)
+			conn.Close()
+			continue
+		}
+		l.reportUsage()
+		return &budgetConn{Conn: conn, listener: l, reserved: n}, nil
+	}
+}
+
+func (l *budgetListener) reportUsage() {
+	l.config.MetricsClient.Gauge("memory.reserved_bytes", float64(l.budget.inUse()), []string{}, 1)
+}
+
+// budgetConn returns its reservation to the budget when it is closed.
+type budgetConn struct {
+	net.Conn
+	listener  *budgetListener
+	reserved  int64
+	closeOnce sync.Once
+}
+
+func (c *budgetConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.listener.budget.release(c.reserved)
+		c.listener.reportUsage()
+	})
+	return c.Conn.Close()
+}
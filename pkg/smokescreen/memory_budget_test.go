@@ -0,0 +1,81 @@
+package smokescreen
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	a := assert.New(t)
+
+	b := newMemoryBudget(100)
+	a.True(b.reserve(60))
+	a.False(b.reserve(60))
+	a.True(b.reserve(40))
+	b.release(60)
+	a.EqualValues(40, b.inUse())
+	a.True(b.reserve(60))
+}
+
+func TestBudgetListenerSheds(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	conf.MaxHeaderBytes = 1 << 10
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	bl := &budgetListener{Listener: ln, config: conf, budget: newMemoryBudget(connMemory(conf))}
+	defer bl.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := bl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		r.NoError(err)
+		return conn
+	}
+
+	first := dial()
+	defer first.Close()
+	server := <-accepted
+
+	// The budget fits a single connection, so the next is closed at once.
+	shed := dial()
+	defer shed.Close()
+	shed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = shed.Read(make([]byte, 1))
+	a.Error(err)
+	a.False(isTimeout(err), "shed connection should be closed, not left open")
+
+	// Closing the first connection makes room for another.
+	server.Close()
+	server.Close()
+	a.EqualValues(0, bl.budget.inUse())
+	next := dial()
+	defer next.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not accepted after the budget was freed")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,52 @@
+// Package metrics defines the interface Smokescreen and its connection
+// tracker report metrics through. The DogStatsD client,
+// *statsd.Client from github.com/DataDog/datadog-go/statsd, implements it;
+// embedders can provide their own to export metrics to Prometheus or
+// OpenTelemetry instead, or use NoOpMetricsClient to not export them at all.
+package metrics
+
+import "time"
+
+// MetricsClient reports metrics. Tags are "key:value" strings, and rate is
+// the fraction of calls being reported, as in DogStatsD.
+type MetricsClient interface {
+	// Incr adds one to a counter.
+	Incr(name string, tags []string, rate float64) error
+	// Count adds value to a counter.
+	Count(name string, value int64, tags []string, rate float64) error
+	// Gauge sets a gauge to value.
+	Gauge(name string, value float64, tags []string, rate float64) error
+	// Histogram records value in a distribution.
+	Histogram(name string, value float64, tags []string, rate float64) error
+	// Timing records a duration in a distribution.
+	Timing(name string, value time.Duration, tags []string, rate float64) error
+}
+
+// NoOpMetricsClient discards every metric.
+type NoOpMetricsClient struct{}
+
+func (NoOpMetricsClient) Incr(name string, tags []string, rate float64) error { return nil }
+
+func (NoOpMetricsClient) Count(name string, value int64, tags []string, rate float64) error {
+	return nil
+}
+
+func (NoOpMetricsClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	return nil
+}
+
+func (NoOpMetricsClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	return nil
+}
+
+func (NoOpMetricsClient) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return nil
+}
+
+// OrNoOp returns c, or a NoOpMetricsClient if c is nil.
+func OrNoOp(c MetricsClient) MetricsClient {
+	if c == nil {
+		return NoOpMetricsClient{}
+	}
+	return c
+}
@@ -0,0 +1,92 @@
+package smokescreen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/metrics"
+)
+
+var _ metrics.MetricsClient = (*statsd.Client)(nil)
+
+// recordingMetricsClient remembers the names of the counters incremented.
+type recordingMetricsClient struct {
+	metrics.NoOpMetricsClient
+
+	mu    sync.Mutex
+	incrs map[string][]string
+}
+
+func (c *recordingMetricsClient) Incr(name string, tags []string, rate float64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.incrs[name] = tags
+	return nil
+}
+
+func TestDeprecatedStatsdClient(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	client, err := statsd.New("127.0.0.1:8125")
+	r.NoError(err)
+	defer client.Close()
+
+	// A StatsdClient set in place of MetricsClient is used.
+	conf := NewConfig()
+	conf.StatsdClient = client
+	conf.useStatsdClient()
+	a.Equal(client, conf.MetricsClient)
+
+	conf = NewConfig()
+	conf.MetricsClient = nil
+	conf.StatsdClient = client
+	conf.useStatsdClient()
+	a.Equal(client, conf.MetricsClient)
+
+	// But doesn't take the place of another MetricsClient.
+	conf = NewConfig()
+	custom := &recordingMetricsClient{incrs: map[string][]string{}}
+	conf.MetricsClient = custom
+	conf.StatsdClient = client
+	conf.useStatsdClient()
+	a.Equal(custom, conf.MetricsClient)
+}
+
+func TestCustomMetricsClient(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	// Metrics are discarded until a client is set.
+	conf := NewConfig()
+	a.Equal(metrics.NoOpMetricsClient{}, conf.MetricsClient)
+	r.NoError(conf.SetupStatsd(""))
+	a.Equal(metrics.NoOpMetricsClient{}, conf.MetricsClient)
+
+	mc := &recordingMetricsClient{incrs: make(map[string][]string)}
+	conf.MetricsClient = mc
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"billing": {Project: "payments", Policy: acl.Enforce, DomainGlobs: []string{"api.example.com"}},
+		},
+	}
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return "billing", nil
+	}
+
+	req := httptest.NewRequest(http.MethodConnect, "http://api.example.com:443", nil)
+	decision := checkACLsForRequest(conf, req, "api.example.com:443")
+	r.True(decision.allow)
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	r.Contains(mc.incrs, "acl.allow")
+	a.Contains(mc.incrs["acl.allow"], "role:billing")
+	a.Contains(mc.incrs["acl.allow"], "rule:billing")
+}
@@ -0,0 +1,187 @@
+package smokescreen
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// TLS inspection
+//
+// CONNECT requests from roles whose ACL rule has a "mitm" section are
+// intercepted: smokescreen completes the TLS handshake with the client using
+// a certificate for the destination signed by MitmCa, checks each request
+// the client sends against the rule's allowed methods and paths, and makes
+// the allowed ones to the destination over a new, verified TLS connection.
+
+// mitmUserDataKey is the context key carrying the user data of an inspected
+// request to the dialer of the inspection transport.
+type mitmUserDataKey struct{}
+
+// SetupMitmCa loads the CA used to sign the certificates presented to
+// clients whose connections are inspected.
+func (config *Config) SetupMitmCa(certFile, keyFile string) error {
+	if certFile == "" {
+		return nil
+	}
+	if keyFile == "" {
+		// Assume certFile is a cert+key bundle
+		keyFile = certFile
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return config.setMitmCa(cert)
+}
+
+func (config *Config) setMitmCa(cert tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !leaf.IsCA {
+		return errors.New("the TLS inspection certificate is not a CA")
+	}
+	// goproxy derives the keys of the certificates it signs from the CA's
+	// key, which only works for RSA keys.
+	if _, ok := cert.PrivateKey.(*rsa.PrivateKey); !ok {
+		return errors.New("the TLS inspection CA must have an RSA key")
+	}
+	cert.Leaf = leaf
+
+	config.MitmCa = &cert
+	// goproxy names the issuer of the certificates it signs after its
+	// global CA, whichever CA actually signs them.
+	goproxy.GoproxyCa = cert
+	return nil
+}
+
+// mitmTunnel returns the user data of the inspected CONNECT request that the
+// request being handled arrived through, if any.
+func mitmTunnel(ctx *goproxy.ProxyCtx) *ctxUserData {
+	ud, ok := ctx.UserData.(*ctxUserData)
+	if !ok {
+		return nil
+	}
+	if ud.tunnel != nil {
+		return ud.tunnel
+	}
+	if ud.connect && ud.decision != nil && ud.decision.allow && ud.decision.mitm != nil && !ud.decision.inspectsPlaintext() {
+		return ud
+	}
+	return nil
+}
+
+// checkHTTPRules denies requests the role's TLS inspection rule doesn't allow.
+func checkHTTPRules(config *Config, decision *aclDecision, req *http.Request) error {
+	if decision.mitm == nil || decision.mitm.Allows(req.Method, req.URL.Path) {
+		return nil
+	}
+
+	decision.allow = false
+	decision.reason = fmt.Sprintf("%s %s is not allowed for role", req.Method, req.URL.Path)
+	config.MetricsClient.Incr("acl.http_rule_deny", []string{fmt.Sprintf("role:%s", decision.role)}, 1)
+	return denyError{error: errors.New(decision.reason), rule: decision.ruleID}
+}
+
+// checkRequestHost denies requests in a tunnel whose HTTP requests are
+// checked if their Host header names another host than the tunnel's
+// destination. Through a CDN or virtual host front shared by several sites,
+// such a request would reach whichever site it names, past the rules that
+// apply to the destination.
+func checkRequestHost(config *Config, decision *aclDecision, req *http.Request) error {
+	if decision.mitm == nil || hostport.Host(req.Host) == hostport.Host(decision.outboundHost) {
+		return nil
+	}
+
+	decision.allow = false
+	decision.reason = fmt.Sprintf("Host %q doesn't match the requested host %s", req.Host, decision.outboundHost)
+	config.MetricsClient.Incr("acl.http_host_deny", []string{fmt.Sprintf("role:%s", decision.role)}, 1)
+	return denyError{error: errors.New(decision.reason), rule: decision.ruleID}
+}
+
+// handleMitmRequest checks a request received inside an inspected TLS
+// connection and, if it is allowed, makes it to the destination.
+func handleMitmRequest(config *Config, transport http.RoundTripper, req *http.Request, ctx *goproxy.ProxyCtx, tunnel *ctxUserData) (*http.Request, *http.Response) {
+	traceCtx, span := startRequestSpan(config, req, "smokescreen.mitm")
+	req = req.WithContext(traceCtx)
+
+	decision := *tunnel.decision
+	userData := &ctxUserData{
+		start:    time.Now(),
+		decision: &decision,
+		traceId:  req.Header.Get(traceHeader),
+		traceCtx: traceCtx,
+		span:     span,
+		tunnel:   tunnel,
+	}
+	ctx.UserData = userData
+
+	config.Log.WithFields(
+		logrus.Fields{
+			"source_ip":      ctx.Req.RemoteAddr,
+			"requested_host": tunnel.decision.outboundHost,
+			"url":            req.RequestURI,
+			"trace_id":       userData.traceId,
+		}).Debug("received inspected HTTPS request")
+
+	req.Header.Del(roleHeader)
+	req.Header.Del(traceHeader)
+
+	if err := checkRequestHost(config, &decision, req); err != nil {
+		return req, rejectResponse(req, config, err)
+	}
+	if err := checkHTTPRules(config, &decision, req); err != nil {
+		return req, rejectResponse(req, config, err)
+	}
+
+	outReq := req.WithContext(context.WithValue(traceCtx, mitmUserDataKey{}, userData))
+	outURL := *req.URL
+	outURL.Scheme = "https"
+	outURL.Host = tunnel.decision.outboundHost
+	outReq.URL = &outURL
+	outReq.Host = req.Host
+	outReq.RequestURI = ""
+	for _, h := range []string{"Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization", "Connection"} {
+		outReq.Header.Del(h)
+	}
+
+	resp, err := transport.RoundTrip(outReq)
+	if err != nil {
+		ctx.Error = err
+		return req, rejectResponse(req, config, err)
+	}
+	return req, resp
+}
+
+// newMitmTransport returns the transport used to make inspected requests.
+// Unlike goproxy's transport, it verifies the destination's certificate.
+func newMitmTransport(config *Config) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(config, network, addr, ctx.Value(mitmUserDataKey{}))
+		},
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			// Upstream proxies from the ACL are tunneled through by dial.
+			if ud, ok := req.Context().Value(mitmUserDataKey{}).(*ctxUserData); ok && ud.decision.upstreamProxy != nil {
+				return nil, nil
+			}
+			return proxyForRequest(config, req)
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: config.MitmUpstreamRootCAs},
+		DisableKeepAlives: true,
+	}
+}
@@ -0,0 +1,196 @@
+package smokescreen
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func testMitmCa(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "smokescreen test inspection CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestMitmRequests(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var reached int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reached, 1)
+		w.Write([]byte("path " + r.URL.Path))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	r.NoError(err)
+
+	// httptest's certificate is valid for example.com.
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("example.com", "127.0.0.1")
+
+	ca, clientRoots := testMitmCa(t)
+	upstreamRoots := x509.NewCertPool()
+	upstreamRoots.AddCert(ts.Certificate())
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.Resolver = dns.Resolver()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	r.NoError(conf.setMitmCa(ca))
+	conf.MitmUpstreamRootCAs = upstreamRoots
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"inspected": {
+				Policy:      acl.Enforce,
+				DomainGlobs: []string{"example.com"},
+				Mitm: &acl.MitmRule{
+					AllowedMethods: []string{"GET"},
+					AllowedPaths:   []string{"/v1/*"},
+				},
+			},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:              http.ProxyURL(proxyURL),
+			ProxyConnectHeader: http.Header{"X-Smokescreen-Role": []string{"inspected"}},
+			TLSClientConfig:    &tls.Config{RootCAs: clientRoots},
+			DisableKeepAlives:  true,
+		},
+	}
+
+	doHost := func(method, path, host string) (*http.Response, string) {
+		req, err := http.NewRequest(method, "https://"+net.JoinHostPort("example.com", port)+path, nil)
+		r.NoError(err)
+		req.Host = host
+		resp, err := client.Do(req)
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		return resp, string(body)
+	}
+	do := func(method, path string) (*http.Response, string) {
+		return doHost(method, path, "")
+	}
+
+	resp, body := do("GET", "/v1/charges")
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal("path /v1/charges", body)
+	a.Equal(int32(1), atomic.LoadInt32(&reached))
+
+	resp, body = do("GET", "/admin")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, "GET /admin is not allowed for role")
+
+	resp, body = do("POST", "/v1/charges")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, "POST /v1/charges is not allowed for role")
+
+	// Paths are checked as the destination resolves them.
+	resp, body = do("GET", "/v1/../admin")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, "GET /v1/../admin is not allowed for role")
+
+	resp, body = do("GET", "/v1/%2e%2e/admin")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, "GET /v1/../admin is not allowed for role")
+
+	// Requests can't name another site behind the destination.
+	resp, body = doHost("GET", "/v1/charges", "other.example.com")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, `Host "other.example.com" doesn't match the requested host`)
+
+	a.Equal(int32(1), atomic.LoadInt32(&reached))
+}
+
+func TestMitmRequiresCa(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("example.com", "127.0.0.1")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return "inspected", nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"inspected": {
+				Policy:      acl.Enforce,
+				DomainGlobs: []string{"example.com"},
+				Mitm:        &acl.MitmRule{AllowedMethods: []string{"GET"}},
+			},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	r.NoError(err)
+	defer conn.Close()
+	req, err := http.NewRequest("CONNECT", "//example.com:443", nil)
+	r.NoError(err)
+	req.Host = "example.com:443"
+	r.NoError(req.Write(conn))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	r.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(string(body), "role requires TLS inspection, which is not configured")
+}
@@ -0,0 +1,174 @@
+package smokescreen
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	// The OpenMetrics specification limits the combined length of an
+	// exemplar's label names and values to 128 characters.
+	maxExemplarLabelLength = 128
+	exemplarTraceLabel     = "trace_id"
+)
+
+// decisionLatencyBuckets are the upper bounds, in seconds, of the decision
+// latency histogram buckets.
+var decisionLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+type exemplar struct {
+	traceID string
+	value   float64
+	ts      time.Time
+}
+
+// OpenMetrics records ACL decision latency and denials and serves them in the
+// OpenMetrics text format. Observations made for requests carrying a trace ID
+// are attached to the metrics as exemplars, so a latency spike or a burst of
+// denials on a dashboard links to representative traces.
+//
+// Set Config.OpenMetrics to enable it; the metrics are then served at
+// /metrics on the stats socket.
+type OpenMetrics struct {
+	sync.Mutex
+
+	latencyCounts    []uint64 // Per bucket, not cumulative. The last entry is +Inf.
+	latencyExemplars []*exemplar
+	latencySum       float64
+	latencyCount     uint64
+
+	denyCount    uint64
+	denyExemplar *exemplar
+
+	buildInfo func() buildInfo // If set, build info and the start time are served too
+}
+
+func NewOpenMetrics() *OpenMetrics {
+	return &OpenMetrics{
+		latencyCounts:    make([]uint64, len(decisionLatencyBuckets)+1),
+		latencyExemplars: make([]*exemplar, len(decisionLatencyBuckets)+1),
+	}
+}
+
+// ObserveDecision records how long an ACL decision took.
+func (om *OpenMetrics) ObserveDecision(d time.Duration, traceID string) {
+	v := d.Seconds()
+	i := 0
+	for i < len(decisionLatencyBuckets) && v > decisionLatencyBuckets[i] {
+		i++
+	}
+
+	om.Lock()
+	defer om.Unlock()
+
+	om.latencyCounts[i]++
+	om.latencySum += v
+	om.latencyCount++
+	if e := newExemplar(traceID, v); e != nil {
+		om.latencyExemplars[i] = e
+	}
+}
+
+// IncDeny records a denied request.
+func (om *OpenMetrics) IncDeny(traceID string) {
+	om.Lock()
+	defer om.Unlock()
+
+	om.denyCount++
+	if e := newExemplar(traceID, 1); e != nil {
+		om.denyExemplar = e
+	}
+}
+
+func newExemplar(traceID string, value float64) *exemplar {
+	if traceID == "" || len(exemplarTraceLabel)+len(traceID) > maxExemplarLabelLength {
+		return nil
+	}
+	return &exemplar{traceID: traceID, value: value, ts: time.Now()}
+}
+
+func (om *OpenMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", openMetricsContentType)
+	om.WriteTo(w)
+}
+
+// WriteTo writes the current metrics in the OpenMetrics text format.
+func (om *OpenMetrics) WriteTo(w io.Writer) (int64, error) {
+	om.Lock()
+	defer om.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# TYPE smokescreen_acl_decision_duration_seconds histogram\n")
+	b.WriteString("# UNIT smokescreen_acl_decision_duration_seconds seconds\n")
+	b.WriteString("# HELP smokescreen_acl_decision_duration_seconds Time taken to decide whether to proxy a request.\n")
+	var cumulative uint64
+	for i, count := range om.latencyCounts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(decisionLatencyBuckets) {
+			le = formatFloat(decisionLatencyBuckets[i])
+		}
+		fmt.Fprintf(&b, "smokescreen_acl_decision_duration_seconds_bucket{le=\"%s\"} %d", le, cumulative)
+		writeExemplar(&b, om.latencyExemplars[i])
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "smokescreen_acl_decision_duration_seconds_sum %s\n", formatFloat(om.latencySum))
+	fmt.Fprintf(&b, "smokescreen_acl_decision_duration_seconds_count %d\n", om.latencyCount)
+
+	b.WriteString("# TYPE smokescreen_acl_deny counter\n")
+	b.WriteString("# HELP smokescreen_acl_deny Requests denied by the proxy.\n")
+	fmt.Fprintf(&b, "smokescreen_acl_deny_total %d", om.denyCount)
+	writeExemplar(&b, om.denyExemplar)
+	b.WriteString("\n")
+
+	if om.buildInfo != nil {
+		bi := om.buildInfo()
+		b.WriteString("# TYPE smokescreen_build info\n")
+		b.WriteString("# HELP smokescreen_build The running build and the configuration and ACL it serves.\n")
+		fmt.Fprintf(&b, "smokescreen_build_info{version=\"%s\",git_sha=\"%s\",go_version=\"%s\",config_hash=\"%s\",acl_hash=\"%s\"} 1\n",
+			escapeLabelValue(bi.version),
+			escapeLabelValue(bi.gitSHA),
+			escapeLabelValue(bi.goVersion),
+			escapeLabelValue(bi.configHash),
+			escapeLabelValue(bi.aclHash))
+
+		b.WriteString("# TYPE smokescreen_start_time_seconds gauge\n")
+		b.WriteString("# UNIT smokescreen_start_time_seconds seconds\n")
+		b.WriteString("# HELP smokescreen_start_time_seconds When the proxy started, in seconds since the epoch.\n")
+		fmt.Fprintf(&b, "smokescreen_start_time_seconds %d\n", bi.start.Unix())
+	}
+
+	b.WriteString("# EOF\n")
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeExemplar(b *strings.Builder, e *exemplar) {
+	if e == nil {
+		return
+	}
+	fmt.Fprintf(b, " # {%s=\"%s\"} %s %s",
+		exemplarTraceLabel,
+		escapeLabelValue(e.traceID),
+		formatFloat(e.value),
+		strconv.FormatFloat(float64(e.ts.UnixNano())/1e9, 'f', 3, 64))
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,36 @@
+package smokescreen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenMetricsExemplars(t *testing.T) {
+	a := assert.New(t)
+
+	om := NewOpenMetrics()
+	om.ObserveDecision(3*time.Millisecond, "trace-slow")
+	om.ObserveDecision(200*time.Microsecond, "")
+	om.IncDeny("trace-\"denied\"")
+	om.IncDeny("")
+	om.IncDeny(strings.Repeat("x", maxExemplarLabelLength))
+
+	var buf bytes.Buffer
+	_, err := om.WriteTo(&buf)
+	require.NoError(t, err)
+	out := buf.String()
+
+	a.Contains(out, `smokescreen_acl_decision_duration_seconds_bucket{le="0.0005"} 1`+"\n")
+	a.Contains(out, `smokescreen_acl_decision_duration_seconds_bucket{le="0.005"} 2 # {trace_id="trace-slow"} 0.003 `)
+	a.Contains(out, `smokescreen_acl_decision_duration_seconds_bucket{le="+Inf"} 2`+"\n")
+	a.Contains(out, "smokescreen_acl_decision_duration_seconds_count 2\n")
+
+	// Unusable trace IDs don't replace the last good exemplar.
+	a.Contains(out, `smokescreen_acl_deny_total 3 # {trace_id="trace-\"denied\""} 1 `)
+	a.True(strings.HasSuffix(out, "# EOF\n"))
+}
@@ -0,0 +1,300 @@
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// Plaintext inspection
+//
+// Clients can tunnel plain HTTP through CONNECT to port 80, which keeps the
+// requests they make out of sight. For roles whose ACL rule sets
+// inspect_plaintext, smokescreen parses every request sent through such a
+// tunnel, logs it, and checks it against the rule's "mitm" methods and paths,
+// if any, before forwarding it unchanged. A denied request is answered with
+// the usual deny response and ends the tunnel, as does anything that isn't
+// HTTP. Protocol upgrades end inspection, so they're denied to roles whose
+// requests are checked.
+
+// plaintextInspectionPort is a variable so tests can inspect tunnels to their own
+// servers.
+var plaintextInspectionPort = "80"
+
+var errNotHTTP = errors.New("traffic in inspected tunnel is not HTTP")
+
+// inspectsPlaintext reports whether the CONNECT tunnel the decision was made
+// for has its HTTP requests inspected.
+func (d *aclDecision) inspectsPlaintext() bool {
+	if !d.inspectPlaintext {
+		return false
+	}
+	_, port, err := hostport.Split(d.outboundHost)
+	return err == nil && strconv.Itoa(port) == plaintextInspectionPort
+}
+
+// plaintextInspector sits between goproxy and the destination of an
+// inspected tunnel. What goproxy writes, the client's side of the tunnel, is
+// parsed as HTTP requests by inspect, which forwards the allowed ones.
+type plaintextInspector struct {
+	net.Conn
+	config *Config
+	tunnel *ctxUserData
+	pw     *io.PipeWriter
+	done   chan struct{} // Closed once inspect stops writing to Conn
+
+	mu     sync.Mutex
+	denied bool
+	denial []byte // The part of the deny response goproxy hasn't read yet
+}
+
+func newPlaintextInspector(config *Config, conn net.Conn, tunnel *ctxUserData) *plaintextInspector {
+	pr, pw := io.Pipe()
+	pi := &plaintextInspector{
+		Conn:   conn,
+		config: config,
+		tunnel: tunnel,
+		pw:     pw,
+		done:   make(chan struct{}),
+	}
+	go pi.inspect(pr)
+	return pi
+}
+
+func (pi *plaintextInspector) Write(b []byte) (int, error) {
+	return pi.pw.Write(b)
+}
+
+// Read returns what the destination sends and, once a request was denied and
+// the destination closed, the deny response.
+func (pi *plaintextInspector) Read(b []byte) (int, error) {
+	n, err := pi.Conn.Read(b)
+	if err == nil || n > 0 {
+		return n, err
+	}
+
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	if !pi.denied {
+		return n, err
+	}
+	if len(pi.denial) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(b, pi.denial)
+	pi.denial = pi.denial[n:]
+	return n, nil
+}
+
+// Close ends inspection and closes the connection to the destination once
+// inspect has stopped writing to it.
+func (pi *plaintextInspector) Close() error {
+	pi.pw.Close()
+	// Don't wait on a destination that isn't reading.
+	pi.Conn.SetWriteDeadline(time.Now())
+	<-pi.done
+	return pi.Conn.Close()
+}
+
+func (pi *plaintextInspector) inspect(pr *io.PipeReader) {
+	defer close(pi.done)
+	br := bufio.NewReader(pr)
+	for {
+		head, req, err := pi.readRequestHead(br)
+		if err == io.EOF {
+			pr.Close()
+			return
+		}
+		if err != nil {
+			pi.refuse(pr, nil, err)
+			return
+		}
+		if err := pi.check(req); err != nil {
+			pi.refuse(pr, req, err)
+			return
+		}
+
+		// Forward the request as the client sent it. Writing the head on
+		// its own keeps clients that wait for "100 Continue" going.
+		if _, err := pi.Conn.Write(head); err != nil {
+			pr.CloseWithError(err)
+			return
+		}
+		if req.Header.Get("Upgrade") != "" {
+			// Whatever follows the upgrade isn't HTTP anymore.
+			_, err := io.Copy(pi.Conn, br)
+			pr.CloseWithError(err)
+			return
+		}
+		if err := forwardBody(pi.Conn, br, req); err != nil {
+			pr.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// readRequestHead reads the request line and headers of the next request
+// from br, returning them as sent and parsed.
+func (pi *plaintextInspector) readRequestHead(br *bufio.Reader) ([]byte, *http.Request, error) {
+	maxHeaderBytes := pi.config.MaxHeaderBytes
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+
+	var head []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		head = append(head, line...)
+		if err == io.EOF && len(head) == 0 {
+			return nil, nil, io.EOF
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, nil, errNotHTTP
+		}
+		if len(head) > maxHeaderBytes {
+			return nil, nil, errNotHTTP
+		}
+		if err == nil && (string(line) == "\r\n" || string(line) == "\n") {
+			break
+		}
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, nil, errNotHTTP
+	}
+	// net/http drops the Content-Length of chunked requests, but the
+	// destination could go by it and find another request in the body.
+	if req.TransferEncoding != nil && bytes.Contains(bytes.ToLower(head), []byte("\ncontent-length:")) {
+		return nil, nil, errNotHTTP
+	}
+	return head, req, nil
+}
+
+// check logs req and checks it against the tunnel's rule.
+func (pi *plaintextInspector) check(req *http.Request) error {
+	decision := *pi.tunnel.decision
+	err := checkRequestHost(pi.config, &decision, req)
+	if err == nil {
+		err = checkHTTPRules(pi.config, &decision, req)
+	}
+	if err == nil && decision.mitm != nil && req.Header.Get("Upgrade") != "" {
+		// Nothing after an upgrade could be checked.
+		decision.allow = false
+		decision.reason = "protocol upgrades can't be inspected"
+		err = denyError{error: errors.New(decision.reason), rule: decision.ruleID}
+	}
+
+	pi.config.MetricsClient.Incr("connect.plaintext_request", []string{
+		fmt.Sprintf("role:%s", decision.role),
+		fmt.Sprintf("allow:%t", err == nil),
+	}, 1)
+
+	entry := pi.config.Log.WithFields(logrus.Fields{
+		"role":            decision.role,
+		"requested_host":  decision.outboundHost,
+		"host":            req.Host,
+		"method":          req.Method,
+		"path":            req.URL.Path,
+		"allow":           err == nil,
+		"decision_reason": decision.reason,
+		"trace_id":        pi.tunnel.traceId,
+	})
+	if err != nil {
+		entry.Warn("denied plaintext request in CONNECT tunnel")
+	} else {
+		entry.Info("inspected plaintext request in CONNECT tunnel")
+	}
+	return err
+}
+
+// refuse ends the tunnel, answering req with a deny response if it was
+// denied.
+func (pi *plaintextInspector) refuse(pr *io.PipeReader, req *http.Request, err error) {
+	var denial bytes.Buffer
+	if req != nil {
+		resp := rejectResponse(req, pi.config, err)
+		resp.Header.Set("Connection", "close")
+		resp.Write(&denial)
+	} else {
+		pi.config.MetricsClient.Incr("connect.plaintext_not_http", []string{
+			fmt.Sprintf("role:%s", pi.tunnel.decision.role),
+		}, 1)
+		pi.config.Log.WithFields(logrus.Fields{
+			"role":           pi.tunnel.decision.role,
+			"requested_host": pi.tunnel.decision.outboundHost,
+			"error":          err,
+			"trace_id":       pi.tunnel.traceId,
+		}).Warn("closing inspected CONNECT tunnel")
+	}
+
+	pi.mu.Lock()
+	pi.denied = true
+	pi.denial = denial.Bytes()
+	pi.mu.Unlock()
+
+	pr.CloseWithError(err)
+	// Unblocks Read, which hands goproxy the deny response.
+	pi.Conn.Close()
+}
+
+// forwardBody copies the body of req from br to w as it was sent.
+func forwardBody(w io.Writer, br *bufio.Reader, req *http.Request) error {
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		return forwardChunked(w, br)
+	}
+	if req.ContentLength > 0 {
+		_, err := io.CopyN(w, br, req.ContentLength)
+		return err
+	}
+	return nil
+}
+
+// forwardChunked copies a chunked body, and its trailer, from br to w.
+func forwardChunked(w io.Writer, br *bufio.Reader) error {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		sizeField := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil || size < 0 {
+			return errNotHTTP
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		if size == 0 {
+			break
+		}
+		// The chunk and the CRLF ending it.
+		if _, err := io.CopyN(w, br, size+2); err != nil {
+			return err
+		}
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		if line == "\r\n" || line == "\n" {
+			return nil
+		}
+	}
+}
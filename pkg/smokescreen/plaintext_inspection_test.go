@@ -0,0 +1,161 @@
+package smokescreen
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestPlaintextInspection(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var reached int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reached, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	r.NoError(err)
+
+	defer func(p string) { plaintextInspectionPort = p }(plaintextInspectionPort)
+	plaintextInspectionPort = port
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("example.com", "127.0.0.1")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.Resolver = dns.Resolver()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"logged": {
+				Policy:           acl.Enforce,
+				DomainGlobs:      []string{"example.com"},
+				InspectPlaintext: true,
+			},
+			"checked": {
+				Policy:      acl.Enforce,
+				DomainGlobs: []string{"example.com"},
+				Mitm: &acl.MitmRule{
+					AllowedMethods: []string{"GET", "POST"},
+					AllowedPaths:   []string{"/v1/*"},
+				},
+				InspectPlaintext: true,
+			},
+		},
+	}
+	logHook := logrustest.NewLocal(conf.Log)
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+
+	connect := func(role string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		r.NoError(err)
+		req, err := http.NewRequest("CONNECT", "//example.com:"+port, nil)
+		r.NoError(err)
+		req.Host = "example.com:" + port
+		req.Header.Set("X-Smokescreen-Role", role)
+		r.NoError(req.Write(conn))
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		return conn, br
+	}
+	send := func(conn net.Conn, br *bufio.Reader, raw string) (*http.Response, string) {
+		_, err := conn.Write([]byte(raw))
+		r.NoError(err)
+		resp, err := http.ReadResponse(br, nil)
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		return resp, string(body)
+	}
+	inspected := func() []string {
+		var paths []string
+		for _, e := range logHook.AllEntries() {
+			if strings.Contains(e.Message, "plaintext request in CONNECT tunnel") {
+				paths = append(paths, e.Data["method"].(string)+" "+e.Data["path"].(string))
+			}
+		}
+		return paths
+	}
+
+	// Requests of roles without method and path rules are only logged.
+	conn, br := connect("logged")
+	resp, body := send(conn, br, "GET /admin HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal("GET /admin ", body)
+	conn.Close()
+	a.Equal([]string{"GET /admin"}, inspected())
+
+	// Every request in the tunnel is checked, and bodies are forwarded as
+	// sent.
+	logHook.Reset()
+	conn, br = connect("checked")
+	defer conn.Close()
+	resp, body = send(conn, br, "POST /v1/charges HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal("POST /v1/charges hello", body)
+	resp, body = send(conn, br, "POST /v1/refunds HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n")
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal("POST /v1/refunds abcde", body)
+
+	resp, body = send(conn, br, "GET /v1/%2e%2e/admin HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, "GET /v1/../admin is not allowed for role")
+	_, err = br.ReadByte()
+	a.Error(err, "a denied request ends the tunnel")
+	a.Equal([]string{"POST /v1/charges", "POST /v1/refunds", "GET /v1/../admin"}, inspected())
+	a.Equal(int32(3), atomic.LoadInt32(&reached))
+
+	conn, br = connect("checked")
+	defer conn.Close()
+
+	resp, body = send(conn, br, "GET /v1/charges HTTP/1.1\r\nHost: other.example.com\r\n\r\n")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, `Host "other.example.com" doesn't match the requested host`)
+	a.Equal(int32(3), atomic.LoadInt32(&reached))
+
+	conn, br = connect("checked")
+	defer conn.Close()
+	resp, body = send(conn, br, "DELETE /v1/charges HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	a.NotEqual(http.StatusOK, resp.StatusCode)
+	a.Contains(body, "DELETE /v1/charges is not allowed for role")
+	_, err = br.ReadByte()
+	a.Error(err, "a denied request ends the tunnel")
+	a.Equal([]string{"POST /v1/charges", "POST /v1/refunds", "GET /v1/../admin", "GET /v1/charges", "DELETE /v1/charges"}, inspected())
+	a.Equal(int32(3), atomic.LoadInt32(&reached))
+
+	// Anything but HTTP ends the tunnel.
+	conn, br = connect("logged")
+	defer conn.Close()
+	_, err = conn.Write([]byte("\x16\x03\x01\x00\x05hello\r\n\r\n"))
+	r.NoError(err)
+	_, err = br.ReadByte()
+	a.Error(err)
+	a.Equal(int32(3), atomic.LoadInt32(&reached))
+}
@@ -0,0 +1,137 @@
+package smokescreen
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+const defaultPolicyCacheMaxEntries = 10000
+
+// PolicyCache is a PolicyEngine that remembers the decisions of Engine for
+// TTL, so remote engines aren't asked about every request. Decisions are
+// remembered per PolicyInput, and errors aren't remembered at all.
+//
+// Embedders that change the policy behind Engine can keep the cache coherent
+// by invalidating the decisions that may have changed, with InvalidateRole,
+// InvalidateHost or Flush, rather than waiting for them to expire. Each
+// invalidation is counted in the policy.cache.invalidated metric, tagged
+// with its scope.
+type PolicyCache struct {
+	Engine     PolicyEngine
+	TTL        time.Duration
+	MaxEntries int // Decisions aren't remembered while this many are; defaults to 10000
+
+	config  *Config
+	mu      sync.Mutex
+	entries map[PolicyInput]policyCacheEntry
+	now     func() time.Time
+}
+
+type policyCacheEntry struct {
+	result  PolicyResult
+	expires time.Time
+}
+
+// SetupPolicyCache has c remember the decisions of the configured
+// PolicyEngine, unless c already has an engine, and decide in its place.
+func (config *Config) SetupPolicyCache(c *PolicyCache) error {
+	if c.TTL <= 0 {
+		return errors.New("policy cache requires a positive TTL")
+	}
+	if c.Engine == nil {
+		c.Engine = config.PolicyEngine
+	}
+	if c.Engine == nil {
+		return errors.New("policy cache requires a policy engine")
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = defaultPolicyCacheMaxEntries
+	}
+	c.config = config
+	c.entries = make(map[PolicyInput]policyCacheEntry)
+	if c.now == nil {
+		c.now = time.Now
+	}
+	config.PolicyEngine = c
+	return nil
+}
+
+func (c *PolicyCache) Decide(ctx context.Context, input PolicyInput) (PolicyResult, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[input]
+	if ok && c.now().After(entry.expires) {
+		delete(c.entries, input)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		c.config.MetricsClient.Incr("policy.cache.hit", []string{}, 1)
+		return entry.result, nil
+	}
+	c.config.MetricsClient.Incr("policy.cache.miss", []string{}, 1)
+
+	result, err := c.Engine.Decide(ctx, input)
+	if err != nil {
+		return result, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= c.MaxEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) < c.MaxEntries {
+		c.entries[input] = policyCacheEntry{result: result, expires: now.Add(c.TTL)}
+	}
+	return result, nil
+}
+
+// InvalidateRole forgets the decisions about role's requests, returning how
+// many there were.
+func (c *PolicyCache) InvalidateRole(role string) int {
+	return c.invalidate("role", func(input PolicyInput) bool {
+		return input.Role == role
+	})
+}
+
+// InvalidateHost forgets the decisions about requests to host, whatever
+// their port, returning how many there were.
+func (c *PolicyCache) InvalidateHost(host string) int {
+	host = hostport.Host(host)
+	return c.invalidate("host", func(input PolicyInput) bool {
+		return input.Host == host
+	})
+}
+
+// Flush forgets every decision, returning how many there were.
+func (c *PolicyCache) Flush() int {
+	return c.invalidate("all", func(PolicyInput) bool {
+		return true
+	})
+}
+
+func (c *PolicyCache) invalidate(scope string, match func(PolicyInput) bool) int {
+	c.mu.Lock()
+	var n int
+	for input := range c.entries {
+		if match(input) {
+			delete(c.entries, input)
+			n++
+		}
+	}
+	c.mu.Unlock()
+
+	tags := []string{"scope:" + scope}
+	c.config.MetricsClient.Incr("policy.cache.invalidated", tags, 1)
+	c.config.MetricsClient.Count("policy.cache.invalidated_entries", int64(n), tags, 1)
+	return n
+}
@@ -0,0 +1,62 @@
+package smokescreen
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyCache(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	r.Error(conf.SetupPolicyCache(&PolicyCache{TTL: time.Minute}))
+
+	engine := &testPolicyEngine{result: PolicyResult{Allow: true, Reason: "fine"}}
+	conf.PolicyEngine = engine
+	r.Error(conf.SetupPolicyCache(&PolicyCache{}))
+
+	now := time.Unix(1000, 0)
+	cache := &PolicyCache{TTL: time.Minute, now: func() time.Time { return now }}
+	r.NoError(conf.SetupPolicyCache(cache))
+	r.Equal(cache, conf.PolicyEngine)
+
+	payments := PolicyInput{Role: "payments", Host: "api.example.com", Port: 443, ResolvedIP: "8.8.9.1", Method: "CONNECT"}
+	billing := PolicyInput{Role: "billing", Host: "api.example.com", Port: 443, ResolvedIP: "8.8.9.1", Method: "CONNECT"}
+	other := PolicyInput{Role: "payments", Host: "other.example.com", Port: 443, ResolvedIP: "8.8.9.2", Method: "CONNECT"}
+	decide := func(input PolicyInput) {
+		result, err := cache.Decide(context.Background(), input)
+		r.NoError(err)
+		a.Equal(engine.result, result)
+	}
+
+	// Decisions are remembered until they expire.
+	decide(payments)
+	decide(payments)
+	a.Len(engine.inputs, 1)
+	now = now.Add(2 * time.Minute)
+	decide(payments)
+	a.Len(engine.inputs, 2)
+
+	// Invalidation forgets the decisions in its scope.
+	decide(billing)
+	decide(other)
+	a.Len(engine.inputs, 4)
+	a.Equal(2, cache.InvalidateRole("payments"))
+	decide(billing)
+	decide(payments)
+	a.Len(engine.inputs, 5)
+
+	a.Equal(2, cache.InvalidateHost("API.example.com."))
+	decide(billing)
+	a.Len(engine.inputs, 6)
+
+	a.Equal(1, cache.Flush())
+	a.Equal(0, cache.Flush())
+	decide(billing)
+	a.Len(engine.inputs, 7)
+}
@@ -0,0 +1,213 @@
+package smokescreen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// PolicyInput is what a PolicyEngine decides on.
+type PolicyInput struct {
+	Role       string `json:"role"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	ResolvedIP string `json:"resolved_ip"` // The address Smokescreen will connect to
+	Method     string `json:"method"`      // CONNECT, or the method of a plain HTTP request
+}
+
+// PolicyResult is a PolicyEngine's decision.
+type PolicyResult struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+	Rule   string `json:"rule"` // Reported like an ACL rule ID, if set
+
+	// Annotations are logged with the proxy decision, each key prefixed with
+	// "policy_", whether or not the request is allowed.
+	Annotations map[string]string `json:"annotations"`
+}
+
+// PolicyEngine decides whether requests may be proxied. It is consulted for
+// requests the egress ACL, if any, allows, once the destination has been
+// resolved to an address that is allowed, so a policy can take the address
+// into account. An error, or failing to decide within Config.PolicyTimeout,
+// denies the request.
+type PolicyEngine interface {
+	Decide(ctx context.Context, input PolicyInput) (PolicyResult, error)
+}
+
+// SwappablePolicyEngine is a PolicyEngine whose underlying engine can be
+// replaced while requests are being decided, such as when a policy module is
+// rebuilt from a file that changed. Each request is decided by either the old
+// engine or the new one.
+type SwappablePolicyEngine struct {
+	current atomic.Value // Stores a swappedPolicyEngine
+}
+
+type swappedPolicyEngine struct {
+	engine PolicyEngine
+}
+
+func NewSwappablePolicyEngine(engine PolicyEngine) *SwappablePolicyEngine {
+	e := &SwappablePolicyEngine{}
+	e.Swap(engine)
+	return e
+}
+
+// Swap makes engine decide subsequent requests.
+func (e *SwappablePolicyEngine) Swap(engine PolicyEngine) {
+	e.current.Store(swappedPolicyEngine{engine})
+}
+
+func (e *SwappablePolicyEngine) Decide(ctx context.Context, input PolicyInput) (PolicyResult, error) {
+	return e.current.Load().(swappedPolicyEngine).engine.Decide(ctx, input)
+}
+
+// OPAPolicyEngine decides with a policy served by an Open Policy Agent
+// server, such as a sidecar, through its Data API. URL names the document
+// that makes the decision, e.g.
+// http://127.0.0.1:8181/v1/data/smokescreen/decision; the document may be a
+// boolean or an object shaped like PolicyResult. An undefined document
+// denies the request.
+type OPAPolicyEngine struct {
+	URL    string
+	Client *http.Client // Defaults to a client with a 5 second timeout
+}
+
+var defaultOPAClient = &http.Client{Timeout: 5 * time.Second}
+
+func (e *OPAPolicyEngine) Decide(ctx context.Context, input PolicyInput) (PolicyResult, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return PolicyResult{}, err
+	}
+
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(body))
+	if err != nil {
+		return PolicyResult{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := e.Client
+	if client == nil {
+		client = defaultOPAClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return PolicyResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return PolicyResult{}, fmt.Errorf("OPA returned %s", resp.Status)
+	}
+
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return PolicyResult{}, fmt.Errorf("decoding OPA response: %v", err)
+	}
+	if len(out.Result) == 0 {
+		return PolicyResult{Reason: "policy decision is undefined"}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(out.Result, &allow); err == nil {
+		return PolicyResult{Allow: allow, Reason: "policy decision"}, nil
+	}
+	var result PolicyResult
+	if err := json.Unmarshal(out.Result, &result); err != nil {
+		return PolicyResult{}, fmt.Errorf("decoding OPA result: %v", err)
+	}
+	if result.Reason == "" {
+		result.Reason = "policy decision"
+	}
+	return result, nil
+}
+
+// checkPolicyEngine asks config.PolicyEngine about a request the ACL allowed,
+// denying it in decision if the engine does.
+func checkPolicyEngine(config *Config, req *http.Request, decision *aclDecision) {
+	// checkACLsForRequest has already vetted the destination.
+	host, _, _ := hostport.Split(decision.outboundHost)
+	input := PolicyInput{
+		Role:   decision.role,
+		Host:   host,
+		Method: req.Method,
+	}
+	if decision.resolvedAddr != nil {
+		input.Port = decision.resolvedAddr.Port
+		input.ResolvedIP = decision.resolvedAddr.IP.String()
+	}
+
+	ctx, span := startSpan(config, req.Context(), "smokescreen.policy")
+	result, err := decideWithTimeout(ctx, config.PolicyEngine, input, config.PolicyTimeout)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+
+	tags := []string{fmt.Sprintf("role:%s", decision.role)}
+	if err != nil {
+		config.Log.WithFields(logrus.Fields{
+			"error": err,
+			"role":  decision.role,
+		}).Warn("PolicyEngine.Decide returned an error.")
+		config.MetricsClient.Incr("policy.error", tags, 1)
+
+		decision.allow = false
+		decision.enforceWouldDeny = true
+		decision.reason = "Policy engine error"
+		return
+	}
+
+	if result.Rule != "" {
+		decision.ruleID = result.Rule
+	}
+	decision.policyAnnotations = result.Annotations
+	if result.Allow {
+		config.MetricsClient.Incr("policy.allow", tags, 1)
+		return
+	}
+	config.MetricsClient.Incr("policy.deny", tags, 1)
+	decision.allow = false
+	decision.enforceWouldDeny = true
+	decision.reason = result.Reason
+}
+
+// decideWithTimeout asks engine to decide, giving up after timeout if it is
+// positive. The context passed to the engine is cancelled then too, but an
+// engine that ignores it is left to finish in the background.
+func decideWithTimeout(ctx context.Context, engine PolicyEngine, input PolicyInput, timeout time.Duration) (PolicyResult, error) {
+	if timeout <= 0 {
+		return engine.Decide(ctx, input)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type outcome struct {
+		result PolicyResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := engine.Decide(ctx, input)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		return PolicyResult{}, fmt.Errorf("policy engine did not decide within %s", timeout)
+	}
+}
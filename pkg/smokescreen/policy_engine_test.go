@@ -0,0 +1,141 @@
+package smokescreen
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOPAPolicyEngine(t *testing.T) {
+	var input PolicyInput
+	var response string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct{ Input PolicyInput }
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		input = body.Input
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer srv.Close()
+
+	engine := &OPAPolicyEngine{URL: srv.URL}
+	in := PolicyInput{Role: "payments", Host: "api.example.com", Port: 443, ResolvedIP: "8.8.9.1", Method: "CONNECT"}
+
+	cases := []struct {
+		name     string
+		response string
+		result   PolicyResult
+	}{
+		{"boolean", `{"result": true}`, PolicyResult{Allow: true, Reason: "policy decision"}},
+		{"object", `{"result": {"allow": false, "reason": "not on weekends", "rule": "weekdays"}}`, PolicyResult{Reason: "not on weekends", Rule: "weekdays"}},
+		{"undefined", `{}`, PolicyResult{Reason: "policy decision is undefined"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response = c.response
+			result, err := engine.Decide(context.Background(), in)
+			require.NoError(t, err)
+			assert.Equal(t, c.result, result)
+			assert.Equal(t, in, input)
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		_, err := engine.Decide(context.Background(), in)
+		assert.EqualError(t, err, "OPA returned 500 Internal Server Error")
+	})
+}
+
+type testPolicyEngine struct {
+	inputs []PolicyInput
+	result PolicyResult
+}
+
+func (e *testPolicyEngine) Decide(ctx context.Context, input PolicyInput) (PolicyResult, error) {
+	e.inputs = append(e.inputs, input)
+	return e.result, nil
+}
+
+func TestPolicyEngineDecides(t *testing.T) {
+	a := assert.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("api.example.com", "8.8.9.1")
+	dns.Set("internal.example.com", "10.0.0.1")
+
+	engine := &testPolicyEngine{}
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.PolicyEngine = engine
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+
+	check := func(host string) *aclDecision {
+		req := httptest.NewRequest("CONNECT", "http://"+host, nil)
+		req.Header.Set("X-Smokescreen-Role", "payments")
+		decision, err := checkIfRequestShouldBeProxied(conf, req, host)
+		require.NoError(t, err)
+		return decision
+	}
+
+	engine.result = PolicyResult{Allow: true}
+	a.True(check("api.example.com:443").allow)
+	a.Equal([]PolicyInput{{Role: "payments", Host: "api.example.com", Port: 443, ResolvedIP: "8.8.9.1", Method: "CONNECT"}}, engine.inputs)
+
+	engine.result = PolicyResult{Reason: "not allowed by policy", Rule: "egress.deny", Annotations: map[string]string{"team": "payments"}}
+	decision := check("api.example.com:443")
+	a.False(decision.allow)
+	a.Equal("not allowed by policy", decision.reason)
+	a.Equal("egress.deny", decision.ruleID)
+	a.Equal(map[string]string{"team": "payments"}, decision.policyAnnotations)
+
+	// Addresses Smokescreen denies never reach the policy engine.
+	engine.inputs = nil
+	a.False(check("internal.example.com:443").allow)
+	a.Empty(engine.inputs)
+}
+
+type slowPolicyEngine struct{}
+
+func (slowPolicyEngine) Decide(ctx context.Context, input PolicyInput) (PolicyResult, error) {
+	time.Sleep(time.Second)
+	return PolicyResult{Allow: true}, nil
+}
+
+func TestPolicyTimeout(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := decideWithTimeout(context.Background(), slowPolicyEngine{}, PolicyInput{}, 10*time.Millisecond)
+	a.EqualError(err, "policy engine did not decide within 10ms")
+
+	engine := &testPolicyEngine{result: PolicyResult{Allow: true}}
+	result, err := decideWithTimeout(context.Background(), engine, PolicyInput{Role: "payments"}, time.Second)
+	a.NoError(err)
+	a.True(result.Allow)
+	a.Len(engine.inputs, 1)
+}
+
+func TestSwappablePolicyEngine(t *testing.T) {
+	a := assert.New(t)
+
+	e := NewSwappablePolicyEngine(&testPolicyEngine{result: PolicyResult{Allow: true}})
+	result, err := e.Decide(context.Background(), PolicyInput{})
+	a.NoError(err)
+	a.True(result.Allow)
+
+	e.Swap(&testPolicyEngine{result: PolicyResult{Reason: "swapped"}})
+	result, err = e.Decide(context.Background(), PolicyInput{})
+	a.NoError(err)
+	a.False(result.Allow)
+	a.Equal("swapped", result.Reason)
+}
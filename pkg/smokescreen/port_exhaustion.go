@@ -0,0 +1,311 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PortExhaustionMode is how dials are handled once a destination address
+// has as many connections as the port exhaustion threshold allows.
+type PortExhaustionMode int
+
+const (
+	PortExhaustionShed  PortExhaustionMode = iota // Dials fail right away, and requests are rejected with a retryable 503
+	PortExhaustionQueue                           // Dials wait, up to the connect timeout, for a port to free up
+)
+
+var portExhaustionModes = map[string]PortExhaustionMode{
+	"shed":  PortExhaustionShed,
+	"queue": PortExhaustionQueue,
+}
+
+func (m PortExhaustionMode) String() string {
+	return [...]string{"shed", "queue"}[m]
+}
+
+// PortExhaustionModeFromString parses a port exhaustion mode. An empty
+// string is PortExhaustionShed.
+func PortExhaustionModeFromString(s string) (PortExhaustionMode, error) {
+	if s == "" {
+		return PortExhaustionShed, nil
+	}
+	if m, ok := portExhaustionModes[s]; ok {
+		return m, nil
+	}
+	return PortExhaustionShed, fmt.Errorf("unknown port exhaustion mode %v", s)
+}
+
+const (
+	// portTimeWait is how long the ports of closed connections stay taken.
+	// Linux keeps the side that closed a connection first in TIME_WAIT for
+	// 60 seconds; we can't tell which side that was, so assume it was us.
+	portTimeWait = 60 * time.Second
+
+	// portUsageSweepInterval is how often destinations whose ports have all
+	// been freed are forgotten, and the busiest one is reported.
+	portUsageSweepInterval = 10 * time.Second
+
+	// Used when the ephemeral port range can't be read from the system.
+	defaultEphemeralPortLow  = 49152
+	defaultEphemeralPortHigh = 65535
+)
+
+// SetupPortExhaustionProtection keeps the proxy host from running out of
+// ephemeral ports. An outbound connection takes a local port from the
+// ephemeral range for as long as it is open, and for a while after it is
+// closed, and a port can only be used once for each destination address.
+// Once every port has been taken for an address, dials to it fail with
+// EADDRNOTAVAIL. Dials to an address that already has threshold, a fraction
+// of the ephemeral range, of its ports taken are instead handled as mode
+// says.
+func (config *Config) SetupPortExhaustionProtection(threshold float64, mode string) error {
+	if threshold <= 0 || threshold > 1 {
+		return fmt.Errorf("port exhaustion threshold must be between 0 and 1, not %v", threshold)
+	}
+	m, err := PortExhaustionModeFromString(mode)
+	if err != nil {
+		return err
+	}
+
+	low, high, err := ephemeralPortRange()
+	if err != nil {
+		config.Log.WithField("error", err).Warn("couldn't read the ephemeral port range; assuming the IANA range")
+		low, high = defaultEphemeralPortLow, defaultEphemeralPortHigh
+	}
+	limit := int(threshold * float64(high-low+1))
+	if limit < 1 {
+		limit = 1
+	}
+	config.portUsage = newPortUsage(config, limit, m)
+	return nil
+}
+
+// parsePortRange parses an ephemeral port range written as two numbers, as
+// in net.ipv4.ip_local_port_range.
+func parsePortRange(s string) (int, int, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	low, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	high, err := strconv.Atoi(fields[1])
+	if err != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return low, high, nil
+}
+
+// portUsage counts the ports taken by connections to each destination
+// address, open ones and those closed less than portTimeWait ago.
+type portUsage struct {
+	sync.Mutex
+	config *Config
+	limit  int
+	mode   PortExhaustionMode
+	now    func() time.Time
+
+	dests     map[string]*destinationPorts
+	changed   chan struct{} // Closed and replaced whenever a port is released
+	lastSweep time.Time
+}
+
+type destinationPorts struct {
+	open    int
+	closing []time.Time // When connections were closed, oldest first
+}
+
+// taken returns the number of ports taken, forgetting connections whose
+// ports have been freed since.
+func (d *destinationPorts) taken(now time.Time) int {
+	for len(d.closing) > 0 && now.Sub(d.closing[0]) >= portTimeWait {
+		d.closing = d.closing[1:]
+	}
+	return d.open + len(d.closing)
+}
+
+func newPortUsage(config *Config, limit int, mode PortExhaustionMode) *portUsage {
+	return &portUsage{
+		config:  config,
+		limit:   limit,
+		mode:    mode,
+		now:     time.Now,
+		dests:   make(map[string]*destinationPorts),
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire takes a port for a connection to addr, an IP address and port,
+// waiting up to wait for one to free up if addr is at the limit. It reports
+// whether a port was taken.
+func (p *portUsage) acquire(addr string, wait time.Duration) bool {
+	p.Lock()
+	deadline := p.now().Add(wait)
+	for {
+		now := p.now()
+		p.sweep(now)
+		d := p.dests[addr]
+		if d == nil {
+			d = &destinationPorts{}
+			p.dests[addr] = d
+		}
+		if d.taken(now) < p.limit {
+			d.open++
+			p.Unlock()
+			return true
+		}
+
+		remaining := deadline.Sub(now)
+		if remaining <= 0 {
+			p.Unlock()
+			return false
+		}
+		if len(d.closing) > 0 {
+			if freed := d.closing[0].Add(portTimeWait).Sub(now); freed < remaining {
+				remaining = freed
+			}
+		}
+		changed := p.changed
+		p.Unlock()
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		p.Lock()
+	}
+}
+
+// atLimit reports whether addr has all the ports it may take.
+func (p *portUsage) atLimit(addr string) bool {
+	p.Lock()
+	defer p.Unlock()
+	d := p.dests[addr]
+	return d != nil && d.taken(p.now()) >= p.limit
+}
+
+// release gives back the port of a connection to addr. Ports of connections
+// that were established stay taken for portTimeWait; those of failed dials
+// are freed right away.
+func (p *portUsage) release(addr string, established bool) {
+	p.Lock()
+	defer p.Unlock()
+	d := p.dests[addr]
+	if d == nil || d.open == 0 {
+		return
+	}
+	d.open--
+	if established {
+		d.closing = append(d.closing, p.now())
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// sweep forgets destinations whose ports have all been freed and reports
+// the most ports any destination has taken, at most every
+// portUsageSweepInterval.
+func (p *portUsage) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < portUsageSweepInterval {
+		return
+	}
+	p.lastSweep = now
+	busiest := 0
+	for addr, d := range p.dests {
+		taken := d.taken(now)
+		if taken == 0 {
+			delete(p.dests, addr)
+		}
+		if taken > busiest {
+			busiest = taken
+		}
+	}
+	p.config.MetricsClient.Gauge("cn.ephemeral_ports.busiest", float64(busiest), []string{}, 1)
+	p.config.MetricsClient.Gauge("cn.ephemeral_ports.busiest_ratio", float64(busiest)/float64(p.limit), []string{}, 1)
+}
+
+// acquirePort takes a port for a connection to addr, if port exhaustion
+// protection is set up, and returns a connLimitError if none can be. Queued
+// dials wait up to timeout, the connection's connect timeout.
+func acquirePort(config *Config, role string, addr *net.TCPAddr, timeout time.Duration) error {
+	p := config.portUsage
+	if p == nil {
+		return nil
+	}
+	tags := []string{fmt.Sprintf("role:%s", role)}
+	var wait time.Duration
+	if p.mode == PortExhaustionQueue {
+		wait = timeout
+	}
+
+	start := time.Now()
+	ok := p.acquire(addr.String(), wait)
+	if waited := time.Since(start); wait > 0 && waited > time.Millisecond {
+		config.MetricsClient.Timing("cn.ephemeral_ports.queue_wait", waited, tags, 1)
+	}
+	if !ok {
+		config.MetricsClient.Incr("cn.ephemeral_ports.shed", tags, 1)
+		return connLimitError{
+			error: fmt.Errorf("too many connections to %s: %d of its ephemeral ports are taken", addr, p.limit),
+			limit: limitEphemeralPort,
+		}
+	}
+	return nil
+}
+
+// checkPortLimit rejects CONNECT requests to a destination address whose
+// ports are all taken, when dials to it would be shed rather than queued.
+func checkPortLimit(config *Config, decision *aclDecision) error {
+	p := config.portUsage
+	if p == nil || p.mode != PortExhaustionShed || decision.resolvedAddr == nil || decision.upstreamProxy != nil {
+		return nil
+	}
+	if !p.atLimit(decision.resolvedAddr.String()) {
+		return nil
+	}
+	config.MetricsClient.Incr("cn.ephemeral_ports.shed", []string{fmt.Sprintf("role:%s", decision.role)}, 1)
+	return connLimitError{
+		error: fmt.Errorf("too many connections to %s: %d of its ephemeral ports are taken", decision.resolvedAddr, p.limit),
+		limit: limitEphemeralPort,
+	}
+}
+
+// portExhaustedError turns a dial error caused by the proxy host having run
+// out of ephemeral ports into a connLimitError saying so, rather than
+// leaving clients with "cannot assign requested address".
+func portExhaustedError(config *Config, role string, addr *net.TCPAddr, err error) error {
+	if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return err
+	}
+	config.MetricsClient.Incr("cn.ephemeral_ports.exhausted", []string{fmt.Sprintf("role:%s", role)}, 1)
+	return connLimitError{
+		error: fmt.Errorf("no ephemeral ports left to connect to %s: %v", addr, err),
+		limit: limitEphemeralPort,
+	}
+}
+
+// portHoldingConn releases the port of its connection when it is closed.
+type portHoldingConn struct {
+	net.Conn
+	ports *portUsage
+	addr  string
+	once  sync.Once
+}
+
+func (c *portHoldingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.ports.release(c.addr, true)
+	})
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package smokescreen
+
+import (
+	"io/ioutil"
+)
+
+const ipLocalPortRangePath = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// ephemeralPortRange reads the range local ports of outbound connections
+// are picked from.
+func ephemeralPortRange() (int, int, error) {
+	b, err := ioutil.ReadFile(ipLocalPortRangePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parsePortRange(string(b))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package smokescreen
+
+import "errors"
+
+func ephemeralPortRange() (int, int, error) {
+	return 0, 0, errors.New("reading the ephemeral port range is only supported on Linux")
+}
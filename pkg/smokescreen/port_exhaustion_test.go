@@ -0,0 +1,139 @@
+package smokescreen
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestPortUsage(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Unix(1000000, 0)
+	p := newPortUsage(NewConfig(), 2, PortExhaustionShed)
+	p.now = func() time.Time { return now }
+
+	a.True(p.acquire("10.0.0.1:443", 0))
+	a.True(p.acquire("10.0.0.1:443", 0))
+	a.False(p.acquire("10.0.0.1:443", 0))
+	a.True(p.atLimit("10.0.0.1:443"))
+	a.True(p.acquire("10.0.0.2:443", 0), "ports are counted per destination address")
+	a.True(p.acquire("10.0.0.1:80", 0))
+
+	// Failed dials free their port right away; closed connections hold it
+	// while in TIME_WAIT.
+	p.release("10.0.0.1:443", false)
+	a.True(p.acquire("10.0.0.1:443", 0))
+	p.release("10.0.0.1:443", true)
+	a.False(p.acquire("10.0.0.1:443", 0))
+	now = now.Add(portTimeWait)
+	a.True(p.acquire("10.0.0.1:443", 0))
+
+	// Destinations whose ports are all free are forgotten.
+	p.release("10.0.0.2:443", false)
+	now = now.Add(portUsageSweepInterval)
+	p.acquire("10.0.0.3:443", 0)
+	a.NotContains(p.dests, "10.0.0.2:443")
+	a.Contains(p.dests, "10.0.0.1:443")
+}
+
+func TestPortUsageQueue(t *testing.T) {
+	a := assert.New(t)
+
+	p := newPortUsage(NewConfig(), 1, PortExhaustionQueue)
+	a.True(p.acquire("10.0.0.1:443", 0))
+
+	start := time.Now()
+	a.False(p.acquire("10.0.0.1:443", 50*time.Millisecond))
+	a.True(time.Since(start) >= 50*time.Millisecond)
+
+	// Waiting dials take the port of the next failed dial.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.release("10.0.0.1:443", false)
+	}()
+	a.True(p.acquire("10.0.0.1:443", 5*time.Second))
+}
+
+func TestParsePortRange(t *testing.T) {
+	a := assert.New(t)
+
+	low, high, err := parsePortRange("32768\t60999\n")
+	a.NoError(err)
+	a.Equal(32768, low)
+	a.Equal(60999, high)
+
+	for _, s := range []string{"", "32768", "60999 32768", "0 100", "1024 65536", "a b", "1 2 3"} {
+		_, _, err := parsePortRange(s)
+		a.Error(err, s)
+	}
+
+	conf := NewConfig()
+	a.Error(conf.SetupPortExhaustionProtection(0, ""))
+	a.Error(conf.SetupPortExhaustionProtection(1.5, ""))
+	a.Error(conf.SetupPortExhaustionProtection(0.8, "drop"))
+	a.NoError(conf.SetupPortExhaustionProtection(0.8, "queue"))
+	a.Equal(PortExhaustionQueue, conf.portUsage.mode)
+	a.True(conf.portUsage.limit > 0)
+}
+
+func TestPortExhaustionShed(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	conf.portUsage = newPortUsage(conf, 1, PortExhaustionShed)
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+	// The first request takes the destination's only port, which stays taken
+	// after its connection closes.
+	resp, err := client.Get(upstream.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Get(upstream.URL)
+	r.NoError(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	r.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	a.Equal(limitEphemeralPort, resp.Header.Get(limitHeader))
+	a.Equal("true", resp.Header.Get(retryableHeader))
+	a.Contains(string(body), "ephemeral ports are taken")
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	r.NoError(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamHost, upstreamHost)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	r.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	a.Equal(limitEphemeralPort, resp.Header.Get(limitHeader))
+}
@@ -0,0 +1,222 @@
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rangeFileProgressInterval is how many entries are read from a range file
+// between progress log lines.
+const rangeFileProgressInterval = 1000000
+
+// DefaultRangeFileMaxEntries bounds the number of entries loaded from range
+// files, which is enough for the largest public threat feeds while keeping
+// the ranges below a few hundred megabytes of memory.
+const DefaultRangeFileMaxEntries = 10000000
+
+// RangeSet is a compact, sorted set of IP ranges. It holds range files that
+// would take too much memory, and too long to search, as RuleRanges.
+type RangeSet struct {
+	v4 []ipv4Range
+	v6 []ipv6Range
+}
+
+type ipv4Range struct{ first, last uint32 }
+
+type ipv6Range struct{ first, last [16]byte }
+
+// Len returns the number of ranges in the set, after overlapping and
+// adjacent ranges have been merged.
+func (s *RangeSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.v4) + len(s.v6)
+}
+
+// Contains reports whether ip is in one of the set's ranges.
+func (s *RangeSet) Contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		v := binary.BigEndian.Uint32(ip4)
+		i := sort.Search(len(s.v4), func(i int) bool { return s.v4[i].last >= v })
+		return i < len(s.v4) && s.v4[i].first <= v
+	}
+
+	var v [16]byte
+	copy(v[:], ip.To16())
+	i := sort.Search(len(s.v6), func(i int) bool { return bytes.Compare(s.v6[i].last[:], v[:]) >= 0 })
+	return i < len(s.v6) && bytes.Compare(s.v6[i].first[:], v[:]) <= 0
+}
+
+func (s *RangeSet) add(n *net.IPNet) {
+	if ip4 := n.IP.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+		first := binary.BigEndian.Uint32(ip4)
+		last := first | ^binary.BigEndian.Uint32(n.Mask)
+		s.v4 = append(s.v4, ipv4Range{first, last})
+		return
+	}
+
+	var r ipv6Range
+	copy(r.first[:], n.IP.To16())
+	for i := range r.last {
+		r.last[i] = r.first[i] | ^n.Mask[i]
+	}
+	s.v6 = append(s.v6, r)
+}
+
+// compact sorts the set's ranges and merges those that overlap or touch.
+func (s *RangeSet) compact() {
+	sort.Slice(s.v4, func(i, j int) bool { return s.v4[i].first < s.v4[j].first })
+	merged4 := s.v4[:0]
+	for _, r := range s.v4 {
+		if n := len(merged4); n > 0 && (merged4[n-1].last == ^uint32(0) || r.first <= merged4[n-1].last+1) {
+			if r.last > merged4[n-1].last {
+				merged4[n-1].last = r.last
+			}
+			continue
+		}
+		merged4 = append(merged4, r)
+	}
+	s.v4 = merged4
+
+	sort.Slice(s.v6, func(i, j int) bool { return bytes.Compare(s.v6[i].first[:], s.v6[j].first[:]) < 0 })
+	merged6 := s.v6[:0]
+	for _, r := range s.v6 {
+		if n := len(merged6); n > 0 && bytes.Compare(r.first[:], merged6[n-1].last[:]) <= 0 {
+			if bytes.Compare(r.last[:], merged6[n-1].last[:]) > 0 {
+				merged6[n-1].last = r.last
+			}
+			continue
+		}
+		merged6 = append(merged6, r)
+	}
+	s.v6 = merged6
+}
+
+// SetupDenyRangeFiles denies the IP ranges listed in each of paths.
+func (config *Config) SetupDenyRangeFiles(paths []string) error {
+	if config.DenyRangeSet == nil {
+		config.DenyRangeSet = &RangeSet{}
+	}
+	return config.loadRangeFiles(config.DenyRangeSet, paths)
+}
+
+// SetupAllowRangeFiles allows the IP ranges listed in each of paths.
+func (config *Config) SetupAllowRangeFiles(paths []string) error {
+	if config.AllowRangeSet == nil {
+		config.AllowRangeSet = &RangeSet{}
+	}
+	return config.loadRangeFiles(config.AllowRangeSet, paths)
+}
+
+func (config *Config) loadRangeFiles(set *RangeSet, paths []string) error {
+	for _, path := range paths {
+		if err := config.loadRangeFile(set, path); err != nil {
+			return err
+		}
+	}
+	set.compact()
+	return nil
+}
+
+// loadRangeFile adds the ranges in the file at path to set. The file is read
+// a line at a time, so only the compact ranges are held in memory.
+//
+// Each line holds an address or a range in CIDR notation. Blank lines are
+// skipped, and anything after a '#' or ';' is a comment, which covers the
+// formats most threat feeds are published in.
+func (config *Config) loadRangeFile(set *RangeSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+
+	cr := &countingReader{r: f}
+	scanner := bufio.NewScanner(cr)
+	entries := 0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		n, err := parseRangeFileEntry(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+
+		if config.RangeFileMaxEntries > 0 && set.Len()+1 > config.RangeFileMaxEntries {
+			return fmt.Errorf("%s: range files have more than %d entries", path, config.RangeFileMaxEntries)
+		}
+		set.add(n)
+		entries++
+
+		if entries%rangeFileProgressInterval == 0 {
+			config.Log.WithFields(log.Fields{
+				"file":       path,
+				"entries":    entries,
+				"bytes_read": cr.n,
+				"bytes":      size,
+			}).Info("Loading range file")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	config.Log.WithFields(log.Fields{
+		"file":    path,
+		"entries": entries,
+	}).Info("Loaded range file")
+	return nil
+}
+
+func parseRangeFileEntry(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address or range '%s'", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
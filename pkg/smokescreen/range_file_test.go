@@ -0,0 +1,90 @@
+package smokescreen
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRangeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestRangeFiles(t *testing.T) {
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-ranges")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	deny := writeRangeFile(t, dir, "deny.txt", `# Threat feed
+1.10.16.0/20 ; SBL256894
+1.10.24.0/21
+1.10.20.0/22
+5.5.5.5
+2001:db8:bad::/48 # documentation
+2001:db8:bad:1::/64
+
+`)
+	allow := writeRangeFile(t, dir, "allow.txt", "1.10.17.0/24\n")
+
+	conf := NewConfig()
+	r.NoError(conf.SetupDenyRangeFiles([]string{deny}))
+	r.NoError(conf.SetupAllowRangeFiles([]string{allow}))
+
+	// The overlapping and adjacent ranges are merged.
+	r.Equal(3, conf.DenyRangeSet.Len())
+
+	for _, c := range []struct {
+		ip       string
+		expected ipClassification
+	}{
+		{"1.10.16.1", ipDenyUserConfigured},
+		{"1.10.31.255", ipDenyUserConfigured},
+		{"1.10.32.0", ipAllowDefault},
+		{"1.10.15.255", ipAllowDefault},
+		{"1.10.17.3", ipAllowUserConfigured},
+		{"5.5.5.5", ipDenyUserConfigured},
+		{"5.5.5.6", ipAllowDefault},
+		{"2001:db8:bad:ffff::1", ipDenyUserConfigured},
+		{"2001:db8:bae::1", ipAllowDefault},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 443}
+		assert.Equal(t, c.expected, classifyAddr(conf, addr), c.ip)
+	}
+}
+
+func TestRangeFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smokescreen-ranges")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("invalid entry", func(t *testing.T) {
+		path := writeRangeFile(t, dir, "invalid.txt", "1.2.3.0/24\nnot-an-ip\n")
+		err := NewConfig().SetupDenyRangeFiles([]string{path})
+		assert.EqualError(t, err, path+":2: invalid address or range 'not-an-ip'")
+	})
+
+	t.Run("too many entries", func(t *testing.T) {
+		path := writeRangeFile(t, dir, "large.txt", "1.2.3.4\n1.2.3.6\n1.2.3.8\n")
+		conf := NewConfig()
+		conf.RangeFileMaxEntries = 2
+		err := conf.SetupDenyRangeFiles([]string{path})
+		assert.EqualError(t, err, path+": range files have more than 2 entries")
+
+		conf.RangeFileMaxEntries = 0
+		assert.NoError(t, conf.SetupDenyRangeFiles([]string{path}))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		err := NewConfig().SetupDenyRangeFiles([]string{filepath.Join(dir, "missing.txt")})
+		assert.Error(t, err)
+	})
+}
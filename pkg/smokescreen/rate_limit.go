@@ -0,0 +1,64 @@
+package smokescreen
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+// rateLimitError is returned for requests denied because their role exceeded
+// the rate limit set in the ACL. Clients get a 429 rather than the usual 407
+// so they can tell being throttled apart from being denied.
+type rateLimitError struct {
+	error
+	retryAfter time.Duration
+	rule       string
+}
+
+// roleRateLimiter keeps a token bucket for every role with a rate limit.
+type roleRateLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	limit  acl.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newRoleRateLimiter() *roleRateLimiter {
+	return &roleRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from role's bucket. If the bucket is empty, it returns
+// false and how long until a token is available. A bucket is reset when the
+// role's limit changes, e.g. after the ACL is reloaded.
+func (rl *roleRateLimiter) Allow(role string, limit acl.RateLimit) (bool, time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := rl.now()
+	b, ok := rl.buckets[role]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Requests), last: now}
+		rl.buckets[role] = b
+	}
+
+	rate := float64(limit.Requests) / limit.Per.Seconds()
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
@@ -0,0 +1,98 @@
+package smokescreen
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestRoleRateLimiter(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Unix(1000, 0)
+	rl := newRoleRateLimiter()
+	rl.now = func() time.Time { return now }
+	limit := acl.RateLimit{Requests: 2, Per: time.Second}
+
+	ok, _ := rl.Allow("chatty", limit)
+	a.True(ok)
+	ok, _ = rl.Allow("chatty", limit)
+	a.True(ok)
+	ok, retryAfter := rl.Allow("chatty", limit)
+	a.False(ok)
+	a.Equal(500*time.Millisecond, retryAfter)
+
+	// Other roles have their own bucket.
+	ok, _ = rl.Allow("quiet", limit)
+	a.True(ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = rl.Allow("chatty", limit)
+	a.True(ok)
+	ok, _ = rl.Allow("chatty", limit)
+	a.False(ok)
+
+	// A new limit starts with a full bucket.
+	ok, _ = rl.Allow("chatty", acl.RateLimit{Requests: 1, Per: time.Second})
+	a.True(ok)
+}
+
+func TestRateLimitedRoleGets429(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	conf := NewConfig()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"chatty": {
+				Policy:      acl.Enforce,
+				DomainGlobs: []string{"127.0.0.1"},
+				RateLimit:   &acl.RateLimit{Requests: 1, Per: time.Hour},
+			},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	client, err := proxyClient(proxy.URL)
+	r.NoError(err)
+
+	get := func() (*http.Response, string) {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		r.NoError(err)
+		req.Header.Set("X-Smokescreen-Role", "chatty")
+		resp, err := client.Do(req)
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		return resp, string(body)
+	}
+
+	resp, _ := get()
+	a.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, body := get()
+	a.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	a.Equal("3600", resp.Header.Get("Retry-After"))
+	a.Equal("chatty", resp.Header.Get(ruleHeader))
+	a.Contains(body, "role exceeded its rate limit of 1 requests per 1h0m0s")
+}
@@ -0,0 +1,138 @@
+package smokescreen
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/transport"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// Redirect following
+//
+// Redirects of plain HTTP requests are normally passed to the client, which
+// sends the request again, to the new location, through the proxy, where it
+// is checked like any other. A role's ACL rule may set follow_redirects to
+// have smokescreen follow up to that many redirects itself instead. Each
+// location is checked against the ACL and resolved as a request from the
+// same role would be, and a denied one is answered with a deny response
+// rather than followed. The locations followed are logged with the proxy
+// decision, which is that of the last one.
+
+// redirectRoleKey is the context key of the role of requests smokescreen
+// makes on a client's behalf, which is already known.
+type redirectRoleKey struct{}
+
+// followRedirects follows the redirects resp, the response to a plain HTTP
+// proxy request, leads to, if the role's ACL rule has them followed, and
+// returns the response to pass to the client.
+func followRedirects(config *Config, tr *transport.Transport, resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	userData, ok := ctx.UserData.(*ctxUserData)
+	if !ok || resp == nil || ctx.Error != nil || userData.tunnel != nil || userData.decision == nil {
+		return resp
+	}
+	max := userData.decision.followRedirects
+	role := userData.decision.role
+	tags := []string{fmt.Sprintf("role:%s", role)}
+
+	prev := ctx.Req
+	for hops := 0; hops < max; hops++ {
+		next := redirectRequest(prev, resp)
+		if next == nil {
+			return resp
+		}
+		resp.Body.Close()
+
+		userData.redirects = append(userData.redirects, next.URL.String())
+		remoteHost := hostport.WithDefaultPort(next.Host, next.URL.Scheme)
+		check := next.WithContext(context.WithValue(next.Context(), redirectRoleKey{}, role))
+		decision, err := checkIfRequestShouldBeProxied(config, check, remoteHost)
+		if err == nil && !decision.allow {
+			err = decision.denyErr()
+		}
+		if err == nil {
+			err = checkPlainHTTPAllowed(config, decision)
+		}
+		if err == nil {
+			err = checkHTTPRules(config, decision, next)
+		}
+		if decision != nil {
+			userData.decision = decision
+		}
+		if err != nil {
+			config.MetricsClient.Incr("redirect.denied", tags, 1)
+			if _, ok := err.(denyError); !ok {
+				ctx.Error = err
+			}
+			return rejectResponse(next, config, err)
+		}
+
+		if decision.upstreamProxy != nil {
+			next = withUpstreamProxy(next, decision.upstreamProxy)
+			if !isSocksProxy(decision.upstreamProxy) {
+				addUpstreamIdentity(config, next.Header, decision)
+			}
+		}
+		config.MetricsClient.Incr("redirect.followed", tags, 1)
+		ctx.RoundTrip, resp, err = tr.DetailedRoundTrip(next, userData)
+		if err != nil {
+			ctx.Error = err
+			return rejectResponse(next, config, err)
+		}
+		prev = next
+	}
+	return resp
+}
+
+// redirectRequest returns the request that follows the redirect resp, the
+// response to prev, leads to, or nil if it isn't a redirect that can be
+// followed: one to a plain HTTP location that doesn't need prev's body
+// sent again.
+func redirectRequest(prev *http.Request, resp *http.Response) *http.Request {
+	method := prev.Method
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		// Like browsers and net/http's client, send the request again
+		// without its body, as a GET.
+		if method != http.MethodHead {
+			method = http.MethodGet
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		if prev.ContentLength != 0 || len(prev.TransferEncoding) > 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	u, err := prev.URL.Parse(location)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return nil
+	}
+
+	next, err := http.NewRequestWithContext(prev.Context(), method, u.String(), nil)
+	if err != nil {
+		return nil
+	}
+	next.Header = prev.Header.Clone()
+	next.Header.Del("Proxy-Authorization")
+	if method != prev.Method {
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	// Like net/http's client, don't send credentials to other hosts.
+	if !strings.EqualFold(hostport.Host(u.Host), hostport.Host(prev.URL.Host)) {
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	next.RemoteAddr = prev.RemoteAddr
+	next.TLS = prev.TLS
+	return next
+}
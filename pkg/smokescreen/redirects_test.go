@@ -0,0 +1,139 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var port string
+	// The transport resolves names with the system resolver, so the
+	// destinations are localhost and loopback addresses.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, _ := net.SplitHostPort(req.Host)
+		switch host + req.URL.Path {
+		case "localhost/start":
+			http.Redirect(w, req, fmt.Sprintf("http://127.0.0.1:%s/final", port), http.StatusFound)
+		case "localhost/relative":
+			http.Redirect(w, req, "/final", http.StatusMovedPermanently)
+		case "localhost/denied":
+			http.Redirect(w, req, fmt.Sprintf("http://127.0.0.2:%s/", port), http.StatusFound)
+		case "localhost/loop":
+			http.Redirect(w, req, "/loop", http.StatusFound)
+		case "localhost/post":
+			http.Redirect(w, req, "/final", http.StatusTemporaryRedirect)
+		default:
+			fmt.Fprintf(w, "%s %s %s auth=%q", req.Method, host, req.URL.Path, req.Header.Get("Authorization"))
+		}
+	}))
+	defer upstream.Close()
+	_, port, _ = net.SplitHostPort(upstream.Listener.Addr().String())
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("localhost", "127.0.0.1")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.ConnectTimeout = 5 * time.Second
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		if role := req.Header.Get(roleHeader); role != "" {
+			return role, nil
+		}
+		return "", errors.New("no role")
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"follower":  {Policy: acl.Enforce, DomainGlobs: []string{"localhost", "127.0.0.1"}, FollowRedirects: 3},
+			"forwarder": {Policy: acl.Enforce, DomainGlobs: []string{"localhost", "127.0.0.1"}},
+		},
+	}
+	logHook := logrustest.NewLocal(conf.Log)
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	do := func(role, method, path string) (*http.Response, string) {
+		var body *strings.Reader
+		if method == http.MethodPost {
+			body = strings.NewReader("payload")
+		} else {
+			body = strings.NewReader("")
+		}
+		req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%s%s", port, path), body)
+		r.NoError(err)
+		req.Header.Set(roleHeader, role)
+		req.Header.Set("Authorization", "Bearer secret")
+		logHook.Reset()
+		resp, err := client.Do(req)
+		r.NoError(err)
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		r.NoError(err)
+		return resp, string(b)
+	}
+
+	// Redirects to allowed hosts are followed, without credentials for
+	// other hosts, and logged.
+	resp, body := do("follower", http.MethodGet, "/start")
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal(`GET 127.0.0.1 /final auth=""`, body)
+	entry := findCanonicalProxyDecision(logHook.AllEntries())
+	r.NotNil(entry)
+	a.Equal([]string{fmt.Sprintf("http://127.0.0.1:%s/final", port)}, entry.Data["redirects"])
+	a.Equal(true, entry.Data["allow"])
+
+	resp, body = do("follower", http.MethodGet, "/relative")
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal(`GET localhost /final auth="Bearer secret"`, body)
+
+	// Redirect targets are checked against the ACL.
+	resp, _ = do("follower", http.MethodGet, "/denied")
+	a.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+	entry = findCanonicalProxyDecision(logHook.AllEntries())
+	a.Equal(false, entry.Data["allow"])
+	a.Equal([]string{fmt.Sprintf("http://127.0.0.2:%s/", port)}, entry.Data["redirects"])
+
+	// Past the limit, and for requests whose body would have to be sent
+	// again, the redirect is passed on.
+	resp, _ = do("follower", http.MethodGet, "/loop")
+	a.Equal(http.StatusFound, resp.StatusCode)
+	a.Len(findCanonicalProxyDecision(logHook.AllEntries()).Data["redirects"], 3)
+
+	resp, _ = do("follower", http.MethodPost, "/post")
+	a.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+
+	// Roles that don't follow redirects get them as they are.
+	resp, _ = do("forwarder", http.MethodGet, "/start")
+	a.Equal(http.StatusFound, resp.StatusCode)
+	a.Equal(fmt.Sprintf("http://127.0.0.1:%s/final", port), resp.Header.Get("Location"))
+	a.NotContains(findCanonicalProxyDecision(logHook.AllEntries()).Data, "redirects")
+}
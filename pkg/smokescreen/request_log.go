@@ -0,0 +1,256 @@
+package smokescreen
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+// Formats of the request log.
+const (
+	RequestLogCommon = "common" // NCSA Common Log Format, as written by Apache
+	RequestLogW3C    = "w3c"    // W3C Extended Log File Format
+)
+
+// w3cFields are the fields of each W3C request log entry, in order. Fields
+// starting with x- are Smokescreen's own.
+const w3cFields = "date time time-taken c-ip cs-username cs-method cs-uri cs-version sc-status sc-bytes cs-bytes s-ip x-decision x-rule-id"
+
+// RequestLog writes one line per proxied request, and per CONNECT tunnel, in
+// a format log analysis tools that don't read JSON can ingest. Plain HTTP
+// requests, and the requests inside inspected tunnels, are written once
+// they're answered. CONNECT tunnels are written once they're closed, with the
+// bytes they carried, or once they're denied. The client's role is logged as
+// the user.
+type RequestLog struct {
+	Format string
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// requestLogEntry is what the request log knows about a request or tunnel.
+type requestLogEntry struct {
+	start         time.Time
+	duration      time.Duration
+	client        string // The client's address, with or without a port
+	role          string
+	method        string
+	uri           string // The requested URL, or host:port for CONNECT requests
+	proto         string
+	status        int
+	bytesSent     int64 // Bytes sent to the client, or -1 if not known
+	bytesReceived int64 // Bytes received from the client, or -1 if not known
+	destIP        string
+	allow         bool
+	ruleID        string
+}
+
+// SetupRequestLog writes a request log in format, RequestLogCommon or
+// RequestLogW3C, to path. The file is rotated like the access log.
+func (config *Config) SetupRequestLog(path, format string, maxSize int64, maxBackups int, compress bool) error {
+	if path == "" {
+		return nil
+	}
+	if format == "" {
+		format = RequestLogCommon
+	}
+
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		Compress:   compress,
+	}
+	switch format {
+	case RequestLogCommon:
+	case RequestLogW3C:
+		// W3C logs describe their fields at the start of every file.
+		rf.Header = func() []byte {
+			return []byte(fmt.Sprintf("#Version: 1.0\n#Software: smokescreen %s\n#Date: %s\n#Fields: %s\n",
+				Version(), time.Now().UTC().Format("2006-01-02 15:04:05"), w3cFields))
+		}
+	default:
+		return fmt.Errorf("unknown request log format %q, expected %q or %q", format, RequestLogCommon, RequestLogW3C)
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	config.RequestLog = &RequestLog{Format: format, out: rf}
+	return nil
+}
+
+func (l *RequestLog) write(e *requestLogEntry) {
+	var line string
+	if l.Format == RequestLogW3C {
+		line = e.w3c()
+	} else {
+		line = e.common()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+// common formats e as a Common Log Format line.
+func (e *requestLogEntry) common() string {
+	bytes := "-"
+	if e.bytesSent > 0 {
+		bytes = strconv.FormatInt(e.bytesSent, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %s\n",
+		clfField(clientHost(e.client)),
+		clfField(e.role),
+		e.start.Format("02/Jan/2006:15:04:05 -0700"),
+		e.method+" "+e.uri+" "+e.proto,
+		e.status,
+		bytes)
+}
+
+// w3c formats e as a W3C extended log line with the fields in w3cFields.
+func (e *requestLogEntry) w3c() string {
+	start := e.start.UTC()
+	decision := "deny"
+	if e.allow {
+		decision = "allow"
+	}
+	count := func(n int64) string {
+		if n < 0 {
+			return "-"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	fields := []string{
+		start.Format("2006-01-02"),
+		start.Format("15:04:05"),
+		strconv.FormatFloat(e.duration.Seconds(), 'f', 3, 64),
+		w3cField(clientHost(e.client)),
+		w3cField(e.role),
+		w3cField(e.method),
+		w3cField(e.uri),
+		w3cField(e.proto),
+		strconv.Itoa(e.status),
+		count(e.bytesSent),
+		count(e.bytesReceived),
+		w3cField(e.destIP),
+		decision,
+		w3cField(e.ruleID),
+	}
+	return strings.Join(fields, " ") + "\n"
+}
+
+// clfField returns s, or "-" if it is empty. Spaces would split the field,
+// so they are replaced.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "_", -1)
+}
+
+// w3cField returns s, or "-" if it is empty, with spaces replaced by "+" as
+// IIS does.
+func w3cField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "+", -1)
+}
+
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// logRequest writes the request a canonical proxy decision is about to the
+// request log, unless it is an allowed CONNECT request, whose tunnel is
+// written once it closes.
+func logRequest(config *Config, ctx *goproxy.ProxyCtx, proxyType string, toAddress *net.TCPAddr, decision *aclDecision, start time.Time, err error) {
+	if config.RequestLog == nil {
+		return
+	}
+	allow := err == nil && decision != nil && decision.allow
+	if proxyType != "http" && proxyType != "mitm" && (proxyType != "connect" || allow) {
+		return
+	}
+
+	e := &requestLogEntry{
+		start:         start,
+		duration:      time.Since(start),
+		client:        ctx.Req.RemoteAddr,
+		method:        ctx.Req.Method,
+		uri:           ctx.Req.URL.String(),
+		proto:         ctx.Req.Proto,
+		bytesSent:     -1,
+		bytesReceived: ctx.Req.ContentLength,
+		allow:         allow,
+	}
+	if proxyType == "connect" {
+		e.uri = ctx.Req.Host
+	}
+	if decision != nil {
+		e.role, e.ruleID = decision.role, decision.ruleID
+	}
+	if toAddress != nil {
+		e.destIP = toAddress.IP.String()
+	}
+
+	switch {
+	case ctx.Resp != nil:
+		e.status = ctx.Resp.StatusCode
+		e.bytesSent = ctx.Resp.ContentLength
+	case proxyType == "connect":
+		if err == nil && decision != nil {
+			err = decision.denyErr()
+		}
+		e.status = http.StatusProxyAuthRequired
+		if status := retryHintFor(config, err).status; status != 0 {
+			e.status = status
+		}
+	default:
+		e.status = http.StatusBadGateway
+	}
+
+	config.RequestLog.write(e)
+}
+
+// logTunnelOnClose has the CONNECT tunnel ic carries written to the request
+// log once it's closed.
+func logTunnelOnClose(config *Config, ic *conntrack.InstrumentedConn, decision *aclDecision, start time.Time) {
+	if config.RequestLog == nil || decision == nil {
+		return
+	}
+	e := requestLogEntry{
+		start:  start,
+		client: decision.clientAddr,
+		role:   decision.role,
+		method: http.MethodConnect,
+		uri:    decision.outboundHost,
+		proto:  "HTTP/1.1",
+		status: http.StatusOK,
+		allow:  true,
+		ruleID: decision.ruleID,
+	}
+	if decision.resolvedAddr != nil {
+		e.destIP = decision.resolvedAddr.IP.String()
+	}
+	ic.OnClose(func(end time.Time) {
+		e.duration = end.Sub(start)
+		e.bytesSent = int64(atomic.LoadUint64(ic.BytesIn))
+		e.bytesReceived = int64(atomic.LoadUint64(ic.BytesOut))
+		config.RequestLog.write(&e)
+	})
+}
@@ -0,0 +1,140 @@
+package smokescreen
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestRequestLogFormats(t *testing.T) {
+	a := assert.New(t)
+
+	e := &requestLogEntry{
+		start:         time.Date(2024, 3, 5, 17, 4, 5, 0, time.FixedZone("", -7*60*60)),
+		duration:      1500 * time.Millisecond,
+		client:        "10.0.0.1:51234",
+		role:          "billing api",
+		method:        "GET",
+		uri:           "http://example.com/a?b=c",
+		proto:         "HTTP/1.1",
+		status:        200,
+		bytesSent:     2326,
+		bytesReceived: -1,
+		destIP:        "93.184.216.34",
+		allow:         true,
+		ruleID:        "billing",
+	}
+	a.Equal(`10.0.0.1 - billing_api [05/Mar/2024:17:04:05 -0700] "GET http://example.com/a?b=c HTTP/1.1" 200 2326`+"\n", e.common())
+	a.Equal("2024-03-06 00:04:05 1.500 10.0.0.1 billing+api GET http://example.com/a?b=c HTTP/1.1 200 2326 - 93.184.216.34 allow billing\n", e.w3c())
+
+	e.role, e.bytesSent, e.allow, e.ruleID = "", 0, false, ""
+	a.Equal(`10.0.0.1 - - [05/Mar/2024:17:04:05 -0700] "GET http://example.com/a?b=c HTTP/1.1" 200 -`+"\n", e.common())
+	a.True(strings.HasSuffix(e.w3c(), " 200 0 - 93.184.216.34 deny -\n"))
+
+	a.Error(NewConfig().SetupRequestLog("/dev/null", "combined", 0, 0, false))
+}
+
+func TestRequestLog(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-request-log")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "request.log")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer tlsServer.Close()
+
+	conf := NewConfig()
+	r.NoError(conf.SetupRequestLog(path, RequestLogW3C, 0, 0, false))
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	conf.AllowedConnectPorts = nil
+
+	proxySrv := httptest.NewServer(BuildProxy(conf))
+	defer proxySrv.Close()
+	proxyURL, err := url.Parse(proxySrv.URL)
+	r.NoError(err)
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: tlsServer.Client().Transport.(*http.Transport).TLSClientConfig}
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(ts.URL + "/plain")
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Get(tlsServer.URL + "/tunneled")
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	_, err = client.Get("https://127.0.0.2:443/")
+	r.Error(err)
+
+	// The tunnel is written once it's closed.
+	transport.CloseIdleConnections()
+	var lines []string
+	for i := 0; i < 50; i++ {
+		b, err := ioutil.ReadFile(path)
+		r.NoError(err)
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		if len(lines) == 7 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Len(lines, 7)
+	a.Equal("#Version: 1.0", lines[0])
+	a.Equal("#Fields: "+w3cFields, lines[3])
+
+	byMethod := make(map[string][]string)
+	for _, line := range lines[4:] {
+		fields := strings.Split(line, " ")
+		r.Len(fields, 14, line)
+		byMethod[fields[5]] = append(byMethod[fields[5]], line)
+	}
+	r.Len(byMethod["GET"], 1)
+	get := strings.Split(byMethod["GET"][0], " ")
+	a.Equal(ts.URL+"/plain", get[6])
+	a.Equal("200", get[8])
+	a.Equal("2", get[9])
+	a.Equal("127.0.0.1", get[11])
+	a.Equal("allow", get[12])
+
+	r.Len(byMethod["CONNECT"], 2)
+	var allowed, denied []string
+	for _, line := range byMethod["CONNECT"] {
+		fields := strings.Split(line, " ")
+		if fields[12] == "allow" {
+			allowed = fields
+		} else {
+			denied = fields
+		}
+	}
+	r.NotNil(allowed)
+	r.NotNil(denied)
+	a.Equal(strings.TrimPrefix(tlsServer.URL, "https://"), allowed[6])
+	a.Equal("200", allowed[8])
+	a.NotEqual("0", allowed[9])
+	a.NotEqual("0", allowed[10])
+	a.Equal("127.0.0.2:443", denied[6])
+	a.Equal("407", denied[8])
+}
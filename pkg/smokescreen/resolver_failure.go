@@ -0,0 +1,76 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ResolverFailureMode sets how requests are answered when their destination
+// can't be resolved because the resolver is unavailable, as opposed to the
+// name not existing.
+type ResolverFailureMode int
+
+const (
+	ResolverFailureUnavailable ResolverFailureMode = iota // The request is rejected as failing temporarily, with a retryable 503 or 504
+	ResolverFailureDeny                                   // The request is denied, like one the ACL or range rules deny
+)
+
+var resolverFailureModes = map[string]ResolverFailureMode{
+	"unavailable": ResolverFailureUnavailable,
+	"deny":        ResolverFailureDeny,
+}
+
+func (m ResolverFailureMode) String() string {
+	return [...]string{"unavailable", "deny"}[m]
+}
+
+// ResolverFailureModeFromString parses a resolver failure mode. An empty
+// string is ResolverFailureUnavailable.
+func ResolverFailureModeFromString(s string) (ResolverFailureMode, error) {
+	if s == "" {
+		return ResolverFailureUnavailable, nil
+	}
+	if m, ok := resolverFailureModes[s]; ok {
+		return m, nil
+	}
+	return ResolverFailureUnavailable, fmt.Errorf("unknown resolver failure mode %v", s)
+}
+
+// resolverOutageError is returned for lookups that failed because the
+// resolver is unavailable: it timed out, couldn't be reached or answered with
+// an error.
+type resolverOutageError struct {
+	error
+}
+
+func (e resolverOutageError) Unwrap() error {
+	return e.error
+}
+
+// isResolverOutage reports whether err, returned by a lookup, means the
+// resolver is unavailable. Names that don't exist aren't an outage.
+func isResolverOutage(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && !dnsErr.IsNotFound
+}
+
+// resolverOutage records that resolving addr failed because the resolver is
+// unavailable, and returns the error to answer the request with, according
+// to the configured ResolverFailureMode.
+func resolverOutage(config *Config, addr string, err error) error {
+	mode := config.ResolverFailureMode
+	config.MetricsClient.Incr("resolver.outage", []string{"mode:" + mode.String()}, 1)
+	config.Log.WithFields(logrus.Fields{
+		"address": addr,
+		"error":   err,
+		"mode":    mode.String(),
+	}).Warn("resolver unavailable")
+
+	if mode == ResolverFailureDeny {
+		return denyError{error: fmt.Errorf("The destination could not be resolved and the proxy fails closed: %v", err)}
+	}
+	return resolverOutageError{err}
+}
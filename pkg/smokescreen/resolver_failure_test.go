@@ -0,0 +1,75 @@
+package smokescreen
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestResolverFailureMode(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+
+	// A name that doesn't exist isn't an outage.
+	_, _, err := safeResolve(conf, "tcp", "missing.test:443", acl.AnyFamily, "")
+	r.Error(err)
+	a.False(isResolverOutage(err))
+	_, ok := err.(resolverOutageError)
+	a.False(ok)
+
+	conf.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return nil, errors.New("resolver down")
+		},
+	}
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+
+	_, _, err = safeResolve(conf, "tcp", "example.com:443", acl.AnyFamily, "")
+	r.Error(err)
+	r.IsType(resolverOutageError{}, err)
+	resp := rejectResponse(req, conf, err)
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	a.Equal("true", resp.Header.Get(retryableHeader))
+
+	_, err = checkIfRequestShouldBeProxied(conf, req, "example.com:443")
+	a.IsType(resolverOutageError{}, err)
+
+	// Failing closed, the request is denied.
+	conf.ResolverFailureMode = ResolverFailureDeny
+	decision, err := checkIfRequestShouldBeProxied(conf, req, "example.com:443")
+	r.NoError(err)
+	a.False(decision.allow)
+	a.Contains(decision.reason, "The destination could not be resolved and the proxy fails closed")
+	resp = rejectResponse(req, conf, decision.denyErr())
+	a.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+	a.Equal("false", resp.Header.Get(retryableHeader))
+}
+
+func TestResolverFailureModeFromString(t *testing.T) {
+	a := assert.New(t)
+
+	mode, err := ResolverFailureModeFromString("")
+	a.NoError(err)
+	a.Equal(ResolverFailureUnavailable, mode)
+
+	mode, err = ResolverFailureModeFromString("deny")
+	a.NoError(err)
+	a.Equal(ResolverFailureDeny, mode)
+
+	_, err = ResolverFailureModeFromString("open")
+	a.Error(err)
+}
@@ -0,0 +1,200 @@
+package smokescreen
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of the latest query in the moving averages of a DNS server's
+	// latency and errors.
+	resolverPoolWeight = 0.2
+
+	// DNS servers failing more than this share of their queries are only
+	// used if all servers are.
+	resolverPoolUnhealthyErrors = 0.5
+
+	// DNS servers that haven't been sent a query in this long are sent the
+	// next one, so that the pool notices them recovering or speeding up.
+	resolverPoolProbeInterval = 30 * time.Second
+
+	// Failed queries count as having taken at least this long in a server's
+	// average latency, so that a server isn't preferred for failing fast.
+	resolverPoolFailureLatency = time.Second
+)
+
+// resolverPool sends each DNS query to the fastest of several DNS servers
+// among those answering, rather than to the first configured, so that a
+// degraded server stops slowing down or failing lookups. Servers are ranked
+// by moving averages of their latency and errors, and each is sent a query
+// every resolverPoolProbeInterval even when it isn't the fastest.
+type resolverPool struct {
+	sync.Mutex
+	config  *Config
+	servers []*resolverPoolServer
+	now     func() time.Time
+}
+
+type resolverPoolServer struct {
+	addr     string
+	tags     []string
+	latency  time.Duration // Moving average of the time taken to answer
+	errors   float64       // Moving average of the share of queries that failed
+	lastUsed time.Time
+}
+
+func newResolverPool(config *Config, addrs []string) *resolverPool {
+	p := &resolverPool{config: config, now: time.Now}
+	for _, addr := range addrs {
+		p.servers = append(p.servers, &resolverPoolServer{
+			addr: addr,
+			tags: []string{"resolver:" + addr},
+		})
+	}
+	return p
+}
+
+// resolver returns a resolver sending its queries to the pool's servers.
+func (p *resolverPool) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			s := p.pick()
+			d := net.Dialer{}
+			conn, err := d.DialContext(ctx, network, s.addr)
+			if err != nil {
+				p.record(s, 0, err)
+				return nil, err
+			}
+			// The resolver frames its queries depending on whether the
+			// connection is a net.PacketConn, so the wrapper must be one too.
+			rc := &resolverPoolConn{Conn: conn, pool: p, server: s}
+			if pc, ok := conn.(net.PacketConn); ok {
+				return &resolverPoolPacketConn{resolverPoolConn: rc, pc: pc}, nil
+			}
+			return rc, nil
+		},
+	}
+}
+
+// pick returns the server to send the next query to: one due to be probed,
+// or else the fastest healthy one, or failing that the one with the fewest
+// errors.
+func (p *resolverPool) pick() *resolverPoolServer {
+	p.Lock()
+	defer p.Unlock()
+
+	now := p.now()
+	var best *resolverPoolServer
+	for _, s := range p.servers {
+		if now.Sub(s.lastUsed) >= resolverPoolProbeInterval {
+			best = s
+			break
+		}
+		if best == nil || s.better(best) {
+			best = s
+		}
+	}
+	best.lastUsed = now
+	return best
+}
+
+func (s *resolverPoolServer) better(o *resolverPoolServer) bool {
+	healthy, oHealthy := s.errors <= resolverPoolUnhealthyErrors, o.errors <= resolverPoolUnhealthyErrors
+	if healthy != oHealthy {
+		return healthy
+	}
+	if !healthy {
+		return s.errors < o.errors
+	}
+	return s.latency < o.latency
+}
+
+// record updates the averages of s with a query that took latency, and
+// failed with err if it isn't nil.
+func (p *resolverPool) record(s *resolverPoolServer, latency time.Duration, err error) {
+	p.Lock()
+	failed := 0.0
+	sample := latency
+	if err != nil {
+		failed = 1
+		if sample < resolverPoolFailureLatency {
+			sample = resolverPoolFailureLatency
+		}
+	}
+	s.errors += resolverPoolWeight * (failed - s.errors)
+	if s.latency == 0 {
+		s.latency = sample
+	} else {
+		s.latency += time.Duration(resolverPoolWeight * float64(sample-s.latency))
+	}
+	errors, average := s.errors, s.latency
+	p.Unlock()
+
+	if err != nil {
+		p.config.MetricsClient.Incr("resolver.pool.error", s.tags, 1)
+	} else {
+		p.config.MetricsClient.Timing("resolver.pool.latency", latency, s.tags, 1)
+	}
+	p.config.MetricsClient.Gauge("resolver.pool.error_rate", errors, s.tags, 1)
+	p.config.MetricsClient.Gauge("resolver.pool.latency_average_ms", float64(average)/float64(time.Millisecond), s.tags, 1)
+}
+
+// resolverPoolConn times the exchange of a query with a server of the pool,
+// from the query being written to the first read of the answer.
+type resolverPoolConn struct {
+	net.Conn
+	pool   *resolverPool
+	server *resolverPoolServer
+
+	sent     time.Time
+	recorded bool
+}
+
+func (c *resolverPoolConn) Write(b []byte) (int, error) {
+	if c.sent.IsZero() {
+		c.sent = c.pool.now()
+	}
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.done(err)
+	}
+	return n, err
+}
+
+func (c *resolverPoolConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.done(err)
+	return n, err
+}
+
+func (c *resolverPoolConn) Close() error {
+	// A query closed before being answered has timed out or been canceled.
+	if !c.sent.IsZero() {
+		c.done(context.DeadlineExceeded)
+	}
+	return c.Conn.Close()
+}
+
+func (c *resolverPoolConn) done(err error) {
+	if c.recorded {
+		return
+	}
+	c.recorded = true
+	c.pool.record(c.server, c.pool.now().Sub(c.sent), err)
+}
+
+type resolverPoolPacketConn struct {
+	*resolverPoolConn
+	pc net.PacketConn
+}
+
+func (c *resolverPoolPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.pc.ReadFrom(b)
+}
+
+func (c *resolverPoolPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
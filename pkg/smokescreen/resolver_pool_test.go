@@ -0,0 +1,89 @@
+package smokescreen
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolverPoolPick(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	p := newResolverPool(NewConfig(), []string{"10.0.0.1:53", "10.0.0.2:53"})
+	p.now = func() time.Time { return now }
+	slow, fast := p.servers[0], p.servers[1]
+	picks := func(n int) []string {
+		var addrs []string
+		for i := 0; i < n; i++ {
+			addrs = append(addrs, p.pick().addr)
+		}
+		return addrs
+	}
+
+	// Servers that haven't been asked anything yet are tried first.
+	a.Equal([]string{"10.0.0.1:53", "10.0.0.2:53"}, picks(2))
+
+	p.record(slow, 50*time.Millisecond, nil)
+	p.record(fast, 5*time.Millisecond, nil)
+	a.Equal([]string{"10.0.0.2:53", "10.0.0.2:53"}, picks(2))
+
+	// Latencies are averaged.
+	p.record(slow, 150*time.Millisecond, nil)
+	a.Equal(70*time.Millisecond, slow.latency)
+
+	// A failing server is avoided, however fast.
+	for i := 0; i < 5; i++ {
+		p.record(fast, 0, errors.New("timeout"))
+	}
+	a.True(fast.errors > resolverPoolUnhealthyErrors)
+	a.Equal([]string{"10.0.0.1:53", "10.0.0.1:53"}, picks(2))
+
+	// Servers are probed again once they have been left alone for a while.
+	now = now.Add(20 * time.Second)
+	a.Equal([]string{"10.0.0.1:53"}, picks(1))
+	now = now.Add(15 * time.Second)
+	a.Equal([]string{"10.0.0.2:53", "10.0.0.1:53"}, picks(2))
+
+	// If all servers fail, the one failing least is used.
+	for i := 0; i < 10; i++ {
+		p.record(slow, 0, errors.New("timeout"))
+	}
+	a.Equal([]string{"10.0.0.2:53"}, picks(1))
+}
+
+func TestResolverPoolAvoidsFailingServer(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	down := newTestDNSServer(t)
+	downAddr := down.conn.LocalAddr().String()
+	down.Close()
+
+	up := newTestDNSServer(t)
+	defer up.Close()
+	up.Set("example.test", "192.0.2.1")
+
+	conf := NewConfig()
+	r.NoError(conf.SetResolverAddresses([]string{downAddr, up.conn.LocalAddr().String()}))
+	r.NotNil(conf.resolverPool)
+
+	for i := 0; i < 5; i++ {
+		ips, err := conf.Resolver.LookupIP(context.Background(), "ip4", "example.test")
+		r.NoError(err)
+		a.Equal([]net.IP{net.ParseIP("192.0.2.1").To4()}, ips)
+	}
+
+	conf.resolverPool.Lock()
+	defer conf.resolverPool.Unlock()
+	a.Equal(1.0*resolverPoolWeight, conf.resolverPool.servers[0].errors)
+	a.Zero(conf.resolverPool.servers[1].errors)
+	a.True(conf.resolverPool.servers[1].latency > 0)
+
+	a.Error(conf.SetResolverAddresses([]string{"10.0.0.1:53", "10.0.0.2"}))
+}
@@ -0,0 +1,40 @@
+package smokescreen
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/elazarl/goproxy"
+)
+
+const instanceHeader = "X-Smokescreen-Instance"
+
+// SetupResponseIdentity makes the responses to plain HTTP requests carry the
+// X-Smokescreen-Instance header, set to instanceID or, if it is empty, the
+// hostname, and the X-Smokescreen-Trace-ID of the request, if it had one.
+// Debugging tools can then tell whether a response went through Smokescreen,
+// and which instance handled it.
+func (config *Config) SetupResponseIdentity(instanceID string) error {
+	if instanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		instanceID = hostname
+	}
+	config.ResponseInstanceID = instanceID
+	return nil
+}
+
+// identifyResponse adds the headers set up by SetupResponseIdentity to resp,
+// overwriting any the destination sent.
+func identifyResponse(config *Config, resp *http.Response, ctx *goproxy.ProxyCtx) {
+	if config.ResponseInstanceID == "" {
+		return
+	}
+	resp.Header.Set(instanceHeader, config.ResponseInstanceID)
+	resp.Header.Del(traceHeader)
+	if ud, ok := ctx.UserData.(*ctxUserData); ok && ud.traceId != "" {
+		resp.Header.Set(traceHeader, ud.traceId)
+	}
+}
@@ -0,0 +1,68 @@
+package smokescreen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestResponseIdentity(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(instanceHeader, "forged")
+		w.Header().Set(traceHeader, "forged")
+	}))
+	defer upstream.Close()
+
+	conf := NewConfig()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(conf.SetupResponseIdentity("smokescreen-1"))
+	proxy := httptest.NewServer(buildHandler(conf))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(target, traceID string) *http.Response {
+		req, err := http.NewRequest("GET", target, nil)
+		r.NoError(err)
+		if traceID != "" {
+			req.Header.Set(traceHeader, traceID)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get(upstream.URL, "abc123")
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal("smokescreen-1", resp.Header.Get(instanceHeader))
+	a.Equal("abc123", resp.Header.Get(traceHeader))
+
+	resp = get(upstream.URL, "")
+	a.Equal("smokescreen-1", resp.Header.Get(instanceHeader))
+	a.Empty(resp.Header.Get(traceHeader))
+
+	// Rejections are marked too.
+	resp = get("http://169.254.169.254/", "def456")
+	a.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+	a.Equal("smokescreen-1", resp.Header.Get(instanceHeader))
+	a.Equal("def456", resp.Header.Get(traceHeader))
+
+	hostname, err := os.Hostname()
+	r.NoError(err)
+	r.NoError(conf.SetupResponseIdentity(""))
+	a.Equal(hostname, conf.ResponseInstanceID)
+}
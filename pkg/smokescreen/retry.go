@@ -0,0 +1,72 @@
+package smokescreen
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	retryableHeader = "X-Smokescreen-Retryable"
+
+	transientMsgTmpl = "Egress proxying to host '%s' failed temporarily: %s."
+)
+
+// retryHint tells clients whether, and when, a rejected request is worth
+// retrying. Denials are final, whereas being throttled, a dial or lookup
+// timing out and a temporary DNS failure are expected to clear up.
+type retryHint struct {
+	retryable  bool
+	status     int
+	retryAfter time.Duration
+}
+
+func retryHintFor(config *Config, err error) retryHint {
+	if rle, ok := err.(rateLimitError); ok {
+		return retryHint{retryable: true, status: http.StatusTooManyRequests, retryAfter: rle.retryAfter}
+	}
+	if _, ok := err.(denyError); ok {
+		return retryHint{}
+	}
+	if _, ok := err.(connLimitError); ok {
+		return retryHint{retryable: true, status: http.StatusServiceUnavailable, retryAfter: config.TransientRetryAfter}
+	}
+	if coe, ok := err.(circuitOpenError); ok {
+		retryAfter := coe.retryAfter
+		if retryAfter <= 0 {
+			retryAfter = config.TransientRetryAfter
+		}
+		return retryHint{retryable: true, status: http.StatusBadGateway, retryAfter: retryAfter}
+	}
+
+	if _, ok := err.(resolverOutageError); ok {
+		status := http.StatusServiceUnavailable
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			status = http.StatusGatewayTimeout
+		}
+		return retryHint{retryable: true, status: status, retryAfter: config.TransientRetryAfter}
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsTemporary && !dnsErr.IsTimeout {
+		return retryHint{retryable: true, status: http.StatusServiceUnavailable, retryAfter: config.TransientRetryAfter}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return retryHint{retryable: true, status: http.StatusGatewayTimeout, retryAfter: config.TransientRetryAfter}
+	}
+	return retryHint{}
+}
+
+// setHeaders marks resp as retryable or not, with a Retry-After header for
+// the former.
+func (h retryHint) setHeaders(resp *http.Response) {
+	resp.Header.Set(retryableHeader, strconv.FormatBool(h.retryable))
+	if h.retryable && h.retryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(h.retryAfter.Seconds()))))
+	}
+}
@@ -0,0 +1,71 @@
+package smokescreen
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRejectResponseRetryHints(t *testing.T) {
+	conf := NewConfig()
+	conf.TransientRetryAfter = 2 * time.Second
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	cases := []struct {
+		name       string
+		err        error
+		status     int
+		retryable  string
+		retryAfter string
+	}{
+		{"deny", denyError{error: errors.New("nope")}, http.StatusProxyAuthRequired, "false", ""},
+		{"rate limit", rateLimitError{error: errors.New("slow down"), retryAfter: 1500 * time.Millisecond}, http.StatusTooManyRequests, "true", "2"},
+		{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, http.StatusGatewayTimeout, "true", "2"},
+		{"dns timeout", &net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true, IsTemporary: true}, http.StatusGatewayTimeout, "true", "2"},
+		{"dns temporary", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, http.StatusServiceUnavailable, "true", "2"},
+		{"dns not found", &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, http.StatusProxyAuthRequired, "false", ""},
+		{"unexpected", errors.New("boom"), http.StatusProxyAuthRequired, "false", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := assert.New(t)
+			resp := rejectResponse(req, conf, c.err)
+			a.Equal(c.status, resp.StatusCode)
+			a.Equal(c.retryable, resp.Header.Get(retryableHeader))
+			a.Equal(c.retryAfter, resp.Header.Get("Retry-After"))
+		})
+	}
+}
+
+func TestRejectResponseConnLimits(t *testing.T) {
+	a := assert.New(t)
+	conf := NewConfig()
+	req := httptest.NewRequest("CONNECT", "http://example.com:443", nil)
+
+	// Clients can tell which limit turned them away.
+	seen := map[string]bool{}
+	for _, limit := range []string{limitHost, limitGlobal, limitEphemeralPort, limitConcurrency} {
+		resp := rejectResponse(req, conf, connLimitError{error: errors.New("too many connections"), limit: limit})
+		a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+		a.Equal("true", resp.Header.Get(retryableHeader))
+		a.Equal(limit, resp.Header.Get(limitHeader))
+		a.False(seen[resp.Header.Get(limitHeader)])
+		seen[resp.Header.Get(limitHeader)] = true
+	}
+
+	// Other errors don't name a limit.
+	resp := rejectResponse(req, conf, denyError{error: errors.New("nope")})
+	a.Empty(resp.Header.Get(limitHeader))
+}
@@ -0,0 +1,117 @@
+package smokescreen
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRoleAliasReloadInterval is how often a role alias file is checked
+// for changes unless configured otherwise.
+const DefaultRoleAliasReloadInterval = 30 * time.Second
+
+// RoleAliases translates the identities clients present, such as
+// certificate common names or role header values, to the roles ACL rules
+// are written for, so that renaming a certificate or a service means adding
+// an alias rather than editing every rule. The aliases are read from a YAML
+// file mapping each role to the identities it stands for:
+//
+//	billing: [billing.prod.example.com, payments-legacy]
+//
+// Identities that aren't listed are used as they are. The file is checked
+// for changes every interval once the proxy is started, and a changed file
+// is swapped in atomically; if it can't be loaded, the current aliases are
+// kept.
+type RoleAliases struct {
+	config   *Config
+	path     string
+	interval time.Duration
+	current  atomic.Value // Stores the map[string]string from identities to roles
+	watcher  *fileWatcher // Reloads the file when it changes
+}
+
+// SetupRoleAliases translates roles with the alias file at path, which is
+// reloaded when it changes, checking every interval. An interval of zero
+// disables reloading.
+func (config *Config) SetupRoleAliases(path string, interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("role alias reload interval must not be negative, not %v", interval)
+	}
+	ra := &RoleAliases{config: config, path: path, interval: interval}
+	ra.watcher = newFileWatcher(config, []string{path}, "role_aliases", "role aliases", ra.Reload)
+	if err := ra.Reload(); err != nil {
+		return err
+	}
+	config.RoleAliases = ra
+	return nil
+}
+
+// Reload reads the alias file again and swaps it in.
+func (ra *RoleAliases) Reload() error {
+	b, err := ioutil.ReadFile(ra.path)
+	if err != nil {
+		return err
+	}
+	aliases, err := parseRoleAliases(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", ra.path, err)
+	}
+	ra.current.Store(aliases)
+	return nil
+}
+
+// parseRoleAliases parses an alias file into a map from identities to
+// roles. An identity may only stand for one role, and can't be a role
+// itself, so resolving a role that has already been resolved changes
+// nothing.
+func parseRoleAliases(b []byte) (map[string]string, error) {
+	var byRole map[string][]string
+	if err := yaml.UnmarshalStrict(b, &byRole); err != nil {
+		return nil, err
+	}
+
+	// Walk the roles in order, so errors don't depend on map order.
+	roles := make([]string, 0, len(byRole))
+	for role := range byRole {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	aliases := make(map[string]string)
+	for _, role := range roles {
+		if role == "" {
+			return nil, fmt.Errorf("aliases for an empty role")
+		}
+		for _, identity := range byRole[role] {
+			if identity == "" {
+				return nil, fmt.Errorf("role %s: empty alias", role)
+			}
+			if other, ok := aliases[identity]; ok && other != role {
+				return nil, fmt.Errorf("%s is an alias of both %s and %s", identity, other, role)
+			}
+			if _, ok := byRole[identity]; ok {
+				return nil, fmt.Errorf("role %s: alias %s is also a role", role, identity)
+			}
+			aliases[identity] = role
+		}
+	}
+	return aliases, nil
+}
+
+// Resolve returns the role identity stands for, and whether it is an alias.
+func (ra *RoleAliases) Resolve(identity string) (string, bool) {
+	aliases, _ := ra.current.Load().(map[string]string)
+	if role, ok := aliases[identity]; ok {
+		return role, true
+	}
+	return identity, false
+}
+
+// watch reloads the alias file every interval when it has changed, until
+// the proxy shuts down.
+func (ra *RoleAliases) watch() {
+	ra.watcher.watch(ra.interval)
+}
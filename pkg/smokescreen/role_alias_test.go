@@ -0,0 +1,127 @@
+package smokescreen
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestParseRoleAliases(t *testing.T) {
+	a := assert.New(t)
+
+	aliases, err := parseRoleAliases([]byte("billing: [billing.prod.example.com, payments-legacy]\nsearch: [search-v1]"))
+	a.NoError(err)
+	a.Equal(map[string]string{
+		"billing.prod.example.com": "billing",
+		"payments-legacy":          "billing",
+		"search-v1":                "search",
+	}, aliases)
+
+	for _, bad := range []string{
+		"billing: [old]\nsearch: [old]",
+		"billing: [search]\nsearch: [search-v1]",
+		"billing: ['']",
+		"billing: old",
+	} {
+		_, err := parseRoleAliases([]byte(bad))
+		a.Error(err, bad)
+	}
+}
+
+func TestRoleAliases(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-aliases")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aliases.yaml")
+	r.NoError(ioutil.WriteFile(path, []byte("billing: [payments-legacy]\n"), 0644))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+
+	var logHook logrustest.Hook
+	conf := NewConfig()
+	conf.Log.AddHook(&logHook)
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	a.Error(conf.SetupRoleAliases(filepath.Join(dir, "missing.yaml"), 0))
+	r.NoError(conf.SetupRoleAliases(path, 10*time.Millisecond))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"billing": {Policy: acl.Open},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	do := func(identity string) (int, map[string]interface{}) {
+		logHook.Reset()
+		req, err := http.NewRequest("GET", upstream.URL, nil)
+		r.NoError(err)
+		req.Header.Set("X-Smokescreen-Role", identity)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		resp.Body.Close()
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		return resp.StatusCode, entry.Data
+	}
+
+	status, fields := do("payments-legacy")
+	a.Equal(http.StatusOK, status)
+	a.Equal("billing", fields["role"])
+	a.Equal("payments-legacy", fields["role_identity"])
+
+	status, fields = do("billing")
+	a.Equal(http.StatusOK, status)
+	a.NotContains(fields, "role_identity")
+
+	status, _ = do("billing-v2")
+	a.Equal(http.StatusProxyAuthRequired, status)
+
+	// Changes to the file are picked up.
+	go conf.RoleAliases.watch()
+	r.NoError(ioutil.WriteFile(path, []byte("billing: [payments-legacy, billing-v2]\n"), 0644))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := conf.RoleAliases.Resolve("billing-v2"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, fields = do("billing-v2")
+	a.Equal(http.StatusOK, status)
+	a.Equal("billing", fields["role"])
+
+	// Files that don't load are ignored.
+	r.NoError(conf.RoleAliases.Reload())
+	r.NoError(ioutil.WriteFile(path, []byte("billing: [billing]\n"), 0644))
+	a.Error(conf.RoleAliases.Reload())
+	role, ok := conf.RoleAliases.Resolve("billing-v2")
+	a.True(ok)
+	a.Equal("billing", role)
+	conf.ShuttingDown.Store(true)
+}
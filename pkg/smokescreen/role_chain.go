@@ -0,0 +1,72 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RoleSource is one of the ways a RoleChain tries to determine a client's
+// role.
+type RoleSource struct {
+	Name            string // Logged as the role_source of requests whose role this source determined
+	RoleFromRequest func(req *http.Request) (string, error)
+}
+
+// RoleChain determines a client's role by trying each of its sources in
+// turn, such as the client certificate, then a JWT, then a static default,
+// so fleets migrating from one kind of identity to another can be served
+// while some clients have only the old one. The first source to find a role
+// wins. Sources finding none, by returning a MissingRoleError, pass on to
+// the next; any other error, such as an invalid token, ends the chain, so
+// clients presenting bad credentials are rejected rather than falling back
+// to a weaker identity. If no source finds a role, the request is handled
+// like any other without one.
+type RoleChain struct {
+	Sources []RoleSource
+}
+
+// RoleFromRequest can be used as Config.RoleFromRequest, though setting
+// Config.RoleChain also logs the source of each role.
+func (rc *RoleChain) RoleFromRequest(req *http.Request) (string, error) {
+	role, _, err := rc.resolve(req)
+	return role, err
+}
+
+// resolve returns the role of req and the name of the source that found it.
+func (rc *RoleChain) resolve(req *http.Request) (string, string, error) {
+	var missing []string
+	for _, s := range rc.Sources {
+		role, err := s.RoleFromRequest(req)
+		if err == nil {
+			return role, s.Name, nil
+		}
+		if !IsMissingRoleError(err) {
+			return "", s.Name, err
+		}
+		missing = append(missing, fmt.Sprintf("%s: %v", s.Name, err))
+	}
+	return "", "", MissingRoleError("no role found: " + strings.Join(missing, "; "))
+}
+
+// RoleFromClientCert can be used as Config.RoleFromRequest, or in a
+// RoleChain, to take the role from the common name of the client's verified
+// certificate. Requests without one produce a MissingRoleError.
+func RoleFromClientCert(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.PeerCertificates) == 0 {
+		return "", MissingRoleError("no verified client certificate")
+	}
+	cn := req.TLS.PeerCertificates[0].Subject.CommonName
+	if cn == "" {
+		return "", MissingRoleError("client certificate has no common name")
+	}
+	return cn, nil
+}
+
+// StaticRole returns a RoleFromRequest giving every request role, as the
+// last source of a RoleChain, say, for clients without an identity yet.
+func StaticRole(role string) func(req *http.Request) (string, error) {
+	return func(req *http.Request) (string, error) {
+		return role, nil
+	}
+}
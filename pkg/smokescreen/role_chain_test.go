@@ -0,0 +1,138 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRoleChain(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	header, err := NewHeaderRoleResolver(HeaderRoleConfig{})
+	r.NoError(err)
+	chain := &RoleChain{Sources: []RoleSource{
+		{Name: "client_cert", RoleFromRequest: RoleFromClientCert},
+		{Name: "header", RoleFromRequest: header.RoleFromRequest},
+		{Name: "static", RoleFromRequest: StaticRole("legacy")},
+	}}
+
+	newReq := func(cn, role string) *http.Request {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		if cn != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+		if role != "" {
+			req.Header.Set("X-Smokescreen-Role", role)
+		}
+		return req
+	}
+
+	for _, tc := range []struct {
+		cn, header   string
+		role, source string
+	}{
+		{"cert-role", "header-role", "cert-role", "client_cert"},
+		{"", "header-role", "header-role", "header"},
+		{"", "", "legacy", "static"},
+	} {
+		role, source, err := chain.resolve(newReq(tc.cn, tc.header))
+		a.NoError(err)
+		a.Equal(tc.role, role)
+		a.Equal(tc.source, source)
+	}
+
+	// Unverified certificates are ignored.
+	req := newReq("cert-role", "")
+	req.TLS.VerifiedChains = nil
+	role, err := chain.RoleFromRequest(req)
+	a.NoError(err)
+	a.Equal("legacy", role)
+
+	// Errors other than missing roles end the chain.
+	chain.Sources[1].RoleFromRequest = func(*http.Request) (string, error) {
+		return "", errors.New("invalid token")
+	}
+	_, source, err := chain.resolve(newReq("", ""))
+	a.EqualError(err, "invalid token")
+	a.Equal("header", source)
+
+	chain.Sources = chain.Sources[:1]
+	_, err = chain.RoleFromRequest(newReq("", ""))
+	a.True(IsMissingRoleError(err))
+}
+
+func TestRoleChainCanonicalLog(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+
+	var logHook logrustest.Hook
+	conf := NewConfig()
+	r.NoError(yaml.UnmarshalStrict([]byte(`
+role_chain:
+  - client_cert: true
+  - header_role: {}
+  - static_role: legacy
+`), conf))
+	conf.Log.AddHook(&logHook)
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.Len(conf.RoleChain.Sources, 3)
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"modern": {Policy: acl.Open},
+			"legacy": {Policy: acl.Open},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for role, source := range map[string]string{"modern": "header", "": "static"} {
+		logHook.Reset()
+		req, err := http.NewRequest("GET", upstream.URL, nil)
+		r.NoError(err)
+		if role != "" {
+			req.Header.Set("X-Smokescreen-Role", role)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		resp.Body.Close()
+		a.Equal(http.StatusOK, resp.StatusCode)
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		a.Equal(source, entry.Data["role_source"])
+	}
+
+	var bad Config
+	a.Error(yaml.UnmarshalStrict([]byte("role_chain: [{client_cert: true, static_role: x}]"), &bad))
+	a.Error(yaml.UnmarshalStrict([]byte("role_chain: [{}]"), &bad))
+	a.Error(yaml.UnmarshalStrict([]byte("role_chain: [{static_role: x}]\nheader_role: {}"), &bad))
+}
@@ -0,0 +1,114 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRoleConfigReloadInterval is how often a role config file is checked
+// for changes unless configured otherwise.
+const DefaultRoleConfigReloadInterval = 30 * time.Second
+
+// RoleConfig determines roles as a role config file says to, so that the
+// way clients are identified can be changed, say to move a fleet from
+// client certificates to JWTs, without restarting every proxy. The file
+// holds the sections of the configuration file that determine roles,
+// jwt_role, header_role, spiffe_role, k8s_token_role or role_chain:
+//
+//	role_chain:
+//	  - client_cert: true
+//	  - jwt_role: {jwks_url: "https://issuer.example.com/jwks.json", role_claim: service}
+//
+// The file is checked for changes every interval once the proxy is started,
+// like the egress ACL, and a changed file is swapped in atomically, so each
+// request is resolved entirely by the old settings or the new ones; if it
+// can't be loaded, the current settings are kept.
+type RoleConfig struct {
+	config   *Config
+	path     string
+	interval time.Duration
+	current  atomic.Value // Stores the *roleSettings roles are determined by
+	watcher  *fileWatcher // Reloads the file when it changes
+}
+
+// roleSettings is what a role config file configures: a RoleChain, or a
+// single RoleFromRequest.
+type roleSettings struct {
+	roleFromRequest roleFromRequestFunc
+	chain           *RoleChain
+	headers         []string // Headers roles or credentials are read from, as for Config.RoleHeaders
+}
+
+// SetupRoleConfigFile determines roles as the role config file at path
+// says, reloading it when it changes, checking every interval. An interval
+// of zero disables reloading. It takes the place of RoleFromRequest and
+// RoleChain.
+func (config *Config) SetupRoleConfigFile(path string, interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("role config reload interval must not be negative, not %v", interval)
+	}
+	rc := &RoleConfig{config: config, path: path, interval: interval}
+	rc.watcher = newFileWatcher(config, []string{path}, "role_config", "role config", rc.Reload)
+	if err := rc.Reload(); err != nil {
+		return err
+	}
+	config.RoleConfig = rc
+	return nil
+}
+
+// Reload reads the role config file again and swaps it in.
+func (rc *RoleConfig) Reload() error {
+	b, err := ioutil.ReadFile(rc.path)
+	if err != nil {
+		return err
+	}
+	settings, err := parseRoleConfig(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", rc.path, err)
+	}
+	rc.current.Store(settings)
+	return nil
+}
+
+func parseRoleConfig(b []byte) (*roleSettings, error) {
+	var y yamlConfigRoles
+	if err := yaml.UnmarshalStrict(b, &y); err != nil {
+		return nil, err
+	}
+	if !y.isSet() {
+		return nil, errors.New("one of jwt_role, header_role, spiffe_role, k8s_token_role or role_chain must be set")
+	}
+	f, chain, err := y.roleResolver()
+	if err != nil {
+		return nil, err
+	}
+	return &roleSettings{roleFromRequest: f, chain: chain, headers: y.headers()}, nil
+}
+
+// resolve returns the role of req, and the name of the role chain source
+// that found it, if the file configures a chain.
+func (rc *RoleConfig) resolve(req *http.Request) (string, string, error) {
+	settings := rc.current.Load().(*roleSettings)
+	if settings.chain != nil {
+		return settings.chain.resolve(req)
+	}
+	role, err := settings.roleFromRequest(req)
+	return role, "", err
+}
+
+// headers returns the headers the current settings read roles or
+// credentials from.
+func (rc *RoleConfig) headers() []string {
+	return rc.current.Load().(*roleSettings).headers
+}
+
+// watch reloads the role config file every interval when it has changed,
+// until the proxy shuts down.
+func (rc *RoleConfig) watch() {
+	rc.watcher.watch(rc.interval)
+}
@@ -0,0 +1,103 @@
+package smokescreen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseRoleConfig(t *testing.T) {
+	a := assert.New(t)
+
+	settings, err := parseRoleConfig([]byte("header_role: {header: X-Old-Role}"))
+	a.NoError(err)
+	a.NotNil(settings.roleFromRequest)
+	a.Nil(settings.chain)
+	a.Equal([]string{"X-Old-Role"}, settings.headers)
+
+	settings, err = parseRoleConfig([]byte("role_chain: [{client_cert: true}, {static_role: default}]"))
+	a.NoError(err)
+	a.Nil(settings.roleFromRequest)
+	if a.NotNil(settings.chain) {
+		a.Len(settings.chain.Sources, 2)
+	}
+
+	for _, bad := range []string{
+		"",
+		"header_role: {header: X-Role}\nspiffe_role: {trust_domains: [example.org]}",
+		"header_role: {trusted_ranges: [bogus]}",
+		"ip: 127.0.0.1",
+	} {
+		_, err := parseRoleConfig([]byte(bad))
+		a.Error(err, bad)
+	}
+}
+
+func TestRoleConfigFile(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-roles")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roles.yaml")
+	r.NoError(ioutil.WriteFile(path, []byte("header_role: {header: X-Old-Role}\n"), 0644))
+
+	conf := NewConfig()
+	a.Error(conf.SetupRoleConfigFile(filepath.Join(dir, "missing.yaml"), 0))
+	r.NoError(conf.SetupRoleConfigFile(path, 10*time.Millisecond))
+	// The file takes the place of the other settings.
+	conf.RoleChain = &RoleChain{Sources: []RoleSource{{Name: "static", RoleFromRequest: StaticRole("ignored")}}}
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Old-Role", "billing")
+	req.Header.Set("X-New-Role", "billing-v2")
+
+	role, source, err := getRole(conf, req)
+	a.NoError(err)
+	a.Equal("billing", role)
+	a.Equal("", source)
+
+	// Reloading the file swaps in its new settings.
+	r.NoError(ioutil.WriteFile(path, []byte("role_chain: [{header_role: {header: X-New-Role}}, {static_role: default}]\n"), 0644))
+	r.NoError(conf.RoleConfig.Reload())
+	role, source, err = getRole(conf, req)
+	a.NoError(err)
+	a.Equal("billing-v2", role)
+	a.Equal("header", source)
+
+	// Files that don't load are ignored.
+	r.NoError(ioutil.WriteFile(path, []byte("role_chain: [{}]\n"), 0644))
+	a.Error(conf.RoleConfig.Reload())
+	role, _, err = getRole(conf, req)
+	a.NoError(err)
+	a.Equal("billing-v2", role)
+}
+
+func TestYAMLLoaderRoleConfigFile(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "smokescreen-roles")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roles.yaml")
+	r.NoError(ioutil.WriteFile(path, []byte("header_role: {}\n"), 0644))
+
+	var c Config
+	r.NoError(yaml.Unmarshal([]byte(fmt.Sprintf("role_config_file: %s\nrole_config_reload_interval: 5s", path)), &c))
+	if a.NotNil(c.RoleConfig) {
+		a.Equal(5*time.Second, c.RoleConfig.interval)
+	}
+
+	err = yaml.Unmarshal([]byte(fmt.Sprintf("role_config_file: %s\nheader_role: {}", path)), &c)
+	a.Error(err, "role_config_file and other role settings can't both be set")
+}
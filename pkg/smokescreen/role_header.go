@@ -0,0 +1,115 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reasons a HeaderRoleResolver in strict mode rejects a role header for.
+const (
+	RoleHeaderUntrustedTransport = "untrusted_transport" // The client neither presented a verified certificate nor connected from a trusted range
+	RoleHeaderDuplicated         = "duplicated"          // The header was sent more than once with the same role
+	RoleHeaderConflicting        = "conflicting"         // The header was sent more than once with different roles
+)
+
+// HeaderRoleConfig configures HeaderRoleResolver.
+type HeaderRoleConfig struct {
+	Header        string   // Header carrying the role. Defaults to "X-Smokescreen-Role"; any other should be listed in Config.RoleHeaders.
+	Strict        bool     // Only accept the header over a trusted transport, and only if it is sent exactly once
+	TrustedRanges []string // CIDR ranges strict mode accepts the header from. Clients presenting a verified certificate are trusted from anywhere.
+}
+
+// HeaderRoleResolver implements RoleFromRequest by taking the role from a
+// request header. Requests without the header produce a MissingRoleError, so
+// AllowMissingRole applies to them.
+//
+// Anyone who can reach the proxy can send any role in a header, so strict
+// mode closes two gaps: the header is only believed from clients that
+// authenticated with a certificate or connected from a trusted network, and
+// requests carrying it more than once are rejected rather than having one of
+// the roles picked for them.
+type HeaderRoleResolver struct {
+	config  HeaderRoleConfig
+	trusted []RuleRange
+}
+
+// RoleHeaderError is returned by a strict HeaderRoleResolver for requests
+// whose role header it won't believe. Reason is one of the RoleHeader
+// constants.
+type RoleHeaderError struct {
+	Reason string
+}
+
+func (e RoleHeaderError) Error() string {
+	return fmt.Sprintf("role header rejected: %s", e.Reason)
+}
+
+func NewHeaderRoleResolver(config HeaderRoleConfig) (*HeaderRoleResolver, error) {
+	if config.Header == "" {
+		config.Header = roleHeader
+	}
+	trusted, err := parseRanges(config.TrustedRanges)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted range: %v", err)
+	}
+
+	return &HeaderRoleResolver{config: config, trusted: trusted}, nil
+}
+
+// RoleFromRequest can be used as Config.RoleFromRequest.
+func (hr *HeaderRoleResolver) RoleFromRequest(req *http.Request) (string, error) {
+	values := req.Header.Values(hr.config.Header)
+	if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+		return "", MissingRoleError(fmt.Sprintf("no role in %s header", hr.config.Header))
+	}
+	if !hr.config.Strict {
+		return values[0], nil
+	}
+
+	if !hr.trustedTransport(req) {
+		return "", RoleHeaderError{Reason: RoleHeaderUntrustedTransport}
+	}
+
+	// Proxies in between may have folded repeated headers into one
+	// comma-separated value.
+	var roles []string
+	for _, v := range values {
+		for _, role := range strings.Split(v, ",") {
+			roles = append(roles, strings.TrimSpace(role))
+		}
+	}
+	if len(roles) > 1 {
+		for _, role := range roles[1:] {
+			if role != roles[0] {
+				return "", RoleHeaderError{Reason: RoleHeaderConflicting}
+			}
+		}
+		return "", RoleHeaderError{Reason: RoleHeaderDuplicated}
+	}
+	return roles[0], nil
+}
+
+// trustedTransport reports whether req came over a connection authenticated
+// with a verified client certificate, or from one of the trusted ranges.
+func (hr *HeaderRoleResolver) trustedTransport(req *http.Request) bool {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, r := range hr.trusted {
+		if r.Net.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
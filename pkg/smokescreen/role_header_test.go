@@ -0,0 +1,120 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"gopkg.in/yaml.v2"
+)
+
+func TestHeaderRoleResolver(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	newReq := func(remoteAddr string, roles ...string) *http.Request {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		req.RemoteAddr = remoteAddr
+		for _, role := range roles {
+			req.Header.Add("X-Smokescreen-Role", role)
+		}
+		return req
+	}
+
+	lax, err := NewHeaderRoleResolver(HeaderRoleConfig{})
+	r.NoError(err)
+	role, err := lax.RoleFromRequest(newReq("192.0.2.1:1234", "a", "b"))
+	a.NoError(err)
+	a.Equal("a", role)
+	_, err = lax.RoleFromRequest(newReq("192.0.2.1:1234"))
+	a.True(IsMissingRoleError(err))
+
+	strict, err := NewHeaderRoleResolver(HeaderRoleConfig{
+		Strict:        true,
+		TrustedRanges: []string{"10.0.0.0/8"},
+	})
+	r.NoError(err)
+
+	role, err = strict.RoleFromRequest(newReq("10.1.2.3:1234", "a"))
+	a.NoError(err)
+	a.Equal("a", role)
+
+	_, err = strict.RoleFromRequest(newReq("192.0.2.1:1234", "a"))
+	a.Equal(RoleHeaderError{Reason: RoleHeaderUntrustedTransport}, err)
+
+	// A verified client certificate is trusted from anywhere.
+	req := newReq("192.0.2.1:1234", "a")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	role, err = strict.RoleFromRequest(req)
+	a.NoError(err)
+	a.Equal("a", role)
+
+	_, err = strict.RoleFromRequest(newReq("10.1.2.3:1234", "a", "a"))
+	a.Equal(RoleHeaderError{Reason: RoleHeaderDuplicated}, err)
+	_, err = strict.RoleFromRequest(newReq("10.1.2.3:1234", "a", "b"))
+	a.Equal(RoleHeaderError{Reason: RoleHeaderConflicting}, err)
+	_, err = strict.RoleFromRequest(newReq("10.1.2.3:1234", "a, b"))
+	a.Equal(RoleHeaderError{Reason: RoleHeaderConflicting}, err)
+	_, err = strict.RoleFromRequest(newReq("10.1.2.3:1234"))
+	a.True(IsMissingRoleError(err))
+
+	// The reason shows up in the proxy decision.
+	conf := NewConfig()
+	conf.RoleFromRequest = strict.RoleFromRequest
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"a": {Policy: acl.Open},
+		},
+	}
+	decision := checkACLsForRequest(conf, newReq("10.1.2.3:1234", "a", "b"), "example.com:443")
+	a.False(decision.allow)
+	a.Equal("Client role cannot be determined: role header rejected: conflicting", decision.reason)
+
+	_, err = NewHeaderRoleResolver(HeaderRoleConfig{TrustedRanges: []string{"10.0.0.0"}})
+	a.Error(err)
+}
+
+func TestStripsCustomRoleHeader(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	receivedCh := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		receivedCh <- req.Header
+	}))
+	defer upstream.Close()
+
+	conf := NewConfig()
+	r.NoError(yaml.UnmarshalStrict([]byte("header_role: {header: X-Team-Role}"), conf))
+	a.Equal([]string{"X-Team-Role"}, conf.RoleHeaders)
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"billing": {Policy: acl.Open},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, err := http.NewRequest("GET", upstream.URL, nil)
+	r.NoError(err)
+	req.Header.Set("X-Team-Role", "billing")
+	resp, err := client.Do(req)
+	r.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.NotContains(<-receivedCh, "X-Team-Role")
+}
@@ -0,0 +1,359 @@
+package smokescreen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWTHeader          = "Proxy-Authorization"
+	defaultJWTRoleClaim       = "sub"
+	defaultJWKSRefresh        = time.Hour
+	minJWKSRefreshOnUnknownID = 30 * time.Second
+	jwtClockSkew              = 30 * time.Second
+)
+
+// JWTRoleConfig configures JWTRoleResolver.
+type JWTRoleConfig struct {
+	Header          string        // Header carrying the token. "Proxy-Authorization" and "Authorization" expect a Bearer token. Defaults to "Proxy-Authorization".
+	JWKSURL         string        // URL of the JSON Web Key Set used to verify token signatures
+	Issuer          string        // Required "iss" claim, if set
+	Audience        string        // Required entry in the "aud" claim, if set
+	RoleClaim       string        // Claim holding the role. Defaults to "sub".
+	RefreshInterval time.Duration // How often to refetch the key set. Defaults to one hour.
+	HTTPClient      *http.Client
+}
+
+// JWTRoleResolver implements RoleFromRequest by validating a JSON Web Token
+// presented by the client and extracting the role from one of its claims.
+// Requests without a token produce a MissingRoleError, so AllowMissingRole
+// applies to them.
+type JWTRoleResolver struct {
+	config JWTRoleConfig
+
+	sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// errUnsupportedJWK is returned for keys of a type or curve tokens can't be
+// verified with. They are left out of the key set rather than failing it.
+var errUnsupportedJWK = errors.New("unsupported key")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func NewJWTRoleResolver(config JWTRoleConfig) (*JWTRoleResolver, error) {
+	if config.JWKSURL == "" {
+		return nil, errors.New("a JWKS URL is required to validate tokens")
+	}
+	if config.Header == "" {
+		config.Header = defaultJWTHeader
+	}
+	if config.RoleClaim == "" {
+		config.RoleClaim = defaultJWTRoleClaim
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = defaultJWKSRefresh
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &JWTRoleResolver{config: config}, nil
+}
+
+// RoleFromRequest can be used as Config.RoleFromRequest.
+func (jr *JWTRoleResolver) RoleFromRequest(req *http.Request) (string, error) {
+	token := req.Header.Get(jr.config.Header)
+	if strings.EqualFold(jr.config.Header, "Proxy-Authorization") || strings.EqualFold(jr.config.Header, "Authorization") {
+		const prefix = "bearer "
+		if len(token) < len(prefix) || !strings.EqualFold(token[:len(prefix)], prefix) {
+			token = ""
+		} else {
+			token = token[len(prefix):]
+		}
+	}
+	if token == "" {
+		return "", MissingRoleError(fmt.Sprintf("no token in %s header", jr.config.Header))
+	}
+
+	claims, err := jr.verify(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %v", err)
+	}
+
+	role, ok := claims[jr.config.RoleClaim].(string)
+	if !ok || role == "" {
+		return "", fmt.Errorf("token has no string claim %q", jr.config.RoleClaim)
+	}
+	return role, nil
+}
+
+func (jr *JWTRoleResolver) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+
+	key, err := jr.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+
+	if err := jr.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (jr *JWTRoleResolver) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return errors.New("token is expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("token is not valid yet")
+		}
+	}
+
+	if jr.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != jr.config.Issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+
+	if jr.config.Audience != "" && !jwtHasAudience(claims["aud"], jr.config.Audience) {
+		return fmt.Errorf("token is not intended for audience %q", jr.config.Audience)
+	}
+	return nil
+}
+
+func jwtHasAudience(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the verification key with the given ID, refreshing the key set
+// when it is stale or the ID is unknown.
+func (jr *JWTRoleResolver) key(kid string) (crypto.PublicKey, error) {
+	jr.Lock()
+	defer jr.Unlock()
+
+	since := time.Since(jr.fetchedAt)
+	key, ok := jr.keys[kid]
+	if !ok && since > minJWKSRefreshOnUnknownID || since > jr.config.RefreshInterval {
+		keys, err := jr.fetchKeys()
+		if err != nil {
+			// Keep using the previous key set if the refresh failed.
+			if jr.keys == nil {
+				return nil, err
+			}
+		} else {
+			jr.keys = keys
+			jr.fetchedAt = time.Now()
+		}
+		key, ok = jr.keys[kid]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (jr *JWTRoleResolver) fetchKeys() (map[string]crypto.PublicKey, error) {
+	resp, err := jr.config.HTTPClient.Get(jr.config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS from %s: unexpected status %d", jr.config.JWKSURL, resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if errors.Is(err, errUnsupportedJWK) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w curve %q", errUnsupportedJWK, jwk.Crv)
+		}
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("%w type %q", errUnsupportedJWK, jwk.Kty)
+	}
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %q does not match RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+
+	case *ecdsa.PublicKey:
+		// Each ES algorithm is defined for one curve only.
+		if curve := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}[alg]; curve != k.Curve.Params().Name {
+			return fmt.Errorf("algorithm %q does not match %s key", alg, k.Curve.Params().Name)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
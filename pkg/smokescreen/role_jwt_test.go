@@ -0,0 +1,154 @@
+package smokescreen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	require.NoError(t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func signTestJWTWithEC(t *testing.T, key *ecdsa.PrivateKey, alg, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	require.NoError(t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	h := map[string]crypto.Hash{"ES256": crypto.SHA256, "ES384": crypto.SHA384}[alg].New()
+	h.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	require.NoError(t, err)
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTRoleResolver(t *testing.T) {
+	r := require.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	r.NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	r.NoError(err)
+
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}, {
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-384",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+			}, {
+				// Keys of unsupported types are skipped.
+				"kty": "OKP",
+				"kid": "ed25519",
+				"crv": "Ed25519",
+				"x":   "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo",
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	resolver, err := NewJWTRoleResolver(JWTRoleConfig{
+		JWKSURL:   jwks.URL,
+		Issuer:    "https://issuer.example.com",
+		Audience:  "smokescreen",
+		RoleClaim: "role",
+	})
+	r.NoError(err)
+
+	valid := map[string]interface{}{
+		"iss":  "https://issuer.example.com",
+		"aud":  []string{"other", "smokescreen"},
+		"exp":  time.Now().Add(time.Hour).Unix(),
+		"role": "billing",
+	}
+
+	withClaims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		for k, v := range overrides {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		role   string
+		errors bool
+	}{
+		{"valid", signTestJWT(t, key, "test", valid), "billing", false},
+		{"expired", signTestJWT(t, key, "test", withClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), "", true},
+		{"wrong issuer", signTestJWT(t, key, "test", withClaims(map[string]interface{}{"iss": "https://evil.example.com"})), "", true},
+		{"wrong audience", signTestJWT(t, key, "test", withClaims(map[string]interface{}{"aud": "other"})), "", true},
+		{"unknown key", signTestJWT(t, key, "other", valid), "", true},
+		{"tampered", signTestJWT(t, key, "test", valid) + "x", "", true},
+		{"unsupported key", signTestJWT(t, key, "ed25519", valid), "", true},
+		{"EC key", signTestJWTWithEC(t, ecKey, "ES384", "ec", valid), "billing", false},
+		{"curve mismatch", signTestJWTWithEC(t, ecKey, "ES256", "ec", valid), "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := assert.New(t)
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer "+c.token)
+
+			role, err := resolver.RoleFromRequest(req)
+			if c.errors {
+				a.Error(err)
+				a.False(IsMissingRoleError(err))
+			} else {
+				a.NoError(err)
+			}
+			a.Equal(c.role, role)
+		})
+	}
+
+	t.Run("missing token", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		_, err := resolver.RoleFromRequest(req)
+		assert.True(t, IsMissingRoleError(err))
+	})
+}
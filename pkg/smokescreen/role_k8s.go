@@ -0,0 +1,236 @@
+package smokescreen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultK8sTokenHeader    = "Proxy-Authorization"
+	defaultK8sTokenCacheTTL  = time.Minute
+	defaultK8sTokenFile      = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultK8sCAFile         = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	k8sTokenNegativeCacheTTL = 10 * time.Second
+	k8sTokenCacheMaxEntries  = 10000
+	k8sServiceAccountPrefix  = "system:serviceaccount:"
+)
+
+// K8sTokenRoleConfig configures K8sTokenRoleResolver.
+type K8sTokenRoleConfig struct {
+	Header     string        // Header carrying the token as a Bearer token. Defaults to "Proxy-Authorization".
+	APIServer  string        // URL of the Kubernetes API server. Defaults to the in-cluster one, from KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT.
+	Audiences  []string      // Audiences the token must have been issued for, if set
+	CacheTTL   time.Duration // How long reviewed tokens are remembered. Defaults to one minute.
+	TokenFile  string        // Smokescreen's own token, sent with the reviews. Defaults to the pod's service account token.
+	CAFile     string        // Verifies the API server. Defaults to the pod's service account CA.
+	HTTPClient *http.Client  // If set, used for reviews instead of a client trusting CAFile
+}
+
+// K8sTokenRoleResolver implements RoleFromRequest by having the Kubernetes
+// API server review a service account token presented by the client, as with
+// a projected service account token volume, and taking
+// "namespace/serviceaccount" as the role. Reviews are cached, so the API
+// server is only asked about each token once per CacheTTL. Requests without
+// a token produce a MissingRoleError, so AllowMissingRole applies to them.
+//
+// Smokescreen's own service account needs to be allowed to create
+// tokenreviews, as the system:auth-delegator cluster role does.
+type K8sTokenRoleResolver struct {
+	config K8sTokenRoleConfig
+	url    string
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]k8sTokenReview
+}
+
+// k8sTokenReview is a cached review of a token.
+type k8sTokenReview struct {
+	role    string
+	err     error // Why the token was rejected, if it was
+	expires time.Time
+}
+
+type k8sTokenReviewRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+}
+
+type k8sTokenReviewResponse struct {
+	Status struct {
+		Authenticated bool   `json:"authenticated"`
+		Error         string `json:"error"`
+		User          struct {
+			Username string `json:"username"`
+		} `json:"user"`
+	} `json:"status"`
+}
+
+func NewK8sTokenRoleResolver(config K8sTokenRoleConfig) (*K8sTokenRoleResolver, error) {
+	if config.Header == "" {
+		config.Header = defaultK8sTokenHeader
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = defaultK8sTokenCacheTTL
+	}
+	if config.TokenFile == "" {
+		config.TokenFile = defaultK8sTokenFile
+	}
+	if config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no Kubernetes API server given, and not running in a cluster")
+		}
+		config.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if config.HTTPClient == nil {
+		if config.CAFile == "" {
+			config.CAFile = defaultK8sCAFile
+		}
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read Kubernetes CA: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+		config.HTTPClient = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	return &K8sTokenRoleResolver{
+		config: config,
+		url:    strings.TrimSuffix(config.APIServer, "/") + "/apis/authentication.k8s.io/v1/tokenreviews",
+		cache:  make(map[[sha256.Size]byte]k8sTokenReview),
+	}, nil
+}
+
+// RoleFromRequest can be used as Config.RoleFromRequest.
+func (kr *K8sTokenRoleResolver) RoleFromRequest(req *http.Request) (string, error) {
+	token := req.Header.Get(kr.config.Header)
+	const prefix = "bearer "
+	if len(token) < len(prefix) || !strings.EqualFold(token[:len(prefix)], prefix) {
+		token = ""
+	} else {
+		token = strings.TrimSpace(token[len(prefix):])
+	}
+	if token == "" {
+		return "", MissingRoleError(fmt.Sprintf("no service account token in %s header", kr.config.Header))
+	}
+
+	// Only hashes of the tokens are kept.
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	kr.mu.Lock()
+	cached, ok := kr.cache[key]
+	kr.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.role, cached.err
+	}
+
+	role, err := kr.review(token)
+	if _, rejected := err.(k8sTokenRejectedError); err != nil && !rejected {
+		return "", fmt.Errorf("can't review service account token: %v", err)
+	}
+	review := k8sTokenReview{role: role, err: err, expires: now.Add(kr.config.CacheTTL)}
+	if err != nil && kr.config.CacheTTL > k8sTokenNegativeCacheTTL {
+		review.expires = now.Add(k8sTokenNegativeCacheTTL)
+	}
+	kr.remember(key, review, now)
+	return role, err
+}
+
+// remember caches review. Once the cache is full, expired reviews are
+// dropped, and if none had, all of them are.
+func (kr *K8sTokenRoleResolver) remember(key [sha256.Size]byte, review k8sTokenReview, now time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if len(kr.cache) >= k8sTokenCacheMaxEntries {
+		for k, r := range kr.cache {
+			if !now.Before(r.expires) {
+				delete(kr.cache, k)
+			}
+		}
+		if len(kr.cache) >= k8sTokenCacheMaxEntries {
+			kr.cache = make(map[[sha256.Size]byte]k8sTokenReview)
+		}
+	}
+	kr.cache[key] = review
+}
+
+// k8sTokenRejectedError is returned for tokens the API server says aren't
+// valid service account tokens.
+type k8sTokenRejectedError struct {
+	error
+}
+
+// review asks the API server about token and returns its role, or a
+// k8sTokenRejectedError if it isn't valid.
+func (kr *K8sTokenRoleResolver) review(token string) (string, error) {
+	ownToken, err := ioutil.ReadFile(kr.config.TokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	var tr k8sTokenReviewRequest
+	tr.APIVersion = "authentication.k8s.io/v1"
+	tr.Kind = "TokenReview"
+	tr.Spec.Token = token
+	tr.Spec.Audiences = kr.config.Audiences
+	body, err := json.Marshal(tr)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, kr.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(ownToken)))
+	resp, err := kr.config.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("API server answered %s", resp.Status)
+	}
+
+	var result k8sTokenReviewResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid token review: %v", err)
+	}
+	if !result.Status.Authenticated {
+		reason := result.Status.Error
+		if reason == "" {
+			reason = "not authenticated"
+		}
+		return "", k8sTokenRejectedError{fmt.Errorf("invalid service account token: %s", reason)}
+	}
+
+	username := result.Status.User.Username
+	parts := strings.Split(strings.TrimPrefix(username, k8sServiceAccountPrefix), ":")
+	if !strings.HasPrefix(username, k8sServiceAccountPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", k8sTokenRejectedError{fmt.Errorf("token of %q is not a service account token", username)}
+	}
+	return parts[0] + "/" + parts[1], nil
+}
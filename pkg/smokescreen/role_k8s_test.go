@@ -0,0 +1,115 @@
+package smokescreen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestK8sTokenRoleResolver(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var reviews int32
+	apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&reviews, 1)
+		if req.Method != http.MethodPost || req.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer smokescreen-token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var review k8sTokenReviewRequest
+		if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var resp k8sTokenReviewResponse
+		switch review.Spec.Token {
+		case "billing-token":
+			if len(review.Spec.Audiences) == 1 && review.Spec.Audiences[0] == "smokescreen" {
+				resp.Status.Authenticated = true
+				resp.Status.User.Username = "system:serviceaccount:payments:billing"
+			}
+		case "user-token":
+			resp.Status.Authenticated = true
+			resp.Status.User.Username = "alice@example.com"
+		default:
+			resp.Status.Error = "token has expired"
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer apiServer.Close()
+
+	dir, err := ioutil.TempDir("", "smokescreen-k8s")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	r.NoError(ioutil.WriteFile(tokenFile, []byte("smokescreen-token\n"), 0600))
+
+	kr, err := NewK8sTokenRoleResolver(K8sTokenRoleConfig{
+		APIServer:  apiServer.URL,
+		Audiences:  []string{"smokescreen"},
+		TokenFile:  tokenFile,
+		HTTPClient: apiServer.Client(),
+	})
+	r.NoError(err)
+
+	newReq := func(auth string) *http.Request {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		return req
+	}
+
+	role, err := kr.RoleFromRequest(newReq("Bearer billing-token"))
+	r.NoError(err)
+	a.Equal("payments/billing", role)
+
+	// Reviews are cached.
+	role, err = kr.RoleFromRequest(newReq("bearer billing-token"))
+	r.NoError(err)
+	a.Equal("payments/billing", role)
+	a.Equal(int32(1), atomic.LoadInt32(&reviews))
+
+	_, err = kr.RoleFromRequest(newReq(""))
+	a.True(IsMissingRoleError(err))
+	_, err = kr.RoleFromRequest(newReq("Basic dXNlcjpwYXNz"))
+	a.True(IsMissingRoleError(err))
+
+	_, err = kr.RoleFromRequest(newReq("Bearer expired-token"))
+	r.Error(err)
+	a.Contains(err.Error(), "token has expired")
+	_, err = kr.RoleFromRequest(newReq("Bearer expired-token"))
+	a.Error(err)
+	a.Equal(int32(2), atomic.LoadInt32(&reviews), "rejections are cached too")
+
+	_, err = kr.RoleFromRequest(newReq("Bearer user-token"))
+	r.Error(err)
+	a.Contains(err.Error(), "not a service account token")
+
+	// Failed reviews aren't cached.
+	r.NoError(ioutil.WriteFile(tokenFile, []byte("wrong-token"), 0600))
+	_, err = kr.RoleFromRequest(newReq("Bearer other-token"))
+	r.Error(err)
+	a.Contains(err.Error(), "403")
+	_, err = kr.RoleFromRequest(newReq("Bearer other-token"))
+	r.Error(err)
+	a.Equal(int32(5), atomic.LoadInt32(&reviews))
+
+	os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	_, err = NewK8sTokenRoleResolver(K8sTokenRoleConfig{})
+	a.Error(err)
+}
@@ -0,0 +1,43 @@
+package smokescreen
+
+import (
+	"net"
+	"sync"
+)
+
+// roleResolvers holds a resolver for each DNS server named by an ACL rule's
+// resolver_address, so roles entitled to split-horizon zones, like those of
+// partner VPNs or private cloud networks, resolve their destinations there.
+//
+// These resolvers send queries to their server as they are: the DNS cache
+// and EDNS Client Subnet options only apply to the configured resolver.
+type roleResolvers struct {
+	sync.Mutex
+	resolvers map[string]*net.Resolver
+}
+
+func newRoleResolvers() *roleResolvers {
+	return &roleResolvers{resolvers: make(map[string]*net.Resolver)}
+}
+
+// resolverFor returns the resolver for the DNS server at addr, or the
+// configured resolver if addr is empty.
+func (config *Config) resolverFor(addr string) *net.Resolver {
+	if addr == "" {
+		return config.Resolver
+	}
+	if config.roleResolvers == nil {
+		return newResolver(addr)
+	}
+
+	rr := config.roleResolvers
+	rr.Lock()
+	defer rr.Unlock()
+
+	r, ok := rr.resolvers[addr]
+	if !ok {
+		r = newResolver(addr)
+		rr.resolvers[addr] = r
+	}
+	return r
+}
@@ -0,0 +1,70 @@
+package smokescreen
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestRoleResolver(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	public := newTestDNSServer(t)
+	defer public.Close()
+	public.Set("partner.test", "8.8.9.1")
+
+	// The partner's zone answers differently on its VPN.
+	partner := newTestDNSServer(t)
+	defer partner.Close()
+	partner.Set("partner.test", "127.0.0.1")
+	partnerAddr := partner.conn.LocalAddr().String()
+
+	conf := NewConfig()
+	conf.Resolver = public.Resolver()
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+
+	resolved, _, err := safeResolve(conf, "tcp", "partner.test:443", acl.AnyFamily, "")
+	r.NoError(err)
+	a.Equal("8.8.9.1", resolved.IP.String())
+
+	resolved, _, err = safeResolve(conf, "tcp", "partner.test:443", acl.AnyFamily, partnerAddr)
+	r.NoError(err)
+	a.Equal("127.0.0.1", resolved.IP.String())
+	a.True(conf.resolverFor(partnerAddr) == conf.resolverFor(partnerAddr))
+
+	// Through the proxy, only the entitled role uses the partner's resolver.
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"entitled": {
+				Policy:          acl.Enforce,
+				DomainGlobs:     []string{"partner.test"},
+				ResolverAddress: partnerAddr,
+			},
+			"other": {
+				Policy:      acl.Enforce,
+				DomainGlobs: []string{"partner.test"},
+			},
+		},
+	}
+
+	for role, ip := range map[string]string{"entitled": "127.0.0.1", "other": "8.8.9.1"} {
+		req := httptest.NewRequest("CONNECT", "partner.test:443", nil)
+		req.Header.Set("X-Smokescreen-Role", role)
+		decision, err := checkIfRequestShouldBeProxied(conf, req, "partner.test:443")
+		r.NoError(err)
+		r.True(decision.allow, role)
+		a.Equal(ip, decision.resolvedAddr.IP.String(), role)
+	}
+
+	a.EqualError(acl.ValidateResolverAddress("10.0.0.53"), "invalid resolver address: address 10.0.0.53: missing port in address")
+	a.NoError(acl.ValidateResolverAddress(net.JoinHostPort("10.0.0.53", "53")))
+}
@@ -0,0 +1,182 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const defaultSPIFFERoleTemplate = "{path}"
+
+// SPIFFERoleConfig configures SPIFFERoleResolver.
+type SPIFFERoleConfig struct {
+	TrustDomains []string // Trust domains whose IDs are accepted. If empty, any trust domain is.
+	Template     string   // How the role is built from the SPIFFE ID; see SPIFFERoleResolver. Defaults to "{path}".
+}
+
+// SPIFFERoleResolver implements RoleFromRequest by taking the role from the
+// SPIFFE ID, such as spiffe://example.org/ns/payments/sa/billing, in the URI
+// SAN of the client's verified certificate, as issued by SPIRE.
+//
+// The role is built from the template, in which {trust_domain} stands for
+// the ID's trust domain, {path} for its path without the leading slash, and
+// any other {name} for the path segment following a segment called name, so
+// that the template "{ns}.{sa}" maps the ID above to "payments.billing".
+// Requests without a certificate, or whose certificate has no SPIFFE ID,
+// produce a MissingRoleError, so AllowMissingRole applies to them.
+type SPIFFERoleResolver struct {
+	config       SPIFFERoleConfig
+	trustDomains map[string]bool
+}
+
+func NewSPIFFERoleResolver(config SPIFFERoleConfig) (*SPIFFERoleResolver, error) {
+	if config.Template == "" {
+		config.Template = defaultSPIFFERoleTemplate
+	}
+	if _, err := parseSPIFFETemplate(config.Template); err != nil {
+		return nil, err
+	}
+
+	var trustDomains map[string]bool
+	if len(config.TrustDomains) > 0 {
+		trustDomains = make(map[string]bool)
+		for _, td := range config.TrustDomains {
+			if td == "" || strings.ContainsAny(td, "/:") {
+				return nil, fmt.Errorf("invalid SPIFFE trust domain %q", td)
+			}
+			trustDomains[strings.ToLower(td)] = true
+		}
+	}
+
+	return &SPIFFERoleResolver{config: config, trustDomains: trustDomains}, nil
+}
+
+// RoleFromRequest can be used as Config.RoleFromRequest.
+func (sr *SPIFFERoleResolver) RoleFromRequest(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.PeerCertificates) == 0 {
+		return "", MissingRoleError("no verified client certificate")
+	}
+
+	var ids []string
+	for _, uri := range req.TLS.PeerCertificates[0].URIs {
+		if strings.EqualFold(uri.Scheme, "spiffe") {
+			ids = append(ids, uri.String())
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", MissingRoleError("no SPIFFE ID in client certificate")
+	case 1:
+	default:
+		return "", fmt.Errorf("client certificate has %d SPIFFE IDs, expected one", len(ids))
+	}
+
+	trustDomain, segments, err := parseSPIFFEID(ids[0])
+	if err != nil {
+		return "", err
+	}
+	if sr.trustDomains != nil && !sr.trustDomains[trustDomain] {
+		return "", fmt.Errorf("SPIFFE trust domain %q is not trusted", trustDomain)
+	}
+
+	role, err := expandSPIFFETemplate(sr.config.Template, trustDomain, segments)
+	if err != nil {
+		return "", fmt.Errorf("can't map SPIFFE ID %s to a role: %v", ids[0], err)
+	}
+	return role, nil
+}
+
+// parseSPIFFEID splits a SPIFFE ID into its trust domain, lowercased, and the
+// segments of its path.
+func parseSPIFFEID(id string) (string, []string, error) {
+	const scheme = "spiffe://"
+	if len(id) < len(scheme) || !strings.EqualFold(id[:len(scheme)], scheme) {
+		return "", nil, fmt.Errorf("invalid SPIFFE ID %q", id)
+	}
+	rest := id[len(scheme):]
+	if strings.ContainsAny(rest, "?#") {
+		return "", nil, fmt.Errorf("invalid SPIFFE ID %q: query and fragment aren't allowed", id)
+	}
+
+	trustDomain, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		trustDomain, path = rest[:i], rest[i+1:]
+	}
+	if trustDomain == "" {
+		return "", nil, fmt.Errorf("invalid SPIFFE ID %q: no trust domain", id)
+	}
+
+	var segments []string
+	if path != "" {
+		segments = strings.Split(path, "/")
+		for _, s := range segments {
+			if s == "" || s == "." || s == ".." {
+				return "", nil, fmt.Errorf("invalid SPIFFE ID %q: bad path segment %q", id, s)
+			}
+		}
+	}
+	return strings.ToLower(trustDomain), segments, nil
+}
+
+// parseSPIFFETemplate splits a role template into literal text and the names
+// of its placeholders, which are at odd indices.
+func parseSPIFFETemplate(template string) ([]string, error) {
+	var parts []string
+	for {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			if strings.IndexByte(template, '}') >= 0 {
+				return nil, errors.New("unbalanced '}' in SPIFFE role template")
+			}
+			return append(parts, template), nil
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 || strings.IndexByte(template[:open], '}') >= 0 {
+			return nil, errors.New("unbalanced braces in SPIFFE role template")
+		}
+		name := template[open+1 : open+end]
+		if name == "" || strings.ContainsAny(name, "{/") {
+			return nil, fmt.Errorf("invalid placeholder {%s} in SPIFFE role template", name)
+		}
+		parts = append(parts, template[:open], name)
+		template = template[open+end+1:]
+	}
+}
+
+func expandSPIFFETemplate(template, trustDomain string, segments []string) (string, error) {
+	parts, err := parseSPIFFETemplate(template)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i, part := range parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		switch part {
+		case "trust_domain":
+			b.WriteString(trustDomain)
+		case "path":
+			b.WriteString(strings.Join(segments, "/"))
+		default:
+			value, ok := "", false
+			for j := 0; j+1 < len(segments); j++ {
+				if segments[j] == part {
+					value, ok = segments[j+1], true
+					break
+				}
+			}
+			if !ok {
+				return "", fmt.Errorf("no %q path segment", part)
+			}
+			b.WriteString(value)
+		}
+	}
+	if b.Len() == 0 {
+		return "", errors.New("the role is empty")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,82 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestSPIFFERoleResolver(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	newReq := func(verified bool, ids ...string) *http.Request {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		cert := &x509.Certificate{}
+		for _, id := range ids {
+			u, err := url.Parse(id)
+			r.NoError(err)
+			cert.URIs = append(cert.URIs, u)
+		}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		return req
+	}
+
+	def, err := NewSPIFFERoleResolver(SPIFFERoleConfig{})
+	r.NoError(err)
+	role, err := def.RoleFromRequest(newReq(true, "spiffe://example.org/ns/payments/sa/billing"))
+	a.NoError(err)
+	a.Equal("ns/payments/sa/billing", role)
+
+	sr, err := NewSPIFFERoleResolver(SPIFFERoleConfig{
+		TrustDomains: []string{"Example.org"},
+		Template:     "{trust_domain}:{ns}.{sa}",
+	})
+	r.NoError(err)
+	role, err = sr.RoleFromRequest(newReq(true, "https://example.org/other", "spiffe://EXAMPLE.org/ns/payments/sa/billing"))
+	a.NoError(err)
+	a.Equal("example.org:payments.billing", role)
+
+	// Clients without a verified SPIFFE ID have no role.
+	_, err = sr.RoleFromRequest(httptest.NewRequest("CONNECT", "example.com:443", nil))
+	a.True(IsMissingRoleError(err))
+	_, err = sr.RoleFromRequest(newReq(false, "spiffe://example.org/ns/payments/sa/billing"))
+	a.True(IsMissingRoleError(err))
+	_, err = sr.RoleFromRequest(newReq(true))
+	a.True(IsMissingRoleError(err))
+
+	for _, ids := range [][]string{
+		{"spiffe://other.org/ns/payments/sa/billing"},
+		{"spiffe://example.org/ns/payments"},
+		{"spiffe://example.org/ns/payments/sa/billing", "spiffe://example.org/ns/payments/sa/other"},
+		{"spiffe://example.org/ns/../sa/billing"},
+	} {
+		_, err = sr.RoleFromRequest(newReq(true, ids...))
+		a.Error(err, "%v", ids)
+		a.False(IsMissingRoleError(err), "%v", ids)
+	}
+
+	for _, template := range []string{"{ns", "ns}", "{}", "{a{b}}", "}{ns}"} {
+		_, err = NewSPIFFERoleResolver(SPIFFERoleConfig{Template: template})
+		a.Error(err, template)
+	}
+	_, err = NewSPIFFERoleResolver(SPIFFERoleConfig{TrustDomains: []string{"spiffe://example.org"}})
+	a.Error(err)
+
+	var conf Config
+	r.NoError(yaml.UnmarshalStrict([]byte("spiffe_role: {trust_domains: [example.org], template: '{sa}'}"), &conf))
+	role, err = conf.RoleFromRequest(newReq(true, "spiffe://example.org/ns/payments/sa/billing"))
+	a.NoError(err)
+	a.Equal("billing", role)
+	a.Error(yaml.UnmarshalStrict([]byte("spiffe_role: {}\nheader_role: {}"), &conf))
+}
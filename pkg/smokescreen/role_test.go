@@ -20,7 +20,7 @@ func _testGetRole(t *testing.T, rfr_s string, rfr_e error, allow_missing bool, e
 		AllowMissingRole: allow_missing,
 		Log:              log.New(),
 	}
-	s, e := getRole(&config, nil)
+	s, _, e := getRole(&config, nil)
 	if e != expect_e {
 		t.Fatalf("expected err %v got %v\n", expect_e, e)
 	}
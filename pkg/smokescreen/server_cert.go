@@ -0,0 +1,31 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+func (config *Config) currentServerCert() *tls.Certificate {
+	cert, _ := config.serverCert.Load().(*tls.Certificate)
+	return cert
+}
+
+// ReloadServerCert re-reads the certificate and key files given to SetupTls.
+// New handshakes present the reloaded certificate immediately, while
+// established connections are left alone. If the files can't be loaded, the
+// current certificate is kept.
+func (config *Config) ReloadServerCert() error {
+	cert, err := tls.LoadX509KeyPair(config.serverCertFile, config.serverKeyFile)
+	if err != nil {
+		return err
+	}
+	config.serverCert.Store(&cert)
+	return nil
+}
+
+// watchServerCert polls the server certificate and key files every interval
+// and reloads them when either changes, until the proxy shuts down.
+func (config *Config) watchServerCert(interval time.Duration) {
+	files := []string{config.serverCertFile, config.serverKeyFile}
+	newFileWatcher(config, files, "tls.server_cert", "server certificate", config.ReloadServerCert).watch(interval)
+}
@@ -0,0 +1,68 @@
+package smokescreen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeServerCert issues a server certificate with the given serial and
+// writes it and its key to the PKI directory.
+func (p *testPKI) writeServerCert(t *testing.T, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "smokescreen"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return p.write(t, "server.pem", "CERTIFICATE", der), p.write(t, "server-key.pem", "EC PRIVATE KEY", keyDer)
+}
+
+func TestReloadServerCert(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	pki := newTestPKI(t)
+	defer os.RemoveAll(pki.dir)
+
+	certFile, keyFile := pki.writeServerCert(t, 20)
+	conf := NewConfig()
+	r.NoError(conf.SetupTls(certFile, keyFile, nil))
+
+	servedSerial := func() int64 {
+		tc, err := conf.tlsConfigForClient(nil)
+		r.NoError(err)
+		r.Len(tc.Certificates, 1)
+		leaf, err := x509.ParseCertificate(tc.Certificates[0].Certificate[0])
+		r.NoError(err)
+		return leaf.SerialNumber.Int64()
+	}
+	a.EqualValues(20, servedSerial())
+
+	pki.writeServerCert(t, 21)
+	r.NoError(conf.ReloadServerCert())
+	a.EqualValues(21, servedSerial())
+
+	// A key that doesn't match the certificate is rejected and the current
+	// certificate is kept.
+	pki.write(t, "server-key.pem", "EC PRIVATE KEY", []byte("garbage"))
+	a.Error(conf.ReloadServerCert())
+	a.EqualValues(21, servedSerial())
+}
@@ -0,0 +1,50 @@
+package smokescreen
+
+import (
+	"context"
+	"sort"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+// ShutdownHook is called when Smokescreen starts shutting down, with the
+// connections still open, so that programs embedding it can deregister from
+// service discovery, flush their own telemetry or release leases as part of
+// its shutdown. ctx expires when the shutdown times out.
+type ShutdownHook func(ctx context.Context, open []*conntrack.InstrumentedConnStats) error
+
+// RegisterShutdownHook adds hook to those called, in the order they were
+// registered, when Smokescreen starts shutting down.
+func (config *Config) RegisterShutdownHook(hook ShutdownHook) {
+	config.OnShutdown = append(config.OnShutdown, hook)
+}
+
+// runShutdownHooks calls the shutdown hooks in turn, logging the errors they
+// return. Hooks still running when ctx expires hold up the shutdown, so they
+// should return once it's done.
+func runShutdownHooks(config *Config, ctx context.Context) {
+	if len(config.OnShutdown) == 0 {
+		return
+	}
+	open := openConnections(config)
+	for i, hook := range config.OnShutdown {
+		if err := hook(ctx, open); err != nil {
+			config.Log.WithField("hook", i).Errorf("shutdown hook failed: %v", err)
+		}
+	}
+}
+
+// openConnections returns the stats of the tracked connections, oldest first.
+func openConnections(config *Config) []*conntrack.InstrumentedConnStats {
+	conns := []*conntrack.InstrumentedConnStats{}
+	if config.ConnTracker != nil {
+		config.ConnTracker.Range(func(k, v interface{}) bool {
+			conns = append(conns, k.(*conntrack.InstrumentedConn).Stats())
+			return true
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Created.Before(conns[j].Created)
+	})
+	return conns
+}
@@ -0,0 +1,64 @@
+package smokescreen
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestShutdownHooks(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+
+	conf := NewConfig()
+	conf.Listener = listener
+
+	called := make(chan string, 2)
+	conf.RegisterShutdownHook(func(ctx context.Context, open []*conntrack.InstrumentedConnStats) error {
+		_, hasDeadline := ctx.Deadline()
+		a.True(hasDeadline)
+		a.Empty(open)
+		a.Equal(true, conf.ShuttingDown.Load())
+		a.Equal(int32(1), atomic.LoadInt32(&conf.health.draining))
+		called <- "first"
+		return errors.New("can't deregister")
+	})
+	conf.RegisterShutdownHook(func(ctx context.Context, open []*conntrack.InstrumentedConnStats) error {
+		called <- "second"
+		return nil
+	})
+
+	quit := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		StartWithConfig(conf, quit)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	quit <- true
+
+	// A failing hook doesn't stop the others from running.
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-called:
+			a.Equal(want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s hook", want)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+}
@@ -2,14 +2,14 @@ package smokescreen
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"sort"
 	"syscall"
 	"time"
 
@@ -19,6 +19,7 @@ import (
 	"github.com/stripe/go-einhorn/einhorn"
 	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
 	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
 )
 
 const (
@@ -27,6 +28,7 @@ const (
 	ipDenyNotGlobalUnicast
 	ipDenyPrivateRange
 	ipDenyUserConfigured
+	ipDenyCloudMetadata
 
 	denyMsgTmpl = "Egress proxying is denied to host '%s': %s."
 )
@@ -37,19 +39,66 @@ type ipType int
 
 type aclDecision struct {
 	reason, role, project, outboundHost string
+	clientAddr                          string // The address of the client the request came from
+	ruleID                              string // The ACL rule that decided, if any
+	fallbackRole                        string // The role whose ACL rule was used because the role has none, if any
+	roleSource                          string // The RoleChain source that determined the role, if any
+	roleIdentity                        string // The identity the client presented, if it is an alias of the role
 	resolvedAddr                        *net.TCPAddr
+	exception                           *acl.Exception // The ACL exception that allowed the request, if any
+	zone                                string         // The zone of the destination, if a zone route matched it
+	sourceIP                            net.IP         // The local address connections to the destination are made from, if its zone route sets one
+	upstreamProxy                       *url.URL
+	upstreamProxyBypassed               bool // Whether the destination is connected to directly despite the role's upstream proxy
 	allow                               bool
 	enforceWouldDeny                    bool
+	rateLimited                         bool
+	retryAfter                          time.Duration
+	mitm                                *acl.MitmRule
+	inspectPlaintext                    bool // Whether the HTTP requests in the role's CONNECT tunnels to port 80 are inspected
+	connectOnly                         bool // Whether the role may only use CONNECT
+	addressFamily                       acl.AddressFamily
+	resolverAddress                     string        // The DNS server the role's destinations are resolved by, if not the configured resolver
+	denyLogInterval                     time.Duration // If set, repeated denials of the role's requests to the same host are logged once this often
+	connectPorts                        []int         // The ports the role's CONNECT requests may target, if its ACL rule overrides the proxy's list
+	followRedirects                     int           // How many redirects of the role's plain HTTP requests are followed
+	alpnProtocols                       []string      // The only ALPN protocols the role's TLS connections may offer, if its ACL rule restricts them
+	policyAnnotations                   map[string]string
 }
 
 type ctxUserData struct {
-	start    time.Time
-	decision *aclDecision
-	traceId  string
+	start     time.Time
+	decision  *aclDecision
+	traceId   string
+	traceCtx  context.Context // Carries the request's span, to parent the spans of later steps
+	span      Span
+	connect   bool         // Whether this is a CONNECT request
+	tunnel    *ctxUserData // For requests inside an inspected CONNECT tunnel, the tunnel's user data
+	redirects []string     // The locations of the redirects followed for a plain HTTP request, if any
 }
 
 type denyError struct {
 	error
+	rule string // The ACL rule that denied the request, if any
+}
+
+// deniedByRule returns the ACL rule that caused err, if any.
+func deniedByRule(err error) string {
+	switch e := err.(type) {
+	case denyError:
+		return e.rule
+	case rateLimitError:
+		return e.rule
+	}
+	return ""
+}
+
+// denyErr returns the error explaining why the request was denied.
+func (d *aclDecision) denyErr() error {
+	if d.rateLimited {
+		return rateLimitError{error: errors.New(d.reason), retryAfter: d.retryAfter, rule: d.ruleID}
+	}
+	return denyError{error: errors.New(d.reason), rule: d.ruleID}
 }
 
 func (t ipType) IsAllowed() bool {
@@ -68,6 +117,8 @@ func (t ipType) String() string {
 		return "Deny: Private Range"
 	case ipDenyUserConfigured:
 		return "Deny: User Configured"
+	case ipDenyCloudMetadata:
+		return "Deny: Cloud Metadata"
 	default:
 		panic(fmt.Errorf("unknown ip type %d", t))
 	}
@@ -85,17 +136,25 @@ func (t ipType) statsdString() string {
 		return "resolver.deny.private_range"
 	case ipDenyUserConfigured:
 		return "resolver.deny.user_configured"
+	case ipDenyCloudMetadata:
+		return "resolver.deny.cloud_metadata"
 	default:
 		panic(fmt.Errorf("unknown ip type %d", t))
 	}
 }
 
 const errorHeader = "X-Smokescreen-Error"
+const ruleHeader = "X-Smokescreen-Rule"
 const roleHeader = "X-Smokescreen-Role"
 const traceHeader = "X-Smokescreen-Trace-ID"
 
 func addrIsInRuleRange(ranges []RuleRange, addr *net.TCPAddr) bool {
-	for _, rng := range ranges {
+	return matchRuleRange(ranges, addr) != nil
+}
+
+// matchRuleRange returns the first of ranges addr is in, or nil.
+func matchRuleRange(ranges []RuleRange, addr *net.TCPAddr) *RuleRange {
+	for i, rng := range ranges {
 		// If the range specifies a port and the port doesn't match,
 		// then this range doesn't match
 		if rng.Port != 0 && addr.Port != rng.Port {
@@ -103,24 +162,48 @@ func addrIsInRuleRange(ranges []RuleRange, addr *net.TCPAddr) bool {
 		}
 
 		if rng.Net.Contains(addr.IP) {
-			return true
+			return &ranges[i]
 		}
 	}
-	return false
+	return nil
 }
 
-func classifyAddr(config *Config, addr *net.TCPAddr) ipType {
+func classifyAddr(config *Config, addr *net.TCPAddr) ipClassification {
+	if ip4 := embeddedIPv4(addr.IP); ip4 != nil {
+		// Deny ranges written for the IPv6 address, which may cover a whole
+		// encoding such as NAT64, apply as well as those for the IPv4 one.
+		if class, denied := classifyDeniedIPv6(config, addr); denied {
+			return class
+		}
+		addr = &net.TCPAddr{IP: ip4, Port: addr.Port}
+	}
+
+	if !config.AllowCloudMetadataAccess && addrIsInRuleRange(CloudMetadataRuleRanges, addr) {
+		return ipDenyCloudMetadata
+	}
+
+	if config.IPClassifier != nil {
+		if class, ok := config.IPClassifier.ClassifyIP(addr); ok {
+			return class
+		}
+	}
+
+	allowRange := matchRuleRange(config.AllowRanges, addr)
+	allowed := allowRange != nil || config.AllowRangeSet.Contains(addr.IP)
+
 	if !addr.IP.IsGlobalUnicast() || addr.IP.IsLoopback() {
-		if addrIsInRuleRange(config.AllowRanges, addr) {
-			return ipAllowUserConfigured
+		if allowed {
+			return rangeClassification(ipAllowUserConfigured, allowRange)
 		} else {
 			return ipDenyNotGlobalUnicast
 		}
 	}
 
-	if addrIsInRuleRange(config.AllowRanges, addr) {
-		return ipAllowUserConfigured
-	} else if addrIsInRuleRange(config.DenyRanges, addr) {
+	if allowed {
+		return rangeClassification(ipAllowUserConfigured, allowRange)
+	} else if denyRange := matchRuleRange(config.DenyRanges, addr); denyRange != nil {
+		return rangeClassification(ipDenyUserConfigured, denyRange)
+	} else if config.DenyRangeSet.Contains(addr.IP) {
 		return ipDenyUserConfigured
 	} else if addrIsInRuleRange(PrivateRuleRanges, addr) {
 		return ipDenyPrivateRange
@@ -129,7 +212,24 @@ func classifyAddr(config *Config, addr *net.TCPAddr) ipType {
 	}
 }
 
-func resolveTCPAddr(config *Config, network, addr string) (*net.TCPAddr, error) {
+// classifyDeniedIPv6 reports whether addr, an IPv6 address embedding an
+// IPv4 one, is in a user-configured deny range and not in an allow range.
+func classifyDeniedIPv6(config *Config, addr *net.TCPAddr) (ipClassification, bool) {
+	if matchRuleRange(config.AllowRanges, addr) != nil || config.AllowRangeSet.Contains(addr.IP) {
+		return nil, false
+	}
+	if denyRange := matchRuleRange(config.DenyRanges, addr); denyRange != nil {
+		return rangeClassification(ipDenyUserConfigured, denyRange), true
+	}
+	if config.DenyRangeSet.Contains(addr.IP) {
+		return ipDenyUserConfigured, true
+	}
+	return nil, false
+}
+
+// resolveTCPAddrs returns every address of family that addr resolves to, in
+// the order the resolver returned them unless family prefers one kind.
+func resolveTCPAddrs(resolver *net.Resolver, network, addr string, family acl.AddressFamily) ([]*net.TCPAddr, error) {
 	if network != "tcp" {
 		return nil, fmt.Errorf("unknown network type %q", network)
 	}
@@ -139,12 +239,12 @@ func resolveTCPAddr(config *Config, network, addr string) (*net.TCPAddr, error)
 	}
 
 	ctx := context.Background()
-	resolvedPort, err := config.Resolver.LookupPort(ctx, network, port)
+	resolvedPort, err := resolver.LookupPort(ctx, network, port)
 	if err != nil {
 		return nil, err
 	}
 
-	ips, err := config.Resolver.LookupIPAddr(ctx, host)
+	ips, err := lookupFamily(ctx, resolver, host, family)
 	if err != nil {
 		return nil, err
 	}
@@ -152,43 +252,198 @@ func resolveTCPAddr(config *Config, network, addr string) (*net.TCPAddr, error)
 		return nil, fmt.Errorf("no IPs resolved")
 	}
 
-	return &net.TCPAddr{
-		IP:   ips[0].IP,
-		Zone: ips[0].Zone,
-		Port: resolvedPort,
-	}, nil
+	addrs := make([]*net.TCPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.TCPAddr{
+			IP:   ip.IP,
+			Zone: ip.Zone,
+			Port: resolvedPort,
+		}
+	}
+	return addrs, nil
+}
+
+// lookupFamily looks up the addresses of host in family. Roles restricted to
+// one family don't query the other at all, so broken records of that kind
+// can't slow them down.
+func lookupFamily(ctx context.Context, resolver *net.Resolver, host string, family acl.AddressFamily) ([]net.IPAddr, error) {
+	var network string
+	switch family {
+	case acl.IPv4Only:
+		network = "ip4"
+	case acl.IPv6Only:
+		network = "ip6"
+	default:
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if family == acl.PreferIPv4 || family == acl.PreferIPv6 {
+			preferV4 := family == acl.PreferIPv4
+			sort.SliceStable(ips, func(i, j int) bool {
+				return (ips[i].IP.To4() != nil) == preferV4 && (ips[j].IP.To4() != nil) != preferV4
+			})
+		}
+		return ips, nil
+	}
+
+	ips, err := resolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs, nil
 }
 
-func safeResolve(config *Config, network, addr string) (*net.TCPAddr, string, error) {
-	config.StatsdClient.Incr("resolver.attempts_total", []string{}, 1)
-	resolved, err := resolveTCPAddr(config, network, addr)
+// safeResolve resolves addr and classifies every address it resolves to. The
+// destination is denied if any of them is denied, since the dialer, or a
+// client retrying through round-robin DNS, could end up at any of them. With
+// DialOnlyAllowedAddresses set, denied addresses are skipped instead. The
+// allowed address to use is picked by the configured AddressSelection. Only
+// addresses in family are considered. If resolverAddr is set, the DNS server
+// there is asked instead of the configured resolver.
+func safeResolve(config *Config, network, addr string, family acl.AddressFamily, resolverAddr string) (*net.TCPAddr, string, error) {
+	config.MetricsClient.Incr("resolver.attempts_total", []string{}, 1)
+	addrs, err := resolveTCPAddrs(config.resolverFor(resolverAddr), network, addr, family)
 	if err != nil {
-		config.StatsdClient.Incr("resolver.errors_total", []string{}, 1)
+		config.MetricsClient.Incr("resolver.errors_total", []string{}, 1)
+		if isResolverOutage(err) {
+			return nil, "destination could not be resolved, see error", resolverOutage(config, addr, err)
+		}
 		return nil, "", err
 	}
 
-	classification := classifyAddr(config, resolved)
-	config.StatsdClient.Incr(classification.statsdString(), []string{}, 1)
+	// Split-horizon answers would look like addresses moving between
+	// public and private space.
+	if config.DNSAnomalyDetector != nil && resolverAddr == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		config.DNSAnomalyDetector.Observe(config, host, addrs)
+	}
+
+	var allowed []*net.TCPAddr
+	var allowedClasses []ipClassification
+	var denied *net.TCPAddr
+	var deniedClass ipClassification
+	for _, a := range addrs {
+		classification := classifyAddr(config, a)
+		if classification.IsAllowed() {
+			allowed = append(allowed, a)
+			allowedClasses = append(allowedClasses, classification)
+		} else if denied == nil {
+			denied, deniedClass = a, classification
+		}
+	}
 
-	if classification.IsAllowed() {
-		return resolved, classification.String(), nil
+	if denied != nil && (allowed == nil || !config.DialOnlyAllowedAddresses) {
+		config.MetricsClient.Incr(deniedClass.statsdString(), classificationTags(deniedClass), 1)
+		return nil, "destination address was denied by rule, see error", denyError{error: fmt.Errorf("The destination address (%s) was denied by rule '%s'", denied.IP, deniedClass)}
+	}
+	if denied != nil {
+		config.MetricsClient.Incr("resolver.denied_addresses_skipped", []string{}, 1)
 	}
-	return nil, "destination address was denied by rule, see error", denyError{fmt.Errorf("The destination address (%s) was denied by rule '%s'", resolved.IP, classification)}
+
+	preferFamily := family == acl.PreferIPv4 || family == acl.PreferIPv6
+	i := config.selectAddress(addr, allowed, preferFamily)
+	config.MetricsClient.Incr(allowedClasses[i].statsdString(), classificationTags(allowedClasses[i]), 1)
+	return allowed[i], allowedClasses[i].String(), nil
+}
+
+// connectTimeout returns how long connecting for a CONNECT request, if
+// connect is set, or a plain HTTP request may take. proxied is set if the
+// connection is to an upstream proxy the request is sent through.
+func connectTimeout(config *Config, connect, proxied bool) time.Duration {
+	switch {
+	case proxied && config.UpstreamConnectTimeout > 0:
+		return config.UpstreamConnectTimeout
+	case connect && config.TunnelConnectTimeout > 0:
+		return config.TunnelConnectTimeout
+	case !connect && config.HTTPConnectTimeout > 0:
+		return config.HTTPConnectTimeout
+	}
+	return config.ConnectTimeout
 }
 
 func dial(config *Config, network, addr string, userdata interface{}) (net.Conn, error) {
 	var role, outboundHost, reason string
+	var decision *aclDecision
 	var resolved *net.TCPAddr
+	var upstream *url.URL
+	var connect bool
+	var family acl.AddressFamily
+	var resolverAddr string
+	var sourceIP net.IP
+	var inspected, sniVerified *ctxUserData
+	var start time.Time
+	traceCtx := context.Background()
 
 	if v, ok := userdata.(*ctxUserData); ok {
+		decision = v.decision
 		role = v.decision.role
 		outboundHost = v.decision.outboundHost
 		resolved = v.decision.resolvedAddr
+		upstream = v.decision.upstreamProxy
+		connect = v.connect
+		start = v.start
+		family = v.decision.addressFamily
+		resolverAddr = v.decision.resolverAddress
+		sourceIP = v.decision.sourceIP
+		if connect && v.decision.inspectsPlaintext() {
+			inspected = v
+		} else if connect && (config.VerifySNI || len(v.decision.alpnProtocols) > 0) && v.decision.mitm == nil {
+			sniVerified = v
+		}
+		if v.traceCtx != nil {
+			traceCtx = v.traceCtx
+		}
+	}
+
+	_, span := startSpan(config, traceCtx, "smokescreen.dial")
+	defer span.End()
+	span.SetAttribute("net.peer.name", addr)
+
+	// Traffic for roles with an upstream proxy always leaves through it. If
+	// the destination itself is being dialed, as for CONNECT requests, we
+	// tunnel to it through the upstream proxy. Otherwise addr is a proxy the
+	// caller is about to speak the proxy protocol to, and the upstream proxy
+	// takes its place.
+	//
+	// A CONNECT request dialing anything but its destination is being sent
+	// to the proxy in https_proxy. SOCKS5 proxies can't take its place, so
+	// we tunnel to the destination and answer the CONNECT request locally.
+	var tunnelTo string
+	answerConnect := false
+	if upstream != nil && network == "tcp" {
+		if hostport.Equal(addr, outboundHost) {
+			tunnelTo = outboundHost
+		} else if connect && isSocksProxy(upstream) {
+			tunnelTo = outboundHost
+			answerConnect = true
+		}
+		addr = upstreamProxyAddr(upstream)
 	}
 
-	if resolved == nil || addr != outboundHost || network != "tcp" {
+	// If the environment is to be ignored, connect to the destination of a
+	// CONNECT request rather than the proxy in https_proxy, and answer the
+	// request locally.
+	if config.IgnoreProxyEnvironment && connect && upstream == nil && network == "tcp" && !hostport.Equal(addr, outboundHost) {
+		addr = outboundHost
+		answerConnect = true
+	}
+
+	proxied := upstream != nil || (outboundHost != "" && !hostport.Equal(addr, outboundHost))
+	timeout := connectTimeout(config, connect, proxied)
+
+	// Connections to the destination vetted by the ACL check are pinned to
+	// the address it resolved to then. Resolving the name again here would
+	// let a DNS rebinding attack swap in a different address after the check.
+	if resolved != nil && network == "tcp" && hostport.Equal(addr, outboundHost) {
+		config.MetricsClient.Incr("resolver.pinned_total", []string{}, 1)
+	} else {
 		var err error
-		resolved, reason, err = safeResolve(config, network, addr)
+		resolved, reason, err = safeResolve(config, network, addr, family, resolverAddr)
 		userdata.(*ctxUserData).decision.reason = reason
 		if err != nil {
 			if _, ok := err.(denyError); ok {
@@ -199,28 +454,137 @@ func dial(config *Config, network, addr string, userdata interface{}) (net.Conn,
 					}).Error("unexpected illegal address in dialer")
 			}
 
+			span.RecordError(err)
 			return nil, err
 		}
 	}
+	span.SetAttribute("net.peer.ip", resolved.IP.String())
+
+	if err := guardDial(config, resolved); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	circuitDone, err := acquireCircuit(config, role, outboundHost)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	hostSlot := destinationHostKey(outboundHost)
+	if hostSlot != "" {
+		if !config.ConnTracker.AcquireHost(hostSlot) {
+			err := hostConnLimitError(config, role, hostSlot)
+			circuitDone(err)
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	if err := acquirePort(config, role, resolved, timeout); err != nil {
+		circuitDone(err)
+		if hostSlot != "" {
+			config.ConnTracker.ReleaseHost(hostSlot)
+		}
+		span.RecordError(err)
+		return nil, err
+	}
+
+	dialDone, err := acquireDialSlot(config, role)
+	if err != nil {
+		circuitDone(err)
+		if config.portUsage != nil {
+			config.portUsage.release(resolved.String(), false)
+		}
+		if hostSlot != "" {
+			config.ConnTracker.ReleaseHost(hostSlot)
+		}
+		span.RecordError(err)
+		return nil, err
+	}
 
-	config.StatsdClient.Incr("cn.atpt.total", []string{}, 1)
-	conn, err := net.DialTimeout(network, resolved.String(), config.ConnectTimeout)
+	config.MetricsClient.Incr("cn.atpt.total", []string{}, 1)
+	dialer := &net.Dialer{Timeout: timeout}
+	if sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	conn, err := dialer.Dial(network, resolved.String())
+	if config.portUsage != nil {
+		if err != nil {
+			config.portUsage.release(resolved.String(), false)
+		} else {
+			conn = &portHoldingConn{Conn: conn, ports: config.portUsage, addr: resolved.String()}
+		}
+	}
+	if err != nil {
+		err = portExhaustedError(config, role, resolved, err)
+	}
+
+	if err == nil && upstream != nil && network == "tcp" && config.UpstreamProxyIdentity == UpstreamIdentityProxyProtocol {
+		err = writeProxyProtocolHeader(conn, decision.clientAddr)
+		if err != nil {
+			conn.Close()
+		}
+	}
+
+	if err == nil && tunnelTo != "" {
+		header := make(http.Header)
+		addUpstreamIdentity(config, header, decision)
+		var tunnel net.Conn
+		tunnel, err = tunnelThroughProxy(conn, upstream, tunnelTo, header, timeout)
+		if err != nil {
+			conn.Close()
+		}
+		conn = tunnel
+	}
+	dialDone(err)
+	circuitDone(err)
 
 	if err != nil {
-		config.StatsdClient.Incr("cn.atpt.fail.total", []string{}, 1)
+		if hostSlot != "" {
+			config.ConnTracker.ReleaseHost(hostSlot)
+		}
+		config.MetricsClient.Incr("cn.atpt.fail.total", []string{}, 1)
+		span.RecordError(err)
 		return nil, err
 	} else {
-		config.StatsdClient.Incr("cn.atpt.success.total", []string{}, 1)
-		return config.ConnTracker.NewInstrumentedConn(conn, role, outboundHost), nil
+		config.MetricsClient.Incr("cn.atpt.success.total", []string{}, 1)
+		ic := config.ConnTracker.NewInstrumentedConn(conn, role, outboundHost)
+		if hostSlot != "" {
+			ic.HoldHostSlot(hostSlot)
+		}
+		if connect {
+			logTunnelOnClose(config, ic, decision, start)
+		}
+		// Tunnels through the proxy in https_proxy start with goproxy's
+		// CONNECT request, and aren't inspected.
+		var tunnelConn net.Conn = ic
+		if tunnelTo != "" || hostport.Equal(addr, outboundHost) {
+			if inspected != nil {
+				tunnelConn = newPlaintextInspector(config, ic, inspected)
+			} else if sniVerified != nil {
+				tunnelConn = newSNIVerifier(config, ic, sniVerified)
+			}
+		}
+		if answerConnect {
+			return &localConnectConn{Conn: tunnelConn}, nil
+		}
+		return tunnelConn, nil
 	}
 }
 
 func rejectResponse(req *http.Request, config *Config, err error) *http.Response {
 	var msg string
+	status := http.StatusProxyAuthRequired
+	hint := retryHintFor(config, err)
 	switch err.(type) {
-	case denyError:
+	case denyError, rateLimitError:
 		msg = fmt.Sprintf(denyMsgTmpl, req.Host, err.Error())
 	default:
+		if hint.retryable {
+			msg = fmt.Sprintf(transientMsgTmpl, req.Host, err.Error())
+			break
+		}
 		config.Log.WithFields(logrus.Fields{
 			"error": err,
 		}).Warn("rejectResponse called with unexpected error")
@@ -231,45 +595,58 @@ func rejectResponse(req *http.Request, config *Config, err error) *http.Response
 		msg = fmt.Sprintf("%s\n\n%s\n", msg, config.AdditionalErrorMessageOnDeny)
 	}
 
+	if hint.status != 0 {
+		status = hint.status
+	}
+
 	resp := goproxy.NewResponse(req,
 		goproxy.ContentTypeText,
-		http.StatusProxyAuthRequired,
+		status,
 		msg+"\n")
 	resp.Status = "Request Rejected by Proxy" // change the default status message
 	resp.ProtoMajor = req.ProtoMajor
 	resp.ProtoMinor = req.ProtoMinor
 	resp.Header.Set(errorHeader, msg)
+	if rule := deniedByRule(err); rule != "" {
+		resp.Header.Set(ruleHeader, rule)
+	}
+	if cle, ok := err.(connLimitError); ok {
+		resp.Header.Set(limitHeader, cle.limit)
+	}
+	hint.setHeaders(resp)
 	return resp
 }
 
 func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
+	config.useStatsdClient()
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = false
 	proxy.Tr.Dial = func(network, addr string, userdata interface{}) (net.Conn, error) {
 		return dial(config, network, addr, userdata)
 	}
+	proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyForRequest(config, req)
+	}
 
 	// Ensure that we don't keep old connections alive to avoid TLS errors
 	// when attempting to re-use an idle connection.
 	proxy.Tr.DisableKeepAlives = true
 
+	mitmTransport := newMitmTransport(config)
+
 	// Handle traditional HTTP proxy
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		userData := ctxUserData{time.Now(), nil, ""}
+		if tunnel := mitmTunnel(ctx); tunnel != nil {
+			return handleMitmRequest(config, mitmTransport, req, ctx, tunnel)
+		}
+
+		traceCtx, span := startRequestSpan(config, req, "smokescreen.http")
+		req = req.WithContext(traceCtx)
+		userData := ctxUserData{start: time.Now(), traceCtx: traceCtx, span: span}
 		ctx.UserData = &userData
 
 		// Build an address parsable by net.ResolveTCPAddr
-		remoteHost := req.Host
-		if strings.LastIndex(remoteHost, ":") <= strings.LastIndex(remoteHost, "]") {
-			switch req.URL.Scheme {
-			case "http":
-				remoteHost = net.JoinHostPort(remoteHost, "80")
-			case "https":
-				remoteHost = net.JoinHostPort(remoteHost, "443")
-			default:
-				remoteHost = net.JoinHostPort(remoteHost, "0")
-			}
-		}
+		remoteHost := hostport.WithDefaultPort(req.Host, req.URL.Scheme)
 
 		config.Log.WithFields(
 			logrus.Fields{
@@ -283,7 +660,7 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 		userData.decision = decision
 		userData.traceId = req.Header.Get(traceHeader)
 
-		req.Header.Del(roleHeader)
+		stripRoleHeaders(config, req.Header)
 		req.Header.Del(traceHeader)
 
 		if err != nil {
@@ -291,7 +668,27 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 			return req, rejectResponse(req, config, err)
 		}
 		if !userData.decision.allow {
-			return req, rejectResponse(req, config, denyError{errors.New(userData.decision.reason)})
+			return req, rejectResponse(req, config, userData.decision.denyErr())
+		}
+		if err := checkPlainHTTPAllowed(config, userData.decision); err != nil {
+			return req, rejectResponse(req, config, err)
+		}
+		if err := checkClientALPN(config, req, userData.decision); err != nil {
+			return req, rejectResponse(req, config, err)
+		}
+		if err := checkHTTPRules(config, userData.decision, req); err != nil {
+			return req, rejectResponse(req, config, err)
+		}
+
+		if userData.decision.upstreamProxy != nil {
+			req = withUpstreamProxy(req, userData.decision.upstreamProxy)
+			if !isSocksProxy(userData.decision.upstreamProxy) {
+				addUpstreamIdentity(config, req.Header, userData.decision)
+			}
+		}
+		prepareForwardedRequest(req)
+		if isWebSocketUpgrade(req) {
+			return req, forwardWebSocketUpgrade(config, req, ctx)
 		}
 
 		// Proceed with proxying the request
@@ -300,7 +697,9 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 
 	// Handle CONNECT proxy to TLS & other TCP protocols destination
 	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		ctx.UserData = &ctxUserData{time.Now(), nil, ""}
+		traceCtx, span := startRequestSpan(config, ctx.Req, "smokescreen.connect")
+		ctx.Req = ctx.Req.WithContext(traceCtx)
+		ctx.UserData = &ctxUserData{start: time.Now(), traceCtx: traceCtx, span: span, connect: true}
 		defer ctx.Req.Header.Del(traceHeader)
 
 		err := handleConnect(config, ctx)
@@ -308,12 +707,18 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 			ctx.Resp = rejectResponse(ctx.Req, config, err)
 			return goproxy.RejectConnect, ""
 		}
+		if mitmTunnel(ctx) != nil {
+			return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, Ca: config.MitmCa}, host
+		}
 		return goproxy.OkConnect, host
 	})
 
 	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp = followRedirects(config, proxy.Tr, resp, ctx)
 		if resp != nil {
 			resp.Header.Del(errorHeader)
+			forwardTrailers(ctx.Req, resp)
+			identifyResponse(config, resp, ctx)
 		}
 
 		if resp == nil && ctx.Error != nil {
@@ -356,9 +761,14 @@ func logProxy(
 		"trace_id":       traceID,
 	}
 
+	if config.tenant != "" {
+		fields["tenant"] = config.tenant
+	}
+
 	if toAddress != nil {
 		fields["dest_ip"] = toAddress.IP.String()
 		fields["dest_port"] = toAddress.Port
+		fields["address_selection"] = config.AddressSelection.String()
 	}
 
 	// attempt to retrieve information about the host originating the proxy request
@@ -378,12 +788,68 @@ func logProxy(
 		fields["decision_reason"] = decision.reason
 		fields["enforce_would_deny"] = decision.enforceWouldDeny
 		fields["allow"] = decision.allow
+		if decision.ruleID != "" {
+			fields["rule_id"] = decision.ruleID
+		}
+		if decision.roleSource != "" {
+			fields["role_source"] = decision.roleSource
+		}
+		if decision.roleIdentity != "" {
+			fields["role_identity"] = decision.roleIdentity
+		}
+		if decision.fallbackRole != "" {
+			fields["fallback_role"] = decision.fallbackRole
+		}
+		if decision.exception != nil {
+			fields["exception_ticket"] = decision.exception.Ticket
+			fields["exception_approver"] = decision.exception.Approver
+		}
+		if decision.upstreamProxy != nil {
+			fields["upstream_proxy"] = decision.upstreamProxy.Host
+		}
+		if decision.upstreamProxyBypassed {
+			fields["upstream_proxy_bypassed"] = true
+		}
+		if decision.zone != "" {
+			fields["dest_zone"] = decision.zone
+		}
+		for k, v := range decision.policyAnnotations {
+			fields["policy_"+k] = v
+		}
 	}
 
 	if err != nil {
 		fields["error"] = err.Error()
 	}
 
+	if userData, ok := ctx.UserData.(*ctxUserData); ok {
+		if len(userData.redirects) > 0 {
+			fields["redirects"] = userData.redirects
+		}
+		userData.endSpan(decision, err)
+	}
+
+	pctx := &ProxyContext{Request: ctx.Req, ProxyType: proxyType, Error: err}
+	if decision != nil {
+		pctx.Role, pctx.Allow, pctx.Reason = decision.role, decision.allow, decision.reason
+	}
+	fields = renameCanonicalLogKeys(config, enrichCanonicalLog(config, fields, pctx))
+
+	// The access log keeps every decision, repeated denials included.
+	if config.AccessLog != nil {
+		config.AccessLog.WithFields(fields).Info(LOGLINE_CANONICAL_PROXY_DECISION)
+	}
+	recordDecisionEvent(config, proxyType, fromHost, ctx.Req.Host, traceID, decision, err)
+
+	logRequest(config, ctx, proxyType, toAddress, decision, start, err)
+	notifyDeny(config, ctx.Req, proxyType, decision, traceID, err)
+
+	if interval := denyLogInterval(config, decision, err); interval > 0 {
+		if !config.denyLogs.admit(config, decision.role, ctx.Req.Host, decision.reason, interval) {
+			return
+		}
+	}
+
 	entry := config.Log.WithFields(fields)
 	var logMethod func(...interface{})
 	if _, ok := err.(denyError); !ok && err != nil {
@@ -404,7 +870,13 @@ func logHTTP(config *Config, ctx *goproxy.ProxyCtx) {
 
 	userData := ctx.UserData.(*ctxUserData)
 
-	logProxy(config, ctx, "http", toAddr, userData.decision, userData.traceId, userData.start, ctx.Error)
+	proxyType := "http"
+	if userData.tunnel != nil {
+		proxyType = "mitm"
+		toAddr = userData.decision.resolvedAddr
+	}
+
+	logProxy(config, ctx, proxyType, toAddr, userData.decision, userData.traceId, userData.start, ctx.Error)
 }
 
 func handleConnect(config *Config, ctx *goproxy.ProxyCtx) error {
@@ -418,6 +890,31 @@ func handleConnect(config *Config, ctx *goproxy.ProxyCtx) error {
 
 	// Check if requesting role is allowed to talk to remote
 	decision, err := checkIfRequestShouldBeProxied(config, ctx.Req, ctx.Req.Host)
+	if err == nil && decision.allow && decision.mitm != nil && !decision.inspectsPlaintext() && config.MitmCa == nil {
+		decision.allow = false
+		decision.reason = "role requires TLS inspection, which is not configured"
+	}
+	if err == nil && decision.allow {
+		err = checkConnectPort(config, decision)
+	}
+	if err == nil && decision.allow {
+		err = checkClientALPN(config, ctx.Req, decision)
+	}
+	if err == nil && decision.allow {
+		err = checkOverloaded(config, decision)
+	}
+	if err == nil && decision.allow {
+		err = checkCircuit(config, decision)
+	}
+	if err == nil && decision.allow {
+		err = checkHostConnLimit(config, decision)
+	}
+	if err == nil && decision.allow {
+		err = checkPortLimit(config, decision)
+	}
+	if err == nil && decision.allow {
+		err = checkConcurrencyLimit(config, decision)
+	}
 	ctx.UserData.(*ctxUserData).decision = decision
 	ctx.UserData.(*ctxUserData).traceId = ctx.Req.Header.Get(traceHeader)
 	logProxy(config, ctx, "connect", decision.resolvedAddr, decision, ctx.Req.Header.Get(traceHeader), start, err)
@@ -425,7 +922,7 @@ func handleConnect(config *Config, ctx *goproxy.ProxyCtx) error {
 		return err
 	}
 	if !decision.allow {
-		return denyError{errors.New(decision.reason)}
+		return decision.denyErr()
 	}
 
 	return nil
@@ -445,19 +942,91 @@ func findListener(ip string, defaultPort uint16) (net.Listener, error) {
 }
 
 func StartWithConfig(config *Config, quit <-chan interface{}) {
-	config.Log.Println("starting")
-	proxy := BuildProxy(config)
+	config.useStatsdClient()
+	config.started = time.Now()
+	config.Log.WithFields(currentBuildInfo(config).fields()).Info("starting")
+	go reportBuildInfo(config, buildInfoInterval)
+	go reportDenyLogs(config, denyLogFlushInterval)
+	if config.OpenMetrics != nil {
+		config.OpenMetrics.buildInfo = func() buildInfo { return currentBuildInfo(config) }
+	}
 
-	listener, err := findListener(config.Ip, config.Port)
-	if err != nil {
-		config.Log.Fatal("can't find listener", err)
+	listener := config.Listener
+	if listener == nil {
+		var err error
+		listener, err = findListener(config.Ip, config.Port)
+		if err != nil {
+			config.Log.Fatal("can't find listener", err)
+		}
 	}
 
-	if config.SupportProxyProtocol {
-		listener = &proxyproto.Listener{Listener: listener}
+	if config.ListenBacklog > 0 {
+		if err := setListenBacklog(listener, config.ListenBacklog); err != nil {
+			config.Log.Fatal("can't set listen backlog: ", err)
+		}
+	}
+	if config.ListenQueueStatsInterval > 0 {
+		go monitorListenQueue(config, listener, config.ListenQueueStatsInterval)
+	}
+
+	// Setup connection tracking
+	config.ConnTracker = conntrack.NewTracker(config.IdleThreshold, config.MetricsClient, config.Log, config.ShuttingDown)
+	config.ConnTracker.ReadIdleThreshold = config.ReadIdleThreshold
+	config.ConnTracker.WriteIdleThreshold = config.WriteIdleThreshold
+	config.ConnTracker.MaxConnsPerHost = config.MaxConnsPerHost
+	config.ConnTracker.MaxConns = config.MaxConns
+	config.ConnTracker.MaxLifetime = config.MaxConnLifetime
+	config.ConnTracker.MaxConnBytes = config.MaxConnBytes
+	config.ConnTracker.MaxConnBandwidth = config.MaxConnBandwidth
+	config.ConnTracker.AccessLog = config.AccessLog
+	if config.ReapIdleConnections {
+		go config.ConnTracker.ReapIdle(config.IdleThreshold)
 	}
+	if config.BytesReportInterval > 0 {
+		go config.ConnTracker.ReportBytes(config.BytesReportInterval)
+	}
+
+	server := http.Server{
+		Handler:        buildHandler(config),
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}
+
+	if config.TlsConfig != nil && config.TlsClientCAReloadInterval > 0 {
+		go config.watchClientTrust(config.TlsClientCAReloadInterval)
+	}
+	if config.TlsConfig != nil && config.TlsServerCertReloadInterval > 0 {
+		go config.watchServerCert(config.TlsServerCertReloadInterval)
+	}
+
+	if p, ok := config.EgressACL.(*PollingACL); ok {
+		go p.poll()
+	}
+	if config.RoleAliases != nil && config.RoleAliases.interval > 0 {
+		go config.RoleAliases.watch()
+	}
+	if config.RoleConfig != nil && config.RoleConfig.interval > 0 {
+		go config.RoleConfig.watch()
+	}
+
+	if config.MemoryBudget > 0 {
+		config.memoryBudget = newMemoryBudget(config.MemoryBudget)
+	}
+
+	tenants := serveTenants(config)
+
+	config.ShuttingDown.Store(false)
+	runServer(config, &server, wrapListener(config, listener), tenants, quit)
+	return
+}
+
+// buildHandler returns the proxy handler for config, including the optional
+// healthcheck, liveness and readiness endpoints.
+func buildHandler(config *Config) http.Handler {
+	var handler http.Handler = withHTTP2Connect(config, withResponseWriter(BuildProxy(config)))
 
-	var handler http.Handler = proxy
+	if config.HealthEndpoints {
+		handler = healthEndpoints(config, handler)
+	}
 
 	if config.Healthcheck != nil {
 		handler = &HealthcheckMiddleware{
@@ -465,25 +1034,57 @@ func StartWithConfig(config *Config, quit <-chan interface{}) {
 			Healthcheck: config.Healthcheck,
 		}
 	}
+	return handler
+}
+
+// wrapListener adds memory budgeting, PROXY protocol and TLS support to
+// listener, as configured.
+func wrapListener(config *Config, listener net.Listener) net.Listener {
+	if config.memoryBudget != nil {
+		listener = &budgetListener{Listener: listener, config: config, budget: config.memoryBudget}
+	}
+
+	if config.SupportProxyProtocol {
+		listener = &proxyproto.Listener{Listener: listener}
+	}
 
 	// TLS support
 	if config.TlsConfig != nil {
-		listener = tls.NewListener(listener, config.TlsConfig)
+		listener = &tlsListener{Listener: listener, config: config}
 	}
+	return listener
+}
 
-	// Setup connection tracking
-	config.ConnTracker = conntrack.NewTracker(config.IdleThreshold, config.StatsdClient, config.Log, config.ShuttingDown)
+// serveTenants starts a server for each configured tenant and returns them so
+// they can be shut down along with the main server. Tenants share the
+// connection tracker of the parent configuration.
+func serveTenants(config *Config) []*http.Server {
+	var servers []*http.Server
+	for i, t := range config.Tenants {
+		tc := config.tenantConfig(t)
 
-	server := http.Server{
-		Handler: handler,
-	}
+		listener, err := findTenantListener(t, i)
+		if err != nil {
+			config.Log.Fatalf("can't find listener for tenant %s: %v", t.Name, err)
+		}
 
-	config.ShuttingDown.Store(false)
-	runServer(config, &server, listener, quit)
-	return
+		server := &http.Server{
+			Handler:        buildHandler(tc),
+			MaxHeaderBytes: tc.MaxHeaderBytes,
+		}
+		servers = append(servers, server)
+
+		tc.Log.WithField("tenant", t.Name).Print("starting tenant")
+		go func(ln net.Listener) {
+			if err := server.Serve(ln); err != http.ErrServerClosed {
+				tc.Log.Errorf("http serve error for tenant %s: %v", t.Name, err)
+			}
+		}(wrapListener(tc, listener))
+	}
+	return servers
 }
 
-func runServer(config *Config, server *http.Server, listener net.Listener, quit <-chan interface{}) {
+func runServer(config *Config, server *http.Server, listener net.Listener, tenants []*http.Server, quit <-chan interface{}) {
 	// Runs the server and shuts it down when it receives a signal.
 	//
 	// Why aren't we using goji's graceful shutdown library? Great question!
@@ -501,6 +1102,22 @@ func runServer(config *Config, server *http.Server, listener net.Listener, quit
 		config.StatsServer = StartStatsServer(config)
 	}
 
+	if config.AdminAddr != "" {
+		adminServer, err := StartAdminServer(config)
+		if err != nil {
+			config.Log.Fatal("can't start admin API: ", err)
+		}
+		config.AdminServer = adminServer
+	}
+
+	if config.ExtAuthzAddr != "" {
+		extAuthzServer, err := StartExtAuthzServer(config)
+		if err != nil {
+			config.Log.Fatal("can't start ext_authz server: ", err)
+		}
+		config.ExtAuthzServer = extAuthzServer
+	}
+
 	graceful := true
 	kill := make(chan os.Signal, 1)
 	signal.Notify(kill, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGHUP)
@@ -513,7 +1130,10 @@ func runServer(config *Config, server *http.Server, listener net.Listener, quit
 			config.Log.Print("quitting now")
 			graceful = false
 		}
-		config.ShuttingDown.Store(true)
+		config.markShuttingDown()
+		if config.health != nil {
+			config.health.setDraining()
+		}
 
 		// Shutdown() will block until all connections are closed unless we
 		// provide it with a cancellation context.
@@ -525,15 +1145,29 @@ func runServer(config *Config, server *http.Server, listener net.Listener, quit
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 
+		runShutdownHooks(config, ctx)
+
+		for _, tenant := range tenants {
+			if err := tenant.Shutdown(ctx); err != nil {
+				config.Log.Errorf("error shutting down tenant http server: %v", err)
+			}
+		}
+
 		err := server.Shutdown(ctx)
 		if err != nil {
 			config.Log.Errorf("error shutting down http server: %v", err)
 		}
 	}()
 
+	if config.health != nil {
+		config.health.setListening(true)
+	}
 	if err := server.Serve(listener); err != http.ErrServerClosed {
 		config.Log.Errorf("http serve error: %v", err)
 	}
+	if config.health != nil {
+		config.health.setListening(false)
+	}
 
 	if graceful {
 		// Wait for all connections to close or become idle before
@@ -585,18 +1219,56 @@ func runServer(config *Config, server *http.Server, listener net.Listener, quit
 	if config.StatsServer != nil {
 		config.StatsServer.Shutdown()
 	}
+	if config.AdminServer != nil {
+		config.AdminServer.Shutdown()
+	}
+	if config.ExtAuthzServer != nil {
+		config.ExtAuthzServer.Shutdown()
+	}
+	if config.AuditReplicator != nil {
+		config.AuditReplicator.Close()
+	}
+	if config.DenyNotifier != nil {
+		config.DenyNotifier.Close()
+	}
+}
+
+// stripRoleHeaders removes the headers clients send their role or
+// credentials for the proxy in, such as service account tokens or JWTs,
+// which are meant for us, not the destination.
+func stripRoleHeaders(config *Config, h http.Header) {
+	h.Del(roleHeader)
+	h.Del("Proxy-Authorization")
+	for _, name := range config.RoleHeaders {
+		h.Del(name)
+	}
+	if config.RoleConfig != nil {
+		for _, name := range config.RoleConfig.headers() {
+			h.Del(name)
+		}
+	}
 }
 
 // Extract the client's ACL role from the HTTP request, using the configured
-// RoleFromRequest function.  Returns the role, or an error if the role cannot
-// be determined (including no RoleFromRequest configured), unless
+// RoleChain or RoleFromRequest function.  Returns the role and, with a
+// RoleChain, the name of the source that determined it, or an error if the
+// role cannot be determined (including no RoleFromRequest configured), unless
 // AllowMissingRole is configured, in which case an empty role and no error is
 // returned.
-func getRole(config *Config, req *http.Request) (string, error) {
-	var role string
+func getRole(config *Config, req *http.Request) (string, string, error) {
+	var role, source string
 	var err error
 
-	if config.RoleFromRequest != nil {
+	if req != nil {
+		if known, ok := req.Context().Value(redirectRoleKey{}).(string); ok {
+			return known, "", nil
+		}
+	}
+	if config.RoleConfig != nil {
+		role, source, err = config.RoleConfig.resolve(req)
+	} else if config.RoleChain != nil {
+		role, source, err = config.RoleChain.resolve(req)
+	} else if config.RoleFromRequest != nil {
 		role, err = config.RoleFromRequest(req)
 	} else {
 		err = MissingRoleError("RoleFromRequest is not configured")
@@ -604,24 +1276,45 @@ func getRole(config *Config, req *http.Request) (string, error) {
 
 	switch {
 	case err == nil:
-		return role, nil
+		return role, source, nil
 	case IsMissingRoleError(err) && config.AllowMissingRole:
-		return "", nil
+		return "", "", nil
 	default:
-		config.Log.WithFields(logrus.Fields{
+		fields := logrus.Fields{
 			"error":              err,
 			"is_missing_role":    IsMissingRoleError(err),
 			"allow_missing_role": config.AllowMissingRole,
-		}).Error("Unable to get role for request")
-		return "", err
+		}
+		if source != "" {
+			fields["role_source"] = source
+		}
+		config.Log.WithFields(fields).Error("Unable to get role for request")
+		return "", "", err
 	}
 }
 
 func checkIfRequestShouldBeProxied(config *Config, req *http.Request, outboundHost string) (*aclDecision, error) {
+	start := time.Now()
 	decision := checkACLsForRequest(config, req, outboundHost)
+	defer func() {
+		recordDecision(config, decision, time.Since(start), req.Header.Get(traceHeader))
+	}()
+
+	if !config.AllowCloudMetadataAccess && isCloudMetadataRequest(req) {
+		config.MetricsClient.Incr("acl.deny.cloud_metadata_request", []string{}, 1)
+		decision.allow = false
+		decision.enforceWouldDeny = true
+		decision.reason = "request carries cloud metadata service headers"
+		return decision, nil
+	}
 
 	if decision.allow {
-		resolved, reason, err := safeResolve(config, "tcp", outboundHost)
+		_, span := startSpan(config, req.Context(), "smokescreen.resolve")
+		resolved, reason, err := safeResolve(config, "tcp", outboundHost, decision.addressFamily, decision.resolverAddress)
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
 		if err != nil {
 			if _, ok := err.(denyError); !ok {
 				return decision, err
@@ -631,43 +1324,147 @@ func checkIfRequestShouldBeProxied(config *Config, req *http.Request, outboundHo
 			decision.enforceWouldDeny = true
 		} else {
 			decision.resolvedAddr = resolved
+			if route := config.zoneRouteFor(outboundHost, resolved.IP); route != nil {
+				applyZoneRoute(config, decision, route)
+			} else if decision.upstreamProxy != nil && config.bypassesUpstreamProxy(outboundHost, resolved.IP) {
+				config.MetricsClient.Incr("upstream_proxy.bypassed", []string{fmt.Sprintf("role:%s", decision.role)}, 1)
+				decision.upstreamProxy = nil
+				decision.upstreamProxyBypassed = true
+			}
 		}
 	}
 
+	if decision.allow && config.PolicyEngine != nil {
+		checkPolicyEngine(config, req, decision)
+	}
+
 	return decision, nil
 }
 
+// checkPlainHTTPAllowed denies plain HTTP proxy requests from roles that may
+// only use CONNECT.
+func checkPlainHTTPAllowed(config *Config, decision *aclDecision) error {
+	if !decision.connectOnly {
+		return nil
+	}
+
+	decision.allow = false
+	decision.enforceWouldDeny = true
+	decision.reason = "role may only use CONNECT, not plain HTTP proxying"
+	config.MetricsClient.Incr("acl.plain_http_deny", []string{fmt.Sprintf("role:%s", decision.role)}, 1)
+	return denyError{error: errors.New(decision.reason), rule: decision.ruleID}
+}
+
+// checkConnectPort denies CONNECT requests to ports that neither the role's
+// ACL rule nor the proxy allow, so that tunnels to allowed hosts can't be
+// used for other protocols, such as SMTP or SSH.
+func checkConnectPort(config *Config, decision *aclDecision) error {
+	ports := config.AllowedConnectPorts
+	if decision.connectPorts != nil {
+		ports = decision.connectPorts
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+
+	_, port, err := hostport.Split(decision.outboundHost)
+	if err == nil {
+		for _, p := range ports {
+			if p == port {
+				return nil
+			}
+		}
+	}
+
+	decision.allow = false
+	decision.enforceWouldDeny = true
+	decision.reason = fmt.Sprintf("CONNECT to port %d is not allowed", port)
+	config.MetricsClient.Incr("acl.connect_port_deny", []string{fmt.Sprintf("role:%s", decision.role), fmt.Sprintf("port:%d", port)}, 1)
+	return denyError{error: errors.New(decision.reason), rule: decision.ruleID}
+}
+
+func recordDecision(config *Config, decision *aclDecision, elapsed time.Duration, traceID string) {
+	config.MetricsClient.Timing("acl.decision_time", elapsed, []string{}, 1)
+
+	if config.OpenMetrics != nil {
+		config.OpenMetrics.ObserveDecision(elapsed, traceID)
+		if !decision.allow {
+			config.OpenMetrics.IncDeny(traceID)
+		}
+	}
+}
+
 func checkACLsForRequest(config *Config, req *http.Request, outboundHost string) *aclDecision {
 	decision := &aclDecision{
-		outboundHost: outboundHost,
+		outboundHost:  outboundHost,
+		clientAddr:    req.RemoteAddr,
+		upstreamProxy: config.UpstreamProxy,
 	}
 
-	if config.EgressACL == nil {
+	if config.EgressACL == nil && config.PolicyEngine == nil {
 		decision.allow = true
 		decision.reason = "Egress ACL is not configured"
 		return decision
 	}
 
-	role, roleErr := getRole(config, req)
+	_, roleSpan := startSpan(config, req.Context(), "smokescreen.role")
+	role, roleSource, roleErr := getRole(config, req)
 	if roleErr != nil {
-		config.StatsdClient.Incr("acl.role_not_determined", []string{}, 1)
+		roleSpan.RecordError(roleErr)
+	}
+	roleSpan.End()
+	if roleErr != nil {
+		config.MetricsClient.Incr("acl.role_not_determined", []string{}, 1)
 		decision.reason = "Client role cannot be determined"
+		if rhe, ok := roleErr.(RoleHeaderError); ok {
+			config.MetricsClient.Incr("acl.role_header_rejected", []string{"reason:" + rhe.Reason}, 1)
+			decision.reason = fmt.Sprintf("%s: %s", decision.reason, rhe.Error())
+		}
 		return decision
 	}
 
+	if config.RoleAliases != nil {
+		if canonical, ok := config.RoleAliases.Resolve(role); ok {
+			config.MetricsClient.Incr("role_aliases.resolved", []string{
+				fmt.Sprintf("role:%s", canonical),
+				fmt.Sprintf("identity:%s", role),
+			}, 1)
+			decision.roleIdentity = role
+			role = canonical
+		}
+	}
 	decision.role = role
+	decision.roleSource = roleSource
 
-	submatch := hostExtractRE.FindStringSubmatch(outboundHost)
-	destination := submatch[1]
+	destination, _, err := hostport.Split(outboundHost)
+	if err != nil {
+		config.MetricsClient.Incr("acl.invalid_destination", []string{}, 1)
+		decision.reason = fmt.Sprintf("invalid destination: %v", err)
+		return decision
+	}
 
+	if config.EgressACL == nil {
+		// The policy engine decides alone.
+		decision.allow = true
+		decision.reason = "Egress ACL is not configured"
+		return decision
+	}
+
+	_, aclSpan := startSpan(config, req.Context(), "smokescreen.acl")
+	aclSpan.SetAttribute("smokescreen.role", role)
 	aclDecision, err := config.EgressACL.Decide(role, destination)
+	if err != nil {
+		aclSpan.RecordError(err)
+	}
+	aclSpan.SetAttribute("smokescreen.acl.result", aclDecision.Result.String())
+	aclSpan.End()
 	if err != nil {
 		config.Log.WithFields(logrus.Fields{
 			"error": err,
 			"role":  role,
 		}).Warn("EgressAcl.Decide returned an error.")
 
-		config.StatsdClient.Incr("acl.decide_error", []string{}, 1)
+		config.MetricsClient.Incr("acl.decide_error", []string{}, 1)
 		decision.reason = aclDecision.Reason
 		return decision
 	}
@@ -676,24 +1473,87 @@ func checkACLsForRequest(config *Config, req *http.Request, outboundHost string)
 		fmt.Sprintf("role:%s", decision.role),
 		fmt.Sprintf("def_rule:%t", aclDecision.Default),
 		fmt.Sprintf("project:%s", aclDecision.Project),
+		fmt.Sprintf("rule:%s", aclDecision.RuleID),
+	}
+	if config.StatsdDestinationTags {
+		tags = append(tags, fmt.Sprintf("destination:%s", destination))
+	}
+
+	if aclDecision.ExpiredRuleID != "" {
+		config.Log.WithFields(logrus.Fields{
+			"role":        role,
+			"destination": destination,
+			"rule_id":     aclDecision.ExpiredRuleID,
+		}).Warn("Request matched an expired ACL rule")
+		config.MetricsClient.Incr("acl.expired_rule", []string{
+			fmt.Sprintf("role:%s", role),
+			fmt.Sprintf("rule:%s", aclDecision.ExpiredRuleID),
+		}, 1)
+	}
+
+	if e := aclDecision.ExpiredException; e != nil {
+		config.Log.WithFields(logrus.Fields{
+			"role":        role,
+			"destination": destination,
+			"ticket":      e.Ticket,
+			"approver":    e.Approver,
+			"expires":     e.Expires.Format(time.RFC3339),
+		}).Warn("Request matched an expired ACL exception")
+		config.MetricsClient.Incr("acl.expired_exception", []string{
+			fmt.Sprintf("role:%s", role),
+			fmt.Sprintf("ticket:%s", e.Ticket),
+		}, 1)
+	}
+	if e := aclDecision.Exception; e != nil {
+		config.MetricsClient.Incr("acl.exception", []string{
+			fmt.Sprintf("role:%s", role),
+			fmt.Sprintf("ticket:%s", e.Ticket),
+		}, 1)
+	}
+
+	if aclDecision.FallbackRole != "" {
+		config.Log.WithFields(logrus.Fields{
+			"role":          role,
+			"destination":   destination,
+			"fallback_role": aclDecision.FallbackRole,
+		}).Warn("Role has no ACL rule, using the fallback role's rule")
+		config.MetricsClient.Incr("acl.fallback_role", []string{
+			fmt.Sprintf("role:%s", role),
+			fmt.Sprintf("fallback_role:%s", aclDecision.FallbackRole),
+		}, 1)
 	}
 
 	decision.reason = aclDecision.Reason
+	decision.ruleID = aclDecision.RuleID
+	decision.fallbackRole = aclDecision.FallbackRole
+	decision.exception = aclDecision.Exception
+	if aclDecision.UpstreamProxy != nil {
+		decision.upstreamProxy = aclDecision.UpstreamProxy
+	}
+	decision.mitm = aclDecision.Mitm
+	decision.inspectPlaintext = aclDecision.InspectPlaintext
+	decision.connectOnly = aclDecision.ConnectOnly
+	decision.connectPorts = aclDecision.ConnectPorts
+	decision.followRedirects = aclDecision.FollowRedirects
+	decision.alpnProtocols = aclDecision.ALPNProtocols
+	decision.addressFamily = aclDecision.AddressFamily
+	decision.resolverAddress = aclDecision.ResolverAddress
+	decision.denyLogInterval = aclDecision.DenyLogInterval
 	switch aclDecision.Result {
 	case acl.Deny:
 		decision.enforceWouldDeny = true
-		config.StatsdClient.Incr("acl.deny", tags, 1)
+		config.MetricsClient.Incr("acl.deny", tags, 1)
 
 	case acl.AllowAndReport:
 		decision.enforceWouldDeny = true
-		config.StatsdClient.Incr("acl.report", tags, 1)
+		config.MetricsClient.Incr("acl.report", tags, 1)
 		decision.allow = true
 
 	case acl.Allow:
 		// Well, everything is going as expected.
 		decision.allow = true
 		decision.enforceWouldDeny = false
-		config.StatsdClient.Incr("acl.allow", tags, 1)
+		config.MetricsClient.Incr("acl.allow", tags, 1)
 	default:
 		config.Log.WithFields(logrus.Fields{
 			"role":        role,
@@ -701,7 +1561,17 @@ func checkACLsForRequest(config *Config, req *http.Request, outboundHost string)
 			"action":      aclDecision.Result.String(),
 		}).Warn("Unknown ACL action")
 		decision.reason = "Internal error"
-		config.StatsdClient.Incr("acl.unknown_error", tags, 1)
+		config.MetricsClient.Incr("acl.unknown_error", tags, 1)
+	}
+
+	if decision.allow && aclDecision.RateLimit != nil && config.rateLimiter != nil {
+		if ok, retryAfter := config.rateLimiter.Allow(role, *aclDecision.RateLimit); !ok {
+			decision.allow = false
+			decision.rateLimited = true
+			decision.retryAfter = retryAfter
+			decision.reason = fmt.Sprintf("role exceeded its rate limit of %s", aclDecision.RateLimit)
+			config.MetricsClient.Incr("acl.rate_limited", tags, 1)
+		}
 	}
 
 	return decision
@@ -17,6 +17,7 @@ import (
 	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
 	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
 )
 
@@ -77,11 +78,28 @@ func TestClassifyAddr(t *testing.T) {
 		testCase{"127.0.1.1", 1, ipAllowUserConfigured},
 
 		// ec2 metadata endpoint
-		testCase{"169.254.169.254", 1, ipDenyNotGlobalUnicast},
+		testCase{"169.254.169.254", 1, ipDenyCloudMetadata},
+		testCase{"169.254.169.253", 1, ipDenyNotGlobalUnicast},
 
 		// Broadcast addresses
 		testCase{"255.255.255.255", 1, ipDenyNotGlobalUnicast},
 		testCase{"ff02:0:0:0:0:0:0:2", 1, ipDenyNotGlobalUnicast},
+
+		// IPv6 addresses embedding an IPv4 address
+		testCase{"::ffff:10.0.0.1", 1, ipDenyPrivateRange},
+		testCase{"::ffff:10.0.1.1", 1, ipAllowUserConfigured},
+		testCase{"::ffff:127.0.0.1", 1, ipDenyNotGlobalUnicast},
+		testCase{"::ffff:169.254.169.254", 1, ipDenyCloudMetadata},
+		testCase{"::ffff:1.1.1.1", 1, ipDenyUserConfigured},
+		testCase{"::ffff:8.8.8.8", 1, ipAllowDefault},
+		testCase{"2002:a00:1::1", 1, ipDenyPrivateRange},
+		testCase{"2002:a9fe:a9fe::1", 1, ipDenyCloudMetadata},
+		testCase{"2002:808:808::1", 1, ipAllowDefault},
+		testCase{"2001:0:4136:e378:8000:63bf:f5ff:fffe", 1, ipDenyPrivateRange},
+		testCase{"2001:0:4136:e378:8000:63bf:80ff:fffe", 1, ipDenyNotGlobalUnicast},
+		testCase{"64:ff9b::c0a8:1", 1, ipDenyPrivateRange},
+		testCase{"64:ff9b::808:808", 1, ipAllowDefault},
+		testCase{"2001:4860:4860::8888", 1, ipAllowDefault},
 	}
 
 	for _, test := range testIPs {
@@ -102,6 +120,30 @@ func TestClassifyAddr(t *testing.T) {
 	}
 }
 
+func TestClassifyAddrIPv6DenyRanges(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	a.NoError(conf.SetDenyRanges([]string{"64:ff9b::/96", "2002::/16", "2001::/32"}))
+	a.NoError(conf.SetAllowRanges([]string{"2002:808:808::/48"}))
+
+	for ip, expected := range map[string]ipType{
+		// Deny ranges for the IPv6 encodings apply, whatever the IPv4
+		// address they embed.
+		"64:ff9b::808:808":                     ipDenyUserConfigured,
+		"2002:808:404::1":                      ipDenyUserConfigured,
+		"2001:0:4136:e378:8000:63bf:f7f7:f7f7": ipDenyUserConfigured,
+		"2001:4860:4860::8888":                 ipAllowDefault,
+		// An allow range for the IPv6 address keeps its deny ranges from
+		// applying, leaving the IPv4 address to decide.
+		"2002:808:808::1": ipAllowDefault,
+		"8.8.8.8":         ipAllowDefault,
+	} {
+		got := classifyAddr(conf, &net.TCPAddr{IP: net.ParseIP(ip), Port: 443})
+		a.Equal(expected, got, ip)
+	}
+}
+
 func TestClearsErrorHeader(t *testing.T) {
 	r := require.New(t)
 
@@ -336,6 +378,62 @@ func TestInvalidHost(t *testing.T) {
 	}
 }
 
+func TestConnectOnlyRoles(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+	plain := httptest.NewServer(ts.Config.Handler)
+	defer plain.Close()
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"modern": {Policy: acl.Open, ConnectOnly: true},
+			"legacy": {Policy: acl.Open},
+		},
+	}
+
+	proxySrv := httptest.NewServer(BuildProxy(conf))
+	defer proxySrv.Close()
+	proxyURL, err := url.Parse(proxySrv.URL)
+	r.NoError(err)
+
+	do := func(role, target string) *http.Response {
+		client := &http.Client{
+			Transport: &http.Transport{
+				Proxy:              http.ProxyURL(proxyURL),
+				ProxyConnectHeader: http.Header{"X-Smokescreen-Role": []string{role}},
+				TLSClientConfig:    ts.Client().Transport.(*http.Transport).TLSClientConfig,
+			},
+		}
+		req, err := http.NewRequest("GET", target, nil)
+		r.NoError(err)
+		req.Header.Set("X-Smokescreen-Role", role)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	a.Equal(http.StatusOK, do("legacy", plain.URL).StatusCode)
+	a.Equal(http.StatusOK, do("legacy", ts.URL).StatusCode)
+	a.Equal(http.StatusOK, do("modern", ts.URL).StatusCode)
+
+	resp := do("modern", plain.URL)
+	a.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+	a.Equal("modern", resp.Header.Get(ruleHeader))
+}
+
 func findCanonicalProxyDecision(logs []*logrus.Entry) *logrus.Entry {
 	for _, entry := range logs {
 		if entry.Message == LOGLINE_CANONICAL_PROXY_DECISION {
@@ -378,3 +476,25 @@ func proxyClient(proxy string) (*http.Client, error) {
 		},
 	}, nil
 }
+
+func TestConnectTimeout(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	conf.ConnectTimeout = 10 * time.Second
+	for _, proxied := range []bool{false, true} {
+		a.Equal(10*time.Second, connectTimeout(conf, true, proxied))
+		a.Equal(10*time.Second, connectTimeout(conf, false, proxied))
+	}
+
+	conf.TunnelConnectTimeout = 2 * time.Second
+	conf.HTTPConnectTimeout = 30 * time.Second
+	a.Equal(2*time.Second, connectTimeout(conf, true, false))
+	a.Equal(30*time.Second, connectTimeout(conf, false, false))
+	a.Equal(2*time.Second, connectTimeout(conf, true, true))
+
+	conf.UpstreamConnectTimeout = 5 * time.Second
+	a.Equal(5*time.Second, connectTimeout(conf, true, true))
+	a.Equal(5*time.Second, connectTimeout(conf, false, true))
+	a.Equal(30*time.Second, connectTimeout(conf, false, false))
+}
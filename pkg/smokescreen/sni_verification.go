@@ -0,0 +1,191 @@
+package smokescreen
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// SNI verification
+//
+// The ACL authorizes the host a CONNECT request names, but nothing makes the
+// client speak to that host once the tunnel is up: a client allowed to reach
+// one site behind a shared frontend can ask for another in its TLS
+// ClientHello, and be routed there. With VerifySNI, smokescreen holds back
+// what the client sends through a tunnel until it has read a whole
+// ClientHello, and closes the tunnel instead of forwarding it unless its
+// server name is the authorized host. Tunnels to IP addresses are only
+// required to carry TLS, since server names can't be addresses. Tunnels
+// whose requests are inspected, as plain HTTP or by MITM, aren't verified.
+//
+// The same ClientHello is checked against the role's ALPN restrictions, if
+// its ACL rule has any, with or without VerifySNI; see alpn.go.
+
+// errSNIRead stops the handshake of an sniVerifier once the ClientHello has
+// been read.
+var errSNIRead = errors.New("ClientHello read")
+
+// errSNIVerified is returned by the pipe of an sniVerifier to writes the
+// handshake didn't read, which are forwarded directly.
+var errSNIVerified = errors.New("server name verified")
+
+// sniVerifier sits between goproxy and the destination of a verified tunnel.
+// What goproxy writes, the client's side of the tunnel, goes through verify
+// until the server name has been checked, and straight to the destination
+// afterwards.
+type sniVerifier struct {
+	net.Conn
+	config *Config
+	tunnel *ctxUserData
+	pw     *io.PipeWriter
+
+	mu       sync.Mutex
+	verified bool
+}
+
+func newSNIVerifier(config *Config, conn net.Conn, tunnel *ctxUserData) *sniVerifier {
+	pr, pw := io.Pipe()
+	sv := &sniVerifier{
+		Conn:   conn,
+		config: config,
+		tunnel: tunnel,
+		pw:     pw,
+	}
+	go sv.verify(pr)
+	return sv
+}
+
+func (sv *sniVerifier) Write(b []byte) (int, error) {
+	sv.mu.Lock()
+	verified := sv.verified
+	sv.mu.Unlock()
+	if verified {
+		return sv.Conn.Write(b)
+	}
+
+	n, err := sv.pw.Write(b)
+	if err == errSNIVerified {
+		m, err := sv.Conn.Write(b[n:])
+		return n + m, err
+	}
+	return n, err
+}
+
+func (sv *sniVerifier) Close() error {
+	sv.pw.Close()
+	return sv.Conn.Close()
+}
+
+// verify reads the ClientHello from pr, and forwards it and everything
+// after it if its server name is the tunnel's destination and it offers only
+// protocols the role may use.
+func (sv *sniVerifier) verify(pr *io.PipeReader) {
+	var hello bytes.Buffer
+	info, err := readClientHello(io.TeeReader(pr, &hello))
+	if err == nil {
+		if sv.config.VerifySNI {
+			err = sv.check(info.ServerName)
+		}
+		if err == nil {
+			err = checkTunnelALPN(sv.config, sv.tunnel, info.SupportedProtos)
+		}
+	} else {
+		sv.config.Log.WithFields(logrus.Fields{
+			"role":           sv.tunnel.decision.role,
+			"requested_host": sv.tunnel.decision.outboundHost,
+			"error":          err,
+			"trace_id":       sv.tunnel.traceId,
+		}).Warn("closing CONNECT tunnel that doesn't start with a TLS ClientHello")
+	}
+	if sv.config.VerifySNI {
+		sv.config.MetricsClient.Incr("connect.sni_verification", []string{
+			fmt.Sprintf("role:%s", sv.tunnel.decision.role),
+			fmt.Sprintf("allow:%t", err == nil),
+		}, 1)
+	}
+	if err != nil {
+		pr.CloseWithError(err)
+		// Unblocks goproxy's copy from the destination.
+		sv.Conn.Close()
+		return
+	}
+
+	if _, err := sv.Conn.Write(hello.Bytes()); err != nil {
+		pr.CloseWithError(err)
+		return
+	}
+	sv.mu.Lock()
+	sv.verified = true
+	sv.mu.Unlock()
+	pr.CloseWithError(errSNIVerified)
+}
+
+// check compares serverName, sent by the client, with the host the ACL
+// authorized.
+func (sv *sniVerifier) check(serverName string) error {
+	decision := sv.tunnel.decision
+	host, _, err := hostport.Split(decision.outboundHost)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if normalized, err := hostport.Normalize(serverName); err == nil && normalized == host {
+		return nil
+	}
+
+	reason := fmt.Sprintf("TLS server name %q doesn't match CONNECT destination %q", serverName, host)
+	if serverName == "" {
+		reason = fmt.Sprintf("TLS ClientHello has no server name for CONNECT destination %q", host)
+	}
+	sv.config.Log.WithFields(logrus.Fields{
+		"role":            decision.role,
+		"requested_host":  decision.outboundHost,
+		"server_name":     serverName,
+		"decision_reason": reason,
+		"trace_id":        sv.tunnel.traceId,
+	}).Warn("denied CONNECT tunnel to a different TLS server name")
+	return denyError{error: errors.New(reason), rule: decision.ruleID}
+}
+
+// readClientHello reads a TLS ClientHello from r and returns what it asks
+// for, such as its server name, which is empty if it has none, and the ALPN
+// protocols it offers. crypto/tls does the parsing, and stops once it has
+// the ClientHello.
+func readClientHello(r io.Reader) (*tls.ClientHelloInfo, error) {
+	var info *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			info = hello
+			return nil, errSNIRead
+		},
+	}).Handshake()
+	if info == nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// readOnlyConn is a net.Conn reading from r, which discards what is written
+// to it, such as the alert crypto/tls sends when readServerName stops it.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,118 @@
+package smokescreen
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestVerifySNI(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var hellos int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	upstream.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			atomic.AddInt32(&hellos, 1)
+			return nil, nil
+		},
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	_, upstreamPort, err := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "https://"))
+	r.NoError(err)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("api.test", "127.0.0.1")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.Resolver = dns.Resolver()
+	conf.ConnectTimeout = 5 * time.Second
+	conf.IgnoreProxyEnvironment = true
+	conf.VerifySNI = true
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return "web", nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"web": {Policy: acl.Enforce, DomainGlobs: []string{"api.test"}},
+		},
+	}
+
+	proxy := httptest.NewServer(buildHandler(conf))
+	defer proxy.Close()
+
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		r.NoError(err)
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprintf(conn, "CONNECT api.test:%s HTTP/1.1\r\nHost: api.test:%s\r\n\r\n", upstreamPort, upstreamPort)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		return conn
+	}
+
+	// The server name the tunnel was allowed for goes through, along with
+	// the rest of the connection.
+	conn := tls.Client(connect(), &tls.Config{ServerName: "API.test", InsecureSkipVerify: true})
+	defer conn.Close()
+	r.NoError(conn.Handshake())
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: api.test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	r.NoError(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	a.Equal("OK", string(body))
+
+	// Other server names, and traffic that isn't TLS, end the tunnel before
+	// the destination sees anything.
+	fronted := tls.Client(connect(), &tls.Config{ServerName: "forbidden.test", InsecureSkipVerify: true})
+	defer fronted.Close()
+	a.Error(fronted.Handshake())
+
+	plain := connect()
+	defer plain.Close()
+	fmt.Fprintf(plain, "GET / HTTP/1.1\r\nHost: api.test\r\n\r\n")
+	_, err = ioutil.ReadAll(plain)
+	a.NoError(err)
+
+	a.Equal(int32(1), atomic.LoadInt32(&hellos))
+}
+
+func TestReadClientHello(t *testing.T) {
+	a := assert.New(t)
+
+	for _, serverName := range []string{"example.com", ""} {
+		client, server := net.Pipe()
+		go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, NextProtos: []string{"h2"}}).Handshake()
+		got, err := readClientHello(server)
+		a.NoError(err)
+		a.Equal(serverName, got.ServerName)
+		a.Equal([]string{"h2"}, got.SupportedProtos)
+		client.Close()
+	}
+
+	_, err := readClientHello(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	a.Error(err)
+}
@@ -23,6 +23,9 @@ func newServer(config *Config) (s *StatsServer) {
 	}
 
 	s.mux.HandleFunc("/", s.stats)
+	if config.OpenMetrics != nil {
+		s.mux.Handle("/metrics", config.OpenMetrics)
+	}
 	return
 }
 
@@ -0,0 +1,54 @@
+package smokescreen
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestStatsdNamespaceAndTags(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	r.NoError(err)
+	defer conn.Close()
+
+	conf := NewConfig()
+	r.Error(conf.SetupStatsdTags([]string{"datacenter:us|east"}))
+	r.NoError(conf.SetupStatsdTags([]string{"datacenter:us-east-1", "cluster:blue"}))
+	r.NoError(conf.SetupStatsdWithNamespace(conn.LocalAddr().String(), "egress"))
+	conf.StatsdDestinationTags = true
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"billing": {Project: "payments", Policy: acl.Enforce, DomainGlobs: []string{"api.example.com"}},
+		},
+	}
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return "billing", nil
+	}
+
+	req := httptest.NewRequest(http.MethodConnect, "http://api.example.com:443", nil)
+	decision := checkACLsForRequest(conf, req, "api.example.com:443")
+	r.True(decision.allow)
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		r.NoError(err)
+		metric := string(buf[:n])
+		if !strings.HasPrefix(metric, "egress.acl.allow:") {
+			continue
+		}
+		a.Equal("egress.acl.allow:1|c|#datacenter:us-east-1,cluster:blue,role:billing,def_rule:false,project:payments,rule:billing,destination:api.example.com", metric)
+		break
+	}
+}
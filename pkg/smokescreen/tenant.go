@@ -0,0 +1,72 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stripe/go-einhorn/einhorn"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/metrics"
+)
+
+// Tenant is an additional enforcement domain served by the same process.
+// Each tenant has its own listener, and may have its own egress ACL, metrics
+// namespace and logger, while connection tracking and every other setting is
+// shared with the parent Config.
+type Tenant struct {
+	Name          string
+	Ip            string
+	Port          uint16
+	EgressACL     acl.Decider           // The parent's egress ACL applies if unset
+	MetricsClient metrics.MetricsClient // The parent's metrics client is used if unset
+	Log           *log.Logger           // The parent's logger is used if unset
+	Listener      net.Listener          // Pre-opened listener to serve on instead of binding Ip and Port
+}
+
+// tenantConfig returns a copy of the parent configuration with the
+// tenant-specific settings applied. Unset tenant fields inherit the parent's
+// values.
+func (config *Config) tenantConfig(t *Tenant) *Config {
+	tc := *config
+	tc.Tenants = nil
+	tc.tenantConfigs = nil
+	tc.tenant = t.Name
+	tc.Ip = t.Ip
+	tc.Port = t.Port
+	tc.Listener = t.Listener
+	tc.rateLimiter = newRoleRateLimiter()
+
+	if t.EgressACL != nil {
+		tc.EgressACL = t.EgressACL
+	}
+	if t.MetricsClient != nil {
+		tc.MetricsClient = t.MetricsClient
+	}
+	if t.Log != nil {
+		tc.Log = t.Log
+	}
+	config.tenantConfigs = append(config.tenantConfigs, &tc)
+	return &tc
+}
+
+// markShuttingDown records that the proxy and its tenants are shutting down.
+func (config *Config) markShuttingDown() {
+	config.ShuttingDown.Store(true)
+	for _, tc := range config.tenantConfigs {
+		tc.ShuttingDown.Store(true)
+	}
+}
+
+// findTenantListener returns the listener for the tenant at index i. Under
+// Einhorn, tenants are bound to the file descriptors following the main
+// listener's.
+func findTenantListener(t *Tenant, i int) (net.Listener, error) {
+	if t.Listener != nil {
+		return t.Listener, nil
+	}
+	if einhorn.IsWorker() {
+		return einhorn.GetListener(i + 1)
+	}
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", t.Ip, t.Port))
+}
@@ -0,0 +1,49 @@
+package smokescreen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTenants(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf, err := LoadConfig("testdata/tenants.yaml")
+	r.NoError(err)
+	r.Len(conf.Tenants, 2)
+
+	payments := conf.Tenants[0]
+	a.Equal("payments", payments.Name)
+	a.Equal(uint16(4751), payments.Port)
+	a.NotNil(payments.EgressACL)
+
+	risk := conf.Tenants[1]
+	a.Equal("127.0.0.1", risk.Ip)
+	a.Nil(risk.EgressACL)
+	// Tenants without an ACL of their own get the parent's.
+	a.Equal(conf.EgressACL, conf.tenantConfig(risk).EgressACL)
+	a.NotEqual(conf.EgressACL, conf.tenantConfig(payments).EgressACL)
+}
+
+func TestTenantConfig(t *testing.T) {
+	a := assert.New(t)
+
+	conf := NewConfig()
+	conf.AdditionalErrorMessageOnDeny = "shared"
+	conf.Tenants = []*Tenant{{Name: "payments", Port: 4751}}
+
+	tc := conf.tenantConfig(conf.Tenants[0])
+	a.Equal("payments", tc.tenant)
+	a.Equal(uint16(4751), tc.Port)
+	a.Equal("shared", tc.AdditionalErrorMessageOnDeny)
+	a.Equal(conf.Log, tc.Log)
+	a.Nil(tc.Tenants)
+
+	// Readiness checks of tenants see the proxy shutting down.
+	a.Nil(tc.ShuttingDown.Load())
+	conf.markShuttingDown()
+	a.Equal(true, tc.ShuttingDown.Load())
+}
@@ -0,0 +1,105 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Causes of client TLS handshake failures, used in metric names and logs.
+const (
+	handshakeUnknownCA        = "unknown_ca"
+	handshakeRevoked          = "revoked"
+	handshakeExpired          = "expired"
+	handshakeBadCert          = "bad_cert"
+	handshakeProtocolMismatch = "protocol_mismatch"
+	handshakeOther            = "other"
+)
+
+// tlsListener is tls.NewListener, except that it reports why client
+// handshakes fail. The handshake is still driven by the HTTP server: the
+// reporting goroutine waits for it and gets the same result.
+type tlsListener struct {
+	net.Listener
+	config *Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Server(c, l.config.TlsConfig)
+	go l.config.reportHandshake(conn)
+	return conn, nil
+}
+
+// reportHandshake waits for conn's handshake and, if it fails, counts it
+// under its cause and logs the client's address and certificate subject.
+// Clients that hang up before the handshake, like TCP health checks, aren't
+// reported.
+func (config *Config) reportHandshake(conn *tls.Conn) {
+	err := conn.Handshake()
+	if err == nil || errors.Is(err, io.EOF) {
+		return
+	}
+
+	cause, cert := classifyHandshakeError(err)
+	config.MetricsClient.Incr("tls.handshake_failure."+cause, []string{}, 1)
+
+	fields := logrus.Fields{
+		"client_addr": conn.RemoteAddr().String(),
+		"cause":       cause,
+		"error":       err,
+	}
+	if cert != nil {
+		fields["cert_subject"] = cert.Subject.String()
+		fields["cert_issuer"] = cert.Issuer.String()
+	}
+	config.Log.WithFields(fields).Warn("client TLS handshake failed")
+}
+
+// classifyHandshakeError returns the cause of a failed handshake and, if the
+// client presented one, its certificate.
+func classifyHandshakeError(err error) (string, *x509.Certificate) {
+	var revoked revokedCertError
+	if errors.As(err, &revoked) {
+		return handshakeRevoked, revoked.cert
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		var cert *x509.Certificate
+		if len(verifyErr.UnverifiedCertificates) > 0 {
+			cert = verifyErr.UnverifiedCertificates[0]
+		}
+
+		var unknownAuthority x509.UnknownAuthorityError
+		var invalid x509.CertificateInvalidError
+		switch {
+		case errors.As(verifyErr.Err, &unknownAuthority):
+			return handshakeUnknownCA, cert
+		case errors.As(verifyErr.Err, &invalid) && invalid.Reason == x509.Expired:
+			return handshakeExpired, cert
+		}
+		return handshakeBadCert, cert
+	}
+
+	// Version and cipher suite negotiation failures are plain errors.
+	msg := err.Error()
+	for _, s := range []string{
+		"unsupported versions",
+		"no cipher suite supported",
+		"inappropriate protocol fallback",
+	} {
+		if strings.Contains(msg, s) {
+			return handshakeProtocolMismatch, nil
+		}
+	}
+	return handshakeOther, nil
+}
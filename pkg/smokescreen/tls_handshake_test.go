@@ -0,0 +1,123 @@
+package smokescreen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientCert issues a client certificate, with its key, valid until notAfter.
+func (p *testPKI) clientCert(t *testing.T, serial int64, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestHandshakeFailureCauses(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	pki := newTestPKI(t)
+	defer os.RemoveAll(pki.dir)
+	otherPki := newTestPKI(t)
+	defer os.RemoveAll(otherPki.dir)
+
+	valid := pki.clientCert(t, 10, time.Now().Add(time.Hour))
+	revoked := pki.clientCert(t, 11, time.Now().Add(time.Hour))
+	expired := pki.clientCert(t, 12, time.Now().Add(-time.Hour))
+	untrusted := otherPki.clientCert(t, 13, time.Now().Add(time.Hour))
+
+	conf := NewConfig()
+	logHook := logrustest.NewLocal(conf.Log)
+	r.NoError(conf.SetupTls(testPkiDir+"server.pem", testPkiDir+"server-key.pem", []string{filepath.Join(pki.dir, "ca.pem")}))
+	r.NoError(conf.SetupCrls([]string{pki.writeCRL(t, revoked.Leaf)}))
+	r.NoError(conf.SetupTlsVersions("1.2", "", nil))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	listener := wrapListener(conf, ln)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	handshake := func(tc *tls.Config) (string, interface{}) {
+		logHook.Reset()
+		tc.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", ln.Addr().String(), tc)
+		if err == nil {
+			// With TLS 1.3, the client certificate is rejected after the
+			// client's side of the handshake is done.
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+
+		var entry map[string]interface{}
+		waitUntil(func() bool {
+			for _, e := range logHook.AllEntries() {
+				if e.Message == "client TLS handshake failed" {
+					entry = e.Data
+					return true
+				}
+			}
+			return false
+		})
+		if entry == nil {
+			return "", nil
+		}
+		a.NotEmpty(entry["client_addr"])
+		return entry["cause"].(string), entry["cert_subject"]
+	}
+
+	cause, _ := handshake(&tls.Config{Certificates: []tls.Certificate{valid}})
+	a.Empty(cause)
+
+	cause, subject := handshake(&tls.Config{Certificates: []tls.Certificate{untrusted}})
+	a.Equal(handshakeUnknownCA, cause)
+	a.Equal("CN=client", subject)
+
+	cause, subject = handshake(&tls.Config{Certificates: []tls.Certificate{expired}})
+	a.Equal(handshakeExpired, cause)
+	a.Equal("CN=client", subject)
+
+	cause, subject = handshake(&tls.Config{Certificates: []tls.Certificate{revoked}})
+	a.Equal(handshakeRevoked, cause)
+	a.Equal("CN=client", subject)
+
+	cause, subject = handshake(&tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11})
+	a.Equal(handshakeProtocolMismatch, cause)
+	a.Nil(subject)
+}
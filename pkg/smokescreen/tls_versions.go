@@ -0,0 +1,83 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// SetupTlsVersions restricts the TLS versions and cipher suites the listener
+// set up by SetupTls negotiates. Versions are given as "1.0" to "1.3"; an
+// empty version leaves Go's default in place. Cipher suites are given by
+// their standard names, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, and
+// only apply to TLS 1.2 and earlier, since TLS 1.3 suites aren't
+// configurable. Suites Go considers insecure are refused.
+func (config *Config) SetupTlsVersions(minVersion, maxVersion string, cipherSuites []string) error {
+	if config.TlsConfig == nil {
+		return errors.New("TLS versions and cipher suites require TLS to be set up")
+	}
+
+	min, err := parseTlsVersion(minVersion)
+	if err != nil {
+		return err
+	}
+	max, err := parseTlsVersion(maxVersion)
+	if err != nil {
+		return err
+	}
+	if min != 0 && max != 0 && min > max {
+		return fmt.Errorf("TLS min version %s is above max version %s", minVersion, maxVersion)
+	}
+
+	var suites []uint16
+	for _, name := range cipherSuites {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return err
+		}
+		suites = append(suites, id)
+	}
+
+	config.TlsConfig.MinVersion = min
+	config.TlsConfig.MaxVersion = max
+	config.TlsConfig.CipherSuites = suites
+	return nil
+}
+
+func parseTlsVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected one of 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+func parseCipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+		for _, v := range cs.SupportedVersions {
+			if v != tls.VersionTLS13 {
+				return cs.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("cipher suite %s is only used by TLS 1.3, whose suites aren't configurable", name)
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %s", name)
+}
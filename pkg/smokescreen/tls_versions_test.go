@@ -0,0 +1,34 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTlsVersions(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	conf := NewConfig()
+	a.EqualError(conf.SetupTlsVersions("1.2", "", nil), "TLS versions and cipher suites require TLS to be set up")
+
+	r.NoError(conf.SetupTls(testPkiDir+"server.pem", testPkiDir+"server-key.pem", nil))
+	r.NoError(conf.SetupTlsVersions("1.2", "1.3", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}))
+	a.EqualValues(tls.VersionTLS12, conf.TlsConfig.MinVersion)
+	a.EqualValues(tls.VersionTLS13, conf.TlsConfig.MaxVersion)
+	a.Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, conf.TlsConfig.CipherSuites)
+
+	// Connections get the restrictions too.
+	tc, err := conf.tlsConfigForClient(nil)
+	r.NoError(err)
+	a.EqualValues(tls.VersionTLS12, tc.MinVersion)
+
+	a.EqualError(conf.SetupTlsVersions("1.4", "", nil), `unknown TLS version "1.4", expected one of 1.0, 1.1, 1.2 or 1.3`)
+	a.EqualError(conf.SetupTlsVersions("1.3", "1.2", nil), "TLS min version 1.3 is above max version 1.2")
+	a.EqualError(conf.SetupTlsVersions("", "", []string{"TLS_AES_128_GCM_SHA256"}), "cipher suite TLS_AES_128_GCM_SHA256 is only used by TLS 1.3, whose suites aren't configurable")
+	a.EqualError(conf.SetupTlsVersions("", "", []string{"TLS_RSA_WITH_RC4_128_SHA"}), "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure")
+	a.EqualError(conf.SetupTlsVersions("", "", []string{"TLS_NOPE"}), "unknown cipher suite TLS_NOPE")
+}
@@ -0,0 +1,136 @@
+package smokescreen
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+)
+
+// Tracer starts the spans smokescreen emits for every proxied request: a
+// "smokescreen.http" or "smokescreen.connect" span for the request, and
+// "smokescreen.role", "smokescreen.acl", "smokescreen.resolve" and
+// "smokescreen.dial" spans for the steps taken while handling it.
+//
+// The interface is deliberately small so that an OpenTelemetry tracer, or any
+// other tracing library, can be adapted to it. The request span's context
+// carries the trace context received from the client, if any; see
+// RemoteSpanContext.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// SpanContext is a W3C Trace Context received from a client.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	TraceFlags byte
+	TraceState string
+}
+
+type remoteSpanContextKey struct{}
+
+// RemoteSpanContext returns the trace context the client sent along with the
+// request being handled, which spans started from ctx should use as their
+// parent.
+func RemoteSpanContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(remoteSpanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// extractSpanContext parses the traceparent and tracestate headers of req.
+func extractSpanContext(req *http.Request) (SpanContext, bool) {
+	var sc SpanContext
+
+	// version "-" trace-id "-" parent-id "-" trace-flags
+	parts := strings.Split(strings.TrimSpace(req.Header.Get(traceparentHeader)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	if !decodeHexInto(sc.TraceID[:], parts[1]) || !decodeHexInto(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+
+	var flags [1]byte
+	if !decodeHexInto(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.TraceFlags = flags[0]
+	sc.TraceState = req.Header.Get(tracestateHeader)
+
+	return sc, true
+}
+
+func decodeHexInto(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// startRequestSpan starts the span covering a whole proxied request, parented
+// to the client's trace context if it sent one.
+func startRequestSpan(config *Config, req *http.Request, name string) (context.Context, Span) {
+	ctx := req.Context()
+	if sc, ok := extractSpanContext(req); ok {
+		ctx = context.WithValue(ctx, remoteSpanContextKey{}, sc)
+	}
+
+	ctx, span := startSpan(config, ctx, name)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("smokescreen.requested_host", req.Host)
+	return ctx, span
+}
+
+func startSpan(config *Config, ctx context.Context, name string) (context.Context, Span) {
+	if config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return config.Tracer.Start(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
+
+// endSpan ends the request's span, annotated with the proxy decision. It may
+// be called more than once, as the response of a rejected HTTP request is
+// logged twice.
+func (ud *ctxUserData) endSpan(decision *aclDecision, err error) {
+	if ud.span == nil {
+		return
+	}
+
+	if decision != nil {
+		ud.span.SetAttribute("smokescreen.role", decision.role)
+		ud.span.SetAttribute("smokescreen.allow", decision.allow)
+		ud.span.SetAttribute("smokescreen.decision_reason", decision.reason)
+	}
+	if err != nil {
+		ud.span.RecordError(err)
+	}
+	ud.span.End()
+	ud.span = nil
+}
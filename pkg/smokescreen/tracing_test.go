@@ -0,0 +1,149 @@
+package smokescreen
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+type recordedSpan struct {
+	name   string
+	remote SpanContext
+	attrs  map[string]interface{}
+	errs   []error
+	ended  int
+}
+
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	s.remote, _ = RemoteSpanContext(ctx)
+	t.Lock()
+	t.spans = append(t.spans, s)
+	t.Unlock()
+	return ctx, &recordingSpan{t, s}
+}
+
+func (t *recordingTracer) find(name string) *recordedSpan {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.spans {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+	s *recordedSpan
+}
+
+func (rs *recordingSpan) SetAttribute(key string, value interface{}) {
+	rs.t.Lock()
+	defer rs.t.Unlock()
+	rs.s.attrs[key] = value
+}
+
+func (rs *recordingSpan) RecordError(err error) {
+	rs.t.Lock()
+	defer rs.t.Unlock()
+	rs.s.errs = append(rs.s.errs, err)
+}
+
+func (rs *recordingSpan) End() {
+	rs.t.Lock()
+	defer rs.t.Unlock()
+	rs.s.ended++
+}
+
+func TestExtractSpanContext(t *testing.T) {
+	a := assert.New(t)
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=opaque")
+
+	sc, ok := extractSpanContext(req)
+	a.True(ok)
+	a.Equal(byte(0x4b), sc.TraceID[0])
+	a.Equal(byte(0xb7), sc.SpanID[7])
+	a.Equal(byte(1), sc.TraceFlags)
+	a.Equal("vendor=opaque", sc.TraceState)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		req.Header.Set("traceparent", bad)
+		_, ok := extractSpanContext(req)
+		a.False(ok, bad)
+	}
+
+	// Later versions may append fields.
+	req.Header.Set("traceparent", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	_, ok = extractSpanContext(req)
+	a.True(ok)
+}
+
+func TestTracingSpans(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	tracer := &recordingTracer{}
+	conf := NewConfig()
+	conf.Tracer = tracer
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+
+	proxySrv := httptest.NewServer(BuildProxy(conf))
+	defer proxySrv.Close()
+
+	client, err := proxyClient(proxySrv.URL)
+	r.NoError(err)
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	r.NoError(err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	resp, err := client.Do(req)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	root := tracer.find("smokescreen.http")
+	r.NotNil(root)
+	a.Equal(1, root.ended)
+	a.Equal(true, root.attrs["smokescreen.allow"])
+	a.Equal(byte(0x4b), root.remote.TraceID[0])
+
+	for _, name := range []string{"smokescreen.resolve", "smokescreen.dial"} {
+		s := tracer.find(name)
+		r.NotNil(s, name)
+		a.Equal(1, s.ended, name)
+		a.Empty(s.errs, name)
+		a.Equal(root.remote, s.remote, name)
+	}
+}
@@ -0,0 +1,88 @@
+package smokescreen
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// UpstreamIdentity sets how the original client of traffic chained
+// through an upstream proxy is identified to it, so that deployments with
+// several tiers of proxies keep attribution end to end.
+type UpstreamIdentity int
+
+const (
+	UpstreamIdentityNone          UpstreamIdentity = iota // The upstream proxy only sees the connection from us
+	UpstreamIdentityForwarded                             // Requests to HTTP upstream proxies carry a Forwarded header with the client's address, and the role header
+	UpstreamIdentityProxyProtocol                         // Connections to upstream proxies start with a PROXY protocol v1 header with the client's address
+)
+
+var upstreamIdentities = map[string]UpstreamIdentity{
+	"none":           UpstreamIdentityNone,
+	"forwarded":      UpstreamIdentityForwarded,
+	"proxy-protocol": UpstreamIdentityProxyProtocol,
+}
+
+func (i UpstreamIdentity) String() string {
+	return [...]string{"none", "forwarded", "proxy-protocol"}[i]
+}
+
+// UpstreamIdentityFromString parses an upstream proxy identity mode. An
+// empty string is UpstreamIdentityNone.
+func UpstreamIdentityFromString(s string) (UpstreamIdentity, error) {
+	if s == "" {
+		return UpstreamIdentityNone, nil
+	}
+	if i, ok := upstreamIdentities[s]; ok {
+		return i, nil
+	}
+	return UpstreamIdentityNone, fmt.Errorf("unknown upstream proxy identity mode %v", s)
+}
+
+// addUpstreamIdentity adds the headers identifying the client and role of
+// decision to h, a request about to be sent to an HTTP upstream proxy. An
+// upstream Smokescreen can take the role from the header with a
+// HeaderRoleResolver; it strips the header before forwarding requests on.
+func addUpstreamIdentity(config *Config, h http.Header, decision *aclDecision) {
+	if config.UpstreamProxyIdentity != UpstreamIdentityForwarded {
+		return
+	}
+	if decision.clientAddr != "" {
+		h.Add("Forwarded", fmt.Sprintf("for=%q", decision.clientAddr))
+	}
+	if decision.role != "" {
+		h.Set(roleHeader, decision.role)
+	}
+}
+
+// writeProxyProtocolHeader starts conn, a connection to an upstream proxy,
+// with a PROXY protocol v1 header naming clientAddr as the source of the
+// traffic. The protocol has no room for the role.
+func writeProxyProtocolHeader(conn net.Conn, clientAddr string) error {
+	header := "PROXY UNKNOWN\r\n"
+	src, srcErr := net.ResolveTCPAddr("tcp", clientAddr)
+	dst, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if srcErr == nil && src.IP != nil && ok {
+		header = fmt.Sprintf("PROXY %s %d %d\r\n", proxyProtocolAddrs(src.IP, dst.IP), src.Port, dst.Port)
+	}
+	_, err := io.WriteString(conn, header)
+	return err
+}
+
+// proxyProtocolAddrs formats the protocol family and source and destination
+// addresses of a PROXY protocol header, which must all be of the same family.
+func proxyProtocolAddrs(src, dst net.IP) string {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		return fmt.Sprintf("TCP4 %s %s", src4, dst4)
+	}
+	return fmt.Sprintf("TCP6 %s %s", ipv6String(src), ipv6String(dst))
+}
+
+// ipv6String formats ip in IPv6 notation, even if it is an IPv4 address.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,277 @@
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy/transport"
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+	"golang.org/x/net/proxy"
+)
+
+// upstreamProxyKey is the request context key holding the upstream proxy the
+// ACL selected for a plain HTTP request.
+type upstreamProxyKey struct{}
+
+// withUpstreamProxy returns req annotated with the upstream proxy that should
+// carry it. The transport doesn't support proxy credentials for plain HTTP
+// requests, so they are added to the request here instead. SOCKS5 proxies are
+// tunneled through by dial, and their credentials never go in the request.
+func withUpstreamProxy(req *http.Request, upstream *url.URL) *http.Request {
+	if upstream.User != nil && !isSocksProxy(upstream) {
+		req.Header.Set("Proxy-Authorization", proxyAuthorization(upstream.User))
+		withoutUser := *upstream
+		withoutUser.User = nil
+		upstream = &withoutUser
+	}
+	return req.WithContext(context.WithValue(req.Context(), upstreamProxyKey{}, upstream))
+}
+
+func proxyAuthorization(u *url.Userinfo) string {
+	password, _ := u.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password))
+}
+
+// proxyForRequest is used as the transport's Proxy function. Requests for
+// roles with an upstream HTTP proxy go through it; all others use the proxy
+// from the environment, if any and unless IgnoreProxyEnvironment is set.
+// Requests for roles with an upstream SOCKS5 proxy are sent as if directly
+// to their destination, which dial reaches through the SOCKS5 proxy.
+func proxyForRequest(config *Config, req *http.Request) (*url.URL, error) {
+	if upstream, ok := req.Context().Value(upstreamProxyKey{}).(*url.URL); ok {
+		if isSocksProxy(upstream) {
+			return nil, nil
+		}
+		return upstream, nil
+	}
+	if config.IgnoreProxyEnvironment {
+		return nil, nil
+	}
+	return transport.ProxyFromEnvironment(req)
+}
+
+// SetupUpstreamProxyBypass sets the destinations that are connected to
+// directly even for roles with an upstream proxy. Like NO_PROXY, each entry is
+// a domain, which also covers its subdomains, or an IP address or CIDR range
+// the destination resolves to.
+func (config *Config) SetupUpstreamProxyBypass(entries []string) error {
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			_, ipnet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return fmt.Errorf("invalid upstream proxy bypass range %q: %v", entry, err)
+			}
+			config.UpstreamProxyBypassRanges = append(config.UpstreamProxyBypassRanges, RuleRange{Net: *ipnet})
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			config.UpstreamProxyBypassRanges = append(config.UpstreamProxyBypassRanges, RuleRange{Net: net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+			continue
+		}
+
+		domain := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(entry, "*"), "."), "."))
+		if domain == "" {
+			return fmt.Errorf("invalid upstream proxy bypass entry %q", entry)
+		}
+		config.UpstreamProxyBypassDomains = append(config.UpstreamProxyBypassDomains, domain)
+	}
+	return nil
+}
+
+// bypassesUpstreamProxy reports whether the destination outboundHost, which
+// resolved to ip, is to be connected to directly rather than through an
+// upstream proxy.
+func (config *Config) bypassesUpstreamProxy(outboundHost string, ip net.IP) bool {
+	host := hostport.Host(outboundHost)
+	for _, domain := range config.UpstreamProxyBypassDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	for _, r := range config.UpstreamProxyBypassRanges {
+		if r.Net.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSocksProxy(upstream *url.URL) bool {
+	return upstream.Scheme == "socks5"
+}
+
+// upstreamProxyAddr returns the host:port to dial to reach upstream.
+func upstreamProxyAddr(upstream *url.URL) string {
+	port := upstream.Port()
+	if port == "" {
+		port = "80"
+		if isSocksProxy(upstream) {
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(upstream.Hostname(), port)
+}
+
+// tunnelThroughProxy opens a tunnel to target through the upstream proxy at
+// the other end of conn, speaking whichever protocol it expects. HTTP proxies
+// are also sent header along with the CONNECT request.
+func tunnelThroughProxy(conn net.Conn, upstream *url.URL, target string, header http.Header, timeout time.Duration) (net.Conn, error) {
+	if isSocksProxy(upstream) {
+		return connectThroughSocks(conn, upstream, target, timeout)
+	}
+	return connectThroughProxy(conn, upstream, target, header, timeout)
+}
+
+// socksConnDialer is implemented by the SOCKS5 dialer of x/net/proxy, which
+// can open a tunnel over a connection to the SOCKS5 proxy we dialed
+// ourselves.
+type socksConnDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+}
+
+// connectThroughSocks asks the SOCKS5 proxy at the other end of conn to open
+// a tunnel to target. The target's name is sent as is, so the proxy resolves
+// it, like an HTTP proxy would for a CONNECT request.
+func connectThroughSocks(conn net.Conn, upstream *url.URL, target string, timeout time.Duration) (net.Conn, error) {
+	var auth *proxy.Auth
+	if upstream.User != nil {
+		password, _ := upstream.User.Password()
+		auth = &proxy.Auth{User: upstream.User.Username(), Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", upstream.Host, auth, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if _, err := d.(socksConnDialer).DialWithConn(ctx, conn, "tcp", target); err != nil {
+		return nil, fmt.Errorf("upstream SOCKS5 proxy %s refused to connect to %s: %v", upstream.Host, target, err)
+	}
+	return conn, nil
+}
+
+// connectThroughProxy asks the proxy at the other end of conn to open a
+// tunnel to target.
+func connectThroughProxy(conn net.Conn, upstream *url.URL, target string, header http.Header, timeout time.Duration) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: header,
+	}
+	if upstream.User != nil {
+		req.Header.Set("Proxy-Authorization", proxyAuthorization(upstream.User))
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading CONNECT response from upstream proxy %s: %v", upstream.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream proxy %s refused CONNECT to %s: %s", upstream.Host, target, resp.Status)
+	}
+
+	// The destination may already have sent data through the tunnel.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// localConnectConn is a direct connection to a CONNECT request's destination
+// that behaves like a tunnel through a proxy. goproxy always honors the
+// https_proxy environment variable for CONNECT requests, dialing the proxy and
+// sending it a CONNECT request of its own; when the environment is to be
+// ignored, the destination is dialed instead and this answers that request.
+type localConnectConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	request  []byte // The part of goproxy's CONNECT request seen so far
+	answered bool
+	response []byte // The part of our answer goproxy hasn't read yet
+}
+
+const localConnectResponse = "HTTP/1.1 200 Connection established\r\n\r\n"
+
+func (lc *localConnectConn) Write(b []byte) (int, error) {
+	lc.mu.Lock()
+	if lc.answered {
+		lc.mu.Unlock()
+		return lc.Conn.Write(b)
+	}
+
+	lc.request = append(lc.request, b...)
+	end := bytes.Index(lc.request, []byte("\r\n\r\n"))
+	if end < 0 {
+		lc.mu.Unlock()
+		return len(b), nil
+	}
+
+	// Anything following the request is meant for the destination.
+	rest := lc.request[end+4:]
+	lc.request = nil
+	lc.answered = true
+	lc.response = []byte(localConnectResponse)
+	lc.mu.Unlock()
+
+	if len(rest) > 0 {
+		if _, err := lc.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (lc *localConnectConn) Read(b []byte) (int, error) {
+	lc.mu.Lock()
+	if len(lc.response) > 0 {
+		n := copy(b, lc.response)
+		lc.response = lc.response[n:]
+		lc.mu.Unlock()
+		return n, nil
+	}
+	lc.mu.Unlock()
+	return lc.Conn.Read(b)
+}
@@ -0,0 +1,466 @@
+package smokescreen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	proxyproto "github.com/armon/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+// upstreamProxy is a minimal forward proxy that answers on behalf of the
+// destinations it is asked to reach.
+func upstreamProxy() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			fmt.Fprintf(conn, "tunnel to %s auth=%q\n", r.Host, r.Header.Get("Proxy-Authorization"))
+			return
+		}
+		fmt.Fprintf(w, "upstream fetched %s auth=%q", r.URL, r.Header.Get("Proxy-Authorization"))
+	}))
+}
+
+func TestUpstreamProxyPerRole(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	upstream := upstreamProxy()
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	r.NoError(err)
+	upstreamURL.User = url.UserPassword("user", "secret")
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("partner.test", "8.8.9.1")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.ConnectTimeout = 5 * time.Second
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"partner-client": {
+				Policy:        acl.Enforce,
+				DomainGlobs:   []string{"partner.test"},
+				UpstreamProxy: upstreamURL,
+			},
+		},
+	}
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+
+	t.Run("http", func(t *testing.T) {
+		client, err := proxyClient(proxy.URL)
+		r.NoError(err)
+		req, err := http.NewRequest("GET", "http://partner.test/status", nil)
+		r.NoError(err)
+		req.Header.Set("X-Smokescreen-Role", "partner-client")
+
+		resp, err := client.Do(req)
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		a.Equal(http.StatusOK, resp.StatusCode)
+		a.Equal("upstream fetched http://partner.test/status auth=\"Basic dXNlcjpzZWNyZXQ=\"", string(body))
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		r.NoError(err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "CONNECT partner.test:443 HTTP/1.1\r\nHost: partner.test:443\r\nX-Smokescreen-Role: partner-client\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		r.NoError(err)
+		a.Equal(http.StatusOK, resp.StatusCode)
+
+		line, err := br.ReadString('\n')
+		r.NoError(err)
+		a.Equal("tunnel to partner.test:443 auth=\"Basic dXNlcjpzZWNyZXQ=\"\n", line)
+	})
+}
+
+func TestIgnoreProxyEnvironment(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	envProxy := upstreamProxy()
+	defer envProxy.Close()
+	for _, k := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Unsetenv(k)
+	}
+	os.Setenv("http_proxy", envProxy.URL)
+	os.Setenv("https_proxy", envProxy.URL)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer echo.Close()
+	var echoed int32
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&echoed, 1)
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "echo %s", line)
+			conn.Close()
+		}
+	}()
+	_, echoPort, err := net.SplitHostPort(echo.Addr().String())
+	r.NoError(err)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("direct.test", "127.0.0.1")
+
+	conf := NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.Resolver = dns.Resolver()
+	conf.ConnectTimeout = 5 * time.Second
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+
+	proxyFor := func() string {
+		req, err := http.NewRequest("GET", "http://direct.test/", nil)
+		r.NoError(err)
+		u, err := proxyForRequest(conf, req)
+		r.NoError(err)
+		if u == nil {
+			return ""
+		}
+		return u.String()
+	}
+
+	connect := func() string {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		r.NoError(err)
+		defer conn.Close()
+
+		target := net.JoinHostPort("direct.test", echoPort)
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		fmt.Fprintf(conn, "hello\n")
+		line, _ := br.ReadString('\n')
+		return line
+	}
+
+	// goproxy drops whatever the environment's proxy sends along with its
+	// CONNECT response, so all we can tell is that it wasn't the destination.
+	a.Equal(envProxy.URL, proxyFor())
+	a.NotEqual("echo hello\n", connect())
+	a.Equal(int32(0), atomic.LoadInt32(&echoed))
+
+	conf.IgnoreProxyEnvironment = true
+	a.Equal("", proxyFor())
+	a.Equal("echo hello\n", connect())
+}
+
+// socksProxy is a minimal SOCKS5 proxy that answers on behalf of the
+// destinations it is asked to reach, requiring the given credentials if any.
+func socksProxy(t *testing.T, user, password string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks(conn, user, password)
+		}
+	}()
+	return ln
+}
+
+func serveSocks(conn net.Conn, user, password string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	greeting := read(2)
+	if greeting == nil || read(int(greeting[1])) == nil {
+		return
+	}
+	if user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		auth := read(2)
+		if auth == nil {
+			return
+		}
+		gotUser := string(read(int(auth[1])))
+		gotPassword := string(read(int(read(1)[0])))
+		if gotUser != user || gotPassword != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Only CONNECT requests with a domain name are expected.
+	req := read(4)
+	if req == nil || req[1] != 1 || req[3] != 3 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	host := string(read(int(read(1)[0])))
+	portBytes := read(2)
+	target := net.JoinHostPort(host, strconv.Itoa(int(portBytes[0])<<8|int(portBytes[1])))
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	if strings.HasSuffix(target, ":80") {
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		body := fmt.Sprintf("socks tunnel to %s fetched %s", target, r.URL.Path)
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+		return
+	}
+	fmt.Fprintf(conn, "socks tunnel to %s\n", target)
+}
+
+func TestUpstreamSocksProxy(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	socks := socksProxy(t, "user", "secret")
+	defer socks.Close()
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("bastioned.test", "8.8.9.1")
+	// goproxy's transport also resolves the destinations of plain HTTP
+	// requests with the system resolver, so they need a name it knows.
+	dns.Set("localhost", "8.8.9.1")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.ConnectTimeout = 5 * time.Second
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	r.NoError(conf.SetupUpstreamProxy("socks5://user:secret@" + socks.Addr().String()))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+
+	t.Run("http", func(t *testing.T) {
+		client, err := proxyClient(proxy.URL)
+		r.NoError(err)
+		resp, err := client.Get("http://localhost/status")
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		a.Equal(http.StatusOK, resp.StatusCode)
+		a.Equal("socks tunnel to localhost:80 fetched /status", string(body))
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		r.NoError(err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "CONNECT bastioned.test:443 HTTP/1.1\r\nHost: bastioned.test:443\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		r.NoError(err)
+		a.Equal(http.StatusOK, resp.StatusCode)
+
+		line, err := br.ReadString('\n')
+		r.NoError(err)
+		a.Equal("socks tunnel to bastioned.test:443\n", line)
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		r.NoError(conf.SetupUpstreamProxy("socks5://user:wrong@" + socks.Addr().String()))
+		client, err := proxyClient(proxy.URL)
+		r.NoError(err)
+		resp, err := client.Get("http://localhost/status")
+		r.NoError(err)
+		resp.Body.Close()
+		a.NotEqual(http.StatusOK, resp.StatusCode)
+	})
+
+	_, err := acl.ParseUpstreamProxy("ftp://bastion:21")
+	a.Error(err)
+}
+
+func TestUpstreamProxyBypass(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("partner.test", "8.8.9.1")
+	dns.Set("internal.corp.test", "8.8.10.1")
+	dns.Set("wiki.test", "8.8.11.7")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	r.NoError(conf.SetupUpstreamProxy("http://corp-gateway:3128"))
+	r.NoError(conf.SetupUpstreamProxyBypass([]string{".corp.test", "8.8.11.0/24", "2001:db8::1"}))
+
+	a.True(conf.bypassesUpstreamProxy("corp.test:443", nil))
+	a.True(conf.bypassesUpstreamProxy("Build.Corp.Test.:443", nil))
+	a.False(conf.bypassesUpstreamProxy("notcorp.test:443", nil))
+	a.True(conf.bypassesUpstreamProxy("[2001:db8::1]:443", net.ParseIP("2001:db8::1")))
+
+	for host, bypassed := range map[string]bool{
+		"partner.test:443":       false,
+		"internal.corp.test:443": true,
+		"wiki.test:80":           true,
+	} {
+		req := httptest.NewRequest("CONNECT", host, nil)
+		decision, err := checkIfRequestShouldBeProxied(conf, req, host)
+		r.NoError(err)
+		r.True(decision.allow, host)
+		a.Equal(bypassed, decision.upstreamProxy == nil, host)
+		a.Equal(bypassed, decision.upstreamProxyBypassed, host)
+	}
+
+	a.Error(conf.SetupUpstreamProxyBypass([]string{"10.0.0.0/33"}))
+	a.Error(conf.SetupUpstreamProxyBypass([]string{"*."}))
+}
+
+func TestUpstreamProxyIdentity(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	// The upstream proxy reports who it believes the client is.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity := fmt.Sprintf("remote=%s forwarded=%q role=%q", req.RemoteAddr, req.Header.Get("Forwarded"), req.Header.Get("X-Smokescreen-Role"))
+		if req.Method == http.MethodConnect {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n%s\n", identity)
+			return
+		}
+		fmt.Fprint(w, identity)
+	}))
+	upstream.Listener = &proxyproto.Listener{Listener: ln}
+	upstream.Start()
+	defer upstream.Close()
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("partner.test", "8.8.9.1")
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	conf.ConnectTimeout = 5 * time.Second
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowRanges([]string{"127.0.0.1/32"}))
+	r.NoError(conf.SetupUpstreamProxy(upstream.URL))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Smokescreen-Role"), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"partner-client": {Policy: acl.Open},
+		},
+	}
+
+	// Requests come from a client whose address the proxy sees, rather
+	// than through the loopback address we would share with it.
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	proxy := httptest.NewUnstartedServer(BuildProxy(conf))
+	proxy.Listener = &proxyproto.Listener{Listener: proxyLn}
+	proxy.Start()
+	defer proxy.Close()
+
+	connect := func() string {
+		conn, err := net.Dial("tcp", proxyLn.Addr().String())
+		r.NoError(err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "PROXY TCP4 192.0.2.10 192.0.2.1 41000 4750\r\n")
+		fmt.Fprintf(conn, "CONNECT partner.test:443 HTTP/1.1\r\nHost: partner.test:443\r\nX-Smokescreen-Role: partner-client\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		line, err := br.ReadString('\n')
+		r.NoError(err)
+		return strings.TrimSuffix(line, "\n")
+	}
+
+	identity := connect()
+	a.NotContains(identity, "192.0.2.10")
+	a.Contains(identity, `forwarded="" role=""`)
+
+	conf.UpstreamProxyIdentity = UpstreamIdentityForwarded
+	a.Contains(connect(), `forwarded="for=\"192.0.2.10:41000\"" role="partner-client"`)
+
+	conf.UpstreamProxyIdentity = UpstreamIdentityProxyProtocol
+	identity = connect()
+	a.True(strings.HasPrefix(identity, "remote=192.0.2.10:41000 "), identity)
+	a.Contains(identity, `forwarded="" role=""`)
+
+	mode, err := UpstreamIdentityFromString("")
+	a.NoError(err)
+	a.Equal(UpstreamIdentityNone, mode)
+	_, err = UpstreamIdentityFromString("x-forwarded-for")
+	a.Error(err)
+}
+
+func TestProxyProtocolAddrs(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("TCP4 192.0.2.10 10.0.0.1", proxyProtocolAddrs(net.ParseIP("192.0.2.10"), net.ParseIP("10.0.0.1")))
+	a.Equal("TCP6 2001:db8::1 ::ffff:10.0.0.1", proxyProtocolAddrs(net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")))
+}
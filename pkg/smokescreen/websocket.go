@@ -0,0 +1,148 @@
+package smokescreen
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/transport/details"
+)
+
+// isWebSocketUpgrade reports whether req, a plain HTTP proxy request, asks
+// to switch its connection to the WebSocket protocol.
+func isWebSocketUpgrade(req *http.Request) bool {
+	if req.ProtoMajor != 1 || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardWebSocketUpgrade sends req, an allowed WebSocket upgrade request,
+// to its destination itself: goproxy's transport drops the Connection header
+// and can't switch protocols. If the destination agrees to the upgrade, the
+// response's body is the connection to it, which goproxy copies to the
+// client once upgradeResponseWriter has taken over the client's connection.
+func forwardWebSocketUpgrade(config *Config, req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+	userData := ctx.UserData.(*ctxUserData)
+	uw, ok := req.Context().Value(responseWriterKey{}).(*upgradeResponseWriter)
+	if !ok {
+		ctx.Error = errors.New("client connection can't be upgraded")
+		return rejectResponse(req, config, ctx.Error)
+	}
+
+	conn, err := dial(config, "tcp", userData.decision.outboundHost, userData)
+	if err != nil {
+		ctx.Error = err
+		return rejectResponse(req, config, err)
+	}
+	if req.URL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: req.URL.Hostname()})
+	}
+	ctx.RoundTrip = &details.RoundTripDetails{Host: userData.decision.outboundHost, TCPAddr: userData.decision.resolvedAddr}
+
+	req.Header.Del("Proxy-Connection")
+	br := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	if err != nil {
+		conn.Close()
+		ctx.Error = err
+		return rejectResponse(req, config, err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &upgradeBody{Reader: resp.Body, conn: conn}
+		return resp
+	}
+	uw.upstream = conn
+	resp.Body = &upgradeBody{Reader: br, conn: conn}
+	return resp
+}
+
+// upgradeBody is the body of the response to an upgrade request, which
+// closes the connection to the destination once it is done with.
+type upgradeBody struct {
+	io.Reader
+	conn net.Conn
+}
+
+func (b *upgradeBody) Close() error {
+	return b.conn.Close()
+}
+
+// upgradeResponseWriter takes over the client's connection when goproxy
+// writes a 101 Switching Protocols response, writing the response's header
+// and body, the destination's side of the upgraded connection, to it
+// directly, and copying what the client sends to the destination.
+type upgradeResponseWriter struct {
+	http.ResponseWriter
+	upstream net.Conn // Set by forwardWebSocketUpgrade if the destination switched protocols
+	conn     net.Conn // The client's connection, once taken over
+}
+
+func (w *upgradeResponseWriter) WriteHeader(status int) {
+	if status != http.StatusSwitchingProtocols || w.upstream == nil || w.conn != nil {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		w.ResponseWriter.WriteHeader(http.StatusBadGateway)
+		w.upstream.Close()
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		w.upstream.Close()
+		return
+	}
+	w.conn = conn
+
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     w.Header(),
+	}
+	if err := resp.Write(buf); err != nil || buf.Flush() != nil {
+		w.upstream.Close()
+		return
+	}
+
+	// Like goproxy's tunnels, the connection ends once either side is done.
+	upstream := w.upstream
+	go func() {
+		io.Copy(upstream, buf.Reader)
+		upstream.Close()
+	}()
+}
+
+func (w *upgradeResponseWriter) Write(b []byte) (int, error) {
+	if w.conn != nil {
+		return w.conn.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish closes the client's connection once goproxy is done copying the
+// destination's side of an upgraded connection to it.
+func (w *upgradeResponseWriter) finish() {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
@@ -0,0 +1,92 @@
+package smokescreen
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestWebSocketUpgrade(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	// The destination switches protocols and echoes lines back, or refuses
+	// the upgrade.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/refuse" || !isWebSocketUpgrade(req) {
+			http.Error(w, "no upgrade", http.StatusForbidden)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(buf, "echo %s", line)
+			buf.Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	conf := NewConfig()
+	tracker := conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	conf.ConnTracker = tracker
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(conf.SetupResponseIdentity("smokescreen-1"))
+	proxy := httptest.NewServer(buildHandler(conf))
+	defer proxy.Close()
+
+	upgrade := func(path string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		r.NoError(err)
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprintf(conn, "GET %s%s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+			upstream.URL, path, strings.TrimPrefix(upstream.URL, "http://"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		r.NoError(err)
+		return conn, br, resp
+	}
+
+	conn, br, resp := upgrade("/")
+	defer conn.Close()
+	r.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	a.Equal("websocket", resp.Header.Get("Upgrade"))
+	a.Equal("smokescreen-1", resp.Header.Get(instanceHeader))
+
+	// Both directions are streamed, over a connection conntrack knows of.
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(conn, "hello %d\n", i)
+		line, err := br.ReadString('\n')
+		r.NoError(err)
+		a.Equal(fmt.Sprintf("echo hello %d\n", i), line)
+	}
+	active := 0
+	tracker.Range(func(k, v interface{}) bool {
+		active++
+		return true
+	})
+	a.Equal(1, active)
+
+	// Refused upgrades are answered like any other response.
+	refused, _, resp := upgrade("/refuse")
+	defer refused.Close()
+	a.Equal(http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,96 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/hostport"
+)
+
+// ZoneRoute labels the destinations in a zone, such as a region or a
+// partner's network, and says how connections to them leave the proxy, so
+// routing policy lives in the proxy's configuration rather than in wrapper
+// scripts setting proxy environment variables or source addresses.
+//
+// A destination is in the zone if its host is one of Domains or a subdomain
+// of one, or if it resolves to an address in one of Ranges. The first
+// matching route of Config.ZoneRoutes applies, for every role, in place of
+// the upstream proxy the role would otherwise use and of
+// UpstreamProxyBypassDomains and UpstreamProxyBypassRanges.
+type ZoneRoute struct {
+	Zone          string      // Names the zone in decision logs and metric tags
+	Domains       []string    // Lower case, without leading or trailing dots
+	Ranges        []RuleRange // Matched against the address the destination resolves to
+	Direct        bool        // Connect to destinations in the zone directly, without an upstream proxy
+	UpstreamProxy *url.URL    // If set, chain connections to destinations in the zone through this proxy
+	SourceIP      net.IP      // If set, make connections from this local address
+}
+
+// SetupZoneRoutes validates routes and routes destinations by them.
+func (config *Config) SetupZoneRoutes(routes []ZoneRoute) error {
+	for i := range routes {
+		r := &routes[i]
+		if r.Zone == "" {
+			return fmt.Errorf("zone route %d: zone must be set", i)
+		}
+		if len(r.Domains) == 0 && len(r.Ranges) == 0 {
+			return fmt.Errorf("zone %s: domains or ranges must be set", r.Zone)
+		}
+		if r.Direct && r.UpstreamProxy != nil {
+			return fmt.Errorf("zone %s: direct and upstream_proxy can't both be set", r.Zone)
+		}
+		for j, domain := range r.Domains {
+			domain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(domain, "*"), "."), "."))
+			if domain == "" {
+				return fmt.Errorf("zone %s: invalid domain %q", r.Zone, r.Domains[j])
+			}
+			r.Domains[j] = domain
+		}
+	}
+	config.ZoneRoutes = routes
+	return nil
+}
+
+// zoneRouteFor returns the route of the first zone the destination
+// outboundHost, which resolved to ip, is in, if any.
+func (config *Config) zoneRouteFor(outboundHost string, ip net.IP) *ZoneRoute {
+	host := strings.ToLower(hostport.Host(outboundHost))
+	for i := range config.ZoneRoutes {
+		r := &config.ZoneRoutes[i]
+		for _, domain := range r.Domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return r
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		for _, rr := range r.Ranges {
+			if rr.Net.Contains(ip) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// applyZoneRoute routes the connections of decision as route says.
+func applyZoneRoute(config *Config, decision *aclDecision, route *ZoneRoute) {
+	decision.zone = route.Zone
+	decision.sourceIP = route.SourceIP
+	path := "default"
+	switch {
+	case route.Direct:
+		decision.upstreamProxy = nil
+		path = "direct"
+	case route.UpstreamProxy != nil:
+		decision.upstreamProxy = route.UpstreamProxy
+		path = "upstream_proxy"
+	}
+	config.MetricsClient.Incr("zone_routes.routed", []string{
+		fmt.Sprintf("zone:%s", route.Zone),
+		fmt.Sprintf("path:%s", path),
+	}, 1)
+}
@@ -0,0 +1,150 @@
+package smokescreen
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"gopkg.in/yaml.v2"
+)
+
+func TestZoneRoutes(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	dns := newTestDNSServer(t)
+	defer dns.Close()
+	dns.Set("api.eu.partner.test", "8.8.9.1")
+	dns.Set("partner.test", "8.8.9.2")
+	dns.Set("internal.corp.test", "8.8.10.1")
+	dns.Set("wiki.corp.test", "8.8.11.7")
+
+	euGateway, err := url.Parse("http://eu-gateway:3128")
+	r.NoError(err)
+	corpRanges, err := parseRanges([]string{"8.8.10.0/24"})
+	r.NoError(err)
+
+	conf := NewConfig()
+	conf.Resolver = dns.Resolver()
+	r.NoError(conf.SetupUpstreamProxy("http://corp-gateway:3128"))
+	r.NoError(conf.SetupUpstreamProxyBypass([]string{"wiki.corp.test"}))
+	r.NoError(conf.SetupZoneRoutes([]ZoneRoute{
+		{Zone: "eu", Domains: []string{"*.EU.Partner.Test."}, UpstreamProxy: euGateway},
+		{Zone: "corp", Ranges: corpRanges, Direct: true, SourceIP: net.ParseIP("10.0.1.5")},
+		{Zone: "wiki", Domains: []string{"wiki.corp.test"}},
+	}))
+	a.Equal([]string{"eu.partner.test"}, conf.ZoneRoutes[0].Domains)
+
+	for host, want := range map[string]struct {
+		zone, proxy, sourceIP string
+	}{
+		"api.eu.partner.test:443": {zone: "eu", proxy: "eu-gateway:3128"},
+		"partner.test:443":        {proxy: "corp-gateway:3128"},
+		"internal.corp.test:443":  {zone: "corp", sourceIP: "10.0.1.5"},
+		// Zone routes take the place of the bypass list.
+		"wiki.corp.test:443": {zone: "wiki", proxy: "corp-gateway:3128"},
+	} {
+		req := httptest.NewRequest("CONNECT", host, nil)
+		decision, err := checkIfRequestShouldBeProxied(conf, req, host)
+		r.NoError(err)
+		r.True(decision.allow, host)
+		a.Equal(want.zone, decision.zone, host)
+		var proxy string
+		if decision.upstreamProxy != nil {
+			proxy = decision.upstreamProxy.Host
+		}
+		a.Equal(want.proxy, proxy, host)
+		var sourceIP string
+		if decision.sourceIP != nil {
+			sourceIP = decision.sourceIP.String()
+		}
+		a.Equal(want.sourceIP, sourceIP, host)
+		a.False(decision.upstreamProxyBypassed, host)
+	}
+
+	for _, bad := range []ZoneRoute{
+		{Domains: []string{"example.com"}},
+		{Zone: "empty"},
+		{Zone: "both", Domains: []string{"example.com"}, Direct: true, UpstreamProxy: euGateway},
+		{Zone: "dot", Domains: []string{"*."}},
+	} {
+		a.Error(conf.SetupZoneRoutes([]ZoneRoute{bad}), bad.Zone)
+	}
+}
+
+func TestZoneRouteSourceIP(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes all of 127.0.0.0/8 to loopback")
+	}
+	a := assert.New(t)
+	r := require.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		w.Write([]byte(host))
+	}))
+	defer upstream.Close()
+
+	conf := NewConfig()
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{"127.0.0.1"}))
+	loopback, err := parseRanges([]string{"127.0.0.0/8"})
+	r.NoError(err)
+	r.NoError(conf.SetupZoneRoutes([]ZoneRoute{
+		{Zone: "local", Ranges: loopback, SourceIP: net.ParseIP("127.0.0.2")},
+	}))
+
+	proxy := httptest.NewServer(BuildProxy(conf))
+	defer proxy.Close()
+	client, err := proxyClient(proxy.URL)
+	r.NoError(err)
+
+	resp, err := client.Get(upstream.URL)
+	r.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal("127.0.0.2", string(body))
+}
+
+func TestYAMLLoaderZoneRoutes(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	var c Config
+	r.NoError(yaml.Unmarshal([]byte(`
+zone_routes:
+  - zone: eu
+    domains: [eu.partner.test]
+    ranges: [10.20.0.0/16]
+    upstream_proxy: http://eu-gateway:3128
+  - zone: corp
+    ranges: [10.0.0.0/8]
+    direct: true
+    source_ip: 10.0.1.5
+`), &c))
+	if a.Len(c.ZoneRoutes, 2) {
+		a.Equal("eu-gateway:3128", c.ZoneRoutes[0].UpstreamProxy.Host)
+		a.Equal("10.20.0.0/16", c.ZoneRoutes[0].Ranges[0].Net.String())
+		a.True(c.ZoneRoutes[1].Direct)
+		a.Equal("10.0.1.5", c.ZoneRoutes[1].SourceIP.String())
+	}
+
+	for _, bad := range []string{
+		"zone_routes: [{zone: eu, ranges: [10.0.0.0/33]}]",
+		"zone_routes: [{zone: eu, domains: [eu.test], source_ip: nowhere}]",
+		"zone_routes: [{zone: eu, domains: [eu.test], upstream_proxy: 'ftp://eu-gateway'}]",
+		"zone_routes: [{domains: [eu.test]}]",
+	} {
+		a.Error(yaml.Unmarshal([]byte(bad), &c), bad)
+	}
+}
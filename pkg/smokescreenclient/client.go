@@ -0,0 +1,231 @@
+// Package smokescreenclient connects to destinations through a smokescreen
+// proxy.
+//
+// Every connection is tunneled with a CONNECT request, which smokescreen
+// accepts for any destination port, so the same Dialer serves both plain
+// HTTP and HTTPS destinations. A denied CONNECT request is returned as an
+// *Error describing smokescreen's decision.
+package smokescreenclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RoleHeader      = "X-Smokescreen-Role"
+	TraceHeader     = "X-Smokescreen-Trace-ID"
+	ErrorHeader     = "X-Smokescreen-Error"
+	RuleHeader      = "X-Smokescreen-Rule"
+	RetryableHeader = "X-Smokescreen-Retryable"
+)
+
+// Dialer opens connections through a smokescreen proxy.
+type Dialer struct {
+	// ProxyURL is the address of the proxy. With an https:// URL, the
+	// connection to the proxy is made over TLS using TLSConfig, which should
+	// carry the client certificate smokescreen derives the role from.
+	ProxyURL  *url.URL
+	TLSConfig *tls.Config
+
+	// Role is sent in the X-Smokescreen-Role header, for proxies that take
+	// the role from a header rather than a client certificate.
+	Role string
+
+	// Header is sent with every CONNECT request.
+	Header http.Header
+
+	// ContextHeader, if set, returns headers to send with the CONNECT request
+	// made on behalf of ctx, such as the traceparent or X-Smokescreen-Trace-ID
+	// of the request being made. http.Transport dials with the request's
+	// context.
+	ContextHeader func(ctx context.Context) http.Header
+
+	// Dialer connects to the proxy. The zero value is used if nil.
+	Dialer *net.Dialer
+}
+
+// DialContext connects to addr through the proxy.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("smokescreenclient: unsupported network %q", network)
+	}
+	if d.ProxyURL == nil {
+		return nil, errors.New("smokescreenclient: no proxy URL")
+	}
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	tunnel, err := d.connect(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// Transport returns an http.Transport that makes every request through the
+// proxy.
+func (d *Dialer) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:         d.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	host := d.ProxyURL.Host
+	if d.ProxyURL.Port() == "" {
+		port := "80"
+		if d.ProxyURL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(d.ProxyURL.Hostname(), port)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if d.ProxyURL.Scheme != "https" {
+		return conn, nil
+	}
+
+	config := d.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = d.ProxyURL.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (d *Dialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+	if d.ContextHeader != nil {
+		for k, v := range d.ContextHeader(ctx) {
+			req.Header[k] = v
+		}
+	}
+	if d.Role != "" {
+		req.Header.Set(RoleHeader, d.Role)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(addr, resp)
+	}
+
+	if br.Buffered() > 0 {
+		// The destination spoke first; don't lose what it sent.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// Error is smokescreen's refusal to connect to a destination.
+type Error struct {
+	Addr       string
+	StatusCode int
+	Message    string        // Why the connection was refused
+	Rule       string        // The ACL rule that denied the connection, if any
+	Retryable  bool          // Whether trying again may succeed, e.g. after being rate limited
+	RetryAfter time.Duration // How long to wait before trying again, if known
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("smokescreen refused to connect to %s: %d %s", e.Addr, e.StatusCode, e.Message)
+}
+
+// Denied reports whether the connection was refused by policy, as opposed
+// to failing.
+func (e *Error) Denied() bool {
+	return e.Rule != "" || e.StatusCode == http.StatusProxyAuthRequired
+}
+
+// decodeError leaves the body unclosed, as closing it would wait for the
+// end of a body without a length; the connection is closed instead.
+func decodeError(addr string, resp *http.Response) *Error {
+	e := &Error{
+		Addr:       addr,
+		StatusCode: resp.StatusCode,
+		Message:    resp.Header.Get(ErrorHeader),
+		Rule:       resp.Header.Get(RuleHeader),
+	}
+	if e.Message == "" {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+
+	e.Retryable, _ = strconv.ParseBool(resp.Header.Get(RetryableHeader))
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
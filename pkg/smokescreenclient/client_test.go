@@ -0,0 +1,125 @@
+package smokescreenclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+func TestDialerThroughSmokescreen(t *testing.T) {
+	r := require.New(t)
+
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer dest.Close()
+	destURL, err := url.Parse(dest.URL)
+	r.NoError(err)
+
+	conf := smokescreen.NewConfig()
+	conf.AllowedConnectPorts = nil // Test servers listen on arbitrary ports
+	conf.ConnectTimeout = 10 * time.Second
+	conf.ConnTracker = conntrack.NewTracker(conf.IdleThreshold, nil, conf.Log, atomic.Value{})
+	r.NoError(conf.SetAllowAddresses([]string{destURL.Host}))
+	conf.RoleFromRequest = func(req *http.Request) (string, error) {
+		return req.Header.Get(RoleHeader), nil
+	}
+	conf.EgressACL = &acl.ACL{
+		Rules: map[string]acl.Rule{
+			"allowed": {
+				Policy:      acl.Enforce,
+				DomainGlobs: []string{destURL.Hostname()},
+			},
+			"denied": {
+				Policy: acl.Enforce,
+				ID:     "denied-rule",
+			},
+		},
+	}
+
+	proxy := httptest.NewServer(smokescreen.BuildProxy(conf))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+
+	t.Run("allowed", func(t *testing.T) {
+		r := require.New(t)
+		d := &Dialer{ProxyURL: proxyURL, Role: "allowed"}
+		client := &http.Client{Transport: d.Transport()}
+
+		resp, err := client.Get(dest.URL)
+		r.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		r.Equal("hello", string(body))
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		a := assert.New(t)
+		d := &Dialer{ProxyURL: proxyURL, Role: "denied"}
+
+		_, err := d.DialContext(context.Background(), "tcp", destURL.Host)
+		e, ok := err.(*Error)
+		require.True(t, ok, "expected *Error, got %#v", err)
+		a.True(e.Denied())
+		a.Equal(http.StatusProxyAuthRequired, e.StatusCode)
+		a.Equal("denied-rule", e.Rule)
+		a.Contains(e.Message, "Egress proxying is denied")
+		a.False(e.Retryable)
+	})
+}
+
+func TestDialerDecodesErrors(t *testing.T) {
+	r := require.New(t)
+
+	var got http.Header
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+		w.Header().Set(RetryableHeader, "true")
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("rate limited\n"))
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	r.NoError(err)
+
+	type traceKey struct{}
+	d := &Dialer{
+		ProxyURL: proxyURL,
+		Header:   http.Header{"X-Custom": {"yes"}},
+		ContextHeader: func(ctx context.Context) http.Header {
+			id, _ := ctx.Value(traceKey{}).(string)
+			return http.Header{TraceHeader: {id}}
+		},
+	}
+
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-1")
+	_, err = d.DialContext(ctx, "tcp", "example.com:443")
+	e, ok := err.(*Error)
+	r.True(ok, "expected *Error, got %#v", err)
+
+	a := assert.New(t)
+	a.Equal("trace-1", got.Get(TraceHeader))
+	a.Equal("yes", got.Get("X-Custom"))
+	a.Empty(got.Get(RoleHeader))
+
+	a.False(e.Denied())
+	a.True(e.Retryable)
+	a.Equal(3*time.Second, e.RetryAfter)
+	a.Equal("rate limited", e.Message)
+	a.Equal("example.com:443", e.Addr)
+}